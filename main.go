@@ -1,105 +1,313 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
 	"matrix-image-manipulation/manipulations"
 	"matrix-image-manipulation/utils"
+	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
+// labels holds the menu entry of each operation provided by the manipulations package, other registered operations
+// are listed with their own description
+var labels = map[string]string{
+	"blur":       "Filtro Gaussiano",
+	"grey":       "Converter para Grayscale",
+	"contrast":   "Alterar Contraste",
+	"luminosity": "Alterar Luminosidade",
+}
+
+// stdio is the path that stands for the standard input or output
+const stdio = "-"
+
+// defaultOutput is the template of the path the interactive mode writes to, next to the input
+const defaultOutput = "{dir}/{name}_new.{ext}"
+
+// placeholder matches the placeholders of an output path template
+var placeholder = regexp.MustCompile(`\{[^{}]*\}`)
+
 func main() {
-	var path, choice string
+	format := flag.String("format", "", "formato do ficheiro de saída (png, jpeg, gif, bmp, tiff, qoi, farbfeld, pbm, pgm, ppm, pnm, pam, ou a matriz em npy, csv ou json), por omissão o do ficheiro de entrada")
+	quality := flag.Int("quality", 0, "qualidade JPEG de 1 a 100")
+	compression := flag.String("compression", "", "compressão TIFF (none, lzw ou deflate), por omissão nenhuma")
+	level := flag.Int("level", 0, "nível de compressão PNG de 1 (mais rápido) a 9 (mais pequeno), por omissão 6")
+	depth := flag.Int("depth", 0, "bits por canal do PNG de saída, 8 ou 16, por omissão os da imagem")
+	interlace := flag.Bool("interlace", false, "escreve PNG entrelaçados (Adam7)")
+	plain := flag.Bool("plain", false, "escreve PBM, PGM e PPM em texto (P1 a P3) em vez de binário")
+	var strip utils.Strip
+	flag.Func("strip", "metadados a remover da saída, separados por vírgulas: text, exif, colour, resolution ou all", func(value string) (err error) {
+		strip, err = utils.ParseStrip(value)
+		return err
+	})
+	in := flag.String("in", stdio, "ficheiro de entrada quando a operação é dada como argumento, - para o stdin")
+	out := flag.String("out", "", "ficheiro de saída, - para o stdout, que pode conter {dir}, {name}, {op} e {ext}, por omissão o stdout quando a operação é dada como argumento e "+defaultOutput+" no modo interativo")
+	force := flag.Bool("force", false, "substitui o ficheiro de saída se já existir")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Uso: %s [opções] [operação [parâmetro=valor ...]]\n", filepath.Base(os.Args[0]))
+		fmt.Fprintln(flag.CommandLine.Output(), "Sem operação o programa pergunta o ficheiro, a operação e os parâmetros. Opções:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	options := utils.WriteOptions{
+		Format:           *format,
+		Quality:          *quality,
+		Compression:      *compression,
+		CompressionLevel: *level,
+		Depth:            *depth,
+		Interlace:        *interlace,
+		Plain:            *plain,
+		Strip:            strip,
+		NoOverwrite:      !*force,
+	}
+
+	// With an operation on the command line the image is processed without questions, so the program can be piped
+	if flag.NArg() > 0 {
+		if *out == "" {
+			*out = stdio
+		}
+		if err := runCommand(flag.Args(), *in, *out, options); err != nil {
+			fmt.Fprintln(os.Stderr, "Erro:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *out == "" {
+		*out = defaultOutput
+	}
+	runInteractive(*out, options)
+}
+
+// runCommand applies the operation named by args[0], with the parameters given as name=value in the rest of args, to
+// the image at in and writes the result to the path the template out expands to, see outputPath. Either may be - for
+// the standard input or output, and images keep the format of the input unless options or the extension of the output
+// name another one.
+func runCommand(args []string, in, out string, options utils.WriteOptions) error {
+	op, ok := manipulations.Lookup(args[0])
+	if !ok {
+		names := make([]string, 0, len(manipulations.Operations()))
+		for _, op := range manipulations.Operations() {
+			names = append(names, op.Name())
+		}
+		return fmt.Errorf("operação desconhecida %q, esperada uma de %s", args[0], strings.Join(names, ", "))
+	}
+	params := manipulations.Params{}
+	for _, arg := range args[1:] {
+		name, value, found := strings.Cut(arg, "=")
+		if !found {
+			return fmt.Errorf("parâmetro %q inválido, esperado nome=valor", arg)
+		}
+		var err error
+		if params[name], err = parseParam(op, name, value); err != nil {
+			return err
+		}
+	}
+	adjustParams(op, params)
+
+	// Read the image, every frame of it
+	input := os.Stdin
+	if in != stdio {
+		file, err := os.Open(in)
+		if err != nil {
+			return err
+		}
+		defer func(file *os.File) {
+			_ = file.Close() // Ignore any errors resulting from closure
+		}(file)
+		input = file
+	}
+	sequence, inputFormat, err := utils.DecodeSequence(input, utils.ReadOptions{})
+	if err != nil {
+		return fmt.Errorf("a ler a imagem: %w", err)
+	}
+
+	sequence, err = new(manipulations.Pipeline).Then(op, params).ApplySequence(context.Background(), sequence)
+	if err != nil {
+		return fmt.Errorf("a aplicar a operação: %w", err)
+	}
+
+	extension, err := utils.Extension(inputFormat)
+	if options.Format != "" {
+		extension, err = utils.Extension(options.Format)
+	}
+	if err != nil {
+		return err
+	}
+	if out != stdio {
+		if out, err = outputPath(out, in, op.Name(), extension); err != nil {
+			return err
+		}
+		if err := utils.WriteSequence(sequence, out, options); errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("o ficheiro %s já existe, use -force para o substituir", out)
+		} else if err != nil {
+			return fmt.Errorf("a escrever a imagem: %w", err)
+		}
+		return nil
+	}
+	if options.Format == "" {
+		options.Format = inputFormat
+	}
+	stdout := bufio.NewWriter(os.Stdout)
+	if err := utils.EncodeSequence(stdout, sequence, options); err != nil {
+		return fmt.Errorf("a escrever a imagem: %w", err)
+	}
+	return stdout.Flush()
+}
+
+// parseParam parses the value of the parameter of op with the given name
+func parseParam(op manipulations.Operation, name, value string) (float64, error) {
+	for _, param := range op.Params() {
+		if param.Name == name {
+			return param.Parse(value)
+		}
+	}
+	return 0, fmt.Errorf("a operação %s não tem o parâmetro %s", op.Name(), name)
+}
+
+// adjustParams applies the conventions of the CLI to the parameters given by the user
+func adjustParams(op manipulations.Operation, params manipulations.Params) {
+	if op.Name() == "contrast" && params["b"] == 1 {
+		params["b"] = 255 // b = 1 stands for the full range, so m = -1 and b = 1 inverts the image
+	}
+}
+
+// outputPath expands the placeholders of an output path template for the given input: {dir} and {name} are the
+// directory and the name of the input without its extension, "stdin" for the standard input, {op} is the name of the
+// operation and {ext} the extension of the output, without the dot
+func outputPath(template, in, op, extension string) (string, error) {
+	dir, name := filepath.Dir(in), strings.TrimSuffix(filepath.Base(in), filepath.Ext(in))
+	if in == stdio {
+		dir, name = ".", "stdin"
+	}
+	values := map[string]string{"{dir}": dir, "{name}": name, "{op}": op, "{ext}": strings.TrimPrefix(extension, ".")}
+	var unknown []string
+	path := placeholder.ReplaceAllStringFunc(template, func(p string) string {
+		value, ok := values[p]
+		if !ok {
+			unknown = append(unknown, p)
+		}
+		return value
+	})
+	if unknown != nil {
+		return "", fmt.Errorf("marcador %s desconhecido no caminho de saída, esperado {dir}, {name}, {op} ou {ext}", unknown[0])
+	}
+	if path == "" {
+		return "", errors.New("o caminho de saída está vazio")
+	}
+	return filepath.Clean(path), nil
+}
+
+// runInteractive asks the user for the file, the operation and its parameters, and writes the result to the path the
+// template out expands to, next to the file unless it says otherwise
+func runInteractive(out string, options utils.WriteOptions) {
+	input := bufio.NewReader(os.Stdin)
 
 	// Request the file path from the user
 	fmt.Print("Qual o path do ficheiro: ")
-	_, err := fmt.Scanln(&path)
+	path, err := readLine(input)
 	if err != nil {
 		fmt.Println("Error requesting input from user:", err)
 		return
 	}
 
-	// Read the image into a matrix
-	matrix, err := utils.ReadImageToMatrix(path)
+	// Read every frame of the image, keeping 16 bits per channel if the file has them. Still images have a single frame.
+	sequence, err := utils.ReadSequence(path, utils.ReadOptions{})
 	if err != nil {
 		fmt.Println("Error reading image:", err)
 		return
 	}
 
-	// Ask the user for the operation to perform
+	// Ask the user for the operation to perform, listing every registered operation
+	operations := manipulations.Operations()
+	choices := make([]string, len(operations))
 	fmt.Println("Escolha uma operação:")
-	fmt.Println("1: Filtro Gaussiano")
-	fmt.Println("2: Converter para Grayscale")
-	fmt.Println("3: Alterar Contraste")
-	fmt.Println("4: Alterar Luminosidade")
-	fmt.Print("Escolha (1, 2, 3 ou 4): ")
-	_, err = fmt.Scanln(&choice)
+	for i, op := range operations {
+		label, ok := labels[op.Name()]
+		if !ok {
+			label = op.Description()
+		}
+		choices[i] = strconv.Itoa(i + 1)
+		fmt.Printf("%d: %s\n", i+1, label)
+	}
+	fmt.Printf("Escolha (%s ou %s): ", strings.Join(choices[:len(choices)-1], ", "), choices[len(choices)-1])
+	choice, err := readLine(input)
 	if err != nil {
 		fmt.Println("Erro a ler a escolha:", err)
 		return
 	}
+	index, err := strconv.Atoi(choice)
+	if err != nil || index < 1 || index > len(operations) {
+		fmt.Println("Escolha inválida.")
+		return
+	}
+	op := operations[index-1]
 
-	switch choice {
-	case "1":
-		matrix, err = manipulations.GaussianFilter(matrix, 7, 10.5)
-		if err != nil {
-			fmt.Println("Erro a aplicar filtro Gaussiano:", err)
-			return
-		}
-	case "2":
-		matrix, err = manipulations.ConvertToGreyScale(matrix)
-		if err != nil {
-			fmt.Println("Erro a converter para grayscale:", err)
-			return
-		}
-	case "3":
-		var m, b float64
-		fmt.Print("3.1: Insira o valor de m: ")
-		_, err = fmt.Scanln(&m)
-		if err != nil {
-			fmt.Println("Erro a ler o valor de m:", err)
-			return
-		}
-		fmt.Print("3.2: Insira o valor de b: ")
-		_, err = fmt.Scanln(&b)
+	// Ask for each parameter, an empty answer keeps the default
+	params := manipulations.Params{}
+	for i, param := range op.Params() {
+		fmt.Printf("%d.%d: Insira o valor de %s (%v): ", index, i+1, param.Name, param.Default)
+		answer, err := readLine(input)
 		if err != nil {
-			fmt.Println("Erro a ler o valor de b:", err)
+			fmt.Printf("Erro a ler o valor de %s: %v\n", param.Name, err)
 			return
 		}
-		if b == 1 {
-			b = 255
-		}
-		matrix, err = manipulations.AdjustContrast(matrix, m, b)
-		if err != nil {
-			fmt.Println("Erro a alterar o contraste:", err)
-			return
+		if answer == "" {
+			continue
 		}
-	case "4":
-		var b float64
-		fmt.Print("4.1: Insira o valor de b: ")
-		_, err = fmt.Scanln(&b)
-		if err != nil {
-			fmt.Println("Erro a ler o valor de b:", err)
-			return
-		}
-		matrix, err = manipulations.AdjustLuminosity(matrix, b)
-		if err != nil {
-			fmt.Println("Erro a alterar a luminosidade:", err)
+		if params[param.Name], err = param.Parse(answer); err != nil {
+			fmt.Printf("Erro a ler o valor de %s: %v\n", param.Name, err)
 			return
 		}
+	}
+	adjustParams(op, params)
 
-	default:
-		fmt.Println("Escolha inválida.")
+	pipeline := new(manipulations.Pipeline).Then(op, params)
+	sequence, err = pipeline.ApplySequence(context.Background(), sequence)
+	if err != nil {
+		fmt.Println("Erro a aplicar a operação:", err)
 		return
 	}
 
-	// Write the modified image back to a file
-	outputPath := strings.TrimSuffix(path, filepath.Ext(path)) + "_new.png"
-	err = utils.WriteImageFromMatrix(matrix, outputPath)
+	// Write the modified image back to a file, in the same format as the input unless another one was requested
+	extension := filepath.Ext(path)
+	if options.Format != "" {
+		extension, err = utils.Extension(options.Format)
+		if err != nil {
+			fmt.Println("Error writing image:", err)
+			return
+		}
+	} else if _, err := utils.Extension(extension); err != nil {
+		extension = ".png"
+	}
+	out, err = outputPath(out, path, op.Name(), extension)
 	if err != nil {
 		fmt.Println("Error writing image:", err)
 		return
 	}
+	err = utils.WriteSequence(sequence, out, options)
+	if errors.Is(err, fs.ErrExist) {
+		fmt.Printf("O ficheiro %s já existe, use -force para o substituir.\n", out)
+		return
+	} else if err != nil {
+		fmt.Println("Error writing image:", err)
+		return
+	}
 
-	fmt.Println("Operação completada. Output guardado em:", outputPath)
+	fmt.Println("Operação completada. Output guardado em:", out)
+}
+
+// readLine reads a single line of user input without the line ending
+func readLine(input *bufio.Reader) (string, error) {
+	line, err := input.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
 }
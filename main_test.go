@@ -1,17 +1,36 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"image"
 	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"math"
 	"math/rand"
 	"matrix-image-manipulation/manipulations"
+	"matrix-image-manipulation/matrix"
+	"matrix-image-manipulation/raster"
+	"matrix-image-manipulation/tiles"
 	"matrix-image-manipulation/utils"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 // loadImage handles loading an image from a given filePath.
@@ -37,29 +56,22 @@ func assertColourEquality(colour1 color.Color, colour2 color.Color) bool {
 }
 
 // generateRandomImage generates a random valid image of a given width and height.
-func generateRandomImage(width int, height int) [][][4]uint32 {
-	img := utils.Make2D[[4]uint32](height, width)
+func generateRandomImage(width int, height int) *raster.Image {
+	img, _ := raster.NewRGBA(width, height)
 
-	// Iterate through all elements of the list and assign it to a random array with 4 random values between 0-255
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			img[y][x] = [4]uint32{
-				uint32(rand.Intn(256)), // Red
-				uint32(rand.Intn(256)), // Green
-				uint32(rand.Intn(256)), // Blue
-				uint32(rand.Intn(256)), // Alpha
-			}
-		}
+	// Iterate through all the samples of the image and assign each a random value between 0-255
+	for i := range img.Pix {
+		img.Pix[i] = uint32(rand.Intn(256))
 	}
 	return img
 }
 
-// assertValidMatrix asserts that a given "matrix" is valid, based only on the RGBA values being within the valid interval
-func assertValidMatrix(matrix [][][4]uint32) error {
-	// Iterate through all the elements of the matrix
-	for y := range matrix {
-		for x := range matrix[y] {
-			pixel := matrix[y][x]
+// assertValidMatrix asserts that a given image is valid, based only on the RGBA values being within the valid interval
+func assertValidMatrix(img *raster.Image) error {
+	// Iterate through all the pixels of the image
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			pixel := img.Pix[img.PixOffset(x, y):]
 			if pixel[0] > 255 || pixel[1] > 255 || pixel[2] > 255 || pixel[3] > 255 { // If any of the values are over 255, raise an error
 				return errors.New("invalid matrix: values exceed 255")
 			}
@@ -73,7 +85,7 @@ func TestMatrixContinuity(t *testing.T) {
 
 	var testImagePath = ".github/test_images/gnome.png"
 
-	matrix, err := utils.ReadImageToMatrix(testImagePath)
+	img, err := utils.ReadImage(testImagePath)
 	if err != nil {
 		t.Fatalf("Failed to load the test image: %s", err)
 		return
@@ -81,7 +93,7 @@ func TestMatrixContinuity(t *testing.T) {
 
 	temporaryPath := t.TempDir() + "gnome.png" // create a temporary path for the output image
 
-	_ = utils.WriteImageFromMatrix(matrix, temporaryPath)
+	_ = utils.WriteImage(img, temporaryPath)
 
 	generatedImage, err := loadImage(temporaryPath)
 	if err != nil {
@@ -146,25 +158,40 @@ func TestMake2D(t *testing.T) {
 // TestConvertToGreyScaleWithRandomInput tests convertToGreyScale function with a randomly generated input.
 func TestConvertToGreyScaleWithRandomInput(t *testing.T) {
 
-	width, height := rand.Intn(3841), rand.Intn(2161) // Random dimensions up to 4k
+	width, height := rand.Intn(3840)+1, rand.Intn(2160)+1 // Random dimensions up to 4k, never empty
 	randomImage := generateRandomImage(width, height)
 
-	expected := make([][][4]uint32, height)
+	expected, _ := raster.New(width, height, raster.GreyAlpha, 8)
+	exact, _ := raster.NewFloat(width, height, 1) // Holds the unrounded luminance of every pixel
 	for y := 0; y < height; y++ {
-		expected[y] = make([][4]uint32, width)
 		for x := 0; x < width; x++ {
-			r, g, b, a := randomImage[y][x][0], randomImage[y][x][1], randomImage[y][x][2], randomImage[y][x][3]
-			luminance := uint32(float64(r)*0.299 + float64(g)*0.587 + float64(b)*0.114)
-			expected[y][x] = [4]uint32{luminance, luminance, luminance, a}
+			pixel, _ := randomImage.Pixel(x, y)
+			r, g, b, a := pixel[0], pixel[1], pixel[2], pixel[3]
+			luminance := float64(r)*0.299 + float64(g)*0.587 + float64(b)*0.114
+			rounded := uint32(math.Round(luminance))
+			_ = expected.SetPixel(x, y, []uint32{rounded, a})
+			exact.Pix[exact.PixOffset(x, y)] = float32(luminance)
 		}
 	}
 
 	result, err := manipulations.ConvertToGreyScale(randomImage)
 	if err != nil {
-		t.Errorf("convertToGreyScale() returned an unexpected error: %v", err)
+		t.Fatalf("convertToGreyScale() returned an unexpected error: %v", err)
 	}
-	if !reflect.DeepEqual(result, expected) {
-		t.Errorf("convertToGreyScale() result does not match expected output")
+	if result.Channels != raster.GreyAlpha {
+		t.Fatalf("convertToGreyScale() returned %d channels, expected luminance and alpha only", result.Channels)
+	}
+
+	// The luminance is computed in floating point and rounded once, so it must be the nearest integer to the exact value
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			got, _ := result.Pixel(x, y)
+			want, _ := expected.Pixel(x, y)
+			luminance := float64(exact.Pix[exact.PixOffset(x, y)])
+			if got[1] != want[1] || math.Abs(float64(got[0])-luminance) > 0.5+1e-3 {
+				t.Fatalf("convertToGreyScale() result does not match expected output at (%d, %d): %v, expected %v", x, y, got, want)
+			}
+		}
 	}
 }
 
@@ -195,19 +222,23 @@ func TestAssertValidMatrix(t *testing.T) {
 		} // @NOTE(Mauro): I miss list comprehensions
 	}
 
-	// Function to generate a random matrix using Make2D
-	generateRandomMatrix := func(width int, height int, valid bool) [][][4]uint32 {
-		matrix := utils.Make2D[[4]uint32](height, width)
+	// Function to generate a random image, writing Pix directly so invalid samples aren't rejected
+	generateRandomMatrix := func(width int, height int, valid bool) *raster.Image {
+		img, _ := raster.NewRGBA(width, height)
 		maxVal := uint32(255)
 		if !valid {
 			maxVal = 300 // Ensure an invalid matrix
 		}
-		for i := range matrix {
-			for j := range matrix[i] {
-				matrix[i][j] = generateRandomPixel(maxVal)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				pixel := generateRandomPixel(maxVal)
+				copy(img.Pix[img.PixOffset(x, y):], pixel[:])
 			}
 		}
-		return matrix
+		if !valid && width > 0 && height > 0 {
+			img.Pix[rand.Intn(len(img.Pix))] = maxVal // Guarantee at least one sample is out of range
+		}
+		return img
 	}
 
 	// Generate a random number of test cases
@@ -215,8 +246,8 @@ func TestAssertValidMatrix(t *testing.T) {
 
 	for i := 0; i < numTests; i++ {
 
-		valid := rand.Intn(2) == 0                        // Randomly decide if this matrix should be valid or not
-		width, height := rand.Intn(3841), rand.Intn(2161) // Random dimensions up to 4k
+		valid := rand.Intn(2) == 0                            // Randomly decide if this matrix should be valid or not
+		width, height := rand.Intn(3840)+1, rand.Intn(2160)+1 // Random dimensions up to 4k, never empty
 		matrix := generateRandomMatrix(width, height, valid)
 
 		err := assertValidMatrix(matrix)
@@ -232,7 +263,7 @@ func TestAssertValidMatrix(t *testing.T) {
 
 func TestAdjustContrast(t *testing.T) {
 
-	width, height := rand.Intn(3841), rand.Intn(2161) // Random dimensions up to 4k
+	width, height := rand.Intn(3840)+1, rand.Intn(2160)+1 // Random dimensions up to 4k, never empty
 	randomImage := generateRandomImage(width, height)
 
 	// Example values for m (contrast factor) and b (brightness offset)
@@ -255,7 +286,7 @@ func TestAdjustContrast(t *testing.T) {
 
 func TestAdjustLuminosity(t *testing.T) {
 
-	width, height := rand.Intn(3841), rand.Intn(2161) // Random dimensions up to 4k
+	width, height := rand.Intn(3840)+1, rand.Intn(2160)+1 // Random dimensions up to 4k, never empty
 	randomImage := generateRandomImage(width, height)
 
 	b := 50.0 // Brightness offset
@@ -273,3 +304,2587 @@ func TestAdjustLuminosity(t *testing.T) {
 		t.Errorf("AdjustLuminosity() resulted in an invalid matrix: %v", err)
 	}
 }
+
+// TestImageAccessors tests that the raster.Image accessors are bounds-checked and reject invalid pixels
+func TestImageAccessors(t *testing.T) {
+	img, err := raster.NewRGBA(3, 2)
+	if err != nil {
+		t.Fatalf("NewRGBA() returned an error: %v", err)
+	}
+
+	if err := img.SetPixel(2, 1, []uint32{1, 2, 3, 4}); err != nil {
+		t.Errorf("SetPixel() returned an error for a valid pixel: %v", err)
+	}
+	pixel, err := img.Pixel(2, 1)
+	if err != nil || !reflect.DeepEqual(pixel, []uint32{1, 2, 3, 4}) {
+		t.Errorf("Pixel() returned %v, %v, expected [1 2 3 4]", pixel, err)
+	}
+	if img.Pix[len(img.Pix)-4] != 1 { // The last pixel of a row-major image is the bottom right one
+		t.Errorf("pixel (2, 1) was not stored at the end of Pix")
+	}
+
+	// Every coordinate outside the image must be rejected
+	for _, coord := range [][2]int{{-1, 0}, {0, -1}, {3, 0}, {0, 2}} {
+		if _, err := img.Pixel(coord[0], coord[1]); !errors.Is(err, raster.ErrOutOfBounds) {
+			t.Errorf("Pixel(%d, %d) returned %v, expected ErrOutOfBounds", coord[0], coord[1], err)
+		}
+		if err := img.SetPixel(coord[0], coord[1], []uint32{0, 0, 0, 0}); !errors.Is(err, raster.ErrOutOfBounds) {
+			t.Errorf("SetPixel(%d, %d) returned %v, expected ErrOutOfBounds", coord[0], coord[1], err)
+		}
+	}
+
+	if err := img.SetPixel(0, 0, []uint32{0, 0, 0}); err == nil {
+		t.Errorf("SetPixel() accepted a pixel with the wrong number of channels")
+	}
+	if err := img.SetPixel(0, 0, []uint32{256, 0, 0, 0}); err == nil {
+		t.Errorf("SetPixel() accepted a sample that exceeds the bit depth")
+	}
+}
+
+// TestFromMatrix tests that FromMatrix round-trips a [y][x] matrix and rejects ragged rows
+func TestFromMatrix(t *testing.T) {
+	matrix := [][][4]uint32{
+		{{1, 1, 1, 255}, {2, 2, 2, 255}, {3, 3, 3, 255}},
+		{{4, 4, 4, 255}, {5, 5, 5, 255}, {6, 6, 6, 255}},
+	}
+
+	img, err := raster.FromMatrix(matrix)
+	if err != nil {
+		t.Fatalf("FromMatrix() returned an error: %v", err)
+	}
+	if img.Width != 3 || img.Height != 2 {
+		t.Errorf("FromMatrix() produced a %dx%d image, expected 3x2", img.Width, img.Height)
+	}
+
+	back, err := img.Matrix()
+	if err != nil || !reflect.DeepEqual(back, matrix) {
+		t.Errorf("Matrix() did not return the original matrix: %v, %v", back, err)
+	}
+
+	ragged := [][][4]uint32{matrix[0], matrix[1][:2]}
+	if _, err := raster.FromMatrix(ragged); err == nil {
+		t.Errorf("FromMatrix() accepted a matrix with ragged rows")
+	}
+}
+
+// generateGradientImage generates an image where every pixel is unique and encodes its own coordinates, so any mix-up
+// between x and y is visible
+func generateGradientImage(width int, height int) *raster.Image {
+	img, _ := raster.NewRGBA(width, height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			_ = img.SetPixel(x, y, []uint32{uint32(x % 256), uint32(y % 256), uint32((x + y) % 256), 255})
+		}
+	}
+	return img
+}
+
+// TestNonSquareRoundTrip tests that a non-square image keeps its geometry through read -> operate -> write
+func TestNonSquareRoundTrip(t *testing.T) {
+	width, height := 37, 11 // Deliberately non-square and larger than the 7x7 Gaussian kernel
+	original := generateGradientImage(width, height)
+	directory := t.TempDir()
+
+	// Write the image and make sure a standard decoder sees the same geometry
+	path := directory + "/gradient.png"
+	if err := utils.WriteImage(original, path); err != nil {
+		t.Fatalf("WriteImage() returned an error: %v", err)
+	}
+	decoded, err := loadImage(path)
+	if err != nil {
+		t.Fatalf("Failed loading the created image: %s", err)
+	}
+	if decoded.Bounds().Dx() != width || decoded.Bounds().Dy() != height {
+		t.Fatalf("Written image is %dx%d, expected %dx%d", decoded.Bounds().Dx(), decoded.Bounds().Dy(), width, height)
+	}
+	if !assertColourEquality(decoded.At(width-1, 0), color.NRGBA{R: uint8(width - 1), G: 0, B: uint8(width - 1), A: 255}) {
+		t.Errorf("Top right pixel was written to the wrong place: %v", decoded.At(width-1, 0))
+	}
+
+	// Read it back, run every operation and write the results
+	img, err := utils.ReadImage(path)
+	if err != nil {
+		t.Fatalf("ReadImage() returned an error: %v", err)
+	}
+	if !reflect.DeepEqual(img, original) {
+		t.Fatalf("ReadImage() did not return the image that was written")
+	}
+
+	operations := map[string]func(*raster.Image) (*raster.Image, error){
+		"gaussian":   func(img *raster.Image) (*raster.Image, error) { return manipulations.GaussianFilter(img, 7, 10.5) },
+		"greyscale":  func(img *raster.Image) (*raster.Image, error) { return manipulations.ConvertToGreyScale(img) },
+		"contrast":   func(img *raster.Image) (*raster.Image, error) { return manipulations.AdjustContrast(img, 1.2, 0) },
+		"luminosity": func(img *raster.Image) (*raster.Image, error) { return manipulations.AdjustLuminosity(img, 50) },
+	}
+	for name, operation := range operations {
+		result, err := operation(img)
+		if err != nil {
+			t.Errorf("%s returned an error: %v", name, err)
+			continue
+		}
+		outputPath := directory + "/" + name + ".png"
+		if err := utils.WriteImage(result, outputPath); err != nil {
+			t.Errorf("WriteImage() returned an error for %s: %v", name, err)
+			continue
+		}
+		written, err := utils.ReadImageWithOptions(outputPath, utils.ReadOptions{Depth: 8, Channels: result.Channels})
+		if err != nil {
+			t.Errorf("ReadImage() returned an error for %s: %v", name, err)
+			continue
+		}
+		if written.Width != width || written.Height != height {
+			t.Errorf("%s produced a %dx%d image, expected %dx%d", name, written.Width, written.Height, width, height)
+		}
+		if !reflect.DeepEqual(written, result) {
+			t.Errorf("%s result changed when written and read back", name)
+		}
+	}
+
+	// The greyscale of the bottom right pixel must be computed from the bottom right pixel of the input
+	grey, _ := manipulations.ConvertToGreyScale(img)
+	pixel, _ := grey.Pixel(width-1, height-1)
+	expected := uint32(math.Round(float64(width-1)*0.299 + float64(height-1)*0.587 + float64(width+height-2)*0.114))
+	if pixel[0] != expected {
+		t.Errorf("Greyscale of the bottom right pixel is %d, expected %d", pixel[0], expected)
+	}
+}
+
+// TestOrientationHelpers tests the transpose, flip and rotation helpers on a non-square image
+func TestOrientationHelpers(t *testing.T) {
+	img := generateGradientImage(5, 3)
+
+	// assertMoved checks that the pixel at (x, y) of the source ended up at (dx, dy) of the result
+	assertMoved := func(name string, result *raster.Image, width, height, x, y, dx, dy int) {
+		if result.Width != width || result.Height != height {
+			t.Errorf("%s produced a %dx%d image, expected %dx%d", name, result.Width, result.Height, width, height)
+			return
+		}
+		want, _ := img.Pixel(x, y)
+		got, _ := result.Pixel(dx, dy)
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("%s: pixel (%d, %d) should be at (%d, %d), found %v instead of %v", name, x, y, dx, dy, got, want)
+		}
+	}
+
+	assertMoved("Transpose", img.Transpose(), 3, 5, 4, 1, 1, 4)
+	assertMoved("FlipHorizontal", img.FlipHorizontal(), 5, 3, 0, 1, 4, 1)
+	assertMoved("FlipVertical", img.FlipVertical(), 5, 3, 1, 0, 1, 2)
+	assertMoved("Rotate90", img.Rotate90(), 3, 5, 0, 0, 2, 0)
+	assertMoved("Rotate180", img.Rotate180(), 5, 3, 0, 0, 4, 2)
+	assertMoved("Rotate270", img.Rotate270(), 3, 5, 0, 0, 0, 4)
+
+	if !reflect.DeepEqual(img.Rotate90().Rotate90().Rotate90().Rotate90(), img) {
+		t.Errorf("Four clockwise rotations did not return the original image")
+	}
+	if !reflect.DeepEqual(img.Rotate90().FlipHorizontal(), img.Transpose()) {
+		t.Errorf("Rotating clockwise and flipping horizontally is not the transpose")
+	}
+
+	// A column-major matrix must describe the same image as its row-major counterpart
+	columns, _ := img.Columns()
+	fromColumns, err := raster.FromColumns(columns)
+	if err != nil || !reflect.DeepEqual(fromColumns, img) {
+		t.Errorf("FromColumns() did not reproduce the image: %v", err)
+	}
+	rows, _ := img.Matrix()
+	if len(rows) != 3 || len(columns) != 5 || rows[2][4] != columns[4][2] {
+		t.Errorf("Matrix() and Columns() disagree on the orientation of the image")
+	}
+}
+
+// TestSixteenBitPipeline tests that 16-bit PNGs keep their precision through read -> operate -> write
+func TestSixteenBitPipeline(t *testing.T) {
+	width, height := 9, 4
+	source := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			// Values that aren't multiples of 257 can't survive a round-trip through 8 bits
+			source.SetNRGBA64(x, y, color.NRGBA64{R: uint16(1000 + x), G: uint16(60000 + y), B: uint16(x * y), A: 65535})
+		}
+	}
+
+	path := t.TempDir() + "/deep.png"
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed creating the test image: %v", err)
+	}
+	if err := png.Encode(file, source); err != nil {
+		t.Fatalf("Failed encoding the test image: %v", err)
+	}
+	_ = file.Close()
+
+	img, err := utils.ReadImageWithOptions(path, utils.ReadOptions{})
+	if err != nil {
+		t.Fatalf("ReadImageWithOptions() returned an error: %v", err)
+	}
+	if img.Depth != 16 || img.MaxValue() != 65535 {
+		t.Fatalf("Expected a 16-bit image, got %d bits", img.Depth)
+	}
+	pixel, _ := img.Pixel(3, 2)
+	if !reflect.DeepEqual(pixel, []uint32{1003, 60002, 6, 65535}) {
+		t.Errorf("Pixel (3, 2) lost precision: %v", pixel)
+	}
+
+	// Operations must clamp to the image's own maximum rather than 255
+	brighter, err := manipulations.AdjustLuminosity(img, 51) // 51 on the 8-bit scale is 13107 at 16 bits
+	if err != nil {
+		t.Fatalf("AdjustLuminosity() returned an error: %v", err)
+	}
+	pixel, _ = brighter.Pixel(3, 2)
+	if !reflect.DeepEqual(pixel, []uint32{14110, 65535, 13113, 65535}) {
+		t.Errorf("AdjustLuminosity() on a 16-bit image returned %v", pixel)
+	}
+	blurred, err := manipulations.GaussianFilter(img, 3, 1)
+	if err != nil {
+		t.Fatalf("GaussianFilter() returned an error: %v", err)
+	}
+	pixel, _ = blurred.Pixel(4, 1)
+	if pixel[1] <= 255 {
+		t.Errorf("GaussianFilter() clamped a 16-bit image to 8 bits: %v", pixel)
+	}
+
+	// Writing must produce a 16-bit PNG with the exact same samples
+	outputPath := t.TempDir() + "/deep_new.png"
+	if err := utils.WriteImage(img, outputPath); err != nil {
+		t.Fatalf("WriteImage() returned an error: %v", err)
+	}
+	written, err := loadImage(outputPath)
+	if err != nil {
+		t.Fatalf("Failed loading the created image: %s", err)
+	}
+	if written.ColorModel() != color.NRGBA64Model && written.ColorModel() != color.RGBA64Model {
+		t.Errorf("WriteImage() did not write a 16-bit PNG")
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if !assertColourEquality(source.At(x, y), written.At(x, y)) {
+				t.Fatalf("Pixel (%d, %d) changed: %v != %v", x, y, source.At(x, y), written.At(x, y))
+			}
+		}
+	}
+
+	// The 8-bit default must still scale 16-bit samples down
+	legacy, err := utils.ReadImage(path)
+	if err != nil {
+		t.Fatalf("ReadImage() returned an error: %v", err)
+	}
+	converted, _ := img.ConvertDepth(8)
+	if legacy.Depth != 8 || converted.Depth != 8 {
+		t.Errorf("Expected 8-bit images, got %d and %d bits", legacy.Depth, converted.Depth)
+	}
+}
+
+// TestSRGBConversion tests the sRGB transfer functions against known values and each other
+func TestSRGBConversion(t *testing.T) {
+	if raster.SRGBToLinear(0) != 0 || math.Abs(float64(raster.SRGBToLinear(1))-1) > 1e-6 {
+		t.Errorf("SRGBToLinear() does not preserve the end points")
+	}
+	if v := raster.SRGBToLinear(0.5); math.Abs(float64(v)-0.214041) > 1e-5 {
+		t.Errorf("SRGBToLinear(0.5) = %f, expected 0.214041", v)
+	}
+	for i := 0; i <= 255; i++ {
+		v := float32(i) / 255
+		if back := raster.LinearToSRGB(raster.SRGBToLinear(v)); math.Abs(float64(back-v)) > 1e-5 {
+			t.Errorf("LinearToSRGB(SRGBToLinear(%f)) = %f", v, back)
+		}
+	}
+
+	// The alpha channel must never be gamma-encoded
+	f, _ := raster.NewFloat(1, 1, 4)
+	_ = f.SetPixel(0, 0, []float32{0.5, 0.5, 0.5, 0.5})
+	linear := f.ToLinear()
+	pixel, _ := linear.Pixel(0, 0)
+	if !linear.Linear || pixel[3] != 0.5 || math.Abs(float64(pixel[0])-0.214041) > 1e-5 {
+		t.Errorf("ToLinear() returned %v", pixel)
+	}
+	img, err := linear.ToImage(8)
+	if err != nil {
+		t.Fatalf("ToImage() returned an error: %v", err)
+	}
+	if back, _ := img.Pixel(0, 0); !reflect.DeepEqual(back, []uint32{128, 128, 128, 128}) {
+		t.Errorf("ToImage() did not encode a linear image back to sRGB: %v", back)
+	}
+}
+
+// TestFloatChaining tests that chaining operations on a raster.Float doesn't accumulate rounding error
+func TestFloatChaining(t *testing.T) {
+	img := generateGradientImage(256, 2)
+
+	// Crushing the contrast and restoring it rounds away most of the information on an integer image...
+	crushed, _ := manipulations.AdjustContrast(img, 0.1, 0)
+	restored, _ := manipulations.AdjustContrast(crushed, 10, 0)
+	if reflect.DeepEqual(restored, img) {
+		t.Fatalf("Expected the integer pipeline to lose precision")
+	}
+
+	// ...but not on a float image, which is only rounded at the very end
+	crushedFloat, err := manipulations.AdjustContrast(img.ToFloat(), 0.1, 0)
+	if err != nil {
+		t.Fatalf("AdjustContrast() returned an error: %v", err)
+	}
+	restoredFloat, _ := manipulations.AdjustContrast(crushedFloat, 10, 0)
+
+	path := t.TempDir() + "/chained.png"
+	if err := utils.WriteFloatImage(restoredFloat, path, 8); err != nil {
+		t.Fatalf("WriteFloatImage() returned an error: %v", err)
+	}
+	written, err := utils.ReadImage(path)
+	if err != nil {
+		t.Fatalf("ReadImage() returned an error: %v", err)
+	}
+	if !reflect.DeepEqual(written, img) {
+		t.Errorf("Chaining operations on a float image lost precision")
+	}
+}
+
+// TestLinearLightBlur tests that blurring in linear light doesn't darken the edge between black and white
+func TestLinearLightBlur(t *testing.T) {
+	img, _ := raster.NewRGBA(8, 3)
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			value := uint32(0)
+			if x >= 4 {
+				value = 255
+			}
+			_ = img.SetPixel(x, y, []uint32{value, value, value, 255})
+		}
+	}
+
+	encoded, err := manipulations.GaussianFilter(img, 3, 1)
+	if err != nil {
+		t.Fatalf("GaussianFilter() returned an error: %v", err)
+	}
+	linear, err := manipulations.GaussianFilter(img, 3, 1, manipulations.InLinearLight())
+	if err != nil {
+		t.Fatalf("GaussianFilter() in linear light returned an error: %v", err)
+	}
+
+	// Pixels on either side of the edge are brighter when the average is taken in linear light
+	for _, x := range []int{3, 4} {
+		e, _ := encoded.Pixel(x, 1)
+		l, _ := linear.Pixel(x, 1)
+		if l[0] <= e[0] {
+			t.Errorf("Pixel (%d, 1) is %d in linear light and %d otherwise, expected it to be brighter", x, l[0], e[0])
+		}
+		if l[3] != 255 {
+			t.Errorf("Blurring in linear light changed the alpha channel to %d", l[3])
+		}
+	}
+}
+
+// generateSprite generates an image that is fully transparent red except for an opaque blue square in the middle,
+// the invisible red is what causes fringes when alpha is handled incorrectly
+func generateSprite() *raster.Image {
+	img, _ := raster.NewRGBA(12, 12)
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			if x >= 4 && x < 8 && y >= 4 && y < 8 {
+				_ = img.SetPixel(x, y, []uint32{0, 0, 255, 255})
+			} else {
+				_ = img.SetPixel(x, y, []uint32{255, 0, 0, 0})
+			}
+		}
+	}
+	return img
+}
+
+// TestAlphaPolicies tests that blurring an image with transparency doesn't produce coloured fringes by default
+func TestAlphaPolicies(t *testing.T) {
+	sprite := generateSprite()
+
+	// By default the blur premultiplies, so the edge of the square is translucent pure blue
+	blurred, err := manipulations.GaussianFilter(sprite, 5, 1.5)
+	if err != nil {
+		t.Fatalf("GaussianFilter() returned an error: %v", err)
+	}
+	edge, _ := blurred.Pixel(3, 5)
+	if edge[0] != 0 || edge[2] != 255 || edge[3] == 0 || edge[3] == 255 {
+		t.Errorf("Premultiplied blur produced a fringe at the edge: %v", edge)
+	}
+
+	// Blurring straight alpha mixes in the invisible red
+	straight, _ := manipulations.GaussianFilter(sprite, 5, 1.5, manipulations.WithAlpha(manipulations.AlphaProcess))
+	edge, _ = straight.Pixel(3, 5)
+	if edge[0] == 0 {
+		t.Errorf("Expected straight alpha blurring to produce a red fringe: %v", edge)
+	}
+
+	// Preserving alpha keeps the hard edge of the mask
+	preserved, _ := manipulations.GaussianFilter(sprite, 5, 1.5, manipulations.WithAlpha(manipulations.AlphaPreserve))
+	edge, _ = preserved.Pixel(3, 5)
+	inside, _ := preserved.Pixel(4, 5)
+	if edge[3] != 0 || inside[3] != 255 {
+		t.Errorf("AlphaPreserve changed the alpha channel: %v, %v", edge, inside)
+	}
+
+	// Point operations preserve alpha by default and only touch it when asked to
+	brighter, _ := manipulations.AdjustLuminosity(sprite, 50)
+	if pixel, _ := brighter.Pixel(0, 0); pixel[3] != 0 {
+		t.Errorf("AdjustLuminosity() changed alpha by default: %v", pixel)
+	}
+	brighter, _ = manipulations.AdjustLuminosity(sprite, 50, manipulations.WithAlpha(manipulations.AlphaProcess))
+	if pixel, _ := brighter.Pixel(0, 0); pixel[3] != 50 {
+		t.Errorf("AdjustLuminosity() with AlphaProcess did not brighten alpha: %v", pixel)
+	}
+}
+
+// TestPremultiply tests that Premultiply and Unpremultiply are inverses and track the state of the image
+func TestPremultiply(t *testing.T) {
+	f, _ := raster.NewFloat(2, 1, 4)
+	_ = f.SetPixel(0, 0, []float32{0.8, 0.4, 0.2, 0.5})
+	_ = f.SetPixel(1, 0, []float32{1, 1, 1, 0})
+
+	premultiplied := f.Premultiply()
+	pixel, _ := premultiplied.Pixel(0, 0)
+	if !premultiplied.Premultiplied || !reflect.DeepEqual(pixel, []float32{0.4, 0.2, 0.1, 0.5}) {
+		t.Errorf("Premultiply() returned %v", pixel)
+	}
+	if twice := premultiplied.Premultiply(); !reflect.DeepEqual(twice, premultiplied) {
+		t.Errorf("Premultiply() applied twice changed the image again")
+	}
+
+	straight := premultiplied.Unpremultiply()
+	pixel, _ = straight.Pixel(0, 0)
+	if straight.Premultiplied || !reflect.DeepEqual(pixel, []float32{0.8, 0.4, 0.2, 0.5}) {
+		t.Errorf("Unpremultiply() returned %v", pixel)
+	}
+	if pixel, _ = straight.Pixel(1, 0); !reflect.DeepEqual(pixel, []float32{0, 0, 0, 0}) {
+		t.Errorf("Unpremultiply() of a transparent pixel returned %v, expected transparent black", pixel)
+	}
+
+	// Quantising must hand back straight alpha regardless of the float's state
+	img, _ := premultiplied.ToImage(8)
+	if pixel, _ := img.Pixel(0, 0); !reflect.DeepEqual(pixel, []uint32{204, 102, 51, 128}) {
+		t.Errorf("ToImage() of a premultiplied image returned %v", pixel)
+	}
+}
+
+// TestGreyscalePNG tests that single-channel images are written as greyscale PNGs and read back as single-channel
+func TestGreyscalePNG(t *testing.T) {
+	for _, depth := range []int{8, 16} {
+		img, _ := raster.New(7, 3, raster.Grey, depth)
+		for i := range img.Pix {
+			img.Pix[i] = uint32(i*997) % (img.MaxValue() + 1)
+		}
+
+		path := t.TempDir() + "/grey.png"
+		if err := utils.WriteImage(img, path); err != nil {
+			t.Fatalf("WriteImage() returned an error for a %d-bit greyscale image: %v", depth, err)
+		}
+		decoded, err := loadImage(path)
+		if err != nil {
+			t.Fatalf("Failed loading the created image: %s", err)
+		}
+		if _, isGray := decoded.(*image.Gray); depth == 8 && !isGray {
+			t.Errorf("Expected an image.Gray, got %T", decoded)
+		}
+		if _, isGray16 := decoded.(*image.Gray16); depth == 16 && !isGray16 {
+			t.Errorf("Expected an image.Gray16, got %T", decoded)
+		}
+
+		read, err := utils.ReadImageWithOptions(path, utils.ReadOptions{})
+		if err != nil {
+			t.Fatalf("ReadImageWithOptions() returned an error: %v", err)
+		}
+		if !reflect.DeepEqual(read, img) {
+			t.Errorf("%d-bit greyscale image changed when written and read back", depth)
+		}
+	}
+}
+
+// TestMultiBandImages tests that operations work on any number of channels and that bands can be split and merged
+func TestMultiBandImages(t *testing.T) {
+	// A mask only has one channel, which is processed like a colour channel
+	mask, _ := raster.New(5, 5, raster.Grey, 8)
+	for i := range mask.Pix {
+		mask.Pix[i] = 100
+	}
+	inverted, err := manipulations.AdjustContrast(mask, -1, 255)
+	if err != nil {
+		t.Fatalf("AdjustContrast() returned an error for a mask: %v", err)
+	}
+	if inverted.Channels != raster.Grey || inverted.Pix[0] != 155 {
+		t.Errorf("AdjustContrast() on a mask returned %d channels with value %d", inverted.Channels, inverted.Pix[0])
+	}
+
+	// A six band image, as produced by a multispectral sensor
+	bands := make([]*raster.Image, 6)
+	for c := range bands {
+		bands[c], _ = raster.New(9, 7, raster.Grey, 16)
+		for i := range bands[c].Pix {
+			bands[c].Pix[i] = uint32(c * 10000)
+		}
+	}
+	multispectral, err := raster.MergeChannels(bands...)
+	if err != nil {
+		t.Fatalf("MergeChannels() returned an error: %v", err)
+	}
+	if multispectral.Channels != 6 || multispectral.HasAlpha() {
+		t.Fatalf("MergeChannels() produced %d channels, alpha %v", multispectral.Channels, multispectral.HasAlpha())
+	}
+	if !reflect.DeepEqual(multispectral.SplitChannels(), bands) {
+		t.Errorf("SplitChannels() did not return the merged bands")
+	}
+
+	// Every band is blurred independently, so uniform bands stay uniform
+	blurred, err := manipulations.GaussianFilter(multispectral, 3, 1)
+	if err != nil {
+		t.Fatalf("GaussianFilter() returned an error for a multispectral image: %v", err)
+	}
+	if pixel, _ := blurred.Pixel(4, 3); !reflect.DeepEqual(pixel, []uint32{0, 10000, 20000, 30000, 40000, 50000}) {
+		t.Errorf("GaussianFilter() mixed the bands of a multispectral image: %v", pixel)
+	}
+
+	// There's no meaningful luminance or PNG encoding for six bands
+	if _, err := manipulations.ConvertToGreyScale(multispectral); err == nil {
+		t.Errorf("ConvertToGreyScale() accepted a six band image")
+	}
+	if err := utils.WriteImage(multispectral, t.TempDir()+"/bands.png"); err == nil {
+		t.Errorf("WriteImage() accepted a six band image")
+	}
+
+	// Colour images without alpha become single-channel greyscale images
+	rgb, _ := raster.New(4, 4, raster.RGB, 8)
+	grey, err := manipulations.ConvertToGreyScale(rgb)
+	if err != nil || grey.Channels != raster.Grey {
+		t.Errorf("ConvertToGreyScale() of an RGB image returned %v, %v", grey, err)
+	}
+}
+
+// TestSubImage tests that views share storage with their parent and use coordinates relative to their own corner
+func TestSubImage(t *testing.T) {
+	img := generateGradientImage(10, 6)
+	view := img.SubImage(image.Rect(3, 2, 8, 9)) // Extends past the bottom, so it is clipped to 5x4
+	if view.Width != 5 || view.Height != 4 {
+		t.Fatalf("SubImage() returned a %dx%d view, expected 5x4", view.Width, view.Height)
+	}
+	if err := view.Validate(); err != nil {
+		t.Fatalf("SubImage() returned an invalid view: %v", err)
+	}
+
+	corner, _ := view.Pixel(0, 0)
+	if want, _ := img.Pixel(3, 2); !reflect.DeepEqual(corner, want) {
+		t.Errorf("The corner of the view is %v, expected %v", corner, want)
+	}
+
+	// Writing through the view must change the parent, and nothing outside the view may be reachable
+	_ = view.SetPixel(4, 3, []uint32{1, 2, 3, 4})
+	if pixel, _ := img.Pixel(7, 5); !reflect.DeepEqual(pixel, []uint32{1, 2, 3, 4}) {
+		t.Errorf("Writing through the view did not change the parent: %v", pixel)
+	}
+	if _, err := view.Pixel(5, 0); !errors.Is(err, raster.ErrOutOfBounds) {
+		t.Errorf("The view gave access to a pixel outside of it")
+	}
+
+	// Copies of a view are independent and packed
+	clone := view.Clone()
+	_ = clone.SetPixel(0, 0, []uint32{0, 0, 0, 0})
+	if pixel, _ := img.Pixel(3, 2); reflect.DeepEqual(pixel, []uint32{0, 0, 0, 0}) {
+		t.Errorf("Writing to a clone of the view changed the parent")
+	}
+	if clone.Stride != clone.Width*clone.Channels {
+		t.Errorf("Clone() of a view kept the parent's stride")
+	}
+}
+
+// TestRegionOperations tests that operations restricted to a region match the full operation inside the region and
+// leave everything else untouched
+func TestRegionOperations(t *testing.T) {
+	img := generateRandomImage(40, 30)
+	operations := map[string]func(*raster.Image, ...manipulations.Option) (*raster.Image, error){
+		"gaussian": func(img *raster.Image, opts ...manipulations.Option) (*raster.Image, error) {
+			return manipulations.GaussianFilter(img, 7, 2, opts...)
+		},
+		"greyscale": func(img *raster.Image, opts ...manipulations.Option) (*raster.Image, error) {
+			grey, err := manipulations.ConvertToGreyScale(img, opts...)
+			if err == nil && grey.Channels != img.Channels { // Expand the full greyscale result to compare it
+				expanded, _ := raster.NewRGBA(grey.Width, grey.Height)
+				err = expanded.Paste(grey, image.Point{})
+				grey = expanded
+			}
+			return grey, err
+		},
+		"contrast": func(img *raster.Image, opts ...manipulations.Option) (*raster.Image, error) {
+			return manipulations.AdjustContrast(img, 1.5, -20, opts...)
+		},
+		"luminosity": func(img *raster.Image, opts ...manipulations.Option) (*raster.Image, error) {
+			return manipulations.AdjustLuminosity(img, 60, opts...)
+		},
+	}
+
+	// One region in the middle, one touching the border of the image
+	for _, region := range []image.Rectangle{image.Rect(10, 5, 25, 20), image.Rect(-5, 20, 12, 40)} {
+		for name, operation := range operations {
+			full, err := operation(img)
+			if err != nil {
+				t.Fatalf("%s returned an error: %v", name, err)
+			}
+			partial, err := operation(img, manipulations.InRegion(region))
+			if err != nil {
+				t.Fatalf("%s in %v returned an error: %v", name, region, err)
+			}
+			if partial.Width != img.Width || partial.Height != img.Height || partial.Channels != img.Channels {
+				t.Fatalf("%s in %v did not return the full image", name, region)
+			}
+
+			for y := 0; y < img.Height; y++ {
+				for x := 0; x < img.Width; x++ {
+					expected, _ := img.Pixel(x, y)
+					if (image.Point{X: x, Y: y}).In(region) {
+						expected, _ = full.Pixel(x, y)
+					}
+					if got, _ := partial.Pixel(x, y); !reflect.DeepEqual(got, expected) {
+						t.Fatalf("%s in %v: pixel (%d, %d) is %v, expected %v", name, region, x, y, got, expected)
+					}
+				}
+			}
+		}
+	}
+
+	// Operating on a view and pasting the result back is equivalent for point operations
+	region := image.Rect(5, 5, 15, 12)
+	brighter, _ := manipulations.AdjustLuminosity(img.SubImage(region), 60)
+	composite := img.Clone()
+	if err := composite.Paste(brighter, region.Min); err != nil {
+		t.Fatalf("Paste() returned an error: %v", err)
+	}
+	expected, _ := manipulations.AdjustLuminosity(img, 60, manipulations.InRegion(region))
+	if !reflect.DeepEqual(composite, expected) {
+		t.Errorf("Operating on a view and pasting it back differs from operating on the region")
+	}
+
+	if _, err := manipulations.AdjustLuminosity(img, 60, manipulations.InRegion(image.Rect(100, 100, 110, 110))); err == nil {
+		t.Errorf("AdjustLuminosity() accepted a region outside the image")
+	}
+}
+
+// encodePNG encodes an image.Image with the standard library's encoder, which picks the colour type from its type
+func encodePNG(t *testing.T, img image.Image) []byte {
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, img); err != nil {
+		t.Fatalf("Failed encoding the test image: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+// TestPNGRowStreaming tests that PNGs read and written a few rows at a time match the standard library
+func TestPNGRowStreaming(t *testing.T) {
+	bounds := image.Rect(0, 0, 23, 17)
+	gray, gray16 := image.NewGray(bounds), image.NewGray16(bounds)
+	nrgba, nrgba64 := image.NewNRGBA(bounds), image.NewNRGBA64(bounds)
+	opaque := image.NewNRGBA(bounds) // Written as an RGB PNG
+	paletted := image.NewPaletted(bounds, color.Palette{color.NRGBA{R: 255, A: 255}, color.NRGBA{G: 128, A: 100}, color.NRGBA{}})
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			gray.SetGray(x, y, color.Gray{Y: uint8(x * y)})
+			gray16.SetGray16(x, y, color.Gray16{Y: uint16(x * y * 163)})
+			nrgba.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 11), G: uint8(y * 13), B: uint8(x + y), A: uint8(x * y)})
+			nrgba64.SetNRGBA64(x, y, color.NRGBA64{R: uint16(x * 1111), G: uint16(y * 1313), B: uint16(x + y), A: 65535 - uint16(x*y)})
+			opaque.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 11), G: uint8(y * 13), B: uint8(x + y), A: 255})
+			paletted.SetColorIndex(x, y, uint8((x+y)%3))
+		}
+	}
+
+	for _, source := range []image.Image{gray, gray16, nrgba, nrgba64, opaque, paletted} {
+		encoded := encodePNG(t, source)
+		reader, err := utils.NewPNGRowReader(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("NewPNGRowReader() returned an error for a %T: %v", source, err)
+		}
+
+		// Read the image in uneven bands, as the tiled engine does
+		streamed, _ := raster.New(reader.Width(), reader.Height(), reader.Channels(), reader.Depth())
+		for top := 0; top < streamed.Height; top += 5 {
+			band := streamed.SubImage(image.Rect(0, top, streamed.Width, top+5))
+			if err := reader.ReadRows(band); err != nil {
+				t.Fatalf("ReadRows() returned an error for a %T: %v", source, err)
+			}
+		}
+
+		expected, _ := utils.ReadImageWithOptions(writeTemporaryFile(t, encoded), utils.ReadOptions{Channels: reader.Channels()})
+		if !reflect.DeepEqual(streamed, expected) {
+			t.Errorf("Streaming a %T did not match decoding it whole", source)
+		}
+
+		// Writing the rows back must produce a PNG the standard library decodes to the same pixels
+		var output bytes.Buffer
+		writer, _ := utils.NewPNGRowWriter(&output, streamed.Width, streamed.Height)
+		for top := 0; top < streamed.Height; top += 4 {
+			if err := writer.WriteRows(streamed.SubImage(image.Rect(0, top, streamed.Width, top+4))); err != nil {
+				t.Fatalf("WriteRows() returned an error for a %T: %v", source, err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Close() returned an error for a %T: %v", source, err)
+		}
+		decoded, err := png.Decode(&output)
+		if err != nil {
+			t.Fatalf("The streamed PNG for a %T could not be decoded: %v", source, err)
+		}
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				if !assertColourEquality(decoded.At(x, y), source.At(x, y)) {
+					t.Fatalf("Streamed %T differs at (%d, %d): %v != %v", source, x, y, decoded.At(x, y), source.At(x, y))
+				}
+			}
+		}
+	}
+}
+
+// pngChunk returns a PNG chunk of the given type holding data, with a correct CRC unless length differs from the data
+func pngChunk(chunkType string, length uint32, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, length)
+	chunk = append(append(chunk, chunkType...), data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// TestPNGRowStreamingLimits tests that the row reader checks chunk lengths and the width before allocating, and reads
+// the image data chunk by chunk
+func TestPNGRowStreamingLimits(t *testing.T) {
+	encoded := encodePNG(t, generateRandomImage(40, 30))
+	ihdr := encoded[8 : 8+25]
+	idat := bytes.Index(encoded, []byte("IDAT")) - 4
+	data := encoded[idat+8 : len(encoded)-12-4] // The compressed data of the only IDAT chunk
+	withChunks := func(chunks ...[]byte) []byte {
+		file := append([]byte(nil), encoded[:8+25]...)
+		for _, chunk := range chunks {
+			file = append(file, chunk...)
+		}
+		return append(file, pngChunk("IEND", 0, nil)...)
+	}
+
+	// Image data split across many chunks, with metadata before it, is read like a single chunk
+	var split [][]byte
+	split = append(split, pngChunk("tEXt", 7, []byte("Title\x00x")))
+	for i := 0; i < len(data); i += 100 {
+		part := data[i:min(i+100, len(data))]
+		split = append(split, pngChunk("IDAT", uint32(len(part)), part))
+	}
+	reader, err := utils.NewPNGRowReader(bytes.NewReader(withChunks(split...)))
+	if err != nil {
+		t.Fatalf("NewPNGRowReader() returned an error for split image data: %v", err)
+	}
+	rows, _ := raster.New(reader.Width(), reader.Height(), reader.Channels(), reader.Depth())
+	if err := reader.ReadRows(rows); err != nil {
+		t.Errorf("ReadRows() returned an error for split image data: %v", err)
+	}
+
+	wide := append([]byte(nil), ihdr...)
+	binary.BigEndian.PutUint32(wide[8:], 1<<31-1)
+	binary.BigEndian.PutUint32(wide[21:], crc32.ChecksumIEEE(wide[4:21]))
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(corrupt)/2] ^= 0xFF
+	corruptChunk := pngChunk("IDAT", uint32(len(data)), data)
+	corruptChunk[len(corruptChunk)-1] ^= 0xFF
+	for name, file := range map[string][]byte{
+		"a forged text chunk length": withChunks(pngChunk("tEXt", 1<<31-1, []byte("Title\x00"))),
+		"a forged IDAT length":       withChunks(pngChunk("IDAT", 1<<31-1, corrupt)),
+		"a huge width":               append(append(append([]byte(nil), encoded[:8]...), wide...), encoded[8+25:]...),
+		"an IDAT CRC mismatch":       withChunks(corruptChunk),
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		reader, err := utils.NewPNGRowReader(bytes.NewReader(file))
+		if err == nil {
+			rows, _ := raster.New(reader.Width(), reader.Height(), reader.Channels(), reader.Depth())
+			err = reader.ReadRows(rows)
+		}
+		runtime.ReadMemStats(&after)
+		if err == nil {
+			t.Errorf("A PNG with %s was read without an error", name)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+			t.Errorf("Reading a PNG with %s allocated %d bytes", name, allocated)
+		}
+	}
+}
+
+// writeTemporaryFile writes data to a new file in a temporary directory and returns its path
+func writeTemporaryFile(t *testing.T, data []byte) string {
+	path := t.TempDir() + "/image"
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("Failed writing a temporary file: %v", err)
+	}
+	return path
+}
+
+// TestTiledProcessing tests that processing an image in tiles gives exactly the same result as processing it whole
+func TestTiledProcessing(t *testing.T) {
+	img := generateRandomImage(64, 50)
+	var source bytes.Buffer
+	writer, _ := utils.NewPNGRowWriter(&source, img.Width, img.Height)
+	_ = writer.WriteRows(img)
+	_ = writer.Close()
+
+	operations := map[string]struct {
+		fn   tiles.Func
+		halo int
+	}{
+		"gaussian":  {func(tile *raster.Image) (*raster.Image, error) { return manipulations.GaussianFilter(tile, 7, 2) }, 3},
+		"greyscale": {func(tile *raster.Image) (*raster.Image, error) { return manipulations.ConvertToGreyScale(tile) }, 0},
+	}
+	for name, operation := range operations {
+		expected, _ := operation.fn(img)
+
+		// A budget of 10 rows plus the halo forces several tiles
+		reader, err := utils.NewPNGRowReader(bytes.NewReader(source.Bytes()))
+		if err != nil {
+			t.Fatalf("NewPNGRowReader() returned an error: %v", err)
+		}
+		var output bytes.Buffer
+		writer, _ := utils.NewPNGRowWriter(&output, img.Width, img.Height)
+		budget := int64(10+2*operation.halo) * int64(img.Width*img.Channels) * 20
+		if err := tiles.Process(reader, writer, operation.fn, tiles.Config{Halo: operation.halo, MemoryBudget: budget}); err != nil {
+			t.Fatalf("Process() returned an error for %s: %v", name, err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Close() returned an error for %s: %v", name, err)
+		}
+
+		reader, _ = utils.NewPNGRowReader(&output)
+		result, _ := raster.New(reader.Width(), reader.Height(), reader.Channels(), reader.Depth())
+		if err := reader.ReadRows(result); err != nil {
+			t.Fatalf("Reading the tiled result back returned an error for %s: %v", name, err)
+		}
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("Tiled %s differs from processing the whole image", name)
+		}
+	}
+
+	// A budget that can't hold a single row and its halo must be refused
+	reader, _ := utils.NewPNGRowReader(bytes.NewReader(source.Bytes()))
+	err := tiles.Process(reader, writer, operations["gaussian"].fn, tiles.Config{Halo: 3, MemoryBudget: 1024})
+	if err == nil {
+		t.Errorf("Process() accepted a memory budget that is too small")
+	}
+}
+
+// TestParallelMatchesSerial tests that splitting an operation across workers gives bit-identical results
+func TestParallelMatchesSerial(t *testing.T) {
+	img := generateRandomImage(rand.Intn(300)+50, rand.Intn(200)+50)
+	float := img.ToFloat()
+
+	operations := map[string]func(*raster.Float, ...manipulations.Option) (*raster.Float, error){
+		"gaussian": func(f *raster.Float, opts ...manipulations.Option) (*raster.Float, error) {
+			return manipulations.GaussianFilter(f, 7, 10.5, opts...)
+		},
+		"greyscale": func(f *raster.Float, opts ...manipulations.Option) (*raster.Float, error) {
+			return manipulations.ConvertToGreyScale(f, opts...)
+		},
+		"contrast": func(f *raster.Float, opts ...manipulations.Option) (*raster.Float, error) {
+			return manipulations.AdjustContrast(f, 1.3, -10, opts...)
+		},
+		"luminosity": func(f *raster.Float, opts ...manipulations.Option) (*raster.Float, error) {
+			return manipulations.AdjustLuminosity(f, 40, opts...)
+		},
+	}
+	for name, operation := range operations {
+		serial, err := operation(float, manipulations.Workers(1))
+		if err != nil {
+			t.Fatalf("%s returned an error: %v", name, err)
+		}
+		for _, workers := range []int{0, 2, 7, 64} {
+			parallel, err := operation(float, manipulations.Workers(workers))
+			if err != nil {
+				t.Fatalf("%s with %d workers returned an error: %v", name, workers, err)
+			}
+			if !reflect.DeepEqual(parallel, serial) {
+				t.Errorf("%s with %d workers differs from the serial result", name, workers)
+			}
+		}
+	}
+
+	// The integer path must agree too, including on images with fewer rows than workers
+	thin := generateRandomImage(40, 3)
+	serial, _ := manipulations.AdjustContrast(thin, 2, 0, manipulations.Workers(1))
+	parallel, _ := manipulations.AdjustContrast(thin, 2, 0, manipulations.Workers(16))
+	if !reflect.DeepEqual(parallel, serial) {
+		t.Errorf("AdjustContrast() with more workers than rows differs from the serial result")
+	}
+}
+
+// TestCancellationAndProgress tests that operations report their progress and stop once their context is cancelled
+func TestCancellationAndProgress(t *testing.T) {
+	img := generateRandomImage(80, 200)
+
+	operations := map[string]func(context.Context, *raster.Image, ...manipulations.Option) (*raster.Image, error){
+		"gaussian": func(ctx context.Context, img *raster.Image, opts ...manipulations.Option) (*raster.Image, error) {
+			return manipulations.GaussianFilterContext(ctx, img, 7, 10.5, opts...)
+		},
+		"greyscale": func(ctx context.Context, img *raster.Image, opts ...manipulations.Option) (*raster.Image, error) {
+			return manipulations.ConvertToGreyScaleContext(ctx, img, opts...)
+		},
+		"contrast": func(ctx context.Context, img *raster.Image, opts ...manipulations.Option) (*raster.Image, error) {
+			return manipulations.AdjustContrastContext(ctx, img, 1.3, -10, opts...)
+		},
+		"luminosity": func(ctx context.Context, img *raster.Image, opts ...manipulations.Option) (*raster.Image, error) {
+			return manipulations.AdjustLuminosityContext(ctx, img, 40, opts...)
+		},
+	}
+	for name, operation := range operations {
+		// Progress must only grow and end with every row done
+		last := 0
+		progress := manipulations.WithProgress(func(done, total int) {
+			if done <= last || total != img.Height {
+				t.Errorf("%s reported %d of %d rows after %d", name, done, total, last)
+			}
+			last = done
+		})
+		if _, err := operation(context.Background(), img, progress, manipulations.Workers(4)); err != nil {
+			t.Fatalf("%s returned an error: %v", name, err)
+		}
+		if last != img.Height {
+			t.Errorf("%s reported %d rows done, expected %d", name, last, img.Height)
+		}
+
+		// An already cancelled context does no work at all
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := operation(ctx, img); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s with a cancelled context returned %v, expected context.Canceled", name, err)
+		}
+
+		// Cancelling part way stops before the remaining rows are processed
+		ctx, cancel = context.WithCancel(context.Background())
+		rows := 0
+		stop := manipulations.WithProgress(func(done, total int) {
+			rows = done
+			cancel()
+		})
+		if _, err := operation(ctx, img, stop, manipulations.Workers(1)); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s cancelled part way returned %v, expected context.Canceled", name, err)
+		}
+		if rows >= img.Height {
+			t.Errorf("%s processed every row despite being cancelled", name)
+		}
+	}
+
+	// The tiled engine reports tiles and stops between them
+	var source bytes.Buffer
+	writer, _ := utils.NewPNGRowWriter(&source, img.Width, img.Height)
+	_ = writer.WriteRows(img)
+	_ = writer.Close()
+	greyscale := func(tile *raster.Image) (*raster.Image, error) { return manipulations.ConvertToGreyScale(tile) }
+	budget := int64(50) * int64(img.Width*img.Channels) * 20
+
+	reader, _ := utils.NewPNGRowReader(bytes.NewReader(source.Bytes()))
+	writer, _ = utils.NewPNGRowWriter(&bytes.Buffer{}, img.Width, img.Height)
+	var reports [][2]int
+	config := tiles.Config{MemoryBudget: budget, Progress: func(done, total int) { reports = append(reports, [2]int{done, total}) }}
+	if err := tiles.Process(reader, writer, greyscale, config); err != nil {
+		t.Fatalf("Process() returned an error: %v", err)
+	}
+	if expected := [][2]int{{1, 4}, {2, 4}, {3, 4}, {4, 4}}; !reflect.DeepEqual(reports, expected) {
+		t.Errorf("Process() reported %v, expected %v", reports, expected)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, _ = utils.NewPNGRowReader(bytes.NewReader(source.Bytes()))
+	writer, _ = utils.NewPNGRowWriter(&bytes.Buffer{}, img.Width, img.Height)
+	tilesDone := 0
+	config.Progress = func(done, total int) {
+		tilesDone = done
+		cancel()
+	}
+	if err := tiles.ProcessContext(ctx, reader, writer, greyscale, config); !errors.Is(err, context.Canceled) {
+		t.Errorf("ProcessContext() cancelled after a tile returned %v, expected context.Canceled", err)
+	}
+	if tilesDone != 1 {
+		t.Errorf("ProcessContext() processed %d tiles after being cancelled, expected 1", tilesDone)
+	}
+}
+
+// invertOperation is a minimal Operation used to test registering operations from outside the package
+type invertOperation struct{}
+
+func (invertOperation) Name() string                               { return "test-invert" }
+func (invertOperation) Description() string                        { return "Invert the colours" }
+func (invertOperation) Params() []manipulations.Param              { return nil }
+func (invertOperation) Validate(params manipulations.Params) error { return nil }
+func (invertOperation) Apply(ctx context.Context, img *raster.Float, params manipulations.Params, opts ...manipulations.Option) (*raster.Float, error) {
+	return manipulations.AdjustContrastContext(ctx, img, -1, 255, opts...)
+}
+
+// TestOperationRegistry tests discovering operations by name, validating their parameters and chaining them
+func TestOperationRegistry(t *testing.T) {
+	var names []string
+	for _, op := range manipulations.Operations() {
+		names = append(names, op.Name())
+	}
+	if !reflect.DeepEqual(names[:4], []string{"blur", "grey", "contrast", "luminosity"}) {
+		t.Errorf("Operations() starts with %v, expected the built in operations in menu order", names)
+	}
+	if _, ok := manipulations.Lookup("sharpen"); ok {
+		t.Errorf("Lookup() found an operation that was never registered")
+	}
+
+	blur, ok := manipulations.Lookup("blur")
+	if !ok {
+		t.Fatalf("Lookup() did not find blur")
+	}
+	invalid := []manipulations.Params{
+		{"size": 4},           // Even kernel
+		{"size": 5.5},         // Not a whole number
+		{"sigma": -1},         // Out of range
+		{"sigma": math.NaN()}, // Not finite
+		{"radius": 3},         // Unknown parameter
+	}
+	for _, params := range invalid {
+		if err := blur.Validate(params); err == nil {
+			t.Errorf("blur accepted %v", params)
+		}
+	}
+	if err := blur.Validate(nil); err != nil {
+		t.Errorf("blur rejected its defaults: %v", err)
+	}
+	if size, err := blur.Params()[0].Parse("9"); err != nil || size != 9 {
+		t.Errorf("Parse(\"9\") = %v, %v", size, err)
+	}
+	if _, err := blur.Params()[0].Parse("9.5"); err == nil {
+		t.Errorf("Parse() accepted a fractional kernel size")
+	}
+
+	// A pipeline gives the same result as chaining the functions on floats and rounding once
+	img := generateRandomImage(40, 30)
+	pipeline := new(manipulations.Pipeline)
+	if _, err := pipeline.ThenNamed("blur", manipulations.Params{"size": 5, "sigma": 1.5}); err != nil {
+		t.Fatalf("ThenNamed() returned an error: %v", err)
+	}
+	pipeline.Then(manipulations.Operations()[2], manipulations.Params{"m": 1.2, "b": -5})
+	result, err := pipeline.ApplyImage(context.Background(), img)
+	if err != nil {
+		t.Fatalf("ApplyImage() returned an error: %v", err)
+	}
+	blurred, _ := manipulations.GaussianFilter(img.ToFloat(), 5, 1.5)
+	contrasted, _ := manipulations.AdjustContrast(blurred, 1.2, -5)
+	expected, _ := contrasted.ToImage(img.Depth)
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Pipeline result differs from chaining the operations directly")
+	}
+
+	// An invalid step is reported before anything runs
+	if _, err := pipeline.ThenNamed("sharpen", nil); err == nil {
+		t.Errorf("ThenNamed() accepted an unknown operation")
+	}
+	pipeline.Then(blur, manipulations.Params{"size": 2})
+	if _, err := pipeline.ApplyImage(context.Background(), img); err == nil {
+		t.Errorf("ApplyImage() ran a pipeline with an invalid step")
+	}
+
+	// Operations from other packages join the registry, but only once
+	if _, ok := manipulations.Lookup("test-invert"); !ok { // The registry outlives a single run with -count
+		manipulations.Register(invertOperation{})
+	}
+	if op, ok := manipulations.Lookup("test-invert"); !ok || op.Description() != "Invert the colours" {
+		t.Errorf("Lookup() did not find a registered operation")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Register() accepted a duplicate name")
+		}
+	}()
+	manipulations.Register(invertOperation{})
+}
+
+// TestStandardImageInterfaces tests that images convert to and from the standard library in memory and can be used
+// wherever an image.Image or draw.Image is expected
+func TestStandardImageInterfaces(t *testing.T) {
+	img := generateRandomImage(37, 23)
+
+	// The concrete standard library copy holds the same pixels, and converting it back is lossless
+	std, err := img.ToImage()
+	if err != nil {
+		t.Fatalf("ToImage() returned an error: %v", err)
+	}
+	if _, ok := std.(*image.NRGBA); !ok {
+		t.Errorf("ToImage() of an 8-bit RGBA image returned %T, expected *image.NRGBA", std)
+	}
+	if back := raster.FromImage(std); !reflect.DeepEqual(back, img) {
+		t.Errorf("FromImage(ToImage()) differs from the original image")
+	}
+
+	// Encoders accept the image directly
+	var direct, converted bytes.Buffer
+	_ = png.Encode(&direct, img)
+	_ = png.Encode(&converted, std)
+	decodedDirect, _ := png.Decode(&direct)
+	decodedConverted, _ := png.Decode(&converted)
+	if !reflect.DeepEqual(raster.FromImage(decodedDirect), raster.FromImage(decodedConverted)) {
+		t.Errorf("Encoding the image directly differs from encoding its standard library copy")
+	}
+
+	// Colour models follow the layout and depth
+	models := []struct {
+		channels, depth int
+		model           color.Model
+	}{
+		{raster.Grey, 8, color.GrayModel},
+		{raster.Grey, 16, color.Gray16Model},
+		{raster.GreyAlpha, 8, color.NRGBAModel},
+		{raster.RGB, 16, color.NRGBA64Model},
+		{raster.RGBA, 8, color.NRGBAModel},
+	}
+	for _, test := range models {
+		blank, _ := raster.New(1, 1, test.channels, test.depth)
+		if blank.ColorModel() != test.model {
+			t.Errorf("ColorModel() of a %d channel %d-bit image is not the expected model", test.channels, test.depth)
+		}
+	}
+
+	// Drawing with image/draw writes into the image's own storage
+	canvas, _ := raster.New(10, 8, raster.RGBA, 16)
+	draw.Draw(canvas, image.Rect(2, 2, 6, 5), image.NewUniform(color.NRGBA64{R: 65535, G: 1000, B: 2, A: 65535}), image.Point{}, draw.Src)
+	if pixel, _ := canvas.Pixel(3, 3); !reflect.DeepEqual(pixel, []uint32{65535, 1000, 2, 65535}) {
+		t.Errorf("Pixel inside the drawn rectangle is %v", pixel)
+	}
+	if pixel, _ := canvas.Pixel(7, 3); !reflect.DeepEqual(pixel, []uint32{0, 0, 0, 0}) {
+		t.Errorf("Pixel outside the drawn rectangle is %v", pixel)
+	}
+
+	// Greyscale images keep the luma of what is drawn into them, like image.Gray
+	grey, _ := raster.New(4, 4, raster.Grey, 8)
+	reference := image.NewGray(image.Rect(0, 0, 4, 4))
+	source := image.NewUniform(color.NRGBA{R: 200, G: 40, B: 90, A: 255})
+	draw.Draw(grey, grey.Bounds(), source, image.Point{}, draw.Src)
+	draw.Draw(reference, reference.Bounds(), source, image.Point{}, draw.Src)
+	if grey.At(1, 1) != reference.At(1, 1) {
+		t.Errorf("Drawing into a greyscale image gave %v, image.Gray gave %v", grey.At(1, 1), reference.At(1, 1))
+	}
+
+	// Out of bounds accesses behave like the standard library's images
+	grey.Set(-1, 0, color.White)
+	if grey.At(4, 0) != (color.Gray{}) {
+		t.Errorf("At() outside the image returned %v", grey.At(4, 0))
+	}
+
+	// Paletted and other models convert to their native layout and depth
+	palette := image.NewPaletted(image.Rect(0, 0, 3, 2), color.Palette{color.Black, color.NRGBA{R: 255, A: 128}})
+	palette.SetColorIndex(1, 1, 1)
+	converted16 := raster.FromImage(image.NewGray16(image.Rect(0, 0, 2, 2)))
+	if fromPalette := raster.FromImage(palette); fromPalette.Channels != raster.RGBA || fromPalette.Depth != 8 {
+		t.Errorf("FromImage() of a paletted image has %d channels at %d bits", fromPalette.Channels, fromPalette.Depth)
+	} else if pixel, _ := fromPalette.Pixel(1, 1); !reflect.DeepEqual(pixel, []uint32{255, 0, 0, 128}) {
+		t.Errorf("FromImage() of a translucent palette entry gave %v", pixel)
+	}
+	if converted16.Channels != raster.Grey || converted16.Depth != 16 {
+		t.Errorf("FromImage() of a Gray16 image has %d channels at %d bits", converted16.Channels, converted16.Depth)
+	}
+	if _, err := raster.FromImageAs(palette, 5, 8); err == nil {
+		t.Errorf("FromImageAs() accepted a multi-band layout")
+	}
+}
+
+// TestMatrixAlgebra tests the dense matrix operations against results worked out by hand
+func TestMatrixAlgebra(t *testing.T) {
+	a := matrix.Must(matrix.FromRows([][]float64{{1, 2, 3}, {4, 5, 6}}))
+	b := matrix.Must(matrix.FromRows([][]float64{{7, 8}, {9, 10}, {11, 12}}))
+
+	product, err := a.Mul(b)
+	if err != nil {
+		t.Fatalf("Mul() returned an error: %v", err)
+	}
+	if expected := matrix.Must(matrix.FromRows([][]float64{{58, 64}, {139, 154}})); !product.Equal(expected, 0) {
+		t.Errorf("Mul() = \n%v\nexpected\n%v", product, expected)
+	}
+	if _, err := a.Mul(a); !errors.Is(err, matrix.ErrShape) {
+		t.Errorf("Mul() of incompatible matrices returned %v, expected ErrShape", err)
+	}
+	if !a.T().Equal(matrix.Must(matrix.FromRows([][]float64{{1, 4}, {2, 5}, {3, 6}})), 0) || !a.T().T().Equal(a, 0) {
+		t.Errorf("T() = \n%v", a.T())
+	}
+
+	// Element-wise operations
+	sum, _ := a.Add(a)
+	difference, _ := sum.Sub(a)
+	hadamard, _ := a.MulElem(a)
+	if !sum.Equal(a.Scale(2), 0) || !difference.Equal(a, 0) || hadamard.At(1, 2) != 36 {
+		t.Errorf("Element-wise operations gave %v, %v and %v", sum, difference, hadamard)
+	}
+	if _, err := a.Add(b); !errors.Is(err, matrix.ErrShape) {
+		t.Errorf("Add() of different shapes returned %v, expected ErrShape", err)
+	}
+	if _, err := matrix.FromRows([][]float64{{1, 2}, {3}}); err == nil {
+		t.Errorf("FromRows() accepted ragged rows")
+	}
+
+	// Determinant and inverse
+	square := matrix.Must(matrix.FromRows([][]float64{{2, -1, 0}, {-1, 2, -1}, {0, -1, 2}}))
+	if det, err := square.Det(); err != nil || math.Abs(det-4) > 1e-12 {
+		t.Errorf("Det() = %v, %v, expected 4", det, err)
+	}
+	inverse, err := square.Inverse()
+	if err != nil {
+		t.Fatalf("Inverse() returned an error: %v", err)
+	}
+	if identity := matrix.Must(square.Mul(inverse)); !identity.Equal(matrix.Identity(3), 1e-12) {
+		t.Errorf("m·m⁻¹ = \n%v", identity)
+	}
+	singular := matrix.Must(matrix.FromRows([][]float64{{1, 2}, {2, 4}}))
+	if det, _ := singular.Det(); det != 0 {
+		t.Errorf("Det() of a singular matrix = %v", det)
+	}
+	if _, err := singular.Inverse(); !errors.Is(err, matrix.ErrSingular) {
+		t.Errorf("Inverse() of a singular matrix returned %v, expected ErrSingular", err)
+	}
+	if _, err := a.Det(); !errors.Is(err, matrix.ErrShape) {
+		t.Errorf("Det() of a non-square matrix returned %v, expected ErrShape", err)
+	}
+
+	// Norms
+	m := matrix.Must(matrix.FromRows([][]float64{{1, -2}, {-3, 4}}))
+	norms := map[matrix.NormKind]float64{matrix.FrobeniusNorm: math.Sqrt(30), matrix.OneNorm: 6, matrix.InfNorm: 7, matrix.MaxNorm: 4}
+	for kind, expected := range norms {
+		if norm := m.Norm(kind); math.Abs(norm-expected) > 1e-12 {
+			t.Errorf("Norm(%d) = %v, expected %v", kind, norm, expected)
+		}
+	}
+
+	// Convolving an impulse reproduces the kernel, flipped as convolution requires
+	impulse, _ := matrix.New(5, 5)
+	impulse.Set(2, 2, 1)
+	kernel := matrix.Must(matrix.FromRows([][]float64{{1, 2, 3}, {4, 5, 6}, {7, 8, 9}}))
+	convolved := impulse.Convolve(kernel)
+	if convolved.At(1, 1) != 1 || convolved.At(1, 3) != 3 || convolved.At(3, 1) != 7 || convolved.At(2, 2) != 5 || convolved.Sum() != 45 {
+		t.Errorf("Convolve() of an impulse = \n%v", convolved)
+	}
+	for _, args := range [][2]float64{{4, 1}, {0, 1}, {-3, 1}, {5, 0}, {5, -1}, {5, math.NaN()}} {
+		if _, err := manipulations.GaussianFilter(generateRandomImage(8, 8), int(args[0]), args[1]); err == nil {
+			t.Errorf("GaussianFilter() accepted a kernel size of %v and sigma %v", args[0], args[1])
+		}
+	}
+	if outer := matrix.Outer([]float64{1, 2}, []float64{3, 4, 5}); !outer.Equal(matrix.Must(matrix.FromRows([][]float64{{3, 4, 5}, {6, 8, 10}})), 0) {
+		t.Errorf("Outer() = \n%v", outer)
+	}
+
+	// Affine transforms compose by multiplication and quarter turns are exact
+	x, y := matrix.Rotation(math.Pi/2).TransformPoint(1, 0)
+	if x != 0 || y != 1 {
+		t.Errorf("A quarter turn moved (1, 0) to (%v, %v), expected (0, 1)", x, y)
+	}
+	transform := matrix.Must(matrix.Translation(10, 20).Mul(matrix.Scaling(2, -1)))
+	if x, y := transform.TransformPoint(3, 4); x != 16 || y != 16 {
+		t.Errorf("Scaling then translating (3, 4) gave (%v, %v), expected (16, 16)", x, y)
+	}
+	back := matrix.Must(transform.Inverse())
+	if x, y := back.TransformPoint(16, 16); math.Abs(x-3) > 1e-12 || math.Abs(y-4) > 1e-12 {
+		t.Errorf("The inverse transform moved (16, 16) to (%v, %v), expected (3, 4)", x, y)
+	}
+}
+
+// TestJPEG tests reading and writing JPEG images and choosing the output format
+func TestJPEG(t *testing.T) {
+	img := generateGradientImage(64, 48) // Smooth content compresses with little error
+	directory := t.TempDir()
+
+	path := directory + "/gradient.jpg"
+	if err := utils.WriteImageWithOptions(img, path, utils.WriteOptions{Quality: 95}); err != nil {
+		t.Fatalf("WriteImageWithOptions() returned an error: %v", err)
+	}
+	result, err := utils.ReadImageWithOptions(path, utils.ReadOptions{})
+	if err != nil {
+		t.Fatalf("ReadImageWithOptions() returned an error for a JPEG: %v", err)
+	}
+	if result.Width != img.Width || result.Height != img.Height || result.Channels != raster.RGB || result.Depth != 8 {
+		t.Fatalf("JPEG read back as a %dx%d image with %d channels at %d bits", result.Width, result.Height, result.Channels, result.Depth)
+	}
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			original, _ := img.Pixel(x, y)
+			decoded, _ := result.Pixel(x, y)
+			for c := 0; c < raster.RGB; c++ {
+				if difference := math.Abs(float64(original[c]) - float64(decoded[c])); difference > 12 {
+					t.Fatalf("Pixel (%d, %d) changed from %v to %v", x, y, original, decoded)
+				}
+			}
+		}
+	}
+
+	// Lower quality gives smaller files
+	noisy := generateRandomImage(64, 48)
+	sizes := map[int]int64{}
+	for _, quality := range []int{20, 95} {
+		path := fmt.Sprintf("%s/noise_%d.jpeg", directory, quality)
+		if err := utils.WriteImageWithOptions(noisy, path, utils.WriteOptions{Quality: quality}); err != nil {
+			t.Fatalf("WriteImageWithOptions() returned an error at quality %d: %v", quality, err)
+		}
+		info, _ := os.Stat(path)
+		sizes[quality] = info.Size()
+	}
+	if sizes[20] >= sizes[95] {
+		t.Errorf("A quality of 20 gave %d bytes, not fewer than the %d bytes of a quality of 95", sizes[20], sizes[95])
+	}
+
+	// Greyscale images stay greyscale
+	grey, _ := manipulations.ConvertToGreyScale(img)
+	greyPath := directory + "/grey.jpg"
+	if err := utils.WriteImage(grey, greyPath); err != nil {
+		t.Fatalf("WriteImage() returned an error for a greyscale JPEG: %v", err)
+	}
+	if result, err := utils.ReadImageWithOptions(greyPath, utils.ReadOptions{}); err != nil || result.Channels != raster.Grey {
+		t.Errorf("A greyscale JPEG read back with an error %v", err)
+	}
+
+	// An explicit format wins over the extension, and files are recognised by content
+	explicit := directory + "/explicit.png"
+	if err := utils.WriteImageWithOptions(img, explicit, utils.WriteOptions{Format: "jpeg"}); err != nil {
+		t.Fatalf("WriteImageWithOptions() returned an error: %v", err)
+	}
+	data, _ := os.ReadFile(explicit)
+	if !bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}) {
+		t.Errorf("Format \"jpeg\" did not write a JPEG")
+	}
+	if _, err := utils.ReadImage(explicit); err != nil {
+		t.Errorf("ReadImage() of a JPEG with a .png extension returned an error: %v", err)
+	}
+
+	// Invalid requests are refused
+	if err := utils.WriteImage(img, directory+"/image.xyz"); err == nil {
+		t.Errorf("WriteImage() accepted an unknown extension")
+	}
+	if err := utils.WriteImageWithOptions(img, path, utils.WriteOptions{Quality: 101}); err == nil {
+		t.Errorf("WriteImageWithOptions() accepted a quality of 101")
+	}
+	if _, err := utils.ReadImage(writeTemporaryFile(t, []byte("not an image"))); err == nil {
+		t.Errorf("ReadImage() accepted a text file")
+	}
+	if extension, err := utils.Extension("JPEG"); err != nil || extension != ".jpg" {
+		t.Errorf("Extension(\"JPEG\") = %q, %v", extension, err)
+	}
+}
+
+// TestAnimatedGIF tests that animated GIFs are read as complete frames, processed frame by frame and written back with
+// their timing, disposal and loop count
+func TestAnimatedGIF(t *testing.T) {
+	red, blue, green, white := color.NRGBA{R: 255, A: 255}, color.NRGBA{B: 255, A: 255}, color.NRGBA{G: 255, A: 255}, color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	palette := color.Palette{color.Transparent, red, blue, green, white}
+	frame := func(r image.Rectangle, c color.Color) *image.Paletted {
+		img := image.NewPaletted(r, palette)
+		draw.Draw(img, r, image.NewUniform(c), image.Point{}, draw.Src)
+		return img
+	}
+	animation := &gif.GIF{
+		Image: []*image.Paletted{
+			frame(image.Rect(0, 0, 8, 6), red),
+			frame(image.Rect(2, 2, 4, 4), blue),  // Cleared to the background afterwards
+			frame(image.Rect(0, 0, 1, 1), green), // Undone afterwards
+			frame(image.Rect(5, 5, 6, 6), white),
+		},
+		Delay:     []int{10, 20, 30, 40},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalPrevious, gif.DisposalNone},
+		LoopCount: 3,
+	}
+	var encoded bytes.Buffer
+	if err := gif.EncodeAll(&encoded, animation); err != nil {
+		t.Fatalf("Failed encoding the test animation: %v", err)
+	}
+
+	sequence, err := utils.ReadSequence(writeTemporaryFile(t, encoded.Bytes()), utils.ReadOptions{})
+	if err != nil {
+		t.Fatalf("ReadSequence() returned an error: %v", err)
+	}
+	if len(sequence.Frames) != 4 || sequence.LoopCount != 3 {
+		t.Fatalf("ReadSequence() returned %d frames looping %d times", len(sequence.Frames), sequence.LoopCount)
+	}
+	expected := []map[image.Point]color.Color{
+		{{3, 3}: red, {0, 0}: red, {5, 5}: red},
+		{{3, 3}: blue, {0, 0}: red, {5, 5}: red},
+		{{3, 3}: color.NRGBA{}, {0, 0}: green, {5, 5}: red},
+		{{3, 3}: color.NRGBA{}, {0, 0}: red, {5, 5}: white},
+	}
+	for i, pixels := range expected {
+		f := sequence.Frames[i]
+		if f.Image.Width != 8 || f.Image.Height != 6 {
+			t.Errorf("Frame %d is %dx%d, expected the 8x6 canvas", i, f.Image.Width, f.Image.Height)
+		}
+		if f.Delay != time.Duration(animation.Delay[i])*10*time.Millisecond || byte(f.Disposal) != animation.Disposal[i] {
+			t.Errorf("Frame %d has a delay of %v and disposal %d", i, f.Delay, f.Disposal)
+		}
+		for p, c := range pixels {
+			if f.Image.At(p.X, p.Y) != c {
+				t.Errorf("Frame %d has %v at %v, expected %v", i, f.Image.At(p.X, p.Y), p, c)
+			}
+		}
+	}
+
+	// Processing every frame keeps the timing and, with few colours, the exact result
+	pipeline, _ := new(manipulations.Pipeline).ThenNamed("grey", nil)
+	grey, err := pipeline.ApplySequence(context.Background(), sequence)
+	if err != nil {
+		t.Fatalf("ApplySequence() returned an error: %v", err)
+	}
+	path := t.TempDir() + "/grey.gif"
+	if err := utils.WriteSequence(grey, path, utils.WriteOptions{}); err != nil {
+		t.Fatalf("WriteSequence() returned an error: %v", err)
+	}
+	written, err := utils.ReadSequence(path, utils.ReadOptions{Channels: raster.GreyAlpha})
+	if err != nil {
+		t.Fatalf("ReadSequence() of the written animation returned an error: %v", err)
+	}
+	if len(written.Frames) != 4 || written.LoopCount != 3 {
+		t.Fatalf("The written animation has %d frames looping %d times", len(written.Frames), written.LoopCount)
+	}
+	for i := range written.Frames {
+		if written.Frames[i].Delay != grey.Frames[i].Delay || written.Frames[i].Disposal != grey.Frames[i].Disposal {
+			t.Errorf("Frame %d lost its timing or disposal", i)
+		}
+		if !reflect.DeepEqual(written.Frames[i].Image, grey.Frames[i].Image) {
+			t.Errorf("Frame %d changed when written", i)
+		}
+	}
+
+	// A transparent frame after an opaque one stays transparent when the frames have no disposal
+	opaque, _ := raster.NewRGBA(3, 2)
+	for i := 0; i < len(opaque.Pix); i += 4 {
+		opaque.Pix[i], opaque.Pix[i+3] = 255, 255
+	}
+	transparent, _ := raster.NewRGBA(3, 2)
+	layered := &raster.Sequence{Frames: []raster.Frame{
+		{Image: opaque, Delay: 100 * time.Millisecond},
+		{Image: transparent, Delay: 100 * time.Millisecond},
+	}}
+	var buffer bytes.Buffer
+	if err := utils.EncodeSequence(&buffer, layered, utils.WriteOptions{Format: "gif"}); err != nil {
+		t.Fatalf("EncodeSequence() returned an error: %v", err)
+	}
+	decoded, _, err := utils.DecodeSequence(&buffer, utils.ReadOptions{Channels: raster.RGBA})
+	if err != nil {
+		t.Fatalf("DecodeSequence() returned an error: %v", err)
+	}
+	for i, frame := range decoded.Frames {
+		if !reflect.DeepEqual(frame.Image.Pix, layered.Frames[i].Image.Pix) {
+			t.Errorf("Frame %d read back as %v, expected %v", i, frame.Image.Pix[:4], layered.Frames[i].Image.Pix[:4])
+		}
+	}
+
+	// Disposals set on the frames are written as they are
+	kept := &raster.Sequence{Frames: []raster.Frame{
+		{Image: opaque, Delay: 100 * time.Millisecond, Disposal: raster.DisposalPrevious},
+		{Image: opaque, Delay: 100 * time.Millisecond, Disposal: raster.DisposalNone},
+		{Image: opaque, Delay: 100 * time.Millisecond, Disposal: raster.DisposalBackground},
+	}}
+	buffer.Reset()
+	if err := utils.EncodeSequence(&buffer, kept, utils.WriteOptions{Format: "gif"}); err != nil {
+		t.Fatalf("EncodeSequence() returned an error: %v", err)
+	}
+	if decoded, _, err = utils.DecodeSequence(&buffer, utils.ReadOptions{}); err != nil {
+		t.Fatalf("DecodeSequence() returned an error: %v", err)
+	}
+	for i, frame := range decoded.Frames {
+		if frame.Disposal != kept.Frames[i].Disposal {
+			t.Errorf("Frame %d was written with disposal %d, expected %d", i, frame.Disposal, kept.Frames[i].Disposal)
+		}
+	}
+
+	// Frames with more colours than a palette holds are approximated closely
+	gradient := raster.NewSequence(generateGradientImage(64, 48))
+	gradientPath := t.TempDir() + "/gradient.gif"
+	if err := utils.WriteSequence(gradient, gradientPath, utils.WriteOptions{}); err != nil {
+		t.Fatalf("WriteSequence() returned an error: %v", err)
+	}
+	approximated, _ := utils.ReadImage(gradientPath)
+	total := 0.0
+	for i, sample := range approximated.Pix {
+		total += math.Abs(float64(sample) - float64(gradient.Frames[0].Image.Pix[i]))
+	}
+	if mean := total / float64(len(approximated.Pix)); mean > 4 {
+		t.Errorf("The regenerated palette is off by %.2f per sample on average", mean)
+	}
+
+	// Formats without animation refuse more than one frame
+	if err := utils.WriteSequence(sequence, t.TempDir()+"/animation.png", utils.WriteOptions{}); err == nil {
+		t.Errorf("WriteSequence() wrote several frames to a PNG")
+	}
+}
+
+// buildBMP assembles a BMP file with a BITMAPINFOHEADER from its parts: extra holds the bit fields or palette that
+// follow the header and rows the padded pixel rows in file order
+func buildBMP(width, height, bitCount int, compression uint32, extra []byte, rows ...[]byte) []byte {
+	offset := 14 + 40 + len(extra)
+	file := make([]byte, offset)
+	copy(file, "BM")
+	binary.LittleEndian.PutUint32(file[10:], uint32(offset))
+	binary.LittleEndian.PutUint32(file[14:], 40)
+	binary.LittleEndian.PutUint32(file[18:], uint32(int32(width)))
+	binary.LittleEndian.PutUint32(file[22:], uint32(int32(height)))
+	binary.LittleEndian.PutUint16(file[26:], 1)
+	binary.LittleEndian.PutUint16(file[28:], uint16(bitCount))
+	binary.LittleEndian.PutUint32(file[30:], compression)
+	copy(file[54:], extra)
+	for _, row := range rows {
+		file = append(file, row...)
+	}
+	return file
+}
+
+// TestBMP tests writing and reading back BMPs of every layout, and reading the variants other programs write
+func TestBMP(t *testing.T) {
+	directory := t.TempDir()
+	random := generateRandomImage(13, 7) // An odd width needs row padding
+	rgb, _ := raster.MergeChannels(random.SplitChannels()[:raster.RGB]...)
+	grey, _ := manipulations.ConvertToGreyScale(rgb)
+	for _, img := range []*raster.Image{random, rgb, grey} {
+		path := fmt.Sprintf("%s/round_trip_%d.bmp", directory, img.Channels)
+		if err := utils.WriteImage(img, path); err != nil {
+			t.Fatalf("WriteImage() returned an error for %d channels: %v", img.Channels, err)
+		}
+		result, err := utils.ReadImageWithOptions(path, utils.ReadOptions{})
+		if err != nil {
+			t.Fatalf("ReadImageWithOptions() returned an error for %d channels: %v", img.Channels, err)
+		}
+		if !reflect.DeepEqual(result, img) {
+			t.Errorf("A BMP with %d channels changed when written and read back", img.Channels)
+		}
+	}
+
+	// A 1-bit image with a two colour palette, stored top-down
+	palette := []byte{0, 0, 0, 0, 0, 0, 255, 0} // Black and red, as BGR with a reserved byte
+	oneBit := buildBMP(3, -2, 1, 0, palette, []byte{0b10100000, 0, 0, 0}, []byte{0b01000000, 0, 0, 0})
+	img, err := utils.ReadImageWithOptions(writeTemporaryFile(t, oneBit), utils.ReadOptions{})
+	if err != nil {
+		t.Fatalf("ReadImageWithOptions() returned an error for a 1-bit BMP: %v", err)
+	}
+	if want := []uint32{255, 0, 0, 0, 0, 0, 255, 0, 0, 0, 0, 0, 255, 0, 0, 0, 0, 0}; img.Channels != raster.RGB || !reflect.DeepEqual(img.Pix, want) {
+		t.Errorf("A 1-bit BMP read as %d channels %v, expected %v", img.Channels, img.Pix, want)
+	}
+
+	// A 4-bit image with a grey palette, stored bottom-up, is read as greyscale
+	greys := make([]byte, 4*16)
+	for i := 0; i < 16; i++ {
+		greys[4*i], greys[4*i+1], greys[4*i+2] = byte(17*i), byte(17*i), byte(17*i)
+	}
+	fourBit := buildBMP(3, 2, 4, 0, greys, []byte{0x12, 0x30, 0, 0}, []byte{0xF0, 0x50, 0, 0})
+	img, err = utils.ReadImageWithOptions(writeTemporaryFile(t, fourBit), utils.ReadOptions{})
+	if err != nil {
+		t.Fatalf("ReadImageWithOptions() returned an error for a 4-bit BMP: %v", err)
+	}
+	if want := []uint32{255, 0, 85, 17, 34, 51}; img.Channels != raster.Grey || !reflect.DeepEqual(img.Pix, want) {
+		t.Errorf("A 4-bit BMP read as %d channels %v, expected %v", img.Channels, img.Pix, want)
+	}
+
+	// 16-bit pixels with 5-6-5 bit fields
+	masks := make([]byte, 12)
+	binary.LittleEndian.PutUint32(masks[0:], 0xF800)
+	binary.LittleEndian.PutUint32(masks[4:], 0x07E0)
+	binary.LittleEndian.PutUint32(masks[8:], 0x001F)
+	sixteenBit := buildBMP(2, 1, 16, 3, masks, []byte{0x00, 0xF8, 0xE0, 0x07})
+	img, err = utils.ReadImageWithOptions(writeTemporaryFile(t, sixteenBit), utils.ReadOptions{})
+	if err != nil {
+		t.Fatalf("ReadImageWithOptions() returned an error for a 16-bit BMP: %v", err)
+	}
+	if want := []uint32{255, 0, 0, 0, 255, 0}; !reflect.DeepEqual(img.Pix, want) {
+		t.Errorf("A 5-6-5 BMP read as %v, expected %v", img.Pix, want)
+	}
+
+	// 32-bit BI_RGB pixels are opaque when their fourth byte is always zero, and keep it as alpha otherwise
+	unused := buildBMP(2, 1, 32, 0, nil, []byte{10, 20, 30, 0, 40, 50, 60, 0})
+	img, err = utils.ReadImageWithOptions(writeTemporaryFile(t, unused), utils.ReadOptions{})
+	if err != nil {
+		t.Fatalf("ReadImageWithOptions() returned an error for a 32-bit BMP: %v", err)
+	}
+	if want := []uint32{30, 20, 10, 255, 60, 50, 40, 255}; !reflect.DeepEqual(img.Pix, want) {
+		t.Errorf("A 32-bit BMP without alpha read as %v, expected %v", img.Pix, want)
+	}
+	withAlpha := buildBMP(2, 1, 32, 0, nil, []byte{10, 20, 30, 0, 40, 50, 60, 128})
+	if img, _ := utils.ReadImageWithOptions(writeTemporaryFile(t, withAlpha), utils.ReadOptions{}); img == nil || img.Pix[3] != 0 || img.Pix[7] != 128 {
+		t.Errorf("A 32-bit BMP with alpha lost it")
+	}
+
+	// Files are recognised by content, and broken ones are rejected
+	disguised := directory + "/disguised.png"
+	if err := utils.WriteImageWithOptions(rgb, disguised, utils.WriteOptions{Format: "bmp"}); err != nil {
+		t.Fatalf("WriteImageWithOptions() returned an error: %v", err)
+	}
+	if result, err := utils.ReadImageWithOptions(disguised, utils.ReadOptions{}); err != nil || !reflect.DeepEqual(result, rgb) {
+		t.Errorf("A BMP named .png was not read back, error %v", err)
+	}
+	if _, err := utils.ReadImage(writeTemporaryFile(t, oneBit[:len(oneBit)-2])); err == nil {
+		t.Errorf("A truncated BMP was read without an error")
+	}
+	if _, err := utils.ReadImage(writeTemporaryFile(t, buildBMP(2, 1, 24, 1, nil, make([]byte, 8)))); err == nil {
+		t.Errorf("A run-length encoded BMP was read without an error")
+	}
+
+	// Huge dimensions fail without allocating the pixels, whether the file gives its size or not
+	huge := buildBMP(math.MaxInt32, math.MaxInt32, 32, 0, nil)
+	large := buildBMP(20000, 20000, 32, 0, nil, make([]byte, 4*20000))
+	sized := append([]byte(nil), large...)
+	binary.LittleEndian.PutUint32(sized[2:], uint32(len(sized)))
+	for name, file := range map[string][]byte{"huge": huge, "large": large, "sized": sized} {
+		if _, _, err := utils.Decode(bytes.NewReader(file), utils.ReadOptions{}); err == nil {
+			t.Errorf("The %s BMP header was read without an error", name)
+		}
+	}
+}
+
+// TestNetpbm tests writing and reading back every Netpbm format, in its plain and binary variants
+func TestNetpbm(t *testing.T) {
+	directory := t.TempDir()
+	random := generateRandomImage(9, 5)
+	rgb, _ := raster.MergeChannels(random.SplitChannels()[:raster.RGB]...)
+	grey, _ := manipulations.ConvertToGreyScale(rgb)
+	wide, _ := raster.New(9, 5, raster.RGB, 16)
+	for i := range wide.Pix {
+		wide.Pix[i] = uint32(rand.Intn(65536))
+	}
+	wideGrey, _ := raster.FromImageAs(wide, raster.Grey, 16)
+	bands, _ := raster.New(4, 3, 6, 8)
+	for i := range bands.Pix {
+		bands.Pix[i] = uint32(rand.Intn(256))
+	}
+	bitmap, _ := raster.New(11, 3, raster.Grey, 8)
+	for i := range bitmap.Pix {
+		bitmap.Pix[i] = uint32(255 * rand.Intn(2))
+	}
+
+	tests := []struct {
+		name      string
+		img       *raster.Image
+		extension string
+		signature string
+	}{
+		{"bitmap", bitmap, ".pbm", "P4"},
+		{"greymap", grey, ".pgm", "P5"},
+		{"16-bit greymap", wideGrey, ".pgm", "P5"},
+		{"pixmap", rgb, ".ppm", "P6"},
+		{"16-bit pixmap", wide, ".ppm", "P6"},
+		{"generic greymap", grey, ".pnm", "P5"},
+		{"generic pixmap", rgb, ".pnm", "P6"},
+		{"RGBA", random, ".pam", "P7"},
+		{"bands", bands, ".pam", "P7"},
+	}
+	for _, test := range tests {
+		for _, plain := range []bool{false, true} {
+			path := fmt.Sprintf("%s/%s_%t%s", directory, test.name, plain, test.extension)
+			if err := utils.WriteImageWithOptions(test.img, path, utils.WriteOptions{Plain: plain}); err != nil {
+				t.Fatalf("WriteImageWithOptions() returned an error for the %s: %v", test.name, err)
+			}
+			signature := []byte(test.signature)
+			if plain && test.signature != "P7" {
+				signature[1] -= 3 // The plain variant of each format
+			}
+			if data, _ := os.ReadFile(path); !bytes.HasPrefix(data, signature) {
+				t.Errorf("The %s was written as %q, expected %s", test.name, data[:2], signature)
+			}
+			result, err := utils.ReadImageWithOptions(path, utils.ReadOptions{})
+			if err != nil {
+				t.Fatalf("ReadImageWithOptions() returned an error for the %s: %v", test.name, err)
+			}
+			if !reflect.DeepEqual(result, test.img) {
+				t.Errorf("The %s changed when written and read back with plain set to %t", test.name, plain)
+			}
+		}
+	}
+
+	// Plain files written by hand, with comments, run-together bits and a maxval the samples are scaled from
+	for _, test := range []struct {
+		text  string
+		depth int
+		want  []uint32
+	}{
+		{"P1\n# a comment\n3 2\n010\n1 1 0", 8, []uint32{255, 0, 255, 0, 0, 255}},
+		{"P2 3 1 15 0 5 15\n", 8, []uint32{0, 85, 255}},
+		{"P3\n1 1 # size\n1000\n0 500 1000", 16, []uint32{0, 32768, 65535}},
+		{"P7\nWIDTH 2\nHEIGHT 1\nDEPTH 1\nMAXVAL 1\nTUPLTYPE BLACKANDWHITE\nENDHDR\n\x00\x01", 8, []uint32{0, 255}},
+	} {
+		img, err := utils.ReadImageWithOptions(writeTemporaryFile(t, []byte(test.text)), utils.ReadOptions{})
+		if err != nil {
+			t.Errorf("ReadImageWithOptions() returned an error for %q: %v", test.text, err)
+			continue
+		}
+		if img.Depth != test.depth || !reflect.DeepEqual(img.Pix, test.want) {
+			t.Errorf("%q read as %v at %d bits, expected %v at %d bits", test.text, img.Pix, img.Depth, test.want, test.depth)
+		}
+	}
+
+	// Colour and alpha are dropped by the formats that cannot hold them, and broken files are rejected
+	path := directory + "/from_colour.pgm"
+	if err := utils.WriteImage(random, path); err != nil {
+		t.Fatalf("WriteImage() returned an error for an RGBA PGM: %v", err)
+	}
+	if img, err := utils.ReadImageWithOptions(path, utils.ReadOptions{}); err != nil || img.Channels != raster.Grey {
+		t.Errorf("An RGBA image was not written as a greyscale PGM, error %v", err)
+	}
+	if err := utils.WriteImage(bands, directory+"/bands.png"); err == nil {
+		t.Errorf("WriteImage() wrote a 6 channel PNG")
+	}
+	for _, text := range []string{
+		"P2\n2 1\n255\n0 256\n", "P5\n2 2\n255\nab", "P6\n0 1\n255\n", "P7\nWIDTH 1\nENDHDR\n",
+		"P7\nWIDTH 2147483647\nHEIGHT 2147483647\nDEPTH 4\nMAXVAL 255\nTUPLTYPE RGB_ALPHA\nENDHDR\n", // Too large to allocate
+		"P6\n20000 20000\n255\n\x01\x02\x03", // Far more pixels than the file holds
+	} {
+		if _, err := utils.ReadImageWithOptions(writeTemporaryFile(t, []byte(text)), utils.ReadOptions{}); err == nil {
+			t.Errorf("%q was read without an error", text)
+		}
+	}
+}
+
+// TestTIFF tests writing and reading back TIFFs with every compression, and reading a file written by hand
+func TestTIFF(t *testing.T) {
+	directory := t.TempDir()
+	random := generateRandomImage(37, 29)
+	rgb, _ := raster.MergeChannels(random.SplitChannels()[:raster.RGB]...)
+	grey, _ := manipulations.ConvertToGreyScale(rgb)
+	greyAlpha, _ := raster.FromImageAs(random, raster.GreyAlpha, 8)
+	wide, _ := raster.New(300, 40, raster.Grey, 16) // Large and smooth enough for LZW codes to grow to 12 bits
+	for y := 0; y < wide.Height; y++ {
+		for x := 0; x < wide.Width; x++ {
+			wide.Pix[wide.PixOffset(x, y)] = uint32(x*y*7) & 0xFFFF
+		}
+	}
+	for _, compression := range []string{"", "none", "lzw", "deflate"} {
+		for _, img := range []*raster.Image{random, rgb, grey, greyAlpha, wide, generateGradientImage(200, 150)} {
+			path := fmt.Sprintf("%s/%s_%d_%d.tif", directory, compression, img.Channels, img.Depth)
+			if err := utils.WriteImageWithOptions(img, path, utils.WriteOptions{Compression: compression}); err != nil {
+				t.Fatalf("WriteImageWithOptions() returned an error with compression %q: %v", compression, err)
+			}
+			result, err := utils.ReadImageWithOptions(path, utils.ReadOptions{})
+			if err != nil {
+				t.Fatalf("ReadImageWithOptions() returned an error with compression %q: %v", compression, err)
+			}
+			if !reflect.DeepEqual(result, img) {
+				t.Errorf("A %d channel %d-bit image changed when written with compression %q", img.Channels, img.Depth, compression)
+			}
+		}
+	}
+	if err := utils.WriteImageWithOptions(grey, directory+"/bad.tiff", utils.WriteOptions{Compression: "jpeg"}); err == nil {
+		t.Errorf("WriteImageWithOptions() accepted an unknown TIFF compression")
+	}
+
+	// Pages are read back as frames
+	small, _ := raster.FromImageAs(generateRandomImage(12, 40), raster.Grey, 16) // Pages may each have their own size
+	pages := &raster.Sequence{Frames: []raster.Frame{{Image: rgb}, {Image: grey}, {Image: random}, {Image: small}}}
+	path := directory + "/pages.tiff"
+	if err := utils.WriteSequence(pages, path, utils.WriteOptions{Compression: "lzw"}); err != nil {
+		t.Fatalf("WriteSequence() returned an error: %v", err)
+	}
+	sequence, err := utils.ReadSequence(path, utils.ReadOptions{})
+	if err != nil {
+		t.Fatalf("ReadSequence() returned an error for a multi-page TIFF: %v", err)
+	}
+	if len(sequence.Frames) != len(pages.Frames) {
+		t.Fatalf("ReadSequence() returned %d pages, expected %d", len(sequence.Frames), len(pages.Frames))
+	}
+	for i := range pages.Frames {
+		if !reflect.DeepEqual(sequence.Frames[i].Image, pages.Frames[i].Image) {
+			t.Errorf("Page %d changed when written and read back", i)
+		}
+	}
+	if first, err := utils.ReadImageWithOptions(path, utils.ReadOptions{}); err != nil || !reflect.DeepEqual(first, rgb) {
+		t.Errorf("ReadImageWithOptions() did not return the first page, error %v", err)
+	}
+	pipeline := new(manipulations.Pipeline)
+	if _, err := pipeline.ThenNamed("grey", nil); err != nil {
+		t.Fatalf("ThenNamed() returned an error: %v", err)
+	}
+	processed, err := pipeline.ApplySequence(context.Background(), sequence)
+	if err != nil || processed.Frames[3].Image.Width != small.Width {
+		t.Errorf("Pages of different sizes were not processed page by page, error %v", err)
+	}
+	if err := utils.WriteSequence(pages, directory+"/pages.gif", utils.WriteOptions{}); err == nil {
+		t.Errorf("WriteSequence() wrote frames of different sizes to a GIF")
+	}
+
+	// A big-endian 9x1 greyscale image compressed with the LZW example of the TIFF specification, 7 7 7 8 8 7 7 6 6
+	var strip []byte
+	var bits, count uint32
+	for _, code := range []uint32{256, 7, 258, 8, 8, 258, 6, 6, 257} {
+		bits, count = bits<<9|code, count+9
+		for count >= 8 {
+			count -= 8
+			strip = append(strip, byte(bits>>count))
+		}
+	}
+	strip = append(strip, byte(bits<<(8-count)))
+	file := buildTIFF([][3]uint32{{256, 3, 9}, {257, 3, 1}, {258, 3, 8}, {259, 3, 5}, {262, 3, 0}}, strip)
+	img, err := utils.ReadImageWithOptions(writeTemporaryFile(t, file), utils.ReadOptions{})
+	if err != nil {
+		t.Fatalf("ReadImageWithOptions() returned an error for the specification's example: %v", err)
+	}
+	if want := []uint32{248, 248, 248, 247, 247, 248, 248, 249, 249}; img.Channels != raster.Grey || !reflect.DeepEqual(img.Pix, want) {
+		t.Errorf("The specification's example read as %v, expected %v with white as zero", img.Pix, want)
+	}
+
+	// Neither a header claiming a huge page nor a strip that decompresses to far more than its rows takes up memory
+	// beyond what the data holds
+	var bomb []byte
+	bits, count = 0, 0
+	for block := 0; block < 8; block++ {
+		codes := []uint32{256, 0} // Clear the table, then every code repeats the last sequence and one more byte
+		for code := uint32(258); code < 4000; code++ {
+			codes = append(codes, code)
+		}
+		for _, code := range codes {
+			width := uint32(9)
+			for code > 1<<width-2 { // The width grows once the table reaches 511, 1023 and 2047 entries
+				width++
+			}
+			if code == 256 && block > 0 {
+				width = 12 // The clear code is read at the width the table has grown to
+			}
+			bits, count = bits<<width|code, count+width
+			for count >= 8 {
+				count -= 8
+				bomb = append(bomb, byte(bits>>count))
+			}
+		}
+	}
+	for name, test := range map[string]struct {
+		file  []byte
+		valid bool
+	}{
+		"huge":  {buildTIFF([][3]uint32{{256, 4, 16000}, {257, 4, 16000}, {258, 3, 8}, {259, 3, 1}, {262, 3, 1}}, make([]byte, 16)), false},
+		"bomb":  {buildTIFF([][3]uint32{{256, 3, 4}, {257, 3, 1}, {258, 3, 8}, {259, 3, 5}, {262, 3, 1}}, bomb), true},
+		"wide":  {buildTIFF([][3]uint32{{256, 4, 1 << 30}, {257, 3, 1}, {258, 3, 8}, {259, 3, 1}, {262, 3, 1}, {277, 3, 64}}, nil), false},
+		"plain": {buildTIFF([][3]uint32{{256, 3, 2}, {257, 3, 2}, {258, 3, 8}, {259, 3, 1}, {262, 3, 1}}, []byte{1, 2, 3, 4}), true},
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, _, err := utils.Decode(bytes.NewReader(test.file), utils.ReadOptions{})
+		runtime.ReadMemStats(&after)
+		if (err == nil) != test.valid {
+			t.Errorf("Decoding the %s TIFF returned the error %v", name, err)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+			t.Errorf("Decoding the %s TIFF of %d bytes allocated %d bytes", name, len(test.file), allocated)
+		}
+	}
+}
+
+// buildTIFF assembles a big-endian TIFF of a single page and strip from the SHORT (3) and LONG (4) entries of its
+// directory, in ascending order of tag, adding the strip offset and byte count
+func buildTIFF(entries [][3]uint32, strip []byte) []byte {
+	entries = append(entries[:len(entries):len(entries)], [3]uint32{273, 4, uint32(8 + 2 + 12*(len(entries)+2) + 4)}, [3]uint32{279, 4, uint32(len(strip))})
+	sort.Slice(entries, func(i, j int) bool { return entries[i][0] < entries[j][0] })
+	file := []byte("MM\x00*\x00\x00\x00\x08")
+	file = binary.BigEndian.AppendUint16(file, uint16(len(entries)))
+	for _, entry := range entries {
+		file = binary.BigEndian.AppendUint16(file, uint16(entry[0]))
+		file = binary.BigEndian.AppendUint16(file, uint16(entry[1]))
+		file = binary.BigEndian.AppendUint32(file, 1)
+		if entry[1] == 3 {
+			file = binary.BigEndian.AppendUint16(file, uint16(entry[2]))
+			file = append(file, 0, 0)
+		} else {
+			file = binary.BigEndian.AppendUint32(file, entry[2])
+		}
+	}
+	return append(append(file, 0, 0, 0, 0), strip...)
+}
+
+// TestQOIAndFarbfeld tests writing and reading back QOI and farbfeld images, and reading files written by hand
+func TestQOIAndFarbfeld(t *testing.T) {
+	directory := t.TempDir()
+	random := generateRandomImage(23, 17)
+	rgb, _ := raster.MergeChannels(random.SplitChannels()[:raster.RGB]...)
+	gradient := generateGradientImage(120, 80) // Smooth, so every kind of QOI chunk is used
+	runs, _ := raster.NewRGBA(100, 3)          // Runs longer than a chunk can hold
+	for _, img := range []*raster.Image{random, rgb, gradient, runs} {
+		path := fmt.Sprintf("%s/image_%d_%d.qoi", directory, img.Width, img.Channels)
+		if err := utils.WriteImage(img, path); err != nil {
+			t.Fatalf("WriteImage() returned an error for a QOI: %v", err)
+		}
+		result, err := utils.ReadImageWithOptions(path, utils.ReadOptions{})
+		if err != nil {
+			t.Fatalf("ReadImageWithOptions() returned an error for a QOI: %v", err)
+		}
+		if !reflect.DeepEqual(result, img) {
+			t.Errorf("A %dx%d image with %d channels changed when written as a QOI", img.Width, img.Height, img.Channels)
+		}
+	}
+	if info, _ := os.Stat(directory + "/image_100_4.qoi"); info.Size() > 14+3*5+8 {
+		t.Errorf("A uniform QOI took %d bytes, runs were not used", info.Size())
+	}
+
+	// A QOI with one chunk of each kind: RGB, DIFF, LUMA, RGBA, INDEX and RUN
+	file := append([]byte("qoif\x00\x00\x00\x07\x00\x00\x00\x01\x04\x00"),
+		0xFE, 100, 150, 200, // (100, 150, 200, 255)
+		0x40|3<<4|1<<2|2,              // Differences of 1, -1 and 0
+		0x80|(10+32), (2+8)<<4|(-3+8), // Green +10, red +12 and blue +7
+		0xFF, 1, 2, 3, 4,
+		0x00|(100*3+150*5+200*7+255*11)%64, // Back to the first pixel
+		0xC0|1,                             // Twice more
+	)
+	file = append(file, 0, 0, 0, 0, 0, 0, 0, 1)
+	img, err := utils.ReadImageWithOptions(writeTemporaryFile(t, file), utils.ReadOptions{})
+	if err != nil {
+		t.Fatalf("ReadImageWithOptions() returned an error for a QOI written by hand: %v", err)
+	}
+	want := []uint32{100, 150, 200, 255, 101, 149, 200, 255, 113, 159, 207, 255, 1, 2, 3, 4, 100, 150, 200, 255, 100, 150, 200, 255, 100, 150, 200, 255}
+	if !reflect.DeepEqual(img.Pix, want) {
+		t.Errorf("A QOI written by hand read as %v, expected %v", img.Pix, want)
+	}
+
+	// farbfeld always holds 16-bit RGBA, which is kept exactly
+	wide, _ := raster.New(11, 7, raster.RGBA, 16)
+	for i := range wide.Pix {
+		wide.Pix[i] = uint32(rand.Intn(65536))
+	}
+	path := directory + "/wide.ff"
+	if err := utils.WriteImage(wide, path); err != nil {
+		t.Fatalf("WriteImage() returned an error for a farbfeld: %v", err)
+	}
+	if result, err := utils.ReadImageWithOptions(path, utils.ReadOptions{}); err != nil || !reflect.DeepEqual(result, wide) {
+		t.Errorf("A 16-bit image changed when written as a farbfeld, error %v", err)
+	}
+	path = directory + "/random.farbfeld"
+	if err := utils.WriteImage(random, path); err != nil {
+		t.Fatalf("WriteImage() returned an error for a farbfeld: %v", err)
+	}
+	if result, err := utils.ReadImageWithOptions(path, utils.ReadOptions{Depth: 8}); err != nil || !reflect.DeepEqual(result, random) {
+		t.Errorf("An 8-bit image changed when written as a farbfeld, error %v", err)
+	}
+	file = append([]byte("farbfeld\x00\x00\x00\x01\x00\x00\x00\x01"), 0xFF, 0xFF, 0x80, 0x00, 0x00, 0x01, 0x12, 0x34)
+	if img, err := utils.ReadImageWithOptions(writeTemporaryFile(t, file), utils.ReadOptions{}); err != nil || !reflect.DeepEqual(img.Pix, []uint32{65535, 32768, 1, 0x1234}) {
+		t.Errorf("A farbfeld written by hand was not read correctly, error %v", err)
+	}
+	if _, err := utils.ReadImage(writeTemporaryFile(t, file[:20])); err == nil {
+		t.Errorf("A truncated farbfeld was read without an error")
+	}
+
+	qoiRGBA := []byte{0xFF, 1, 2, 3, 4}
+	// Headers claiming far more pixels than the file holds fail without allocating them
+	huge := append([]byte("farbfeld"), 0x7F, 0xFF, 0xFF, 0xFF, 0x7F, 0xFF, 0xFF, 0xFF)
+	large := append([]byte("qoif"), 0, 0, 0x4E, 0x20, 0, 0, 0x4E, 0x20, 4, 0) // 20000x20000 RGBA
+	for name, header := range map[string][]byte{"farbfeld": huge, "QOI": large, "QOI with a pixel": append(large, qoiRGBA...)} {
+		if _, _, err := utils.Decode(bytes.NewReader(header), utils.ReadOptions{}); err == nil {
+			t.Errorf("A %s header of huge dimensions was read without an error", name)
+		}
+	}
+}
+
+// rawFormat is a format registered by TestFormatRegistry: a signature, the width, height and channels as bytes, then
+// every 8-bit sample
+var rawFormat = &utils.Format{
+	Name:       "testraw",
+	Extensions: []string{".testraw", ".TRAW"},
+	Magic:      [][]byte{[]byte("RAW?IMG")},
+	Decode: func(r io.Reader, options utils.ReadOptions) (*raster.Image, error) {
+		header := make([]byte, 10)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		img, err := raster.New(int(header[7]), int(header[8]), int(header[9]), 8)
+		if err != nil {
+			return nil, err
+		}
+		samples := make([]byte, len(img.Pix))
+		if _, err := io.ReadFull(r, samples); err != nil {
+			return nil, err
+		}
+		for i, sample := range samples {
+			img.Pix[i] = uint32(sample)
+		}
+		return img, nil
+	},
+	Encode: func(w io.Writer, img *raster.Image, options utils.WriteOptions) error {
+		out := append([]byte("RAW!IMG"), byte(img.Width), byte(img.Height), byte(img.Channels))
+		for _, sample := range img.Pix {
+			out = append(out, byte(sample))
+		}
+		_, err := w.Write(out)
+		return err
+	},
+}
+
+// TestFormatRegistry tests registering a format and how unsupported formats are reported
+func TestFormatRegistry(t *testing.T) {
+	if _, ok := utils.LookupFormat("testraw"); !ok {
+		utils.RegisterFormat(rawFormat)
+	}
+	if formats := utils.Formats(); formats[0].Name != "png" || formats[len(formats)-1].Name != "testraw" {
+		t.Errorf("Formats() does not start with PNG and end with the format registered last")
+	}
+	if f, ok := utils.LookupFormat("traw"); !ok || f.Name != "testraw" {
+		t.Errorf("LookupFormat() did not find a registered format by its extension")
+	}
+
+	// The registered format is picked by extension when writing and by signature when reading
+	img := generateRandomImage(5, 4)
+	path := t.TempDir() + "/image.testraw"
+	if err := utils.WriteImage(img, path); err != nil {
+		t.Fatalf("WriteImage() returned an error for a registered format: %v", err)
+	}
+	result, err := utils.ReadImageWithOptions(path, utils.ReadOptions{})
+	if err != nil {
+		t.Fatalf("ReadImageWithOptions() returned an error for a registered format: %v", err)
+	}
+	if !reflect.DeepEqual(result, img) {
+		t.Errorf("An image changed when written and read back through a registered format")
+	}
+	if extension, err := utils.Extension("TRAW"); err != nil || extension != ".testraw" {
+		t.Errorf("Extension() of a registered format returned %q and error %v", extension, err)
+	}
+
+	// Duplicates and invalid formats are programming errors
+	for name, f := range map[string]*utils.Format{
+		"a duplicate name":      {Name: "PNG", Decode: rawFormat.Decode},
+		"a duplicate extension": {Name: "other", Extensions: []string{".jpg"}, Decode: rawFormat.Decode},
+		"no codecs":             {Name: "empty"},
+		"a bad extension":       {Name: "other", Extensions: []string{"other"}, Decode: rawFormat.Decode},
+		"nil":                   nil,
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RegisterFormat() of a format with %s did not panic", name)
+				}
+			}()
+			utils.RegisterFormat(f)
+		}()
+	}
+
+	// Files of known formats without a codec are named in the error
+	for header, name := range map[string]string{"RIFF\x10\x00\x00\x00WEBPVP8 ": "WebP", "\x00\x00\x00\x1cftypavif": "AVIF", "8BPS\x00\x01": "Photoshop"} {
+		_, err := utils.ReadImage(writeTemporaryFile(t, []byte(header)))
+		if !errors.Is(err, utils.ErrUnsupportedFormat) || !strings.Contains(err.Error(), name) {
+			t.Errorf("Reading a %s file returned the error %v", name, err)
+		}
+		if _, err := utils.DetectFormat([]byte(header)); !errors.Is(err, utils.ErrUnsupportedFormat) {
+			t.Errorf("DetectFormat() of a %s file returned the error %v", name, err)
+		}
+	}
+	if f, err := utils.DetectFormat([]byte("GIF89a")); err != nil || f.Name != "gif" {
+		t.Errorf("DetectFormat() did not recognise a GIF header")
+	}
+	if err := utils.WriteImageWithOptions(img, t.TempDir()+"/image.png", utils.WriteOptions{Format: "webp"}); !errors.Is(err, utils.ErrUnsupportedFormat) {
+		t.Errorf("Writing an unregistered format returned the error %v", err)
+	}
+}
+
+// TestReaderWriterIO tests decoding and encoding images in memory, and the CLI reading and writing files and the
+// standard output
+func TestReaderWriterIO(t *testing.T) {
+	img := generateRandomImage(12, 9)
+	for _, format := range []string{"png", "bmp", "qoi", "pam"} {
+		var buffer bytes.Buffer
+		if err := utils.Encode(&buffer, img, utils.WriteOptions{Format: format}); err != nil {
+			t.Fatalf("Encode() returned an error for %s: %v", format, err)
+		}
+		result, name, err := utils.Decode(&buffer, utils.ReadOptions{})
+		if err != nil {
+			t.Fatalf("Decode() returned an error for %s: %v", format, err)
+		}
+		if name != format || !reflect.DeepEqual(result, img) {
+			t.Errorf("An image encoded as %s was decoded as %s with different pixels", format, name)
+		}
+	}
+	var buffer bytes.Buffer
+	if err := utils.Encode(&buffer, img, utils.WriteOptions{}); err != nil || !bytes.HasPrefix(buffer.Bytes(), []byte("\x89PNG")) {
+		t.Errorf("Encode() without a format did not write a PNG, error %v", err)
+	}
+
+	// Sequences go through memory as well
+	pages := &raster.Sequence{Frames: []raster.Frame{{Image: img}, {Image: generateRandomImage(12, 9)}}}
+	buffer.Reset()
+	if err := utils.EncodeSequence(&buffer, pages, utils.WriteOptions{Format: "tiff"}); err != nil {
+		t.Fatalf("EncodeSequence() returned an error: %v", err)
+	}
+	if sequence, name, err := utils.DecodeSequence(&buffer, utils.ReadOptions{}); err != nil || name != "tiff" || !reflect.DeepEqual(sequence.Frames, pages.Frames) {
+		t.Errorf("A sequence changed when encoded and decoded in memory, error %v", err)
+	}
+	if err := utils.EncodeSequence(&buffer, pages, utils.WriteOptions{Format: "png"}); err == nil {
+		t.Errorf("EncodeSequence() wrote two frames to a PNG")
+	}
+
+	// The CLI applies an operation given as an argument, keeping the input's format on the standard output
+	directory := t.TempDir()
+	input := directory + "/input.bmp"
+	if err := utils.WriteImage(img, input); err != nil {
+		t.Fatalf("WriteImage() returned an error: %v", err)
+	}
+	output := directory + "/output.png"
+	if err := runCommand([]string{"contrast", "m=-1", "b=1"}, input, output, utils.WriteOptions{}); err != nil {
+		t.Fatalf("runCommand() returned an error: %v", err)
+	}
+	inverted, _ := utils.ReadImage(output)
+	for i, sample := range inverted.Pix {
+		if i%4 != 3 && sample != 255-img.Pix[i] {
+			t.Fatalf("Sample %d is %d after inverting %d", i, sample, img.Pix[i])
+		}
+	}
+
+	stdout, err := os.CreateTemp(directory, "stdout")
+	if err != nil {
+		t.Fatalf("Failed creating a file for the standard output: %v", err)
+	}
+	original := os.Stdout
+	os.Stdout = stdout
+	err = runCommand([]string{"grey"}, input, stdio, utils.WriteOptions{})
+	os.Stdout = original
+	_ = stdout.Close()
+	if err != nil {
+		t.Fatalf("runCommand() returned an error writing to the standard output: %v", err)
+	}
+	data, _ := os.ReadFile(stdout.Name())
+	if !bytes.HasPrefix(data, []byte("BM")) {
+		t.Errorf("The standard output did not receive a BMP like the input")
+	}
+
+	for _, args := range [][]string{{"sharpen"}, {"blur", "size"}, {"blur", "radius=3"}, {"blur", "size=abc"}} {
+		if err := runCommand(args, input, output, utils.WriteOptions{}); err == nil {
+			t.Errorf("runCommand() accepted the arguments %q", args)
+		}
+	}
+}
+
+// buildEXIF builds little-endian EXIF data holding only an orientation
+func buildEXIF(orientation uint16) []byte {
+	exif := []byte("II*\x00")
+	exif = binary.LittleEndian.AppendUint32(exif, 8) // First image file directory
+	exif = binary.LittleEndian.AppendUint16(exif, 1) // One entry
+	exif = binary.LittleEndian.AppendUint16(exif, 274)
+	exif = binary.LittleEndian.AppendUint16(exif, 3) // SHORT
+	exif = binary.LittleEndian.AppendUint32(exif, 1)
+	exif = binary.LittleEndian.AppendUint16(exif, orientation)
+	exif = append(exif, 0, 0)                        // Padding of the value to 4 bytes
+	return binary.LittleEndian.AppendUint32(exif, 0) // No next directory
+}
+
+// TestMetadata tests that PNG and JPEG metadata is read, carried through operations, written back and stripped on
+// request, and that EXIF orientation is applied on load
+func TestMetadata(t *testing.T) {
+	directory := t.TempDir()
+	profile := make([]byte, 70000) // Larger than a JPEG segment, so it has to be split
+	rand.New(rand.NewSource(1)).Read(profile)
+	metadata := &raster.Metadata{
+		Text: []raster.TextEntry{
+			{Keyword: "Title", Text: "Gnomo"},
+			{Keyword: "Author", Text: "Zoë Ζωή"},                          // Not Latin-1, so written as iTXt
+			{Keyword: "Description", Text: strings.Repeat("gnome ", 500)}, // Long enough to be compressed
+		},
+		ICCProfile: profile,
+		Gamma:      0.45455,
+		Resolution: &raster.Resolution{X: 2835, Y: 5670},
+		EXIF:       buildEXIF(1),
+	}
+	img := generateGradientImage(16, 8)
+	img.Metadata = metadata
+
+	// PNG keeps every field
+	pngPath := directory + "/metadata.png"
+	if err := utils.WriteImage(img, pngPath); err != nil {
+		t.Fatalf("WriteImage() returned an error: %v", err)
+	}
+	result, err := utils.ReadImageWithOptions(pngPath, utils.ReadOptions{})
+	if err != nil {
+		t.Fatalf("ReadImageWithOptions() returned an error: %v", err)
+	}
+	if !reflect.DeepEqual(result.Metadata, metadata) {
+		t.Errorf("PNG metadata read back as %+v", result.Metadata)
+	}
+	if reference, err := png.Decode(bytes.NewReader(mustReadFile(t, pngPath))); err != nil || reference.Bounds().Dx() != 16 {
+		t.Errorf("The standard library could not read a PNG with metadata: %v", err)
+	}
+
+	// XMP is always written as uncompressed iTXt, where XMP readers look for it, even when it is short Latin-1 text
+	xmp := generateGradientImage(4, 4)
+	xmp.Metadata = &raster.Metadata{Text: []raster.TextEntry{{Keyword: "XML:com.adobe.xmp", Text: "<x:xmpmeta/>"}}}
+	xmpPath := directory + "/xmp.png"
+	if err := utils.WriteImage(xmp, xmpPath); err != nil {
+		t.Fatalf("WriteImage() returned an error for XMP: %v", err)
+	}
+	if !bytes.Contains(mustReadFile(t, xmpPath), []byte("iTXtXML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>")) {
+		t.Errorf("XMP was not written as an uncompressed iTXt chunk")
+	}
+
+	// Operations carry it along, and JPEG keeps what it can hold
+	pipeline := new(manipulations.Pipeline)
+	if _, err := pipeline.ThenNamed("blur", manipulations.Params{"size": 3}); err != nil {
+		t.Fatalf("ThenNamed() returned an error: %v", err)
+	}
+	blurred, err := pipeline.ApplyImage(context.Background(), result)
+	if err != nil {
+		t.Fatalf("ApplyImage() returned an error: %v", err)
+	}
+	if !reflect.DeepEqual(blurred.Metadata, metadata) {
+		t.Errorf("ApplyImage() did not keep the metadata")
+	}
+	for name, operation := range map[string]func(img *raster.Image, opts ...manipulations.Option) (*raster.Image, error){
+		"GaussianFilter": func(img *raster.Image, opts ...manipulations.Option) (*raster.Image, error) {
+			return manipulations.GaussianFilter(img, 3, 1, opts...)
+		},
+		"ConvertToGreyScale": manipulations.ConvertToGreyScale[*raster.Image],
+		"AdjustContrast": func(img *raster.Image, opts ...manipulations.Option) (*raster.Image, error) {
+			return manipulations.AdjustContrast(img, -1, 255, opts...)
+		},
+	} {
+		for _, opts := range [][]manipulations.Option{nil, {manipulations.InRegion(image.Rect(2, 2, 6, 6))}} {
+			processed, err := operation(result, opts...)
+			if err != nil {
+				t.Fatalf("%s() returned an error: %v", name, err)
+			}
+			if !reflect.DeepEqual(processed.Metadata, metadata) {
+				t.Errorf("%s() with %d options did not keep the metadata", name, len(opts))
+			}
+			if processed.Metadata == result.Metadata {
+				t.Errorf("%s() shares the metadata of its input instead of copying it", name)
+			}
+		}
+	}
+	jpegPath := directory + "/metadata.jpg"
+	if err := utils.WriteImage(blurred, jpegPath); err != nil {
+		t.Fatalf("WriteImage() returned an error for a JPEG: %v", err)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(mustReadFile(t, jpegPath))); err != nil {
+		t.Errorf("The standard library could not read a JPEG with metadata: %v", err)
+	}
+	result, err = utils.ReadImageWithOptions(jpegPath, utils.ReadOptions{})
+	if err != nil {
+		t.Fatalf("ReadImageWithOptions() returned an error for a JPEG: %v", err)
+	}
+	got := result.Metadata
+	if got == nil || !bytes.Equal(got.ICCProfile, profile) || !bytes.Equal(got.EXIF, metadata.EXIF) || got.Gamma != 0 {
+		t.Fatalf("JPEG metadata read back as %+v", got)
+	}
+	if got.Resolution == nil || math.Abs(got.Resolution.X-2835) > 20 || math.Abs(got.Resolution.Y-5670) > 20 {
+		t.Errorf("JPEG resolution read back as %+v", got.Resolution)
+	}
+	if len(got.Text) != 3 || got.Text[0] != (raster.TextEntry{Keyword: "Comment", Text: "Title: Gnomo"}) {
+		t.Errorf("JPEG comments read back as %+v", got.Text)
+	}
+
+	// EXIF orientation is applied on load and then reset, so the image is not turned twice
+	for orientation, turn := range map[uint16]func(*raster.Image) *raster.Image{
+		3: (*raster.Image).Rotate180,
+		6: (*raster.Image).Rotate90,
+		7: func(img *raster.Image) *raster.Image { return img.Transpose().Rotate180() },
+		8: (*raster.Image).Rotate270,
+	} {
+		sideways := generateGradientImage(5, 3)
+		sideways.Metadata = &raster.Metadata{EXIF: buildEXIF(orientation), Resolution: &raster.Resolution{X: 100, Y: 200}}
+		path := fmt.Sprintf("%s/orientation_%d.png", directory, orientation)
+		if err := utils.WriteImage(sideways, path); err != nil {
+			t.Fatalf("WriteImage() returned an error: %v", err)
+		}
+		upright, err := utils.ReadImageWithOptions(path, utils.ReadOptions{Channels: raster.RGBA})
+		if err != nil {
+			t.Fatalf("ReadImageWithOptions() returned an error for orientation %d: %v", orientation, err)
+		}
+		want := turn(sideways)
+		if !reflect.DeepEqual(upright.Pix, want.Pix) || upright.Width != want.Width {
+			t.Errorf("Orientation %d was not undone", orientation)
+		}
+		if !bytes.Equal(upright.Metadata.EXIF, buildEXIF(1)) {
+			t.Errorf("Orientation %d was not reset after being applied", orientation)
+		}
+		if transposed := upright.Width != sideways.Width; transposed != (upright.Metadata.Resolution.X == 200) {
+			t.Errorf("Orientation %d gave the resolution %+v", orientation, upright.Metadata.Resolution)
+		}
+	}
+
+	// Stripping removes only what was asked for
+	strip, err := utils.ParseStrip("exif, Text")
+	if err != nil || strip != utils.StripEXIF|utils.StripText {
+		t.Fatalf("ParseStrip() = %v, %v", strip, err)
+	}
+	if _, err := utils.ParseStrip("gps"); err == nil {
+		t.Errorf("ParseStrip() accepted an unknown kind of metadata")
+	}
+	strippedPath := directory + "/stripped.png"
+	if err := utils.WriteImageWithOptions(img, strippedPath, utils.WriteOptions{Strip: strip}); err != nil {
+		t.Fatalf("WriteImageWithOptions() returned an error: %v", err)
+	}
+	result, _ = utils.ReadImageWithOptions(strippedPath, utils.ReadOptions{})
+	if result.Metadata == nil || result.Metadata.Text != nil || result.Metadata.EXIF != nil || !bytes.Equal(result.Metadata.ICCProfile, profile) {
+		t.Errorf("Stripping EXIF data and text left %+v", result.Metadata)
+	}
+	if img.Metadata != metadata || len(metadata.EXIF) == 0 {
+		t.Errorf("Stripping changed the metadata of the image written")
+	}
+	var buf bytes.Buffer
+	if err := utils.Encode(&buf, img, utils.WriteOptions{Format: "jpeg", Strip: utils.StripAll}); err != nil {
+		t.Fatalf("Encode() returned an error: %v", err)
+	}
+	if result, _, err := utils.Decode(&buf, utils.ReadOptions{}); err != nil || result.Metadata != nil {
+		t.Errorf("Stripping everything left %+v, %v", result.Metadata, err)
+	}
+}
+
+// mustReadFile reads a whole file, failing the test if it cannot
+func mustReadFile(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() returned an error: %v", err)
+	}
+	return data
+}
+
+// TestPNGEncoding tests that PNGs are written in the smallest colour type that holds the image, and that the bit depth,
+// compression level and interlacing options are honoured
+func TestPNGEncoding(t *testing.T) {
+	directory := t.TempDir()
+	// write writes an image as a PNG, checks that it reads back unchanged and returns the file
+	write := func(name string, img *raster.Image, options utils.WriteOptions) []byte {
+		t.Helper()
+		path := directory + "/" + name + ".png"
+		if err := utils.WriteImageWithOptions(img, path, options); err != nil {
+			t.Fatalf("%s: WriteImageWithOptions() returned an error: %v", name, err)
+		}
+		if _, err := png.Decode(bytes.NewReader(mustReadFile(t, path))); err != nil {
+			t.Fatalf("%s: the standard library could not read the PNG: %v", name, err)
+		}
+		read, err := utils.ReadImageWithOptions(path, utils.ReadOptions{Channels: img.Channels, Depth: img.Depth})
+		if err != nil {
+			t.Fatalf("%s: ReadImageWithOptions() returned an error: %v", name, err)
+		}
+		if options.Depth == 0 && !reflect.DeepEqual(read.Pix, img.Pix) {
+			t.Errorf("%s: the image changed when written and read back", name)
+		}
+		return mustReadFile(t, path)
+	}
+	// header returns the bit depth, colour type and interlace method of a PNG
+	header := func(data []byte) [3]byte { return [3]byte{data[24], data[25], data[28]} }
+
+	grey := generateGradientImage(40, 30)
+	for i := 0; i < len(grey.Pix); i += 4 {
+		grey.Pix[i+1], grey.Pix[i+2] = grey.Pix[i], grey.Pix[i] // Grey, although stored as RGBA
+	}
+	twoLevels, _ := raster.New(9, 5, raster.RGB, 8)
+	for i := range twoLevels.Pix {
+		twoLevels.Pix[i] = uint32(i/3%2) * 255
+	}
+	fewColours, _ := raster.NewRGBA(40, 30)
+	for i := 0; i < len(fewColours.Pix); i += 4 {
+		k := uint32(i / 4 % 5)
+		copy(fewColours.Pix[i:], []uint32{k * 50, 255 - k*50, 7, 255 - uint32(i/4%3)*100}) // Some transparency, for tRNS
+	}
+	greyAlpha := grey.Clone()
+	for i := 3; i < len(greyAlpha.Pix); i += 4 {
+		greyAlpha.Pix[i] = uint32(i * 7 % 256) // Too many combinations of grey and alpha for a palette
+	}
+	manyColours := generateRandomImage(40, 30)
+	for i := 3; i < len(manyColours.Pix); i += 4 {
+		manyColours.Pix[i] = 255
+	}
+
+	for _, test := range []struct {
+		name string
+		img  *raster.Image
+		want [3]byte
+	}{
+		{"grey", grey, [3]byte{8, 0, 0}},
+		{"two_levels", twoLevels, [3]byte{1, 0, 0}},
+		{"few_colours", fewColours, [3]byte{4, 3, 0}},
+		{"grey_alpha", greyAlpha, [3]byte{8, 4, 0}},
+		{"opaque", manyColours, [3]byte{8, 2, 0}},
+		{"random", generateRandomImage(40, 30), [3]byte{8, 6, 0}},
+	} {
+		if got := header(write(test.name, test.img, utils.WriteOptions{})); got != test.want {
+			t.Errorf("%s: written with bit depth, colour type and interlace %v, expected %v", test.name, got, test.want)
+		}
+	}
+	if data := write("few_colours", fewColours, utils.WriteOptions{}); !bytes.Contains(data, []byte("tRNS")) {
+		t.Errorf("A paletted PNG with transparent colours has no tRNS chunk")
+	}
+
+	// Interlaced images of any size, including those with empty passes, read back unchanged
+	for _, size := range [][2]int{{1, 1}, {3, 2}, {13, 7}, {40, 30}} {
+		img := generateRandomImage(size[0], size[1])
+		if data := write(fmt.Sprintf("interlaced_%dx%d", size[0], size[1]), img, utils.WriteOptions{Interlace: true}); data[28] != 1 {
+			t.Errorf("A %dx%d PNG was not interlaced", size[0], size[1])
+		}
+	}
+	write("interlaced_two_levels", twoLevels, utils.WriteOptions{Interlace: true})
+
+	// The bit depth can be changed either way
+	deep, _ := manyColours.ConvertDepth(16)
+	if data := write("deep", deep, utils.WriteOptions{}); data[24] != 16 {
+		t.Errorf("A 16-bit image was written with %d bits", data[24])
+	}
+	if data := write("shallow", deep, utils.WriteOptions{Depth: 8}); data[24] != 8 {
+		t.Errorf("Depth 8 wrote %d bits", data[24])
+	}
+	if read, _ := utils.ReadImageWithOptions(directory+"/shallow.png", utils.ReadOptions{}); read == nil || !reflect.DeepEqual(read.Pix, manyColours.Pix) {
+		t.Errorf("A 16-bit image written with 8 bits did not read back as the 8-bit original")
+	}
+	if data := write("widened", manyColours, utils.WriteOptions{Depth: 16}); data[24] != 16 {
+		t.Errorf("Depth 16 wrote %d bits", data[24])
+	}
+
+	// Higher levels compress harder
+	smooth := generateGradientImage(256, 256)
+	fast, small := write("fast", smooth, utils.WriteOptions{CompressionLevel: 1}), write("small", smooth, utils.WriteOptions{CompressionLevel: 9})
+	if len(small) > len(fast) {
+		t.Errorf("Level 9 gave %d bytes, more than the %d bytes of level 1", len(small), len(fast))
+	}
+	var buf bytes.Buffer
+	if err := utils.Encode(&buf, smooth, utils.WriteOptions{CompressionLevel: 10}); err == nil {
+		t.Errorf("Encode() accepted a compression level of 10")
+	}
+	if err := utils.Encode(&buf, smooth, utils.WriteOptions{Depth: 12}); err == nil {
+		t.Errorf("Encode() accepted a bit depth of 12")
+	}
+}
+
+// TestArrays tests that images and matrices round-trip exactly through CSV, JSON and .npy, and that .npy files in the
+// other layouts NumPy writes are read
+func TestArrays(t *testing.T) {
+	directory := t.TempDir()
+	deep, _ := generateRandomImage(7, 5).ConvertDepth(16)
+	grey, _ := raster.New(6, 4, raster.Grey, 8)
+	for i := range grey.Pix {
+		grey.Pix[i] = uint32(i * 11 % 256)
+	}
+	kernel, err := manipulations.GaussianKernel(5, 1.3)
+	if err != nil {
+		t.Fatalf("GaussianKernel() returned an error: %v", err)
+	}
+
+	for _, format := range []string{"csv", "json", "npy"} {
+		for name, img := range map[string]*raster.Image{"rgba": generateRandomImage(7, 5), "deep": deep, "grey": grey} {
+			path := directory + "/" + name + "." + format
+			if err := utils.WriteImage(img, path); err != nil {
+				t.Fatalf("%s: WriteImage() returned an error: %v", path, err)
+			}
+			read, err := utils.ReadImageWithOptions(path, utils.ReadOptions{Channels: img.Channels, Depth: img.Depth})
+			if err != nil {
+				t.Fatalf("%s: ReadImageWithOptions() returned an error: %v", path, err)
+			}
+			if read.Width != img.Width || read.Height != img.Height || !reflect.DeepEqual(read.Pix, img.Pix) {
+				t.Errorf("%s: the image changed when written and read back", path)
+			}
+		}
+
+		path := directory + "/kernel." + format
+		if err := utils.WriteArray(utils.MatrixArray(kernel), path); err != nil {
+			t.Fatalf("%s: WriteArray() returned an error: %v", path, err)
+		}
+		a, err := utils.ReadArray(path)
+		if err != nil {
+			t.Fatalf("%s: ReadArray() returned an error: %v", path, err)
+		}
+		if m, err := a.Matrix(); err != nil || !reflect.DeepEqual(m, kernel) {
+			t.Errorf("%s: the kernel changed when written and read back, %v", path, err)
+		}
+	}
+
+	// Arrays that do not match their shape or type are refused
+	for _, a := range []*utils.Array{
+		{Shape: []int{2, 2}, DType: "uint8", Data: []float64{1, 2, 3}},
+		{Shape: []int{2}, DType: "uint8", Data: []float64{1, 256}},
+		{Shape: []int{2}, DType: "int16", Data: []float64{1, 0.5}},
+		{Shape: []int{1}, DType: "complex128", Data: []float64{1}},
+	} {
+		if err := utils.EncodeArray(io.Discard, a, "npy"); err == nil {
+			t.Errorf("EncodeArray() accepted %+v", a)
+		}
+	}
+
+	// A big-endian int16 array in Fortran order, as numpy.save(f, numpy.asfortranarray(a.astype(">i2"))) writes it
+	header := "{'descr': '>i2', 'fortran_order': True, 'shape': (2, 3), }"
+	header += strings.Repeat(" ", 64-(10+len(header)+1)%64) + "\n"
+	npy := append([]byte("\x93NUMPY\x01\x00"), byte(len(header)), 0)
+	npy = append(npy, header...)
+	for _, v := range []int16{1, -4, 2, -5, 3, -6} { // Columns first
+		npy = binary.BigEndian.AppendUint16(npy, uint16(v))
+	}
+	a, err := utils.DecodeArray(bytes.NewReader(npy), "npy")
+	if err != nil {
+		t.Fatalf("DecodeArray() returned an error: %v", err)
+	}
+	want := &utils.Array{Shape: []int{2, 3}, DType: "int16", Data: []float64{1, 2, 3, -4, -5, -6}}
+	if !reflect.DeepEqual(a, want) {
+		t.Errorf("DecodeArray() read %+v, expected %+v", a, want)
+	}
+
+	// CSV files without a shape are read as a matrix
+	a, err = utils.DecodeArray(strings.NewReader("1, 2.5\n3,4\n"), "csv")
+	if err != nil || !reflect.DeepEqual(a.Shape, []int{2, 2}) || !reflect.DeepEqual(a.Data, []float64{1, 2.5, 3, 4}) {
+		t.Errorf("DecodeArray() read %+v from a plain CSV file, %v", a, err)
+	}
+}
+
+// TestSafeOutput tests that output paths are expanded from templates, that existing files are only replaced when asked
+// to, and that failed writes leave neither a truncated file nor a temporary one behind
+func TestSafeOutput(t *testing.T) {
+	for _, test := range []struct {
+		template, in, want string
+	}{
+		{defaultOutput, "images/gnome.png", "images/gnome_new.png"},
+		{"{name}_{op}.{ext}", "images/gnome.png", "gnome_blur.png"},
+		{"out/{name}.{ext}", stdio, "out/stdin.png"},
+		{"{dir}/{name}", "gnome", "gnome"},
+	} {
+		if path, err := outputPath(test.template, test.in, "blur", ".png"); err != nil || path != filepath.FromSlash(test.want) {
+			t.Errorf("outputPath(%q, %q) returned %q and error %v, expected %q", test.template, test.in, path, err, test.want)
+		}
+	}
+	for _, template := range []string{"{name}_{size}.png", "{}.png", ""} {
+		if _, err := outputPath(template, "gnome.png", "blur", ".png"); err == nil {
+			t.Errorf("outputPath() accepted the template %q", template)
+		}
+	}
+
+	directory := t.TempDir()
+	input := directory + "/input.png"
+	img := generateRandomImage(6, 5)
+	if err := utils.WriteImage(img, input); err != nil {
+		t.Fatalf("WriteImage() returned an error: %v", err)
+	}
+	if err := os.Chmod(input, 0600); err != nil {
+		t.Fatalf("Failed changing the permissions of the input: %v", err)
+	}
+	original := mustReadFile(t, input)
+
+	// Existing files are refused unless overwriting is allowed, which keeps their permissions
+	grey := generateGradientImage(6, 5)
+	if err := utils.WriteImageWithOptions(grey, input, utils.WriteOptions{NoOverwrite: true}); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("WriteImageWithOptions() returned %v for an existing file, expected fs.ErrExist", err)
+	}
+	if !bytes.Equal(mustReadFile(t, input), original) {
+		t.Errorf("A file was changed although overwriting was refused")
+	}
+	if err := runCommand([]string{"grey"}, input, "{dir}/{name}.{ext}", utils.WriteOptions{NoOverwrite: true}); err == nil {
+		t.Errorf("runCommand() replaced its own input")
+	}
+	if err := utils.WriteImage(grey, input); err != nil {
+		t.Fatalf("WriteImage() returned an error replacing a file: %v", err)
+	}
+	if info, err := os.Stat(input); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("A replaced file lost its permissions, %v", err)
+	}
+
+	// The CLI writes to the expanded template, in the format of the input
+	if err := runCommand([]string{"grey"}, input, "{dir}/{name}_{op}.{ext}", utils.WriteOptions{NoOverwrite: true}); err != nil {
+		t.Fatalf("runCommand() returned an error: %v", err)
+	}
+	if _, err := os.Stat(directory + "/input_grey.png"); err != nil {
+		t.Errorf("runCommand() did not write to the expanded template: %v", err)
+	}
+
+	// A write that fails midway leaves the existing file as it was
+	broken := &utils.Array{Shape: []int{2}, DType: "float64", Data: []float64{1, math.NaN()}}
+	kernel := directory + "/kernel.json"
+	if err := utils.WriteArray(utils.MatrixArray(matrix.Identity(3)), kernel); err != nil {
+		t.Fatalf("WriteArray() returned an error: %v", err)
+	}
+	saved := mustReadFile(t, kernel)
+	if err := utils.WriteArrayWithOptions(utils.MatrixArray(matrix.Identity(2)), kernel, utils.WriteOptions{NoOverwrite: true}); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("WriteArrayWithOptions() returned %v for an existing file, expected fs.ErrExist", err)
+	}
+	if err := utils.WriteArray(broken, kernel); err == nil {
+		t.Fatalf("WriteArray() wrote a NaN to JSON")
+	}
+	if !bytes.Equal(mustReadFile(t, kernel), saved) {
+		t.Errorf("A failed write changed an existing file")
+	}
+	entries, _ := os.ReadDir(directory)
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			t.Errorf("A temporary file was left behind: %s", entry.Name())
+		}
+	}
+}
+
+// TestImageSizeLimit tests that images too large to allocate are refused with an error rather than a panic
+func TestImageSizeLimit(t *testing.T) {
+	for _, size := range [][3]int{{math.MaxInt32, math.MaxInt32, 4}, {math.MaxInt, 2, 1}, {2, math.MaxInt, 4}, {1 << 15, 1 << 15, 4}} {
+		if _, err := raster.New(size[0], size[1], size[2], 8); err == nil {
+			t.Errorf("New() accepted a %dx%d image with %d channels", size[0], size[1], size[2])
+		}
+		if _, err := raster.NewFloat(size[0], size[1], size[2]); err == nil {
+			t.Errorf("NewFloat() accepted a %dx%d image with %d channels", size[0], size[1], size[2])
+		}
+	}
+}
@@ -1,29 +1,67 @@
 package manipulations
 
 import (
-	"errors"
-	"matrix-image-manipulation/utils"
+	"context"
+	"fmt"
+	"matrix-image-manipulation/matrix"
+	"matrix-image-manipulation/raster"
 )
 
-// ConvertToGreyScale converts a matrix to greyscale equivalent
-func ConvertToGreyScale(matrix [][][4]uint32) ([][][4]uint32, error) {
-	height := len(matrix) // Get the height of the matrix
-	if height == 0 {
-		return nil, errors.New("empty matrix")
-	}
+// ConvertToGreyScale converts an image to its greyscale equivalent.
+// Colour images become single-channel images, or two-channel images if they have alpha, rather than repeating the
+// luminance in three channels. Images that are already greyscale are copied.
+func ConvertToGreyScale[R raster.Raster](img R, opts ...Option) (R, error) {
+	return ConvertToGreyScaleContext(context.Background(), img, opts...)
+}
+
+// ConvertToGreyScaleContext is ConvertToGreyScale stopping with ctx.Err() as soon as ctx is cancelled
+func ConvertToGreyScaleContext[R raster.Raster](ctx context.Context, img R, opts ...Option) (R, error) {
+	return run(ctx, img, opts, spec{alpha: AlphaPreserve, apply: convertToGreyScale})
+}
 
-	width := len(matrix[0])
+// luminanceMatrix is the ITU-R BT.601 colour transform Y = 0.299R + 0.587G + 0.114B as a 1x3 matrix, the
+// luminance of a pixel is its product with the column vector [R G B]ᵀ
+var luminanceMatrix = matrix.Must(matrix.FromRows([][]float64{{0.299, 0.587, 0.114}}))
 
-	greyScaleImage := utils.Make2D[[4]uint32](height, width) // Create a new image
+// convertToGreyScale is the float working space implementation of ConvertToGreyScale.
+// Luminance is a weighted sum, so it is the same whether or not the colour is premultiplied and alpha is always kept.
+func convertToGreyScale(img *raster.Float, o options) (*raster.Float, error) {
+	var channels int
+	switch img.Channels {
+	case raster.Grey, raster.GreyAlpha:
+		return img.Clone(), nil
+	case raster.RGB:
+		channels = raster.Grey
+	case raster.RGBA:
+		channels = raster.GreyAlpha
+	default:
+		return nil, fmt.Errorf("cannot convert a %d band image to greyscale", img.Channels)
+	}
+
+	greyScaleImage, err := raster.NewFloat(img.Width, img.Height, channels) // Create a new image
+	if err != nil {
+		return nil, err
+	}
+	greyScaleImage.Linear, greyScaleImage.Premultiplied = img.Linear, img.Premultiplied
 
 	// Iterate through all pixels
-	for y := 0; y < height; y++ {
-		for x := range matrix[y] {
-			current := matrix[y][x]                                                     // Convenience, cleans up the following line, does allocate more memory however
-			r, g, b, a := current[0], current[1], current[2], current[3]                // Thank you Go for not providing list expansion
-			luminance := uint32(float64(r)*0.299 + float64(g)*0.587 + float64(b)*0.114) // Apply  the formula
-			greyScaleImage[y][x] = [4]uint32{luminance, luminance, luminance, a}        // Write the luminance value, keeping the alpha as current
+	err = parallelRows(img.Height, o, func(y0, y1 int) {
+		rgb, luminance := make([]float64, 3), make([]float64, 1) // Scratch vectors reused for every pixel in this band
+		for y := y0; y < y1; y++ {
+			for x := 0; x < img.Width; x++ {
+				current := img.Pix[img.PixOffset(x, y):] // Convenience, cleans up the following lines
+				rgb[0], rgb[1], rgb[2] = float64(current[0]), float64(current[1]), float64(current[2])
+				_ = luminanceMatrix.MulVecTo(luminance, rgb) // Apply the formula, the dimensions always match
+				out := greyScaleImage.Pix[greyScaleImage.PixOffset(x, y):]
+				out[0] = float32(luminance[0]) // Write the luminance value
+				if channels == raster.GreyAlpha {
+					out[1] = current[3] // Keep the alpha as current
+				}
+			}
 		}
+	})
+	if err != nil {
+		return nil, err
 	}
 	return greyScaleImage, nil
 }
@@ -0,0 +1,220 @@
+package manipulations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"matrix-image-manipulation/raster"
+)
+
+// Option configures how an operation runs
+type Option func(*options)
+
+// options holds the settings every operation understands, built from a list of Option
+type options struct {
+	linear   bool             // Whether to process linear-light values instead of sRGB-encoded ones
+	alpha    AlphaPolicy      // How the alpha channel is treated
+	region   *image.Rectangle // The only pixels the operation may change, nil for the whole image
+	workers  int              // How many goroutines to split the rows across, see Workers
+	progress ProgressFunc     // Receives the number of rows processed, may be nil
+	ctx      context.Context  // Stops the operation once cancelled, set by the Context variants
+}
+
+// context returns the context the operation runs under
+func (o options) context() context.Context {
+	if o.ctx == nil {
+		return context.Background()
+	}
+	return o.ctx
+}
+
+// operation is the float working space implementation of an exported operation
+type operation func(img *raster.Float, o options) (*raster.Float, error)
+
+// spec describes an exported operation to run
+type spec struct {
+	alpha AlphaPolicy // The alpha policy used unless another one is requested
+	halo  int         // How many pixels away from the one being computed the operation reads
+	apply operation   // The float working space implementation
+}
+
+// AlphaPolicy describes how an operation treats the alpha channel of an image
+type AlphaPolicy int
+
+const (
+	// AlphaDefault lets each operation pick the policy that suits it: AlphaPremultiply for filters that mix
+	// neighbouring pixels and AlphaPreserve for operations that work on one pixel at a time
+	AlphaDefault AlphaPolicy = iota
+	// AlphaProcess treats alpha like any other channel and the colour channels as stored, in straight form
+	AlphaProcess
+	// AlphaPreserve copies alpha to the result untouched and processes the colour channels in straight form
+	AlphaPreserve
+	// AlphaPremultiply multiplies the colour channels by alpha before processing and divides them afterwards.
+	// Filters process alpha as well, so transparent pixels don't bleed their invisible colour into visible ones.
+	AlphaPremultiply
+)
+
+// WithAlpha sets the policy an operation applies to the alpha channel
+func WithAlpha(policy AlphaPolicy) Option {
+	return func(o *options) {
+		o.alpha = policy
+	}
+}
+
+// InLinearLight makes an operation decode the image to linear light before processing it and encode the result back
+// afterwards. Averaging in linear light keeps blurs from darkening edges between bright and dark regions.
+func InLinearLight() Option {
+	return func(o *options) {
+		o.linear = true
+	}
+}
+
+// InRegion restricts an operation to the pixels inside r, clipped to the image. The result is still the full image,
+// with every pixel outside r copied from the input. Filters keep reading neighbours from outside r, so the region
+// blends in exactly as if the whole image had been processed and only r kept.
+func InRegion(r image.Rectangle) Option {
+	return func(o *options) {
+		o.region = &r
+	}
+}
+
+// newOptions applies every Option to the default settings
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// validateInput checks that an image can be processed by the operations in this package
+func validateInput(img *raster.Image) error {
+	if img == nil || img.Empty() {
+		return errors.New("empty image")
+	}
+	return img.Validate()
+}
+
+// validateFloatInput is the raster.Float equivalent of validateInput
+func validateFloatInput(img *raster.Float) error {
+	if img == nil || img.Empty() {
+		return errors.New("empty image")
+	}
+	return img.Validate()
+}
+
+// run carries out an operation in the float working space under ctx.
+// Integer images are converted to floats and the result is quantised back to their bit depth only once, at the end.
+// Float images are processed as they are, so chaining operations on them never rounds.
+func run[R raster.Raster](ctx context.Context, img R, opts []Option, s spec) (R, error) {
+	o := newOptions(opts)
+	if o.alpha == AlphaDefault {
+		o.alpha = s.alpha
+	}
+	o.ctx = ctx
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	switch source := any(img).(type) {
+	case *raster.Image:
+		if err := validateInput(source); err != nil {
+			return nil, err
+		}
+		region, area, err := regionOf(source.Bounds(), o, s)
+		if err != nil {
+			return nil, err
+		}
+
+		// Only the pixels the operation reads are converted to floats and back
+		result, err := runFloat(source.SubImage(area).ToFloat(), o, s.apply)
+		if err != nil {
+			return nil, err
+		}
+		quantised, err := result.ToImage(source.Depth)
+		if err != nil {
+			return nil, err
+		}
+		quantised.Metadata = source.Metadata.Clone() // Floats carry no metadata, so it is restored from the input
+		if region == source.Bounds() {
+			return any(quantised).(R), nil
+		}
+
+		// Composite the region back into a copy of the full image
+		composite := source.Clone()
+		if err := composite.Paste(quantised.SubImage(region.Sub(area.Min)), region.Min); err != nil {
+			return nil, err
+		}
+		return any(composite).(R), nil
+	case *raster.Float:
+		if err := validateFloatInput(source); err != nil {
+			return nil, err
+		}
+		region, area, err := regionOf(source.Bounds(), o, s)
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := runFloat(source.SubImage(area), o, s.apply)
+		if err != nil {
+			return nil, err
+		}
+		if region == source.Bounds() {
+			return any(result).(R), nil
+		}
+
+		composite := source.Clone()
+		if err := composite.Paste(result.SubImage(region.Sub(area.Min)), region.Min); err != nil {
+			return nil, err
+		}
+		return any(composite).(R), nil
+	default:
+		return nil, fmt.Errorf("unsupported image type %T", img)
+	}
+}
+
+// regionOf returns the region an operation changes within bounds and the larger area it has to read to do so, which
+// includes the halo around the region
+func regionOf(bounds image.Rectangle, o options, s spec) (region, area image.Rectangle, err error) {
+	if o.region == nil {
+		return bounds, bounds, nil
+	}
+	region = o.region.Intersect(bounds)
+	if region.Empty() {
+		return region, region, fmt.Errorf("region %v does not overlap the %dx%d image", *o.region, bounds.Dx(), bounds.Dy())
+	}
+	return region, region.Inset(-s.halo).Intersect(bounds), nil
+}
+
+// runFloat applies an operation to a float image, moving it to linear light and premultiplying it as requested, and
+// returns the result in the same form as the input
+func runFloat(img *raster.Float, o options, operation operation) (*raster.Float, error) {
+	working := img
+	if o.linear && !img.Linear {
+		working = working.ToLinear()
+	}
+	switch {
+	case o.alpha == AlphaPremultiply && !img.Premultiplied:
+		working = working.Premultiply()
+	case o.alpha != AlphaPremultiply && img.Premultiplied:
+		working = working.Unpremultiply() // The other policies work on straight colour
+	}
+
+	result, err := operation(working, o)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Premultiplied != img.Premultiplied {
+		if img.Premultiplied {
+			result = result.Premultiply()
+		} else {
+			result = result.Unpremultiply()
+		}
+	}
+	if result.Linear != img.Linear {
+		result = result.ToSRGB()
+	}
+	return result, nil
+}
@@ -1,83 +1,116 @@
 package manipulations
 
 import (
-	"errors"
+	"context"
+	"fmt"
 	"math"
-	"matrix-image-manipulation/utils"
+	"matrix-image-manipulation/matrix"
+	"matrix-image-manipulation/raster"
 )
 
-// GaussianFilter applies a Gaussian filter to a matrix representing an image.
-func GaussianFilter(matrix [][][4]uint32, kernelSize int, sigma float64) ([][][4]uint32, error) {
-	height := len(matrix) // Get the height of the matrix
-	if height == 0 {
-		return nil, errors.New("empty matrix")
-	}
-	width := len(matrix[0])
+// GaussianFilter applies a Gaussian filter to an image.
+// By default the colour is premultiplied by alpha while blurring, so transparent regions don't leave dark fringes.
+func GaussianFilter[R raster.Raster](img R, kernelSize int, sigma float64, opts ...Option) (R, error) {
+	return GaussianFilterContext(context.Background(), img, kernelSize, sigma, opts...)
+}
 
+// GaussianFilterContext is GaussianFilter stopping with ctx.Err() as soon as ctx is cancelled
+func GaussianFilterContext[R raster.Raster](ctx context.Context, img R, kernelSize int, sigma float64, opts ...Option) (R, error) {
 	// Generate the Gaussian kernel with the given size and standard deviation (sigma).
-	kernel := generateGaussianKernel(kernelSize, sigma)
+	kernel, err := GaussianKernel(kernelSize, sigma)
+	if err != nil {
+		var zero R
+		return zero, err
+	}
+	return run(ctx, img, opts, spec{alpha: AlphaPremultiply, halo: kernelSize / 2, apply: func(img *raster.Float, o options) (*raster.Float, error) {
+		return gaussianFilter(img, kernel, o)
+	}})
+}
 
-	filteredMatrix := utils.Make2D[[4]uint32](height, width)
+// gaussianFilter is the float working space implementation of GaussianFilter, convolving img with an odd-sized kernel.
+// Alpha is blurred along with the colour unless the policy is AlphaPreserve.
+func gaussianFilter(img *raster.Float, kernel *matrix.Dense, o options) (*raster.Float, error) {
+	kernelSize := kernel.Rows
+	filteredImage, err := raster.NewFloat(img.Width, img.Height, img.Channels)
+	if err != nil {
+		return nil, err
+	}
+	filteredImage.Linear, filteredImage.Premultiplied = img.Linear, img.Premultiplied
 
 	// Apply the Gaussian kernel to each pixel.
 	// kOffset is used to handle border effects by avoiding out-of-bounds indices.
 	kOffset := kernelSize / 2
-	for y := kOffset; y < height-kOffset; y++ {
-		for x := kOffset; x < width-kOffset; x++ {
-			// Apply the kernel to the pixel at (x, y) and store the result.
-			filteredMatrix[y][x] = applyKernel(x, y, matrix, kernel, kOffset)
+	alpha := img.AlphaChannel()
+	err = parallelRows(img.Height, o, func(y0, y1 int) {
+		sum := make([]float64, img.Channels) // Scratch space reused by every call to applyKernel in this band
+		for y := max(y0, kOffset); y < min(y1, img.Height-kOffset); y++ {
+			for x := kOffset; x < img.Width-kOffset; x++ {
+				// Apply the kernel to the pixel at (x, y) and store the result.
+				out := filteredImage.Pix[filteredImage.PixOffset(x, y):]
+				applyKernel(x, y, img, kernel, kOffset, sum, out)
+				if alpha >= 0 && o.alpha == AlphaPreserve {
+					out[alpha] = img.Pix[img.PixOffset(x, y)+alpha] // Restore the original alpha
+				}
+			}
 		}
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return filteredMatrix, nil
+	return filteredImage, nil
 }
 
-// applyKernel applies the given Gaussian kernel to a single pixel.
-func applyKernel(x int, y int, matrix [][][4]uint32, kernel [][]float64, kOffset int) [4]uint32 {
-	var sum [4]float64
-	for ky := 0; ky < len(kernel); ky++ {
-		for kx := 0; kx < len(kernel); kx++ {
+// applyKernel applies the given Gaussian kernel to a single pixel, accumulating in sum and writing the result into out.
+// The kernel is flipped relative to the image, as convolution requires.
+func applyKernel(x int, y int, img *raster.Float, kernel *matrix.Dense, kOffset int, sum []float64, out []float32) {
+	for i := range sum {
+		sum[i] = 0
+	}
+	for ky := 0; ky < kernel.Rows; ky++ {
+		for kx := 0; kx < kernel.Cols; kx++ {
 			// Multiply each kernel coefficient with the corresponding pixel value.
-			px := matrix[y+kOffset-ky][x+kOffset-kx]
-			for i := range px {
-				sum[i] += float64(px[i]) * kernel[ky][kx]
+			px := img.Pix[img.PixOffset(x+kOffset-kx, y+kOffset-ky):]
+			weight := kernel.Data[ky*kernel.Cols+kx]
+			for i := range sum {
+				sum[i] += float64(px[i]) * weight
 			}
 		}
 	}
 
-	// Convert the summed values back to uint32, ensuring they remain within the valid range [0, 255].
-	var result [4]uint32
-	for i := range result {
-		result[i] = uint32(math.Min(math.Max(sum[i], 0), 255))
+	// Convert the summed values back to float32, ensuring they remain within the valid range [0, 1].
+	for i := range sum {
+		out[i] = float32(math.Min(math.Max(sum[i], 0), 1))
 	}
-	return result
 }
 
-// generateGaussianKernel generates a Gaussian kernel for image blurring.
-// The Gaussian kernel is a square matrix used for the blurring effect.
-func generateGaussianKernel(size int, sigma float64) [][]float64 {
-	kernel := utils.Make2D[float64](size, size)
+// GaussianKernel returns the size x size kernel GaussianFilter convolves images with, so it can be inspected or
+// exported, for instance with utils.MatrixArray
+func GaussianKernel(size int, sigma float64) (*matrix.Dense, error) {
+	if size < 1 || size%2 == 0 {
+		return nil, fmt.Errorf("kernel size must be odd and positive, got %d", size)
+	}
+	if !(sigma > 0) { // Also refuses NaN
+		return nil, fmt.Errorf("sigma must be positive, got %v", sigma)
+	}
+	return generateGaussianKernel(size, sigma), nil
+}
 
-	sum := 0.0
+// generateGaussianKernel generates a Gaussian kernel for image blurring.
+// The Gaussian kernel is a square matrix used for the blurring effect. The two dimensional Gaussian is separable,
+// G(x, y) = g(x)·g(y), so the kernel is the outer product g·gᵀ of the one dimensional profile with itself.
+func generateGaussianKernel(size int, sigma float64) *matrix.Dense {
 	offset := size / 2
 
-	// Fill the kernel with values computed using the Gaussian function.
-	// The kernel values are based on the distance from the center, modulated by the sigma (standard deviation).
-	for y := -offset; y <= offset; y++ {
-		for x := -offset; x <= offset; x++ {
-			val := (1.0 / (2.0 * math.Pi * sigma * sigma)) * math.Exp(-(float64(x*x+y*y) / (2.0 * sigma * sigma)))
-			kernel[y+offset][x+offset] = val
-			sum += val
-		}
+	// Sample the profile g(x) = exp(-x² / 2σ²) at the distances from the center.
+	// The 1 / 2πσ² factor of the Gaussian is left out since the normalisation below cancels it.
+	profile := make([]float64, size)
+	for x := -offset; x <= offset; x++ {
+		profile[x+offset] = math.Exp(-float64(x*x) / (2.0 * sigma * sigma))
 	}
+	kernel := matrix.Outer(profile, profile)
 
 	// Normalize the kernel so that the sum of all its values equals 1.
 	// This ensures that applying the kernel to an image preserves the image's brightness.
-	for y := range kernel {
-		for x := range kernel[y] {
-			kernel[y][x] /= sum
-		}
-	}
-
-	return kernel
+	return kernel.Scale(1 / kernel.Sum())
 }
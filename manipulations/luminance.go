@@ -1,71 +1,74 @@
 package manipulations
 
 import (
-	"errors"
+	"context"
 	"math"
-	"matrix-image-manipulation/utils"
+	"matrix-image-manipulation/raster"
 )
 
 // AdjustContrast alters the contrast of an image using the formula g(u) = mu*u + b.
-func AdjustContrast(matrix [][][4]uint32, m, b float64) ([][][4]uint32, error) {
-	height := len(matrix) // Get the height of the matrix
-	if height == 0 {
-		return nil, errors.New("empty matrix")
-	}
-
-	width := len(matrix[0])
-
-	// Create a new matrix for the contrast-adjusted image.
-	contrastMatrix := utils.Make2D[[4]uint32](height, width)
-
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			var adjustedPixel [4]uint32
-			originalPixel := matrix[y][x]
+// b is expressed on the 8-bit scale [0, 255] and is scaled to the range of the image.
+func AdjustContrast[R raster.Raster](img R, m, b float64, opts ...Option) (R, error) {
+	return AdjustContrastContext(context.Background(), img, m, b, opts...)
+}
 
-			for i := 0; i < 3; i++ { // Iterate over R, G, B components (not A)
-				// Apply the contrast formula.
-				// Clamp the result to the range [0, 255].
-				adjustedValue := math.Max(math.Min(m*float64(originalPixel[i])+b, 255), 0)
-				adjustedPixel[i] = uint32(adjustedValue)
-			}
-			adjustedPixel[3] = originalPixel[3] // Preserve the alpha channel
+// AdjustContrastContext is AdjustContrast stopping with ctx.Err() as soon as ctx is cancelled
+func AdjustContrastContext[R raster.Raster](ctx context.Context, img R, m, b float64, opts ...Option) (R, error) {
+	return run(ctx, img, opts, spec{alpha: AlphaPreserve, apply: func(img *raster.Float, o options) (*raster.Float, error) {
+		return adjustContrast(img, m, b/255, o)
+	}})
+}
 
-			contrastMatrix[y][x] = adjustedPixel
-		}
-	}
+// AdjustLuminosity alters the luminosity of an image using the formula g(u) = u + b.
+// b is expressed on the 8-bit scale [0, 255] and is scaled to the range of the image.
+func AdjustLuminosity[R raster.Raster](img R, b float64, opts ...Option) (R, error) {
+	return AdjustLuminosityContext(context.Background(), img, b, opts...)
+}
 
-	return contrastMatrix, nil
+// AdjustLuminosityContext is AdjustLuminosity stopping with ctx.Err() as soon as ctx is cancelled
+func AdjustLuminosityContext[R raster.Raster](ctx context.Context, img R, b float64, opts ...Option) (R, error) {
+	return run(ctx, img, opts, spec{alpha: AlphaPreserve, apply: func(img *raster.Float, o options) (*raster.Float, error) {
+		return adjustContrast(img, 1, b/255, o) // Luminosity is the special case of contrast where m = 1
+	}})
 }
 
-// AdjustLuminosity alters the contrast of an image using the formula g(u) = mu*u + b.
-func AdjustLuminosity(matrix [][][4]uint32, b float64) ([][][4]uint32, error) {
-	height := len(matrix) // Get the height of the matrix
-	if height == 0 {
-		return nil, errors.New("empty matrix")
+// adjustContrast is the float working space implementation of AdjustContrast, b is already normalised.
+// The formula is only applied to alpha under AlphaProcess, otherwise alpha is copied.
+func adjustContrast(img *raster.Float, m, b float64, o options) (*raster.Float, error) {
+	// Create a new image for the contrast-adjusted result.
+	contrastImage, err := raster.NewFloat(img.Width, img.Height, img.Channels)
+	if err != nil {
+		return nil, err
 	}
+	contrastImage.Linear, contrastImage.Premultiplied = img.Linear, img.Premultiplied
 
-	width := len(matrix[0])
+	alpha := img.AlphaChannel()
+	err = parallelRows(img.Height, o, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < img.Width; x++ {
+				originalPixel := img.Pix[img.PixOffset(x, y) : img.PixOffset(x, y)+img.Channels]
+				adjustedPixel := contrastImage.Pix[contrastImage.PixOffset(x, y):]
 
-	// Create a new matrix for the contrast-adjusted image.
-	contrastMatrix := utils.Make2D[[4]uint32](height, width)
-
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			var adjustedPixel [4]uint32
-			originalPixel := matrix[y][x]
-
-			for i := 0; i < 3; i++ { // Iterate over R, G, B components (not A)
-				// Apply the luminosity formula.
-				// Clamp the result to the range [0, 255].
-				adjustedValue := math.Max(math.Min(float64(originalPixel[i])+b, 255), 0)
-				adjustedPixel[i] = uint32(adjustedValue)
+				for i := range originalPixel { // Iterate over the colour components, and alpha only if it should be processed
+					if i == alpha && o.alpha != AlphaProcess {
+						adjustedPixel[i] = originalPixel[i] // Preserve the alpha channel
+						continue
+					}
+					// Apply the contrast formula.
+					// Clamp the result to the range [0, 1], or to alpha for premultiplied colour.
+					upper := 1.0
+					if img.Premultiplied && i != alpha {
+						upper = float64(originalPixel[alpha])
+					}
+					adjustedValue := math.Max(math.Min(m*float64(originalPixel[i])+b, upper), 0)
+					adjustedPixel[i] = float32(adjustedValue)
+				}
 			}
-			adjustedPixel[3] = originalPixel[3] // Preserve the alpha channel
-
-			contrastMatrix[y][x] = adjustedPixel
 		}
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return contrastMatrix, nil
+	return contrastImage, nil
 }
@@ -0,0 +1,206 @@
+package manipulations
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"matrix-image-manipulation/raster"
+	"strconv"
+)
+
+// ParamKind is the type of value a parameter holds
+type ParamKind int
+
+const (
+	IntParam   ParamKind = iota // A whole number, such as a kernel size
+	FloatParam                  // A real number, such as a standard deviation
+)
+
+// String returns the name of the kind, as used in error messages
+func (k ParamKind) String() string {
+	switch k {
+	case IntParam:
+		return "int"
+	case FloatParam:
+		return "float"
+	default:
+		return fmt.Sprintf("ParamKind(%d)", int(k))
+	}
+}
+
+// Param describes a single parameter an Operation accepts
+type Param struct {
+	Name        string    // Identifies the parameter in Params
+	Description string    // A short human readable explanation
+	Kind        ParamKind // The type of value the parameter holds
+	Default     float64   // The value used when Params leaves the parameter out
+	Min, Max    float64   // The inclusive range of accepted values, ignored when both are zero
+}
+
+// Parse converts the textual form of a value, such as a command line argument, to a value of the parameter's kind
+func (p Param) Parse(s string) (float64, error) {
+	switch p.Kind {
+	case IntParam:
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("%s must be a whole number, got %q", p.Name, s)
+		}
+		return float64(v), nil
+	default:
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s must be a number, got %q", p.Name, s)
+		}
+		return v, nil
+	}
+}
+
+// validate checks that v is an acceptable value for the parameter
+func (p Param) validate(v float64) error {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Errorf("%s must be a finite number, got %v", p.Name, v)
+	}
+	if p.Kind == IntParam && v != math.Trunc(v) {
+		return fmt.Errorf("%s must be a whole number, got %v", p.Name, v)
+	}
+	if (p.Min != 0 || p.Max != 0) && (v < p.Min || v > p.Max) {
+		return fmt.Errorf("%s must be between %v and %v, got %v", p.Name, p.Min, p.Max, v)
+	}
+	return nil
+}
+
+// Params holds the values given to an Operation, keyed by parameter name. Integer parameters are stored as whole
+// float64 values so a single map holds every kind.
+type Params map[string]float64
+
+// Int returns the value of an integer parameter
+func (p Params) Int(name string) int {
+	return int(p[name])
+}
+
+// Float returns the value of a real parameter
+func (p Params) Float(name string) float64 {
+	return p[name]
+}
+
+// ResolveParams checks params against the parameters described by specs and returns a copy with the defaults filled
+// in for any parameter that was left out. Unknown names are an error, as they are most likely typos.
+func ResolveParams(specs []Param, params Params) (Params, error) {
+	resolved := make(Params, len(specs))
+	for _, spec := range specs {
+		v, ok := params[spec.Name]
+		if !ok {
+			v = spec.Default
+		}
+		if err := spec.validate(v); err != nil {
+			return nil, err
+		}
+		resolved[spec.Name] = v
+	}
+	for name := range params {
+		if _, ok := resolved[name]; !ok {
+			return nil, fmt.Errorf("unknown parameter %q", name)
+		}
+	}
+	return resolved, nil
+}
+
+// Operation is an image manipulation that can be discovered through the registry and composed into a Pipeline
+type Operation interface {
+	Name() string        // Unique identifier, such as "blur"
+	Description() string // A short human readable explanation
+	Params() []Param     // The parameters Apply accepts
+
+	// Validate checks params without touching any image, so a Pipeline can reject bad input before doing any work
+	Validate(params Params) error
+
+	// Apply runs the operation on img and returns the result, leaving img untouched
+	Apply(ctx context.Context, img *raster.Float, params Params, opts ...Option) (*raster.Float, error)
+}
+
+// builtin implements Operation for the manipulations provided by this package
+type builtin struct {
+	name        string
+	description string
+	params      []Param
+	check       func(p Params) error // Extra validation beyond each parameter's kind and range, may be nil
+	apply       func(ctx context.Context, img *raster.Float, p Params, opts []Option) (*raster.Float, error)
+}
+
+func (b *builtin) Name() string        { return b.name }
+func (b *builtin) Description() string { return b.description }
+func (b *builtin) Params() []Param     { return append([]Param(nil), b.params...) }
+
+func (b *builtin) Validate(params Params) error {
+	_, err := b.resolve(params)
+	return err
+}
+
+func (b *builtin) Apply(ctx context.Context, img *raster.Float, params Params, opts ...Option) (*raster.Float, error) {
+	resolved, err := b.resolve(params)
+	if err != nil {
+		return nil, err
+	}
+	return b.apply(ctx, img, resolved, opts)
+}
+
+// resolve validates params and fills in the defaults, naming the operation in any error
+func (b *builtin) resolve(params Params) (Params, error) {
+	resolved, err := ResolveParams(b.params, params)
+	if err == nil && b.check != nil {
+		err = b.check(resolved)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.name, err)
+	}
+	return resolved, nil
+}
+
+// The operations of this package, in the order they are registered
+var (
+	gaussianOperation = &builtin{
+		name:        "blur",
+		description: "Gaussian filter",
+		params: []Param{
+			{Name: "size", Description: "width and height of the kernel, odd", Kind: IntParam, Default: 7, Min: 1, Max: 255},
+			{Name: "sigma", Description: "standard deviation of the Gaussian", Kind: FloatParam, Default: 10.5, Min: 1e-3, Max: 1e3},
+		},
+		check: func(p Params) error {
+			if p.Int("size")%2 == 0 {
+				return fmt.Errorf("size must be odd, got %d", p.Int("size"))
+			}
+			return nil
+		},
+		apply: func(ctx context.Context, img *raster.Float, p Params, opts []Option) (*raster.Float, error) {
+			return GaussianFilterContext(ctx, img, p.Int("size"), p.Float("sigma"), opts...)
+		},
+	}
+	greyScaleOperation = &builtin{
+		name:        "grey",
+		description: "Convert to greyscale",
+		apply: func(ctx context.Context, img *raster.Float, p Params, opts []Option) (*raster.Float, error) {
+			return ConvertToGreyScaleContext(ctx, img, opts...)
+		},
+	}
+	contrastOperation = &builtin{
+		name:        "contrast",
+		description: "Adjust contrast with g(u) = mu + b",
+		params: []Param{
+			{Name: "m", Description: "slope", Kind: FloatParam, Default: 1},
+			{Name: "b", Description: "offset on the 8-bit scale", Kind: FloatParam, Default: 0},
+		},
+		apply: func(ctx context.Context, img *raster.Float, p Params, opts []Option) (*raster.Float, error) {
+			return AdjustContrastContext(ctx, img, p.Float("m"), p.Float("b"), opts...)
+		},
+	}
+	luminosityOperation = &builtin{
+		name:        "luminosity",
+		description: "Adjust luminosity with g(u) = u + b",
+		params: []Param{
+			{Name: "b", Description: "offset on the 8-bit scale", Kind: FloatParam, Default: 0},
+		},
+		apply: func(ctx context.Context, img *raster.Float, p Params, opts []Option) (*raster.Float, error) {
+			return AdjustLuminosityContext(ctx, img, p.Float("b"), opts...)
+		},
+	}
+)
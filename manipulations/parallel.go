@@ -0,0 +1,73 @@
+package manipulations
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// chunksPerWorker is how many bands of rows each worker processes on average. Several smaller bands balance the load
+// when some rows are cheaper than others, such as the untouched border of a filter.
+const chunksPerWorker = 4
+
+// maxChunkHeight caps the height of a band, so cancellation is noticed and progress reported regularly even when a
+// single worker processes a large image
+const maxChunkHeight = 32
+
+// ProgressFunc receives how many units of work, rows for operations and tiles for the tiled engine, are complete out of
+// the total. It is never called concurrently and done only grows.
+type ProgressFunc func(done, total int)
+
+// Workers sets how many goroutines an operation splits its rows across. Zero or less, the default, uses one worker per
+// CPU as reported by runtime.GOMAXPROCS, and 1 processes the image serially. The result is identical either way, as
+// every pixel is computed on its own.
+func Workers(n int) Option {
+	return func(o *options) {
+		o.workers = n
+	}
+}
+
+// WithProgress makes an operation report how many rows it has processed to fn
+func WithProgress(fn ProgressFunc) Option {
+	return func(o *options) {
+		o.progress = fn
+	}
+}
+
+// parallelRows calls fn for consecutive bands [y0, y1) covering the rows [0, height), spread over the number of workers
+// requested in o. fn must only write to the rows it is given. Between bands it reports progress and checks the
+// context, returning ctx.Err() once it is cancelled without starting any further band.
+func parallelRows(height int, o options, fn func(y0, y1 int)) error {
+	ctx := o.context()
+	workers := o.workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = max(min(workers, height), 1)
+
+	chunkHeight := min(max(height/(workers*chunksPerWorker), 1), maxChunkHeight)
+	chunks := (height + chunkHeight - 1) / chunkHeight
+
+	var next atomic.Int64 // Index of the next chunk to be claimed
+	var mu sync.Mutex     // Serialises the progress callback
+	done := 0
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := int(next.Add(1) - 1); chunk < chunks && ctx.Err() == nil; chunk = int(next.Add(1) - 1) {
+				y0, y1 := chunk*chunkHeight, min((chunk+1)*chunkHeight, height)
+				fn(y0, y1)
+				if o.progress != nil {
+					mu.Lock()
+					done += y1 - y0
+					o.progress(done, height)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
@@ -0,0 +1,96 @@
+package manipulations
+
+import (
+	"context"
+	"fmt"
+	"matrix-image-manipulation/raster"
+)
+
+// Step is a single operation of a Pipeline with the parameters and options it runs with
+type Step struct {
+	Operation Operation
+	Params    Params
+	Options   []Option
+}
+
+// Pipeline chains operations, feeding the result of each one to the next.
+// The image stays in the float working space from the first step to the last, so it is only rounded once.
+type Pipeline struct {
+	Steps []Step
+}
+
+// Then appends an operation to the pipeline and returns the pipeline, so calls can be chained
+func (p *Pipeline) Then(op Operation, params Params, opts ...Option) *Pipeline {
+	p.Steps = append(p.Steps, Step{Operation: op, Params: params, Options: opts})
+	return p
+}
+
+// ThenNamed appends the registered operation with the given name, see Lookup
+func (p *Pipeline) ThenNamed(name string, params Params, opts ...Option) (*Pipeline, error) {
+	op, ok := Lookup(name)
+	if !ok {
+		return p, fmt.Errorf("unknown operation %q", name)
+	}
+	return p.Then(op, params, opts...), nil
+}
+
+// Validate checks the parameters of every step
+func (p *Pipeline) Validate() error {
+	for i, step := range p.Steps {
+		if step.Operation == nil {
+			return fmt.Errorf("step %d has no operation", i+1)
+		}
+		if err := step.Operation.Validate(step.Params); err != nil {
+			return fmt.Errorf("step %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Apply validates every step and then runs them in order on img. No step runs if any of them is invalid.
+func (p *Pipeline) Apply(ctx context.Context, img *raster.Float) (*raster.Float, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	result := img
+	for i, step := range p.Steps {
+		var err error
+		result, err = step.Operation.Apply(ctx, result, step.Params, step.Options...)
+		if err != nil {
+			return nil, fmt.Errorf("step %d (%s): %w", i+1, step.Operation.Name(), err)
+		}
+	}
+	if len(p.Steps) == 0 {
+		return img.Clone(), nil // Like the operations, never hand back the input itself
+	}
+	return result, nil
+}
+
+// ApplyImage runs the pipeline on an integer image, converting it to floats once before the first step and quantising
+// the result back to the same bit depth after the last one. The result keeps the metadata of img.
+func (p *Pipeline) ApplyImage(ctx context.Context, img *raster.Image) (*raster.Image, error) {
+	if err := validateInput(img); err != nil {
+		return nil, err
+	}
+	result, err := p.Apply(ctx, img.ToFloat())
+	if err != nil {
+		return nil, err
+	}
+	out, err := result.ToImage(img.Depth)
+	if err != nil {
+		return nil, err
+	}
+	out.Metadata = img.Metadata.Clone()
+	return out, nil
+}
+
+// ApplySequence runs the pipeline on every frame of an animation, keeping the timing, disposal and loop count.
+// Invalid steps are reported before the first frame is processed.
+func (p *Pipeline) ApplySequence(ctx context.Context, sequence *raster.Sequence) (*raster.Sequence, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return sequence.Map(func(img *raster.Image) (*raster.Image, error) {
+		return p.ApplyImage(ctx, img)
+	})
+}
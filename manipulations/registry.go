@@ -0,0 +1,53 @@
+package manipulations
+
+import (
+	"sync"
+)
+
+// registry holds every Operation available by name, in the order they were registered
+var registry struct {
+	sync.RWMutex
+	byName map[string]Operation
+	order  []Operation
+}
+
+func init() {
+	for _, op := range []Operation{gaussianOperation, greyScaleOperation, contrastOperation, luminosityOperation} {
+		Register(op)
+	}
+}
+
+// Register makes an operation available through Lookup and Operations, usually from the init function of the package
+// that provides it. Like sql.Register, it panics if op is nil or if an operation with the same name is already
+// registered, since both are programming errors.
+func Register(op Operation) {
+	if op == nil {
+		panic("manipulations: Register of a nil operation")
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.byName == nil {
+		registry.byName = make(map[string]Operation)
+	}
+	if _, dup := registry.byName[op.Name()]; dup {
+		panic("manipulations: Register called twice for operation " + op.Name())
+	}
+	registry.byName[op.Name()] = op
+	registry.order = append(registry.order, op)
+}
+
+// Lookup returns the registered operation with the given name
+func Lookup(name string) (Operation, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	op, ok := registry.byName[name]
+	return op, ok
+}
+
+// Operations returns every registered operation in the order they were registered, starting with the ones provided
+// by this package
+func Operations() []Operation {
+	registry.RLock()
+	defer registry.RUnlock()
+	return append([]Operation(nil), registry.order...)
+}
@@ -0,0 +1,29 @@
+package matrix
+
+// Convolve returns the discrete convolution of the matrix with kernel, (m * k)(i, j) = Σ m(i-a, j-b)·k(a, b), with
+// the kernel centred on each element. The result has the dimensions of m and elements outside m count as zero.
+// The kernel is flipped, as convolution requires, which makes no difference for symmetric kernels such as a Gaussian.
+func (m *Dense) Convolve(kernel *Dense) *Dense {
+	result := Must(New(m.Rows, m.Cols))
+	ci, cj := kernel.Rows/2, kernel.Cols/2
+	for i := 0; i < m.Rows; i++ {
+		for j := 0; j < m.Cols; j++ {
+			sum := 0.0
+			for a := 0; a < kernel.Rows; a++ {
+				si := i + ci - a
+				if si < 0 || si >= m.Rows {
+					continue
+				}
+				for b := 0; b < kernel.Cols; b++ {
+					sj := j + cj - b
+					if sj < 0 || sj >= m.Cols {
+						continue
+					}
+					sum += m.Data[si*m.Cols+sj] * kernel.Data[a*kernel.Cols+b]
+				}
+			}
+			result.Data[i*result.Cols+j] = sum
+		}
+	}
+	return result
+}
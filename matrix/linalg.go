@@ -0,0 +1,156 @@
+package matrix
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrSingular is returned when inverting a matrix whose determinant is zero
+var ErrSingular = errors.New("matrix is singular")
+
+// singularTolerance is the pivot magnitude, relative to the largest element, below which a matrix is treated as singular
+const singularTolerance = 1e-12
+
+// Det returns the determinant of a square matrix. It is computed by LU decomposition with partial pivoting, which is
+// exact enough for the small matrices used by kernels and transforms.
+func (m *Dense) Det() (float64, error) {
+	if m.Rows != m.Cols {
+		return 0, fmt.Errorf("%w: the determinant of a %dx%d matrix is undefined", ErrShape, m.Rows, m.Cols)
+	}
+	lu := m.Clone()
+	n := m.Rows
+	det := 1.0
+	for k := 0; k < n; k++ {
+		pivot := lu.pivot(k)
+		if lu.Data[pivot*n+k] == 0 {
+			return 0, nil
+		}
+		if pivot != k {
+			lu.swapRows(pivot, k)
+			det = -det
+		}
+		det *= lu.Data[k*n+k]
+		lu.eliminate(k, k+1)
+	}
+	return det, nil
+}
+
+// Inverse returns the inverse of a square matrix by Gauss-Jordan elimination with partial pivoting
+func (m *Dense) Inverse() (*Dense, error) {
+	if m.Rows != m.Cols {
+		return nil, fmt.Errorf("%w: a %dx%d matrix has no inverse", ErrShape, m.Rows, m.Cols)
+	}
+	n := m.Rows
+	scale := m.Norm(MaxNorm)
+
+	// Reduce [m | I] to [I | m⁻¹]
+	augmented := Must(New(n, 2*n))
+	for i := 0; i < n; i++ {
+		copy(augmented.Data[i*2*n:], m.Data[i*n:(i+1)*n])
+		augmented.Data[i*2*n+n+i] = 1
+	}
+	for k := 0; k < n; k++ {
+		pivot := augmented.pivot(k)
+		if math.Abs(augmented.Data[pivot*2*n+k]) <= singularTolerance*scale {
+			return nil, ErrSingular
+		}
+		augmented.swapRows(pivot, k)
+
+		row := augmented.Data[k*2*n : (k+1)*2*n]
+		p := row[k]
+		for j := range row {
+			row[j] /= p
+		}
+		augmented.eliminate(k, 0)
+	}
+
+	inverse := Must(New(n, n))
+	for i := 0; i < n; i++ {
+		copy(inverse.Data[i*n:(i+1)*n], augmented.Data[i*2*n+n:(i+1)*2*n])
+	}
+	return inverse, nil
+}
+
+// pivot returns the row at or below k with the largest magnitude in column k
+func (m *Dense) pivot(k int) int {
+	best := k
+	for i := k + 1; i < m.Rows; i++ {
+		if math.Abs(m.Data[i*m.Cols+k]) > math.Abs(m.Data[best*m.Cols+k]) {
+			best = i
+		}
+	}
+	return best
+}
+
+// swapRows exchanges rows a and b in place
+func (m *Dense) swapRows(a, b int) {
+	if a == b {
+		return
+	}
+	ra, rb := m.Data[a*m.Cols:(a+1)*m.Cols], m.Data[b*m.Cols:(b+1)*m.Cols]
+	for j := range ra {
+		ra[j], rb[j] = rb[j], ra[j]
+	}
+}
+
+// eliminate subtracts multiples of row k from every row from start onwards, except k itself, to zero column k
+func (m *Dense) eliminate(k, start int) {
+	pivot := m.Data[k*m.Cols : (k+1)*m.Cols]
+	for i := start; i < m.Rows; i++ {
+		if i == k {
+			continue
+		}
+		row := m.Data[i*m.Cols : (i+1)*m.Cols]
+		factor := row[k] / pivot[k]
+		if factor == 0 {
+			continue
+		}
+		for j := k; j < m.Cols; j++ {
+			row[j] -= factor * pivot[j]
+		}
+	}
+}
+
+// NormKind selects the norm computed by Norm
+type NormKind int
+
+const (
+	FrobeniusNorm NormKind = iota // Square root of the sum of the squared elements
+	OneNorm                       // Largest sum of absolute values in a column
+	InfNorm                       // Largest sum of absolute values in a row
+	MaxNorm                       // Largest absolute value of any element
+)
+
+// Norm returns the requested norm of the matrix, 0 for an empty matrix
+func (m *Dense) Norm(kind NormKind) float64 {
+	norm := 0.0
+	switch kind {
+	case FrobeniusNorm:
+		for _, v := range m.Data {
+			norm += v * v
+		}
+		return math.Sqrt(norm)
+	case OneNorm:
+		for j := 0; j < m.Cols; j++ {
+			sum := 0.0
+			for i := 0; i < m.Rows; i++ {
+				sum += math.Abs(m.Data[i*m.Cols+j])
+			}
+			norm = math.Max(norm, sum)
+		}
+	case InfNorm:
+		for i := 0; i < m.Rows; i++ {
+			sum := 0.0
+			for _, v := range m.Data[i*m.Cols : (i+1)*m.Cols] {
+				sum += math.Abs(v)
+			}
+			norm = math.Max(norm, sum)
+		}
+	case MaxNorm:
+		for _, v := range m.Data {
+			norm = math.Max(norm, math.Abs(v))
+		}
+	}
+	return norm
+}
@@ -0,0 +1,255 @@
+// Package matrix provides the dense matrices the operations are built on, so the code follows the equations of the
+// paper: kernels are outer products, colour conversions are matrix products and geometric transforms are affine
+// matrices in homogeneous coordinates.
+package matrix
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrShape is returned when the dimensions of the operands don't allow an operation
+var ErrShape = errors.New("incompatible matrix dimensions")
+
+// Dense is a matrix of float64 values.
+//
+// Elements are stored in row-major order, the element in row i and column j is Data[i*Cols+j], the same layout
+// raster.Image uses for its pixels.
+type Dense struct {
+	Rows int       // Number of rows
+	Cols int       // Number of columns
+	Data []float64 // The elements, row by row
+}
+
+// New creates a zeroed rows x cols matrix
+func New(rows, cols int) (*Dense, error) {
+	if rows < 0 || cols < 0 {
+		return nil, fmt.Errorf("invalid dimensions %dx%d", rows, cols)
+	}
+	return &Dense{Rows: rows, Cols: cols, Data: make([]float64, rows*cols)}, nil
+}
+
+// Must returns m, panicking if err is not nil. It wraps calls whose dimensions are known to be compatible, such as
+// products of the 3x3 transforms in this package, like template.Must.
+func Must(m *Dense, err error) *Dense {
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Identity creates the n x n identity matrix
+func Identity(n int) *Dense {
+	m := Must(New(n, n))
+	for i := 0; i < n; i++ {
+		m.Data[i*n+i] = 1
+	}
+	return m
+}
+
+// FromRows copies a slice of rows into a new matrix, every row must have the same length
+func FromRows(rows [][]float64) (*Dense, error) {
+	cols := 0
+	if len(rows) > 0 {
+		cols = len(rows[0])
+	}
+	m, err := New(len(rows), cols)
+	if err != nil {
+		return nil, err
+	}
+	for i, row := range rows {
+		if len(row) != cols { // Ragged rows have no meaningful width
+			return nil, fmt.Errorf("row %d has %d elements, expected %d", i, len(row), cols)
+		}
+		copy(m.Data[i*cols:], row)
+	}
+	return m, nil
+}
+
+// Vector creates a column vector holding the given values
+func Vector(values ...float64) *Dense {
+	return &Dense{Rows: len(values), Cols: 1, Data: append([]float64(nil), values...)}
+}
+
+// Dims returns the number of rows and columns
+func (m *Dense) Dims() (rows, cols int) {
+	return m.Rows, m.Cols
+}
+
+// At returns the element in row i and column j, it panics if either is out of range like indexing a slice does
+func (m *Dense) At(i, j int) float64 {
+	m.checkIndex(i, j)
+	return m.Data[i*m.Cols+j]
+}
+
+// Set changes the element in row i and column j, it panics if either is out of range like indexing a slice does
+func (m *Dense) Set(i, j int, v float64) {
+	m.checkIndex(i, j)
+	m.Data[i*m.Cols+j] = v
+}
+
+// checkIndex panics if (i, j) lies outside the matrix, a column index past the end would otherwise silently wrap
+// into the next row
+func (m *Dense) checkIndex(i, j int) {
+	if i < 0 || j < 0 || i >= m.Rows || j >= m.Cols {
+		panic(fmt.Sprintf("matrix: index (%d, %d) out of range for a %dx%d matrix", i, j, m.Rows, m.Cols))
+	}
+}
+
+// shape formats the dimensions of the matrix for error messages
+func (m *Dense) shape() string {
+	return fmt.Sprintf("%dx%d", m.Rows, m.Cols)
+}
+
+// Row returns a copy of row i
+func (m *Dense) Row(i int) []float64 {
+	m.checkIndex(i, 0)
+	return append([]float64(nil), m.Data[i*m.Cols:(i+1)*m.Cols]...)
+}
+
+// ToRows copies the matrix into a slice of rows, the inverse of FromRows
+func (m *Dense) ToRows() [][]float64 {
+	rows := make([][]float64, m.Rows)
+	for i := range rows {
+		rows[i] = m.Data[i*m.Cols : (i+1)*m.Cols : (i+1)*m.Cols]
+	}
+	return rows
+}
+
+// Clone returns a deep copy of the matrix
+func (m *Dense) Clone() *Dense {
+	return &Dense{Rows: m.Rows, Cols: m.Cols, Data: append([]float64(nil), m.Data...)}
+}
+
+// Equal reports whether both matrices have the same dimensions and every pair of elements differs by at most tolerance
+func (m *Dense) Equal(other *Dense, tolerance float64) bool {
+	if m.Rows != other.Rows || m.Cols != other.Cols {
+		return false
+	}
+	for i, v := range m.Data {
+		if math.Abs(v-other.Data[i]) > tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the matrix one row per line, for debugging and test failures
+func (m *Dense) String() string {
+	s := ""
+	for i := 0; i < m.Rows; i++ {
+		s += fmt.Sprint(m.Data[i*m.Cols : (i+1)*m.Cols])
+		if i < m.Rows-1 {
+			s += "\n"
+		}
+	}
+	return s
+}
+
+// T returns the transpose of the matrix, the element in row i and column j moves to row j and column i
+func (m *Dense) T() *Dense {
+	t := Must(New(m.Cols, m.Rows))
+	for i := 0; i < m.Rows; i++ {
+		for j := 0; j < m.Cols; j++ {
+			t.Data[j*t.Cols+i] = m.Data[i*m.Cols+j]
+		}
+	}
+	return t
+}
+
+// Mul returns the matrix product m·other, m must have as many columns as other has rows
+func (m *Dense) Mul(other *Dense) (*Dense, error) {
+	if m.Cols != other.Rows {
+		return nil, fmt.Errorf("%w: cannot multiply %dx%d by %dx%d", ErrShape, m.Rows, m.Cols, other.Rows, other.Cols)
+	}
+	product := Must(New(m.Rows, other.Cols))
+	for i := 0; i < m.Rows; i++ {
+		out := product.Data[i*product.Cols : (i+1)*product.Cols]
+		for k := 0; k < m.Cols; k++ {
+			a := m.Data[i*m.Cols+k]
+			for j, b := range other.Data[k*other.Cols : (k+1)*other.Cols] {
+				out[j] += a * b
+			}
+		}
+	}
+	return product, nil
+}
+
+// MulVecTo computes the product of the matrix and the column vector x into dst without allocating, which suits
+// transforming every pixel of an image. x must hold Cols values and dst Rows values.
+func (m *Dense) MulVecTo(dst, x []float64) error {
+	if len(x) != m.Cols || len(dst) != m.Rows {
+		return fmt.Errorf("%w: cannot multiply %dx%d by a vector of %d into %d values", ErrShape, m.Rows, m.Cols, len(x), len(dst))
+	}
+	for i := range dst {
+		sum := 0.0
+		for j, v := range m.Data[i*m.Cols : (i+1)*m.Cols] {
+			sum += v * x[j]
+		}
+		dst[i] = sum
+	}
+	return nil
+}
+
+// elementWise combines two matrices of the same dimensions element by element
+func (m *Dense) elementWise(other *Dense, name string, fn func(a, b float64) float64) (*Dense, error) {
+	if m.Rows != other.Rows || m.Cols != other.Cols {
+		return nil, fmt.Errorf("%w: cannot %s %dx%d and %dx%d", ErrShape, name, m.Rows, m.Cols, other.Rows, other.Cols)
+	}
+	result := m.Clone()
+	for i, b := range other.Data {
+		result.Data[i] = fn(result.Data[i], b)
+	}
+	return result, nil
+}
+
+// Add returns the element-wise sum m + other
+func (m *Dense) Add(other *Dense) (*Dense, error) {
+	return m.elementWise(other, "add", func(a, b float64) float64 { return a + b })
+}
+
+// Sub returns the element-wise difference m - other
+func (m *Dense) Sub(other *Dense) (*Dense, error) {
+	return m.elementWise(other, "subtract", func(a, b float64) float64 { return a - b })
+}
+
+// MulElem returns the element-wise, or Hadamard, product of m and other
+func (m *Dense) MulElem(other *Dense) (*Dense, error) {
+	return m.elementWise(other, "multiply element-wise", func(a, b float64) float64 { return a * b })
+}
+
+// Scale returns the matrix with every element multiplied by s
+func (m *Dense) Scale(s float64) *Dense {
+	return m.Apply(func(v float64) float64 { return v * s })
+}
+
+// Apply returns the matrix with fn applied to every element
+func (m *Dense) Apply(fn func(v float64) float64) *Dense {
+	result := m.Clone()
+	for i, v := range result.Data {
+		result.Data[i] = fn(v)
+	}
+	return result
+}
+
+// Sum returns the sum of every element
+func (m *Dense) Sum() float64 {
+	sum := 0.0
+	for _, v := range m.Data {
+		sum += v
+	}
+	return sum
+}
+
+// Outer returns the outer product u·vᵀ of two vectors, a len(u) x len(v) matrix. A separable kernel, such as a
+// Gaussian, is the outer product of its one dimensional profiles.
+func Outer(u, v []float64) *Dense {
+	m := Must(New(len(u), len(v)))
+	for i, a := range u {
+		for j, b := range v {
+			m.Data[i*m.Cols+j] = a * b
+		}
+	}
+	return m
+}
@@ -0,0 +1,53 @@
+package matrix
+
+import (
+	"math"
+)
+
+// The constructors below return 3x3 affine transforms in homogeneous coordinates, acting on column vectors
+// [x y 1]ᵀ. Transforms compose by multiplication, A·B applies B first and then A, so a rotation about the origin
+// followed by a translation is Must(Translation(tx, ty).Mul(Rotation(theta))).
+
+// Translation returns the transform that moves every point by (tx, ty)
+func Translation(tx, ty float64) *Dense {
+	m := Identity(3)
+	m.Data[2], m.Data[5] = tx, ty
+	return m
+}
+
+// Scaling returns the transform that scales x by sx and y by sy about the origin, a negative factor mirrors the axis
+func Scaling(sx, sy float64) *Dense {
+	m := Identity(3)
+	m.Data[0], m.Data[4] = sx, sy
+	return m
+}
+
+// Rotation returns the transform that rotates points by theta radians about the origin. In image coordinates, where
+// y grows downwards, a positive angle turns clockwise. Quarter turns are exact, the sine and cosine are snapped to
+// 0 and ±1 so pixel coordinates map onto pixel coordinates.
+func Rotation(theta float64) *Dense {
+	sin, cos := math.Sincos(theta)
+	sin, cos = snap(sin), snap(cos)
+	m := Identity(3)
+	m.Data[0], m.Data[1] = cos, -sin
+	m.Data[3], m.Data[4] = sin, cos
+	return m
+}
+
+// snap rounds values within rounding error of 0, 1 or -1 to them
+func snap(v float64) float64 {
+	if r := math.Round(v); math.Abs(v-r) < 1e-12 {
+		return r
+	}
+	return v
+}
+
+// TransformPoint applies a 3x3 affine transform to the point (x, y), it panics for any other shape
+func (m *Dense) TransformPoint(x, y float64) (float64, float64) {
+	if m.Rows != 3 || m.Cols != 3 {
+		panic("matrix: TransformPoint of a " + m.shape() + " matrix")
+	}
+	d := m.Data
+	w := d[6]*x + d[7]*y + d[8]
+	return (d[0]*x + d[1]*y + d[2]) / w, (d[3]*x + d[4]*y + d[5]) / w
+}
@@ -0,0 +1,96 @@
+package raster
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The channel layouts Image and Float understand. Any other count is treated as that many independent bands without
+// alpha, such as multispectral data.
+const (
+	Grey      = 1 // A single intensity channel, also used for masks and depth maps
+	GreyAlpha = 2 // Intensity followed by alpha
+	RGB       = 3 // Red, green and blue
+	RGBA      = 4 // Red, green and blue followed by alpha
+)
+
+// alphaChannel returns the index of the alpha channel for a channel count, or -1 if that layout has no alpha
+func alphaChannel(channels int) int {
+	if channels == GreyAlpha || channels == RGBA {
+		return channels - 1
+	}
+	return -1
+}
+
+// AlphaChannel returns the index of the alpha channel within a pixel, or -1 if the image has no alpha
+func (img *Image) AlphaChannel() int {
+	return alphaChannel(img.Channels)
+}
+
+// HasAlpha reports whether the image has an alpha channel
+func (img *Image) HasAlpha() bool {
+	return img.AlphaChannel() >= 0
+}
+
+// HasAlpha reports whether the image has an alpha channel
+func (f *Float) HasAlpha() bool {
+	return f.AlphaChannel() >= 0
+}
+
+// Channel returns a new single-channel image holding a copy of channel c
+func (img *Image) Channel(c int) (*Image, error) {
+	if c < 0 || c >= img.Channels {
+		return nil, fmt.Errorf("channel %d does not exist in a %d channel image", c, img.Channels)
+	}
+
+	band, err := New(img.Width, img.Height, Grey, img.Depth)
+	if err != nil {
+		return nil, err
+	}
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			band.Pix[band.PixOffset(x, y)] = img.Pix[img.PixOffset(x, y)+c]
+		}
+	}
+	return band, nil
+}
+
+// SplitChannels returns every channel of the image as its own single-channel image
+func (img *Image) SplitChannels() []*Image {
+	bands := make([]*Image, img.Channels)
+	for c := range bands {
+		bands[c], _ = img.Channel(c) // c is always in range
+	}
+	return bands
+}
+
+// MergeChannels interleaves the channels of several images into one, the inverse of SplitChannels.
+// Every image must have the same dimensions and bit depth, and the result has as many channels as they do combined.
+func MergeChannels(images ...*Image) (*Image, error) {
+	if len(images) == 0 {
+		return nil, errors.New("no images to merge")
+	}
+
+	first, channels := images[0], 0
+	for i, img := range images {
+		if img.Width != first.Width || img.Height != first.Height || img.Depth != first.Depth {
+			return nil, fmt.Errorf("image %d is %dx%d at %d bits, expected %dx%d at %d bits",
+				i, img.Width, img.Height, img.Depth, first.Width, first.Height, first.Depth)
+		}
+		channels += img.Channels
+	}
+
+	merged, err := New(first.Width, first.Height, channels, first.Depth)
+	if err != nil {
+		return nil, err
+	}
+	for y := 0; y < merged.Height; y++ {
+		for x := 0; x < merged.Width; x++ {
+			out := merged.Pix[merged.PixOffset(x, y):]
+			for _, img := range images {
+				out = out[copy(out, img.Pix[img.PixOffset(x, y):img.PixOffset(x, y)+img.Channels]):]
+			}
+		}
+	}
+	return merged, nil
+}
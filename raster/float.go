@@ -0,0 +1,291 @@
+package raster
+
+import (
+	"fmt"
+	"math"
+)
+
+// Float is the floating-point working representation of an Image.
+//
+// It shares Image's row-major layout, the samples of the pixel at (x, y) start at Pix[y*Stride+x*Channels], but every
+// sample is normalised to the range [0, 1] regardless of the bit depth it came from. Chaining operations on a Float
+// avoids the rounding an Image suffers after every step, so conversion back to integers should only happen when writing.
+type Float struct {
+	Pix      []float32 // The samples of every pixel, normalised to [0, 1]
+	Stride   int       // Distance in Pix between two vertically adjacent pixels
+	Width    int       // Number of columns
+	Height   int       // Number of rows
+	Channels int       // Number of samples per pixel
+	Linear   bool      // Whether the colour channels hold linear-light values rather than sRGB-encoded ones
+
+	// Premultiplied records whether the colour channels have been multiplied by alpha, see Premultiply
+	Premultiplied bool
+}
+
+// Raster is the constraint satisfied by both pixel containers, it allows operations to accept either of them
+type Raster interface {
+	*Image | *Float
+}
+
+// NewFloat creates a zeroed, sRGB-encoded float image with the given dimensions and channel count
+func NewFloat(width, height, channels int) (*Float, error) {
+	if err := CheckSize(width, height, channels); err != nil {
+		return nil, err
+	}
+	return &Float{
+		Pix:      make([]float32, width*height*channels),
+		Stride:   width * channels,
+		Width:    width,
+		Height:   height,
+		Channels: channels,
+	}, nil
+}
+
+// ToFloat converts the image to the float working representation, dividing every sample by MaxValue
+func (img *Image) ToFloat() *Float {
+	f := &Float{
+		Pix:      make([]float32, img.Width*img.Height*img.Channels),
+		Stride:   img.Width * img.Channels,
+		Width:    img.Width,
+		Height:   img.Height,
+		Channels: img.Channels,
+	}
+	scale := 1 / float32(img.MaxValue())
+	for y := 0; y < img.Height; y++ {
+		row := img.Pix[img.PixOffset(0, y) : img.PixOffset(0, y)+f.Stride]
+		out := f.Pix[f.PixOffset(0, y):]
+		for i, sample := range row {
+			out[i] = float32(sample) * scale
+		}
+	}
+	return f
+}
+
+// ToImage quantises the float image to the given bit depth, rounding to the nearest value and clamping to [0, 1].
+// Premultiplied images are unpremultiplied and linear-light images are encoded back to sRGB first, as Image holds
+// straight, sRGB-encoded samples like the files it is read from.
+func (f *Float) ToImage(depth int) (*Image, error) {
+	if f.Premultiplied {
+		f = f.Unpremultiply()
+	}
+	if f.Linear {
+		f = f.ToSRGB()
+	}
+	img, err := New(f.Width, f.Height, f.Channels, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	maxValue := float64(img.MaxValue())
+	for y := 0; y < f.Height; y++ {
+		row := f.Pix[f.PixOffset(0, y) : f.PixOffset(0, y)+img.Stride]
+		out := img.Pix[img.PixOffset(0, y):]
+		for i, sample := range row {
+			out[i] = uint32(math.Round(math.Min(math.Max(float64(sample), 0), 1) * maxValue))
+		}
+	}
+	return img, nil
+}
+
+// SRGBToLinear decodes a normalised sRGB-encoded value to linear light, following IEC 61966-2-1
+func SRGBToLinear(v float32) float32 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return float32(math.Pow((float64(v)+0.055)/1.055, 2.4))
+}
+
+// LinearToSRGB encodes a normalised linear-light value to sRGB, the inverse of SRGBToLinear
+func LinearToSRGB(v float32) float32 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return float32(1.055*math.Pow(float64(v), 1/2.4) - 0.055)
+}
+
+// ToLinear returns a copy of the image with its colour channels decoded to linear light, alpha is left untouched.
+// An image that is already linear is simply copied.
+func (f *Float) ToLinear() *Float {
+	if f.Linear {
+		return f.Clone()
+	}
+	linear := f.mapColour(SRGBToLinear)
+	linear.Linear = true
+	return linear
+}
+
+// ToSRGB returns a copy of the image with its colour channels encoded to sRGB, alpha is left untouched.
+// An image that is already sRGB-encoded is simply copied.
+func (f *Float) ToSRGB() *Float {
+	if !f.Linear {
+		return f.Clone()
+	}
+	encoded := f.mapColour(LinearToSRGB)
+	encoded.Linear = false
+	return encoded
+}
+
+// mapColour returns a copy of the image with fn applied to every straight colour sample, skipping the alpha channel.
+// Premultiplied images are unpremultiplied around the call since the transfer functions aren't linear.
+func (f *Float) mapColour(fn func(float32) float32) *Float {
+	if f.Premultiplied {
+		return f.Unpremultiply().mapColour(fn).Premultiply()
+	}
+
+	out := f.Clone()
+	alpha := out.AlphaChannel()
+	for y := 0; y < out.Height; y++ {
+		for x := 0; x < out.Width; x++ {
+			pixel := out.Pix[out.PixOffset(x, y) : out.PixOffset(x, y)+out.Channels]
+			for c := range pixel {
+				if c == alpha { // The alpha channel is never gamma-encoded
+					continue
+				}
+				pixel[c] = fn(pixel[c])
+			}
+		}
+	}
+	return out
+}
+
+// AlphaChannel returns the index of the alpha channel within a pixel, or -1 if the image has no alpha
+func (f *Float) AlphaChannel() int {
+	return alphaChannel(f.Channels)
+}
+
+// Premultiply returns a copy of the image with every colour sample multiplied by the pixel's alpha.
+// Filters that mix neighbouring pixels must work on premultiplied samples, otherwise the colour of fully transparent
+// pixels, which is invisible, bleeds into the visible ones. Images without alpha or already premultiplied are copied.
+func (f *Float) Premultiply() *Float {
+	out := f.Clone()
+	alpha := out.AlphaChannel()
+	if alpha < 0 || f.Premultiplied {
+		return out
+	}
+
+	for y := 0; y < out.Height; y++ {
+		for x := 0; x < out.Width; x++ {
+			pixel := out.Pix[out.PixOffset(x, y) : out.PixOffset(x, y)+out.Channels]
+			for c := range pixel {
+				if c != alpha {
+					pixel[c] *= pixel[alpha]
+				}
+			}
+		}
+	}
+	out.Premultiplied = true
+	return out
+}
+
+// Unpremultiply returns a copy of the image with every colour sample divided by the pixel's alpha, the inverse of
+// Premultiply. Fully transparent pixels have no recoverable colour and become black.
+func (f *Float) Unpremultiply() *Float {
+	out := f.Clone()
+	alpha := out.AlphaChannel()
+	if alpha < 0 || !f.Premultiplied {
+		return out
+	}
+
+	for y := 0; y < out.Height; y++ {
+		for x := 0; x < out.Width; x++ {
+			pixel := out.Pix[out.PixOffset(x, y) : out.PixOffset(x, y)+out.Channels]
+			for c := range pixel {
+				if c == alpha {
+					continue
+				}
+				if pixel[alpha] > 0 {
+					pixel[c] = min(pixel[c]/pixel[alpha], 1) // Clamp as rounding can push the quotient slightly above 1
+				} else {
+					pixel[c] = 0
+				}
+			}
+		}
+	}
+	out.Premultiplied = false
+	return out
+}
+
+// Empty reports whether the image has no pixels
+func (f *Float) Empty() bool {
+	return f.Width <= 0 || f.Height <= 0
+}
+
+// InBounds reports whether (x, y) lies inside the image
+func (f *Float) InBounds(x, y int) bool {
+	return x >= 0 && y >= 0 && x < f.Width && y < f.Height
+}
+
+// PixOffset returns the index in Pix of the first sample of the pixel at (x, y), without checking bounds
+func (f *Float) PixOffset(x, y int) int {
+	return y*f.Stride + x*f.Channels
+}
+
+// Pixel returns a copy of the samples of the pixel at (x, y)
+func (f *Float) Pixel(x, y int) ([]float32, error) {
+	if !f.InBounds(x, y) {
+		return nil, fmt.Errorf("%w: (%d, %d) in %dx%d image", ErrOutOfBounds, x, y, f.Width, f.Height)
+	}
+	pixel := make([]float32, f.Channels)
+	copy(pixel, f.Pix[f.PixOffset(x, y):])
+	return pixel, nil
+}
+
+// SetPixel overwrites the samples of the pixel at (x, y), pixel must hold exactly Channels samples
+func (f *Float) SetPixel(x, y int, pixel []float32) error {
+	if !f.InBounds(x, y) {
+		return fmt.Errorf("%w: (%d, %d) in %dx%d image", ErrOutOfBounds, x, y, f.Width, f.Height)
+	}
+	if len(pixel) != f.Channels {
+		return fmt.Errorf("expected %d samples, got %d", f.Channels, len(pixel))
+	}
+	copy(f.Pix[f.PixOffset(x, y):], pixel)
+	return nil
+}
+
+// Clone returns a deep copy of the image with a tightly packed Pix
+func (f *Float) Clone() *Float {
+	clone := &Float{
+		Pix:      make([]float32, f.Width*f.Height*f.Channels),
+		Stride:   f.Width * f.Channels,
+		Width:    f.Width,
+		Height:   f.Height,
+		Channels: f.Channels,
+		Linear:   f.Linear,
+
+		Premultiplied: f.Premultiplied,
+	}
+	for y := 0; y < f.Height; y++ {
+		copy(clone.Pix[y*clone.Stride:(y+1)*clone.Stride], f.Pix[f.PixOffset(0, y):])
+	}
+	return clone
+}
+
+// Validate checks that the image's fields are consistent with each other and that every sample is a finite number
+func (f *Float) Validate() error {
+	if f.Width < 0 || f.Height < 0 {
+		return fmt.Errorf("invalid dimensions %dx%d", f.Width, f.Height)
+	}
+	if f.Channels <= 0 {
+		return fmt.Errorf("invalid channel count %d", f.Channels)
+	}
+	if f.Empty() {
+		return nil
+	}
+	rowLength := f.Width * f.Channels
+	if f.Stride < rowLength {
+		return fmt.Errorf("stride %d is shorter than a row of %d samples", f.Stride, rowLength)
+	}
+	if required := (f.Height-1)*f.Stride + rowLength; len(f.Pix) < required {
+		return fmt.Errorf("pix holds %d samples, expected at least %d", len(f.Pix), required)
+	}
+
+	for y := 0; y < f.Height; y++ {
+		row := f.Pix[f.PixOffset(0, y) : f.PixOffset(0, y)+rowLength]
+		for i, sample := range row {
+			if math.IsNaN(float64(sample)) || math.IsInf(float64(sample), 0) {
+				return fmt.Errorf("sample at (%d, %d) is not a finite number", i/f.Channels, y)
+			}
+		}
+	}
+	return nil
+}
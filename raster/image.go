@@ -0,0 +1,238 @@
+// Package raster defines Image, the pixel container shared by the I/O and manipulation packages.
+package raster
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrOutOfBounds is returned by the accessors when a coordinate lies outside the image
+var ErrOutOfBounds = errors.New("coordinate out of bounds")
+
+// Image is a rectangular grid of pixels with non-premultiplied samples.
+//
+// Pixels are stored in row-major order: rows run top to bottom and, within a row, pixels run left to right. The
+// samples of the pixel at (x, y) start at Pix[y*Stride+x*Channels] and occupy Channels consecutive elements, ordered
+// as described by the Grey, GreyAlpha, RGB and RGBA layouts. Each sample lies in the range [0, MaxValue()].
+type Image struct {
+	Pix      []uint32 // The samples of every pixel, see above for the layout
+	Stride   int      // Distance in Pix between two vertically adjacent pixels
+	Width    int      // Number of columns
+	Height   int      // Number of rows
+	Channels int      // Number of samples per pixel
+	Depth    int      // Number of bits per sample
+
+	Metadata *Metadata // What the file the image came from says about it, nil if nothing
+}
+
+// MaxSamples is the largest number of samples New and NewFloat allocate, 16384x16384 RGBA pixels, so the dimensions
+// in a corrupt or malicious file header cannot exhaust the memory
+const MaxSamples = 1 << 30
+
+// New creates a zeroed image with the given dimensions, channel count and bit depth
+func New(width, height, channels, depth int) (*Image, error) {
+	if err := CheckSize(width, height, channels); err != nil {
+		return nil, err
+	}
+	if !validDepth(depth) {
+		return nil, fmt.Errorf("unsupported bit depth %d", depth)
+	}
+	return &Image{
+		Pix:      make([]uint32, width*height*channels),
+		Stride:   width * channels,
+		Width:    width,
+		Height:   height,
+		Channels: channels,
+		Depth:    depth,
+	}, nil
+}
+
+// CheckSize checks that an image of the given dimensions and channel count is valid and holds at most MaxSamples
+// samples, dividing rather than multiplying so the check cannot overflow. Decoders that fill an image as its data
+// arrives call it before allocating any of it.
+func CheckSize(width, height, channels int) error {
+	if width < 0 || height < 0 {
+		return fmt.Errorf("invalid dimensions %dx%d", width, height)
+	}
+	if channels <= 0 {
+		return fmt.Errorf("invalid channel count %d", channels)
+	}
+	if width > 0 && height > 0 && (width > MaxSamples/channels || height > MaxSamples/channels/width) {
+		return fmt.Errorf("image of %dx%d pixels with %d channels is too large, the limit is %d samples", width, height, channels, MaxSamples)
+	}
+	return nil
+}
+
+// validDepth reports whether samples can be stored with the given number of bits, 8 bits is the common case and 16 bits
+// is used for high-bit-depth sources such as scanners
+func validDepth(depth int) bool {
+	return depth == 8 || depth == 16
+}
+
+// NewRGBA creates a zeroed four-channel, 8-bit image, the default format produced when reading a file
+func NewRGBA(width, height int) (*Image, error) {
+	return New(width, height, RGBA, 8)
+}
+
+// FromMatrix copies a matrix indexed as matrix[y][x] into a new four-channel, 8-bit image.
+// Every row must have the same length and every sample must fit in 8 bits.
+func FromMatrix(matrix [][][4]uint32) (*Image, error) {
+	height := len(matrix)
+	width := 0
+	if height > 0 {
+		width = len(matrix[0])
+	}
+
+	img, err := NewRGBA(width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	for y, row := range matrix {
+		if len(row) != width { // Ragged rows have no meaningful width
+			return nil, fmt.Errorf("row %d has %d pixels, expected %d", y, len(row), width)
+		}
+		for x, pixel := range row {
+			copy(img.Pix[img.PixOffset(x, y):], pixel[:])
+		}
+	}
+
+	return img, img.Validate()
+}
+
+// Matrix copies the image into a matrix indexed as matrix[y][x], the inverse of FromMatrix.
+// Only four-channel images can be represented this way.
+func (img *Image) Matrix() ([][][4]uint32, error) {
+	if img.Channels != 4 {
+		return nil, fmt.Errorf("expected 4 channels, got %d", img.Channels)
+	}
+
+	matrix := make([][][4]uint32, img.Height)
+	for y := range matrix {
+		matrix[y] = make([][4]uint32, img.Width)
+		for x := range matrix[y] {
+			copy(matrix[y][x][:], img.Pix[img.PixOffset(x, y):])
+		}
+	}
+	return matrix, nil
+}
+
+// MaxValue returns the largest value a sample can hold at the image's bit depth
+func (img *Image) MaxValue() uint32 {
+	return 1<<img.Depth - 1
+}
+
+// ConvertDepth returns a copy of the image rescaled to the given bit depth, so that MaxValue maps to MaxValue.
+// Converting from 16 to 8 bits rounds to the nearest value.
+func (img *Image) ConvertDepth(depth int) (*Image, error) {
+	if !validDepth(depth) {
+		return nil, fmt.Errorf("unsupported bit depth %d", depth)
+	}
+
+	converted := img.Clone()
+	converted.Depth = depth
+	from, to := uint64(img.MaxValue()), uint64(converted.MaxValue())
+	if from == to {
+		return converted, nil
+	}
+	for i, sample := range converted.Pix {
+		converted.Pix[i] = uint32((uint64(sample)*to + from/2) / from)
+	}
+	return converted, nil
+}
+
+// Empty reports whether the image has no pixels
+func (img *Image) Empty() bool {
+	return img.Width <= 0 || img.Height <= 0
+}
+
+// InBounds reports whether (x, y) lies inside the image
+func (img *Image) InBounds(x, y int) bool {
+	return x >= 0 && y >= 0 && x < img.Width && y < img.Height
+}
+
+// PixOffset returns the index in Pix of the first sample of the pixel at (x, y).
+// It does not check bounds, callers in hot loops are expected to have done so already.
+func (img *Image) PixOffset(x, y int) int {
+	return y*img.Stride + x*img.Channels
+}
+
+// Pixel returns a copy of the samples of the pixel at (x, y)
+func (img *Image) Pixel(x, y int) ([]uint32, error) {
+	if !img.InBounds(x, y) {
+		return nil, fmt.Errorf("%w: (%d, %d) in %dx%d image", ErrOutOfBounds, x, y, img.Width, img.Height)
+	}
+	pixel := make([]uint32, img.Channels)
+	copy(pixel, img.Pix[img.PixOffset(x, y):])
+	return pixel, nil
+}
+
+// SetPixel overwrites the samples of the pixel at (x, y), pixel must hold exactly Channels samples
+func (img *Image) SetPixel(x, y int, pixel []uint32) error {
+	if !img.InBounds(x, y) {
+		return fmt.Errorf("%w: (%d, %d) in %dx%d image", ErrOutOfBounds, x, y, img.Width, img.Height)
+	}
+	if len(pixel) != img.Channels {
+		return fmt.Errorf("expected %d samples, got %d", img.Channels, len(pixel))
+	}
+	maxValue := img.MaxValue()
+	for c, sample := range pixel {
+		if sample > maxValue {
+			return fmt.Errorf("sample %d of channel %d exceeds %d", sample, c, maxValue)
+		}
+	}
+	copy(img.Pix[img.PixOffset(x, y):], pixel)
+	return nil
+}
+
+// Clone returns a deep copy of the image with a tightly packed Pix
+func (img *Image) Clone() *Image {
+	clone := &Image{
+		Pix:      make([]uint32, img.Width*img.Height*img.Channels),
+		Stride:   img.Width * img.Channels,
+		Width:    img.Width,
+		Height:   img.Height,
+		Channels: img.Channels,
+		Depth:    img.Depth,
+		Metadata: img.Metadata.Clone(),
+	}
+	for y := 0; y < img.Height; y++ {
+		copy(clone.Pix[y*clone.Stride:(y+1)*clone.Stride], img.Pix[img.PixOffset(0, y):])
+	}
+	return clone
+}
+
+// Validate checks that the image's fields are consistent with each other and that every sample is in range
+func (img *Image) Validate() error {
+	if img.Width < 0 || img.Height < 0 {
+		return fmt.Errorf("invalid dimensions %dx%d", img.Width, img.Height)
+	}
+	if img.Channels <= 0 {
+		return fmt.Errorf("invalid channel count %d", img.Channels)
+	}
+	if !validDepth(img.Depth) {
+		return fmt.Errorf("unsupported bit depth %d", img.Depth)
+	}
+	if img.Empty() {
+		return nil
+	}
+	rowLength := img.Width * img.Channels
+	if img.Stride < rowLength {
+		return fmt.Errorf("stride %d is shorter than a row of %d samples", img.Stride, rowLength)
+	}
+	if required := (img.Height-1)*img.Stride + rowLength; len(img.Pix) < required {
+		return fmt.Errorf("pix holds %d samples, expected at least %d", len(img.Pix), required)
+	}
+
+	// Every sample must be representable at the image's bit depth
+	maxValue := img.MaxValue()
+	for y := 0; y < img.Height; y++ {
+		row := img.Pix[img.PixOffset(0, y) : img.PixOffset(0, y)+rowLength]
+		for i, sample := range row {
+			if sample > maxValue {
+				return fmt.Errorf("sample %d at (%d, %d) exceeds %d", sample, i/img.Channels, y, maxValue)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package raster
+
+// Metadata holds what a file says about an image besides its pixels. The decoders fill in what they find and the
+// encoders write back whatever their format can hold, so metadata is carried from one file to the next. Every field is
+// optional, the zero value of each meaning the file had none.
+type Metadata struct {
+	Text       []TextEntry // Textual information, such as PNG text chunks and JPEG comments, in file order
+	ICCProfile []byte      // ICC colour profile the samples are expressed in, uncompressed
+	Gamma      float64     // Gamma the samples were encoded with, 1/2.2 for sRGB, as held by PNG's gAMA chunk
+	Resolution *Resolution // Physical size of the pixels
+	EXIF       []byte      // EXIF data as a TIFF structure, without the "Exif\0\0" header JPEG puts before it
+}
+
+// TextEntry is a keyword and its text, both UTF-8
+type TextEntry struct {
+	Keyword string // Such as "Title", "Author" or "Comment", see https://www.w3.org/TR/png/#11keywords
+	Text    string
+}
+
+// Resolution is the size of a pixel, given as how many pixels fit in a metre
+type Resolution struct {
+	X, Y       float64 // Pixels per metre horizontally and vertically
+	AspectOnly bool    // Whether only the ratio of X to Y is known, not the physical size
+}
+
+// Clone returns a deep copy of the metadata, nil if m is nil
+func (m *Metadata) Clone() *Metadata {
+	if m == nil {
+		return nil
+	}
+	clone := &Metadata{
+		Text:       append([]TextEntry(nil), m.Text...),
+		ICCProfile: append([]byte(nil), m.ICCProfile...),
+		Gamma:      m.Gamma,
+		EXIF:       append([]byte(nil), m.EXIF...),
+	}
+	if m.Resolution != nil {
+		resolution := *m.Resolution
+		clone.Resolution = &resolution
+	}
+	return clone
+}
+
+// Empty reports whether the metadata holds nothing, which is also true of nil
+func (m *Metadata) Empty() bool {
+	return m == nil || len(m.Text) == 0 && len(m.ICCProfile) == 0 && m.Gamma == 0 && m.Resolution == nil && len(m.EXIF) == 0
+}
+
+// transposed returns a copy of the metadata for the image turned on its side, with the resolution swapped
+func (m *Metadata) transposed() *Metadata {
+	clone := m.Clone()
+	if clone != nil && clone.Resolution != nil {
+		clone.Resolution.X, clone.Resolution.Y = clone.Resolution.Y, clone.Resolution.X
+	}
+	return clone
+}
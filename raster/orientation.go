@@ -0,0 +1,139 @@
+package raster
+
+import (
+	"fmt"
+	"math"
+	"matrix-image-manipulation/matrix"
+)
+
+// FromColumns copies a matrix indexed as matrix[x][y], the column-major layout produced by utils.Make2D(width, height),
+// into a new four-channel, 8-bit image. It is the transpose of FromMatrix and exists so that code holding such a
+// matrix has to state its orientation explicitly.
+func FromColumns(matrix [][][4]uint32) (*Image, error) {
+	width := len(matrix)
+	height := 0
+	if width > 0 {
+		height = len(matrix[0])
+	}
+
+	img, err := NewRGBA(width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	for x, column := range matrix {
+		if len(column) != height { // Ragged columns have no meaningful height
+			return nil, fmt.Errorf("column %d has %d pixels, expected %d", x, len(column), height)
+		}
+		for y, pixel := range column {
+			copy(img.Pix[img.PixOffset(x, y):], pixel[:])
+		}
+	}
+
+	return img, img.Validate()
+}
+
+// Columns copies the image into a matrix indexed as matrix[x][y], the inverse of FromColumns
+func (img *Image) Columns() ([][][4]uint32, error) {
+	if img.Channels != 4 {
+		return nil, fmt.Errorf("expected 4 channels, got %d", img.Channels)
+	}
+
+	matrix := make([][][4]uint32, img.Width)
+	for x := range matrix {
+		matrix[x] = make([][4]uint32, img.Height)
+		for y := range matrix[x] {
+			copy(matrix[x][y][:], img.Pix[img.PixOffset(x, y):])
+		}
+	}
+	return matrix, nil
+}
+
+// remap builds a width x height image by moving every pixel of img to where the affine transform forward maps it.
+// Each destination pixel is fetched from the source pixel the inverse transform maps it back to, so the result has no
+// holes. The orientation helpers below only use transforms that map the pixel grid onto itself. The metadata is copied.
+func (img *Image) remap(width, height int, forward *matrix.Dense) *Image {
+	inverse := matrix.Must(forward.Inverse()) // Every transform used here is a rotation or a reflection, never singular
+	out := &Image{
+		Pix:      make([]uint32, width*height*img.Channels),
+		Stride:   width * img.Channels,
+		Width:    width,
+		Height:   height,
+		Channels: img.Channels,
+		Depth:    img.Depth,
+		Metadata: img.Metadata.Clone(),
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			fx, fy := inverse.TransformPoint(float64(x), float64(y))
+			sx, sy := int(math.Round(fx)), int(math.Round(fy))
+			copy(out.Pix[out.PixOffset(x, y):out.PixOffset(x, y)+img.Channels], img.Pix[img.PixOffset(sx, sy):])
+		}
+	}
+	return out
+}
+
+// Transpose returns a new image mirrored along its main diagonal, the pixel at (x, y) moves to (y, x)
+func (img *Image) Transpose() *Image {
+	swap := matrix.Must(matrix.FromRows([][]float64{{0, 1, 0}, {1, 0, 0}, {0, 0, 1}}))
+	out := img.remap(img.Height, img.Width, swap)
+	out.Metadata = img.Metadata.transposed()
+	return out
+}
+
+// FlipHorizontal returns a new image mirrored left to right, x moves to width-1-x
+func (img *Image) FlipHorizontal() *Image {
+	mirror := matrix.Must(matrix.Translation(float64(img.Width-1), 0).Mul(matrix.Scaling(-1, 1)))
+	return img.remap(img.Width, img.Height, mirror)
+}
+
+// FlipVertical returns a new image mirrored top to bottom, y moves to height-1-y
+func (img *Image) FlipVertical() *Image {
+	mirror := matrix.Must(matrix.Translation(0, float64(img.Height-1)).Mul(matrix.Scaling(1, -1)))
+	return img.remap(img.Width, img.Height, mirror)
+}
+
+// Rotate90 returns a new image rotated 90 degrees clockwise, (x, y) moves to (height-1-y, x)
+func (img *Image) Rotate90() *Image {
+	rotation := matrix.Must(matrix.Translation(float64(img.Height-1), 0).Mul(matrix.Rotation(math.Pi / 2)))
+	out := img.remap(img.Height, img.Width, rotation)
+	out.Metadata = img.Metadata.transposed()
+	return out
+}
+
+// Rotate180 returns a new image rotated 180 degrees, (x, y) moves to (width-1-x, height-1-y)
+func (img *Image) Rotate180() *Image {
+	rotation := matrix.Must(matrix.Translation(float64(img.Width-1), float64(img.Height-1)).Mul(matrix.Rotation(math.Pi)))
+	return img.remap(img.Width, img.Height, rotation)
+}
+
+// Rotate270 returns a new image rotated 90 degrees counter-clockwise, (x, y) moves to (y, width-1-x)
+func (img *Image) Rotate270() *Image {
+	rotation := matrix.Must(matrix.Translation(0, float64(img.Width-1)).Mul(matrix.Rotation(-math.Pi / 2)))
+	out := img.remap(img.Height, img.Width, rotation)
+	out.Metadata = img.Metadata.transposed()
+	return out
+}
+
+// Orient returns a new image turned upright according to an EXIF orientation, 1 to 8, which says how the stored pixels
+// were turned from the scene. Orientation 1 and unknown values return an unchanged copy.
+func (img *Image) Orient(orientation int) *Image {
+	switch orientation {
+	case 2:
+		return img.FlipHorizontal()
+	case 3:
+		return img.Rotate180()
+	case 4:
+		return img.FlipVertical()
+	case 5:
+		return img.Transpose()
+	case 6:
+		return img.Rotate90()
+	case 7:
+		return img.Rotate270().FlipHorizontal() // The transverse, mirrored along the other diagonal
+	case 8:
+		return img.Rotate270()
+	default:
+		return img.Clone()
+	}
+}
@@ -0,0 +1,90 @@
+package raster
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Disposal says what happens to the canvas after a frame has been shown, before the next frame is drawn. The values
+// are the ones GIF uses.
+type Disposal byte
+
+const (
+	DisposalUnspecified Disposal = 0 // No preference, decoders treat it like DisposalNone
+	DisposalNone        Disposal = 1 // The frame is left in place and the next one is drawn over it
+	DisposalBackground  Disposal = 2 // The frame's area is cleared to transparent
+	DisposalPrevious    Disposal = 3 // The canvas is restored to what it was before the frame was drawn
+)
+
+// Frame is a single image of an animation and how long it is shown for
+type Frame struct {
+	Image    *Image
+	Delay    time.Duration // How long the frame is shown before the next one
+	Disposal Disposal      // What the file said happens to the canvas after the frame, already applied to Image and kept when written
+}
+
+// Sequence is an animation: a series of frames of the same size shown one after the other, or the pages of a
+// multi-page document, which may each have their own size.
+// Every frame holds the complete picture shown at that point, rather than only the part that changed, so operations
+// can process each frame on its own.
+type Sequence struct {
+	Frames []Frame
+
+	// LoopCount is how many times the animation repeats, with the meaning GIF gives it: 0 loops forever, -1 plays the
+	// frames once and n plays them n+1 times
+	LoopCount int
+}
+
+// NewSequence wraps a still image in a sequence of a single frame
+func NewSequence(img *Image) *Sequence {
+	return &Sequence{Frames: []Frame{{Image: img}}}
+}
+
+// Validate checks that the sequence has at least one frame, that every frame is a valid image and that they all have
+// the same dimensions, as the frames of an animation must
+func (s *Sequence) Validate() error {
+	if err := s.ValidatePages(); err != nil {
+		return err
+	}
+	first := s.Frames[0].Image
+	for i, frame := range s.Frames {
+		if frame.Image.Width != first.Width || frame.Image.Height != first.Height {
+			return fmt.Errorf("frame %d is %dx%d, expected %dx%d like the first frame", i, frame.Image.Width, frame.Image.Height, first.Width, first.Height)
+		}
+	}
+	return nil
+}
+
+// ValidatePages checks that the sequence has at least one frame and that every frame is a valid image, which may have
+// a size of its own like the pages of a multi-page TIFF
+func (s *Sequence) ValidatePages() error {
+	if len(s.Frames) == 0 {
+		return errors.New("sequence has no frames")
+	}
+	for i, frame := range s.Frames {
+		if frame.Image == nil {
+			return fmt.Errorf("frame %d has no image", i)
+		}
+		if err := frame.Image.Validate(); err != nil {
+			return fmt.Errorf("frame %d: %w", i, err)
+		}
+		if frame.Delay < 0 {
+			return fmt.Errorf("frame %d has a negative delay", i)
+		}
+	}
+	return nil
+}
+
+// Map returns a new sequence with fn applied to the image of every frame, keeping the timing, disposal and loop count
+func (s *Sequence) Map(fn func(img *Image) (*Image, error)) (*Sequence, error) {
+	out := &Sequence{Frames: make([]Frame, len(s.Frames)), LoopCount: s.LoopCount}
+	for i, frame := range s.Frames {
+		img, err := fn(frame.Image)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %w", i, err)
+		}
+		out.Frames[i] = Frame{Image: img, Delay: frame.Delay, Disposal: frame.Disposal}
+	}
+	return out, nil
+}
@@ -0,0 +1,218 @@
+package raster
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Image satisfies the standard library's image interfaces, so it can be passed to image/draw, image/png and any other
+// code that accepts an image.Image without being copied
+var _ draw.Image = (*Image)(nil)
+
+// isGrey reports whether the image is presented to the standard library as greyscale: single-channel images and
+// multi-band images, of which only the first band is shown
+func (img *Image) isGrey() bool {
+	return img.Channels == Grey || img.Channels > RGBA
+}
+
+// ColorModel returns the standard library colour model matching the image's layout and depth: Gray or Gray16 for
+// greyscale images and NRGBA or NRGBA64 for everything else, as the samples are not premultiplied
+func (img *Image) ColorModel() color.Model {
+	switch {
+	case img.isGrey() && img.Depth == 16:
+		return color.Gray16Model
+	case img.isGrey():
+		return color.GrayModel
+	case img.Depth == 16:
+		return color.NRGBA64Model
+	default:
+		return color.NRGBAModel
+	}
+}
+
+// At returns the colour of the pixel at (x, y) in the image's ColorModel, or a transparent black outside the image.
+// Greyscale pixels are repeated in the red, green and blue channels and layouts without alpha are fully opaque.
+func (img *Image) At(x, y int) color.Color {
+	if !img.InBounds(x, y) {
+		return img.ColorModel().Convert(color.Transparent)
+	}
+	pixel := img.Pix[img.PixOffset(x, y):]
+	if img.isGrey() {
+		if img.Depth == 16 {
+			return color.Gray16{Y: uint16(pixel[0])}
+		}
+		return color.Gray{Y: uint8(pixel[0])}
+	}
+
+	r, g, b, a := img.straightRGBA(pixel)
+	if img.Depth == 16 {
+		return color.NRGBA64{R: uint16(r), G: uint16(g), B: uint16(b), A: uint16(a)}
+	}
+	return color.NRGBA{R: uint8(r), G: uint8(g), B: uint8(b), A: uint8(a)}
+}
+
+// straightRGBA returns a pixel with the image's layout as straight red, green, blue and alpha samples
+func (img *Image) straightRGBA(pixel []uint32) (r, g, b, a uint32) {
+	switch img.Channels {
+	case Grey:
+		return pixel[0], pixel[0], pixel[0], img.MaxValue()
+	case GreyAlpha:
+		return pixel[0], pixel[0], pixel[0], pixel[1]
+	case RGB:
+		return pixel[0], pixel[1], pixel[2], img.MaxValue()
+	default:
+		return pixel[0], pixel[1], pixel[2], pixel[3]
+	}
+}
+
+// Set changes the colour of the pixel at (x, y), doing nothing outside the image.
+// The colour is stored in straight form at the image's depth. Greyscale layouts keep its luma, computed like
+// color.GrayModel, and layouts without alpha drop the alpha, as happens when a file is read into them. Multi-band
+// images only have their first band set.
+func (img *Image) Set(x, y int, c color.Color) {
+	if !img.InBounds(x, y) {
+		return
+	}
+	var r, g, b, a uint32
+	if img.Depth == 16 {
+		n := color.NRGBA64Model.Convert(c).(color.NRGBA64)
+		r, g, b, a = uint32(n.R), uint32(n.G), uint32(n.B), uint32(n.A)
+	} else {
+		n := color.NRGBAModel.Convert(c).(color.NRGBA)
+		r, g, b, a = uint32(n.R), uint32(n.G), uint32(n.B), uint32(n.A)
+	}
+
+	pixel := img.Pix[img.PixOffset(x, y):]
+	switch img.Channels {
+	case GreyAlpha:
+		pixel[0], pixel[1] = img.luma(c), a
+	case RGB:
+		pixel[0], pixel[1], pixel[2] = r, g, b
+	case RGBA:
+		pixel[0], pixel[1], pixel[2], pixel[3] = r, g, b, a
+	default:
+		pixel[0] = img.luma(c)
+	}
+}
+
+// luma returns the intensity of the straight form of c at the image's depth.
+// It is always computed from 16-bit samples, so 8-bit results round exactly like color.GrayModel.
+func (img *Image) luma(c color.Color) uint32 {
+	n := color.NRGBA64Model.Convert(c).(color.NRGBA64)
+	y := Luma(uint32(n.R), uint32(n.G), uint32(n.B))
+	if img.Depth == 8 {
+		return y >> 8
+	}
+	return y
+}
+
+// Luma returns the intensity of a colour with the same weights and rounding as color.GrayModel, so greyscale files
+// read back exactly. It works at any depth, as the weights sum to 1.
+func Luma(r, g, b uint32) uint32 {
+	return (19595*r + 38470*g + 7471*b + 1<<15) >> 16
+}
+
+// FromImage copies any image.Image into a new Image with the layout and depth that best preserve it: 16 bits for
+// 16-bit colour models and 8 otherwise, a single channel for greyscale models, RGB for the YCbCr and CMYK models of
+// JPEG images, which have no alpha, and RGBA otherwise
+func FromImage(src image.Image) *Image {
+	img, _ := FromImageAs(src, 0, 0) // The native layout and depth are always valid
+	return img
+}
+
+// FromImageAs copies any image.Image into a new Image with the given channel layout and depth. A zero channels or
+// depth picks the native one, as FromImage does. The top left corner of src's bounds becomes (0, 0).
+func FromImageAs(src image.Image, channels, depth int) (*Image, error) {
+	if depth == 0 {
+		depth = nativeDepth(src.ColorModel())
+	}
+	if channels == 0 {
+		channels = nativeChannels(src.ColorModel())
+	}
+	if channels > RGBA {
+		return nil, fmt.Errorf("cannot convert an image into %d channels", channels)
+	}
+
+	bounds := src.Bounds()
+	img, err := New(bounds.Dx(), bounds.Dy(), channels, depth)
+	if err != nil {
+		return nil, err
+	}
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			img.Set(x, y, src.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return img, nil
+}
+
+// nativeDepth returns the bit depth a colour model stores its samples with
+func nativeDepth(model color.Model) int {
+	switch model {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model:
+		return 16
+	default:
+		return 8
+	}
+}
+
+// nativeChannels returns the channel layout that holds a colour model without loss
+func nativeChannels(model color.Model) int {
+	switch model {
+	case color.GrayModel, color.Gray16Model:
+		return Grey
+	case color.YCbCrModel, color.CMYKModel:
+		return RGB
+	default:
+		return RGBA
+	}
+}
+
+// ToImage copies the image into the standard library type matching its layout and depth: *image.Gray or
+// *image.Gray16 for single-channel images and *image.NRGBA or *image.NRGBA64 for the other layouts. Encoders are
+// often faster with these concrete types than with the Image itself. Multi-band images cannot be converted.
+func (img *Image) ToImage() (image.Image, error) {
+	if img.Channels > RGBA {
+		return nil, fmt.Errorf("cannot convert a %d channel image", img.Channels)
+	}
+
+	bounds := img.Bounds()
+	switch {
+	case img.Channels == Grey && img.Depth == 16:
+		out := image.NewGray16(bounds)
+		for y := 0; y < img.Height; y++ {
+			for x := 0; x < img.Width; x++ {
+				out.SetGray16(x, y, color.Gray16{Y: uint16(img.Pix[img.PixOffset(x, y)])})
+			}
+		}
+		return out, nil
+	case img.Channels == Grey:
+		out := image.NewGray(bounds)
+		for y := 0; y < img.Height; y++ {
+			for x := 0; x < img.Width; x++ {
+				out.SetGray(x, y, color.Gray{Y: uint8(img.Pix[img.PixOffset(x, y)])})
+			}
+		}
+		return out, nil
+	case img.Depth == 16:
+		out := image.NewNRGBA64(bounds)
+		for y := 0; y < img.Height; y++ {
+			for x := 0; x < img.Width; x++ {
+				r, g, b, a := img.straightRGBA(img.Pix[img.PixOffset(x, y):])
+				out.SetNRGBA64(x, y, color.NRGBA64{R: uint16(r), G: uint16(g), B: uint16(b), A: uint16(a)})
+			}
+		}
+		return out, nil
+	default:
+		out := image.NewNRGBA(bounds)
+		for y := 0; y < img.Height; y++ {
+			for x := 0; x < img.Width; x++ {
+				r, g, b, a := img.straightRGBA(img.Pix[img.PixOffset(x, y):])
+				out.SetNRGBA(x, y, color.NRGBA{R: uint8(r), G: uint8(g), B: uint8(b), A: uint8(a)})
+			}
+		}
+		return out, nil
+	}
+}
@@ -0,0 +1,121 @@
+package raster
+
+import (
+	"fmt"
+	"image"
+)
+
+// Bounds returns the rectangle covered by the image, always anchored at the origin
+func (img *Image) Bounds() image.Rectangle {
+	return image.Rect(0, 0, img.Width, img.Height)
+}
+
+// Bounds returns the rectangle covered by the image, always anchored at the origin
+func (f *Float) Bounds() image.Rectangle {
+	return image.Rect(0, 0, f.Width, f.Height)
+}
+
+// viewExtent returns the indices in a Pix slice spanned by the rectangle r, which must lie inside the image
+func viewExtent(r image.Rectangle, stride, channels int) (start, end int) {
+	start = r.Min.Y*stride + r.Min.X*channels
+	end = start + (r.Dy()-1)*stride + r.Dx()*channels
+	return start, end
+}
+
+// SubImage returns a view of the part of the image inside r, clipped to the image's bounds.
+// Like image.NRGBA.SubImage the view shares the parent's storage, so writing to one is visible in the other, but its
+// coordinates start at (0, 0) in the top left corner of r.
+func (img *Image) SubImage(r image.Rectangle) *Image {
+	r = r.Intersect(img.Bounds())
+	view := &Image{Stride: img.Stride, Width: r.Dx(), Height: r.Dy(), Channels: img.Channels, Depth: img.Depth, Metadata: img.Metadata}
+	if !r.Empty() {
+		start, end := viewExtent(r, img.Stride, img.Channels)
+		view.Pix = img.Pix[start:end:end]
+	}
+	return view
+}
+
+// SubImage returns a view of the part of the image inside r, clipped to the image's bounds, see Image.SubImage
+func (f *Float) SubImage(r image.Rectangle) *Float {
+	r = r.Intersect(f.Bounds())
+	view := &Float{
+		Stride:        f.Stride,
+		Width:         r.Dx(),
+		Height:        r.Dy(),
+		Channels:      f.Channels,
+		Linear:        f.Linear,
+		Premultiplied: f.Premultiplied,
+	}
+	if !r.Empty() {
+		start, end := viewExtent(r, f.Stride, f.Channels)
+		view.Pix = f.Pix[start:end:end]
+	}
+	return view
+}
+
+// pasteLayout checks that pixels with src channels can be pasted into an image with dst channels.
+// Identical layouts are copied as they are, greyscale pixels can also be pasted into colour images, which repeats the
+// intensity in the red, green and blue channels.
+func pasteLayout(src, dst int) error {
+	if src == dst || (src == Grey || src == GreyAlpha) && (dst == RGB || dst == RGBA) {
+		return nil
+	}
+	return fmt.Errorf("cannot paste a %d channel image into a %d channel image", src, dst)
+}
+
+// pastePixel copies the samples of a single pixel between the layouts accepted by pasteLayout, a missing alpha
+// channel in the source leaves the destination's alpha untouched
+func pastePixel[T uint32 | float32](src, dst []T, srcChannels, dstChannels int) {
+	if srcChannels == dstChannels {
+		copy(dst[:dstChannels], src[:srcChannels])
+		return
+	}
+	dst[0], dst[1], dst[2] = src[0], src[0], src[0]
+	if srcChannels == GreyAlpha && dstChannels == RGBA {
+		dst[3] = src[1]
+	}
+}
+
+// Paste copies src into the image with its top left corner at p. src must fit inside the image entirely.
+// It composites results computed on a view, or on a SubImage copy, back into the full image.
+func (img *Image) Paste(src *Image, p image.Point) error {
+	target := src.Bounds().Add(p)
+	if !target.In(img.Bounds()) {
+		return fmt.Errorf("a %dx%d image at %v does not fit in a %dx%d image", src.Width, src.Height, p, img.Width, img.Height)
+	}
+	if src.Depth != img.Depth {
+		return fmt.Errorf("cannot paste a %d-bit image into a %d-bit image", src.Depth, img.Depth)
+	}
+	if err := pasteLayout(src.Channels, img.Channels); err != nil {
+		return err
+	}
+
+	for y := 0; y < src.Height; y++ {
+		for x := 0; x < src.Width; x++ {
+			pastePixel(src.Pix[src.PixOffset(x, y):], img.Pix[img.PixOffset(p.X+x, p.Y+y):], src.Channels, img.Channels)
+		}
+	}
+	return nil
+}
+
+// Paste copies src into the image with its top left corner at p, see Image.Paste.
+// Both images must hold samples in the same form, linear or not and premultiplied or not.
+func (f *Float) Paste(src *Float, p image.Point) error {
+	target := src.Bounds().Add(p)
+	if !target.In(f.Bounds()) {
+		return fmt.Errorf("a %dx%d image at %v does not fit in a %dx%d image", src.Width, src.Height, p, f.Width, f.Height)
+	}
+	if src.Linear != f.Linear || src.Premultiplied != f.Premultiplied {
+		return fmt.Errorf("cannot paste between images with differently encoded samples")
+	}
+	if err := pasteLayout(src.Channels, f.Channels); err != nil {
+		return err
+	}
+
+	for y := 0; y < src.Height; y++ {
+		for x := 0; x < src.Width; x++ {
+			pastePixel(src.Pix[src.PixOffset(x, y):], f.Pix[f.PixOffset(p.X+x, p.Y+y):], src.Channels, f.Channels)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// Package tiles runs operations on images too large to hold in memory, by reading, processing and writing them one
+// band of rows at a time.
+package tiles
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"matrix-image-manipulation/raster"
+)
+
+// Source provides the rows of an image in order from top to bottom, utils.PNGRowReader is one
+type Source interface {
+	Width() int
+	Height() int
+	Channels() int
+	Depth() int
+	ReadRows(dst *raster.Image) error // Fills dst with the next dst.Height rows
+}
+
+// Sink consumes the rows of an image in order from top to bottom, utils.PNGRowWriter is one
+type Sink interface {
+	WriteRows(src *raster.Image) error
+}
+
+// Func processes a single tile and returns the result, which must have the same dimensions as the tile
+type Func func(tile *raster.Image) (*raster.Image, error)
+
+// bytesPerSample estimates the memory used per sample of a tile while it is processed: the tile itself, the float
+// working copy, a premultiplied or linear copy of it, the float result and the quantised result
+const bytesPerSample = 4 * 5
+
+// Config controls how an image is split into tiles
+type Config struct {
+	// Halo is how many pixels around the one being computed the operation reads, kernelSize/2 for GaussianFilter and
+	// 0 for point operations. Each tile is read with this many extra rows above and below, so the rows that are kept
+	// are exactly what processing the whole image would have produced.
+	Halo int
+
+	// MemoryBudget is roughly how many bytes a tile may use while it is processed, it decides how many rows each tile
+	// holds. The budget must fit at least one row plus the halo above and below.
+	MemoryBudget int64
+
+	// Progress, if set, is called after every tile is written with the number of tiles done and the total
+	Progress func(done, total int)
+}
+
+// Process reads every row of src, runs fn on tiles of as many full-width rows as the memory budget allows and writes
+// the results to dst. The halo rows shared by consecutive tiles are kept from one tile to the next, so src is read
+// exactly once.
+func Process(src Source, dst Sink, fn Func, config Config) error {
+	return ProcessContext(context.Background(), src, dst, fn, config)
+}
+
+// ProcessContext is Process checking ctx before every tile, it returns ctx.Err() once ctx is cancelled. fn should
+// pass ctx on to the operation it runs, such as manipulations.GaussianFilterContext, to stop within a tile as well.
+func ProcessContext(ctx context.Context, src Source, dst Sink, fn Func, config Config) error {
+	width, height := src.Width(), src.Height()
+	if width <= 0 || height <= 0 {
+		return errors.New("empty image")
+	}
+	if config.Halo < 0 {
+		return fmt.Errorf("invalid halo %d", config.Halo)
+	}
+
+	rowCost := int64(width) * int64(src.Channels()) * bytesPerSample
+	rows := int(config.MemoryBudget/rowCost) - 2*config.Halo // Rows each tile produces
+	if rows < 1 {
+		return fmt.Errorf("a memory budget of %d bytes cannot hold %d rows of %d bytes", config.MemoryBudget, 1+2*config.Halo, rowCost)
+	}
+	rows = min(rows, height)
+
+	// buffer holds the rows [first, first+buffered) of the image
+	buffer, err := raster.New(width, min(rows+2*config.Halo, height), src.Channels(), src.Depth())
+	if err != nil {
+		return err
+	}
+	first, buffered := 0, 0
+	total := (height + rows - 1) / rows
+
+	for top := 0; top < height; top += rows {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		bottom := min(top+rows, height)
+		start, end := max(top-config.Halo, 0), min(bottom+config.Halo, height) // The rows the tile is computed from
+
+		// Drop the rows above the tile, keeping the halo shared with the previous tile
+		if drop := start - first; drop > 0 {
+			copy(buffer.Pix, buffer.Pix[buffer.PixOffset(0, drop):buffer.PixOffset(0, buffered)])
+			first, buffered = start, buffered-drop
+		}
+		// Read the rows below it
+		if missing := end - (first + buffered); missing > 0 {
+			if err := src.ReadRows(buffer.SubImage(image.Rect(0, buffered, width, buffered+missing))); err != nil {
+				return err
+			}
+			buffered += missing
+		}
+
+		tile := buffer.SubImage(image.Rect(0, 0, width, end-start))
+		result, err := fn(tile)
+		if err != nil {
+			return fmt.Errorf("processing rows %d to %d: %w", top, bottom, err)
+		}
+		if result.Width != tile.Width || result.Height != tile.Height {
+			return fmt.Errorf("processing a %dx%d tile returned a %dx%d image", tile.Width, tile.Height, result.Width, result.Height)
+		}
+
+		// Only the rows the tile was responsible for are written, the halo is discarded
+		if err := dst.WriteRows(result.SubImage(image.Rect(0, top-start, width, bottom-start))); err != nil {
+			return err
+		}
+		if config.Progress != nil {
+			config.Progress(top/rows+1, total)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"matrix-image-manipulation/matrix"
+	"matrix-image-manipulation/raster"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Array is an n-dimensional array of numbers, the form in which pixel matrices and kernels are exported as CSV, JSON
+// and NumPy .npy files and loaded back. The shape and data type travel with the elements, so the round trip is exact
+// and numpy.array(data, dtype).reshape(shape) rebuilds the same array in Python.
+type Array struct {
+	Shape []int     // Length of each dimension, height, width and channels for an image and rows and columns for a matrix
+	DType string    // NumPy name of the element type, such as "uint8", "uint16" or "float64", see ArrayDTypes
+	Data  []float64 // The elements in row-major order, the last index varying fastest
+}
+
+// arrayDType describes an element type: its size and whether it holds integers, and their range
+type arrayDType struct {
+	size     int
+	kind     byte // 'u' for unsigned integers, 'i' for signed ones and 'f' for floating point, as in NumPy
+	min, max float64
+}
+
+// arrayDTypes holds the element types arrays can have, by NumPy name
+var arrayDTypes = map[string]arrayDType{
+	"uint8":   {1, 'u', 0, math.MaxUint8},
+	"uint16":  {2, 'u', 0, math.MaxUint16},
+	"uint32":  {4, 'u', 0, math.MaxUint32},
+	"uint64":  {8, 'u', 0, math.MaxUint64},
+	"int8":    {1, 'i', math.MinInt8, math.MaxInt8},
+	"int16":   {2, 'i', math.MinInt16, math.MaxInt16},
+	"int32":   {4, 'i', math.MinInt32, math.MaxInt32},
+	"int64":   {8, 'i', math.MinInt64, math.MaxInt64},
+	"float32": {4, 'f', -math.MaxFloat32, math.MaxFloat32},
+	"float64": {8, 'f', -math.MaxFloat64, math.MaxFloat64},
+}
+
+// ArrayDTypes lists the element types an Array can have. 64-bit integers are held as float64, so only those up to 2⁵³
+// in magnitude are exact.
+var ArrayDTypes = []string{"uint8", "uint16", "uint32", "uint64", "int8", "int16", "int32", "int64", "float32", "float64"}
+
+// Len returns the number of elements the shape holds
+func (a *Array) Len() int {
+	n := 1
+	for _, length := range a.Shape {
+		n *= length
+	}
+	return n
+}
+
+// Validate checks that the array has a known type, a valid shape and as many elements as its shape holds, all of
+// which the type can represent
+func (a *Array) Validate() error {
+	dtype, ok := arrayDTypes[a.DType]
+	if !ok {
+		return fmt.Errorf("unknown array type %q, expected one of %s", a.DType, strings.Join(ArrayDTypes, ", "))
+	}
+	for _, length := range a.Shape {
+		if length < 0 {
+			return fmt.Errorf("invalid array shape %v", a.Shape)
+		}
+	}
+	if len(a.Data) != a.Len() {
+		return fmt.Errorf("array of shape %v has %d elements, expected %d", a.Shape, len(a.Data), a.Len())
+	}
+	for i, v := range a.Data {
+		switch {
+		case dtype.kind != 'f' && (v != math.Trunc(v) || v < dtype.min || v > dtype.max):
+			return fmt.Errorf("element %d of an %s array is %v", i, a.DType, v)
+		case a.DType == "float32" && float64(float32(v)) != v && !math.IsNaN(v):
+			return fmt.Errorf("element %d of a float32 array is %v, which float32 cannot hold", i, v)
+		}
+	}
+	return nil
+}
+
+// ImageArray returns the samples of an image as a height x width x channels array, or height x width for greyscale
+// images, of uint8 for 8-bit images and uint16 for 16-bit ones, the layout NumPy and OpenCV give images
+func ImageArray(img *raster.Image) *Array {
+	a := &Array{Shape: []int{img.Height, img.Width, img.Channels}, DType: "uint8", Data: make([]float64, 0, img.Width*img.Height*img.Channels)}
+	if img.Channels == raster.Grey {
+		a.Shape = a.Shape[:2]
+	}
+	if img.Depth == 16 {
+		a.DType = "uint16"
+	}
+	for y := 0; y < img.Height; y++ {
+		for _, sample := range img.Pix[img.PixOffset(0, y) : img.PixOffset(0, y)+img.Width*img.Channels] {
+			a.Data = append(a.Data, float64(sample))
+		}
+	}
+	return a
+}
+
+// Image returns the image an array of uint8 or uint16 holds, laid out as ImageArray does. Two-dimensional arrays are
+// greyscale images, and the length of the third dimension gives the channels.
+func (a *Array) Image() (*raster.Image, error) {
+	if err := a.Validate(); err != nil {
+		return nil, err
+	}
+	depth := map[string]int{"uint8": 8, "uint16": 16}[a.DType]
+	if depth == 0 {
+		return nil, fmt.Errorf("cannot make an image of a %s array, expected uint8 or uint16", a.DType)
+	}
+	if len(a.Shape) != 2 && len(a.Shape) != 3 {
+		return nil, fmt.Errorf("cannot make an image of a %d-dimensional array, expected height x width x channels", len(a.Shape))
+	}
+	channels := raster.Grey
+	if len(a.Shape) == 3 {
+		channels = a.Shape[2]
+	}
+	img, err := raster.New(a.Shape[1], a.Shape[0], channels, depth)
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range a.Data { // New images are contiguous, in the same order as the array
+		img.Pix[i] = uint32(v)
+	}
+	return img, nil
+}
+
+// MatrixArray returns a matrix, such as the kernel from manipulations.GaussianKernel, as a rows x columns array of
+// float64
+func MatrixArray(m *matrix.Dense) *Array {
+	return &Array{Shape: []int{m.Rows, m.Cols}, DType: "float64", Data: append([]float64(nil), m.Data...)}
+}
+
+// Matrix returns the matrix a two-dimensional array holds, one-dimensional arrays giving a column vector
+func (a *Array) Matrix() (*matrix.Dense, error) {
+	if err := a.Validate(); err != nil {
+		return nil, err
+	}
+	switch len(a.Shape) {
+	case 1:
+		return matrix.Vector(a.Data...), nil
+	case 2:
+		return &matrix.Dense{Rows: a.Shape[0], Cols: a.Shape[1], Data: append([]float64(nil), a.Data...)}, nil
+	default:
+		return nil, fmt.Errorf("cannot make a matrix of a %d-dimensional array", len(a.Shape))
+	}
+}
+
+// arrayFormats maps the names and extensions of the array formats to their codecs
+var arrayFormats = map[string]struct {
+	encode func(w io.Writer, a *Array) error
+	decode func(r io.Reader) (*Array, error)
+}{
+	"csv":  {encodeArrayCSV, decodeArrayCSV},
+	"json": {encodeArrayJSON, decodeArrayJSON},
+	"npy":  {encodeNPY, decodeNPY},
+}
+
+// arrayFormat returns the name of the array format given by name or by a path's extension
+func arrayFormat(name string) (string, error) {
+	name = strings.TrimPrefix(strings.ToLower(name), ".")
+	if _, ok := arrayFormats[name]; !ok {
+		return "", fmt.Errorf("unknown array format %q, expected csv, json or npy", name)
+	}
+	return name, nil
+}
+
+// EncodeArray writes an array to w in the named format, "csv", "json" or "npy"
+func EncodeArray(w io.Writer, a *Array, format string) error {
+	format, err := arrayFormat(format)
+	if err != nil {
+		return err
+	}
+	if err := a.Validate(); err != nil {
+		return err
+	}
+	return arrayFormats[format].encode(w, a)
+}
+
+// DecodeArray reads an array in the named format from r, see EncodeArray
+func DecodeArray(r io.Reader, format string) (*Array, error) {
+	format, err := arrayFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	a, err := arrayFormats[format].decode(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.Validate(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// WriteArray writes an array to a file in the format its extension names, .csv, .json or .npy, replacing any file
+// already there
+func WriteArray(a *Array, path string) error {
+	return WriteArrayWithOptions(a, path, WriteOptions{})
+}
+
+// WriteArrayWithOptions writes an array like WriteArray, refusing to replace an existing file if options.NoOverwrite
+// is set. The format is always the one the extension names, and the options that only apply to images are ignored.
+func WriteArrayWithOptions(a *Array, path string, options WriteOptions) error {
+	format, err := arrayFormat(filepath.Ext(path))
+	if err != nil {
+		return err
+	}
+	if err := a.Validate(); err != nil { // Checked before the file is created, so nothing is left behind
+		return err
+	}
+	return createFile(path, !options.NoOverwrite, func(w io.Writer) error {
+		return arrayFormats[format].encode(w, a)
+	})
+}
+
+// ReadArray reads an array from a file in the format its extension names, see WriteArray
+func ReadArray(path string) (*Array, error) {
+	format, err := arrayFormat(filepath.Ext(path))
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) {
+		_ = file.Close() // Ignore any errors resulting from closure
+	}(file)
+	return DecodeArray(file, format)
+}
+
+// decodeArrayImage returns a codec for the format registry that reads images from an array format
+func decodeArrayImage(format string) func(r io.Reader, options ReadOptions) (*raster.Image, error) {
+	return func(r io.Reader, options ReadOptions) (*raster.Image, error) {
+		a, err := DecodeArray(r, format)
+		if err != nil {
+			return nil, err
+		}
+		img, err := a.Image()
+		if err != nil {
+			return nil, err
+		}
+		return convertLayout(img, options)
+	}
+}
+
+// encodeArrayImage returns a codec for the format registry that writes images in an array format
+func encodeArrayImage(format string) func(w io.Writer, img *raster.Image, options WriteOptions) error {
+	return func(w io.Writer, img *raster.Image, options WriteOptions) error {
+		return EncodeArray(w, ImageArray(img), format)
+	}
+}
@@ -0,0 +1,236 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// csvShapeHeader and csvTypeHeader start the comment lines that give the shape and type of an array in a CSV file
+const (
+	csvShapeHeader = "# shape:"
+	csvTypeHeader  = "# dtype:"
+)
+
+// formatElement formats an element of an array with as few digits as read it back exactly
+func formatElement(v float64, dtype string) string {
+	switch dtype {
+	case "float32":
+		return strconv.FormatFloat(v, 'g', -1, 32)
+	case "float64":
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return strconv.FormatFloat(v, 'f', -1, 64) // Whole numbers, without an exponent
+	}
+}
+
+// csvRows splits the elements of an array into the lines of a CSV file, one for each index of the first dimension
+// holding the remaining dimensions flattened, as numpy.savetxt does with a.reshape(len(a), -1)
+func csvRows(a *Array) (rows, cols int) {
+	if len(a.Shape) == 0 {
+		return 1, 1
+	}
+	if a.Shape[0] == 0 {
+		return 0, 0
+	}
+	return a.Shape[0], a.Len() / a.Shape[0]
+}
+
+// encodeArrayCSV writes an array as comma separated values, preceded by comments giving its shape and type. NumPy
+// reads it back with numpy.loadtxt(path, delimiter=",", dtype=dtype).reshape(shape).
+func encodeArrayCSV(w io.Writer, a *Array) error {
+	bw := bufio.NewWriter(w)
+	shape := make([]string, len(a.Shape))
+	for i, length := range a.Shape {
+		shape[i] = strconv.Itoa(length)
+	}
+	_, _ = fmt.Fprintf(bw, "%s %s\n%s %s\n", csvShapeHeader, strings.Join(shape, ","), csvTypeHeader, a.DType)
+
+	rows, cols := csvRows(a)
+	for i := 0; i < rows; i++ {
+		for j, v := range a.Data[i*cols : (i+1)*cols] {
+			if j > 0 {
+				_ = bw.WriteByte(',')
+			}
+			_, _ = bw.WriteString(formatElement(v, a.DType))
+		}
+		_ = bw.WriteByte('\n')
+	}
+	return bw.Flush() // Reports any error of the writes above, which bufio keeps
+}
+
+// decodeArrayCSV reads comma separated values. Files without the comments encodeArrayCSV writes are read as a float64
+// matrix with a row for each line.
+func decodeArrayCSV(r io.Reader) (*Array, error) {
+	a := &Array{DType: "float64"}
+	var shape []int
+	rows, cols := 0, -1
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<30) // Rows of large images are long
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(text, csvShapeHeader):
+			shape = []int{}
+			if fields := strings.TrimSpace(strings.TrimPrefix(text, csvShapeHeader)); fields != "" {
+				for _, field := range strings.Split(fields, ",") {
+					length, err := strconv.Atoi(strings.TrimSpace(field))
+					if err != nil {
+						return nil, fmt.Errorf("line %d: invalid shape %q", line, fields)
+					}
+					shape = append(shape, length)
+				}
+			}
+			continue
+		case strings.HasPrefix(text, csvTypeHeader):
+			a.DType = strings.TrimSpace(strings.TrimPrefix(text, csvTypeHeader))
+			continue
+		case text == "" || text[0] == '#':
+			continue
+		}
+
+		fields := strings.Split(text, ",")
+		if cols >= 0 && len(fields) != cols {
+			return nil, fmt.Errorf("line %d has %d values, expected %d like the lines above", line, len(fields), cols)
+		}
+		cols = len(fields)
+		for _, field := range fields {
+			v, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid value %q", line, field)
+			}
+			a.Data = append(a.Data, v)
+		}
+		rows++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	a.Shape = shape
+	if shape == nil {
+		a.Shape = []int{rows, max(cols, 0)}
+	}
+	return a, nil
+}
+
+// jsonArray is the JSON object arrays are written as, with the elements nested like numpy.ndarray.tolist does
+type jsonArray struct {
+	Shape []int  `json:"shape"`
+	DType string `json:"dtype"`
+	Data  any    `json:"data"`
+}
+
+// encodeArrayJSON writes an array as a JSON object holding its shape, its type and its elements as nested lists, one
+// line for each index of the first dimension. NumPy reads it back with numpy.array(data["data"], dtype=data["dtype"]).
+func encodeArrayJSON(w io.Writer, a *Array) error {
+	for _, v := range a.Data {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("JSON cannot hold the value %v", v)
+		}
+	}
+	shape, err := json.Marshal(a.Shape)
+	if err != nil {
+		return err
+	}
+	if a.Shape == nil {
+		shape = []byte("[]")
+	}
+	bw := bufio.NewWriter(w)
+	_, _ = fmt.Fprintf(bw, "{\"shape\": %s, \"dtype\": %q, \"data\": ", shape, a.DType)
+	writeNested(bw, a.Data, a.Shape, a.DType, true)
+	_, _ = bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// writeNested writes the elements of an array of the given shape as nested lists, breaking lines between the elements
+// of the outermost one
+func writeNested(bw *bufio.Writer, data []float64, shape []int, dtype string, outermost bool) {
+	if len(shape) == 0 {
+		_, _ = bw.WriteString(formatElement(data[0], dtype))
+		return
+	}
+	_ = bw.WriteByte('[')
+	step := 1
+	for _, length := range shape[1:] {
+		step *= length
+	}
+	for i := 0; i < shape[0]; i++ {
+		if i > 0 {
+			_ = bw.WriteByte(',')
+			if outermost {
+				_, _ = bw.WriteString("\n ")
+			}
+		}
+		writeNested(bw, data[i*step:(i+1)*step], shape[1:], dtype, false)
+	}
+	_ = bw.WriteByte(']')
+}
+
+// decodeArrayJSON reads an array written by encodeArrayJSON. The shape may be left out, in which case it is taken from
+// the nesting of the lists, and the type defaults to float64.
+func decodeArrayJSON(r io.Reader) (*Array, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber() // Keeps the digits, so 64-bit integers are not rounded twice
+	var object jsonArray
+	if err := decoder.Decode(&object); err != nil {
+		return nil, fmt.Errorf("reading the JSON array: %w", err)
+	}
+	if object.Data == nil {
+		return nil, errors.New("JSON array has no data")
+	}
+	a := &Array{Shape: object.Shape, DType: object.DType}
+	if a.DType == "" {
+		a.DType = "float64"
+	}
+	if a.Shape == nil {
+		a.Shape = []int{}
+		for v := object.Data; ; {
+			list, ok := v.([]any)
+			if !ok {
+				break
+			}
+			a.Shape = append(a.Shape, len(list))
+			if len(list) == 0 {
+				break
+			}
+			v = list[0]
+		}
+	}
+	var err error
+	if a.Data, err = flatten(object.Data, a.Shape, nil); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// flatten appends the elements of nested lists to data, checking that the nesting matches shape
+func flatten(v any, shape []int, data []float64) ([]float64, error) {
+	if len(shape) == 0 {
+		number, ok := v.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("JSON array holds %v where a number was expected", v)
+		}
+		f, err := strconv.ParseFloat(string(number), 64)
+		if err != nil {
+			return nil, err
+		}
+		return append(data, f), nil
+	}
+	list, ok := v.([]any)
+	if !ok || len(list) != shape[0] {
+		return nil, fmt.Errorf("JSON array data does not match the shape %v", shape)
+	}
+	var err error
+	for _, element := range list {
+		if data, err = flatten(element, shape[1:], data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
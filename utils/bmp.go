@@ -0,0 +1,355 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"matrix-image-manipulation/raster"
+)
+
+// bmpSignature is the "BM" every Windows bitmap starts with
+var bmpSignature = []byte("BM")
+
+// The compression methods of a BMP file that can be decoded
+const (
+	bmpRGB            = 0 // BI_RGB, uncompressed pixels in a fixed layout
+	bmpBitFields      = 3 // BI_BITFIELDS, uncompressed pixels with the position of each channel given by a mask
+	bmpAlphaBitFields = 6 // BI_ALPHABITFIELDS, BI_BITFIELDS with an alpha mask as well
+)
+
+// Sizes of the file header and of the information headers that are understood
+const (
+	bmpFileHeaderSize = 14
+	bmpCoreHeaderSize = 12  // BITMAPCOREHEADER, from OS/2, with 16-bit dimensions and 3-byte palette entries
+	bmpInfoHeaderSize = 40  // BITMAPINFOHEADER, the most common one
+	bmpV3HeaderSize   = 56  // BITMAPV3INFOHEADER, the first to include the alpha mask
+	bmpV4HeaderSize   = 108 // BITMAPV4HEADER, which adds the channel masks and colour space
+)
+
+// bmpHeader holds what the decoder needs from the headers of a BMP file
+type bmpHeader struct {
+	fileSize    uint32    // Size of the whole file, 0 if the writer left it out
+	offset      uint32    // Where the pixel array starts, from the beginning of the file
+	size        uint32    // Size of the information header
+	width       int       // Number of columns
+	height      int       // Number of rows
+	topDown     bool      // Whether the first row in the file is the top one, a negative height in the file
+	bitCount    int       // Bits per pixel
+	compression uint32    // One of the compression constants above
+	colours     int       // Number of palette entries
+	masks       [4]uint32 // Red, green, blue and alpha masks for 16 and 32-bit pixels, alpha may be 0
+}
+
+// decodeBMP decodes a Windows bitmap: 1, 4 and 8-bit paletted images, 16, 24 and 32-bit images, stored bottom-up or
+// top-down, uncompressed or with bit fields. Images are read as RGB, RGBA when they have an alpha channel and
+// greyscale when their palette only holds greys.
+func decodeBMP(r io.Reader, options ReadOptions) (*raster.Image, error) {
+	br := bufio.NewReader(r)
+	header, read, err := readBMPHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	// The palette sits between the headers and the pixel array
+	var palette [][3]uint32
+	grey := false // Paletted images with only grey entries are read as greyscale, like the ones encodeBMP writes
+	if header.bitCount <= 8 {
+		entrySize := 4
+		if header.size == bmpCoreHeaderSize {
+			entrySize = 3
+		}
+		entry := make([]byte, entrySize)
+		palette = make([][3]uint32, header.colours)
+		for i := range palette {
+			if _, err := io.ReadFull(br, entry); err != nil {
+				return nil, fmt.Errorf("reading the BMP palette: %w", err)
+			}
+			palette[i] = [3]uint32{uint32(entry[2]), uint32(entry[1]), uint32(entry[0])} // Entries are stored as BGR
+		}
+		read += header.colours * entrySize
+		grey = true
+		for _, entry := range palette {
+			grey = grey && entry[0] == entry[1] && entry[1] == entry[2]
+		}
+	}
+	if skip := int(header.offset) - read; skip > 0 {
+		if _, err := br.Discard(skip); err != nil {
+			return nil, fmt.Errorf("seeking to the BMP pixels: %w", err)
+		}
+	} else if skip < 0 {
+		return nil, errors.New("BMP pixel array overlaps its headers")
+	}
+
+	// 32-bit BI_RGB pixels officially leave their fourth byte unused, but many programs store alpha there. It is
+	// treated as alpha unless it is zero everywhere, which would make the whole image invisible.
+	implicitAlpha := header.bitCount == 32 && header.compression == bmpRGB
+	hasAlpha := header.masks[3] != 0
+	channels := raster.RGB
+	if hasAlpha {
+		channels = raster.RGBA
+	} else if grey {
+		channels = raster.Grey
+	}
+	rowSize := (int64(header.width)*int64(header.bitCount) + 31) / 32 * 4 // Rows are padded to a multiple of 4 bytes
+	if size := int64(header.offset) + rowSize*int64(header.height); header.fileSize != 0 && size > int64(header.fileSize) {
+		return nil, fmt.Errorf("BMP of %dx%d pixels needs %d bytes, but the file is %d bytes", header.width, header.height, size, header.fileSize)
+	}
+
+	// The rows are read in the order they are stored, and bottom-up images are flipped once they are complete
+	var row []byte
+	anyAlpha := false
+	img, err := readRows(header.width, header.height, channels, 8, func(i int, out []uint32) error {
+		if row == nil {
+			row = make([]byte, rowSize) // Once readRows has checked the size
+		}
+		if _, err := io.ReadFull(br, row); err != nil {
+			return fmt.Errorf("reading BMP row %d: %w", i, err)
+		}
+		y := header.height - 1 - i
+		if header.topDown {
+			y = i
+		}
+		for x := 0; x < header.width; x++ {
+			pixel := out[x*channels:]
+			switch header.bitCount {
+			case 1, 4, 8:
+				index := bmpIndex(row, x, header.bitCount)
+				if index >= len(palette) {
+					return fmt.Errorf("BMP pixel (%d, %d) uses colour %d of a %d colour palette", x, y, index, len(palette))
+				}
+				copy(pixel[:channels], palette[index][:])
+			case 24:
+				pixel[0], pixel[1], pixel[2] = uint32(row[3*x+2]), uint32(row[3*x+1]), uint32(row[3*x])
+			case 16, 32:
+				var value uint32
+				if header.bitCount == 16 {
+					value = uint32(binary.LittleEndian.Uint16(row[2*x:]))
+				} else {
+					value = binary.LittleEndian.Uint32(row[4*x:])
+				}
+				for c := 0; c < channels; c++ {
+					pixel[c] = extractBMPChannel(value, header.masks[c])
+				}
+				anyAlpha = anyAlpha || hasAlpha && pixel[3] != 0
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !header.topDown {
+		flipRows(img)
+	}
+
+	if implicitAlpha && !anyAlpha {
+		for i := 3; i < len(img.Pix); i += raster.RGBA {
+			img.Pix[i] = 255 // The fourth byte was padding after all
+		}
+	}
+	return convertLayout(img, options)
+}
+
+// readBMPHeader reads the file and information headers and returns them with the number of bytes read
+func readBMPHeader(r io.Reader) (*bmpHeader, int, error) {
+	fileHeader := make([]byte, bmpFileHeaderSize+4) // Followed by the size of the information header
+	if _, err := io.ReadFull(r, fileHeader); err != nil {
+		return nil, 0, fmt.Errorf("reading the BMP header: %w", err)
+	}
+	if string(fileHeader[:2]) != string(bmpSignature) {
+		return nil, 0, errors.New("file is not a BMP image")
+	}
+	header := &bmpHeader{
+		fileSize: binary.LittleEndian.Uint32(fileHeader[2:]),
+		offset:   binary.LittleEndian.Uint32(fileHeader[10:]),
+		size:     binary.LittleEndian.Uint32(fileHeader[14:]),
+	}
+	if header.size != bmpCoreHeaderSize && (header.size < bmpInfoHeaderSize || header.size > 1024) {
+		return nil, 0, fmt.Errorf("unsupported BMP header of %d bytes", header.size)
+	}
+	info := make([]byte, header.size)
+	copy(info, fileHeader[14:])
+	if _, err := io.ReadFull(r, info[4:]); err != nil {
+		return nil, 0, fmt.Errorf("reading the BMP header: %w", err)
+	}
+	read := bmpFileHeaderSize + int(header.size)
+
+	if header.size == bmpCoreHeaderSize {
+		header.width = int(binary.LittleEndian.Uint16(info[4:]))
+		header.height = int(binary.LittleEndian.Uint16(info[6:]))
+		header.bitCount = int(binary.LittleEndian.Uint16(info[10:]))
+	} else {
+		header.width = int(int32(binary.LittleEndian.Uint32(info[4:])))
+		header.height = int(int32(binary.LittleEndian.Uint32(info[8:])))
+		header.bitCount = int(binary.LittleEndian.Uint16(info[14:]))
+		header.compression = binary.LittleEndian.Uint32(info[16:])
+		header.colours = int(binary.LittleEndian.Uint32(info[32:]))
+	}
+	if header.height < 0 {
+		header.height, header.topDown = -header.height, true
+	}
+	if header.width <= 0 || header.height <= 0 {
+		return nil, 0, fmt.Errorf("invalid BMP dimensions %dx%d", header.width, header.height)
+	}
+
+	switch header.bitCount {
+	case 1, 4, 8:
+		if header.colours == 0 || header.colours > 1<<header.bitCount {
+			header.colours = 1 << header.bitCount
+		}
+	case 16, 24, 32:
+		header.colours = 0 // Any palette of true colour images is only a hint for display on old hardware
+	default:
+		return nil, 0, fmt.Errorf("unsupported BMP bit depth %d", header.bitCount)
+	}
+
+	switch header.compression {
+	case bmpRGB:
+		switch header.bitCount {
+		case 16:
+			header.masks = [4]uint32{0x7C00, 0x03E0, 0x001F, 0} // 5 bits per channel
+		case 32:
+			header.masks = [4]uint32{0x00FF0000, 0x0000FF00, 0x000000FF, 0xFF000000}
+		}
+	case bmpBitFields, bmpAlphaBitFields:
+		if header.bitCount != 16 && header.bitCount != 32 {
+			return nil, 0, fmt.Errorf("BMP bit fields require 16 or 32-bit pixels, not %d", header.bitCount)
+		}
+		count := 3
+		if header.compression == bmpAlphaBitFields || header.size >= bmpV3HeaderSize {
+			count = 4
+		}
+		masks := info[bmpInfoHeaderSize:]
+		if header.size == bmpInfoHeaderSize { // The masks follow the header instead of being part of it
+			masks = make([]byte, 4*count)
+			if _, err := io.ReadFull(r, masks); err != nil {
+				return nil, 0, fmt.Errorf("reading the BMP bit fields: %w", err)
+			}
+			read += len(masks)
+		} else if len(masks) < 4*count {
+			count = len(masks) / 4
+		}
+		for c := 0; c < count; c++ {
+			header.masks[c] = binary.LittleEndian.Uint32(masks[4*c:])
+		}
+		if header.masks[0] == 0 || header.masks[1] == 0 || header.masks[2] == 0 {
+			return nil, 0, errors.New("BMP bit fields are missing a colour mask")
+		}
+	default:
+		return nil, 0, fmt.Errorf("unsupported BMP compression %d", header.compression)
+	}
+	return header, read, nil
+}
+
+// flipRows turns a contiguous image upside down in place
+func flipRows(img *raster.Image) {
+	for top, bottom := 0, img.Height-1; top < bottom; top, bottom = top+1, bottom-1 {
+		a, b := img.Pix[top*img.Stride:(top+1)*img.Stride], img.Pix[bottom*img.Stride:(bottom+1)*img.Stride]
+		for i := range a {
+			a[i], b[i] = b[i], a[i]
+		}
+	}
+}
+
+// bmpIndex returns the palette index of pixel x in a row of 1, 4 or 8-bit pixels, packed most significant bits first
+func bmpIndex(row []byte, x, bitCount int) int {
+	perByte := 8 / bitCount
+	shift := (perByte - 1 - x%perByte) * bitCount
+	return int(row[x/perByte]>>shift) & (1<<bitCount - 1)
+}
+
+// extractBMPChannel isolates the bits of value selected by mask and scales them to 8 bits, rounding to the nearest
+func extractBMPChannel(value, mask uint32) uint32 {
+	if mask == 0 {
+		return 0
+	}
+	shift := bits.TrailingZeros32(mask)
+	maxValue := uint64(mask >> shift)
+	return uint32((uint64((value&mask)>>shift)*255 + maxValue/2) / maxValue)
+}
+
+// encodeBMP encodes an image as a bottom-up Windows bitmap.
+// Greyscale images are written as 8-bit paletted images with a grey palette, RGB images as 24-bit images and images
+// with alpha as 32-bit images with bit fields, which readers that understand BITMAPV4HEADER show with transparency.
+// BMP only stores 8 bits per sample, so 16-bit images are rounded.
+func encodeBMP(w io.Writer, img *raster.Image, options WriteOptions) error {
+	if img.Depth != 8 {
+		converted, err := img.ConvertDepth(8)
+		if err != nil {
+			return err
+		}
+		img = converted
+	}
+	if int64(img.Width) > 1<<31-1 || int64(img.Height) > 1<<31-1 {
+		return fmt.Errorf("a %dx%d image is too large for a BMP", img.Width, img.Height)
+	}
+
+	headerSize, bitCount, compression, colours := bmpInfoHeaderSize, 24, uint32(bmpRGB), 0
+	switch img.Channels {
+	case raster.Grey:
+		bitCount, colours = 8, 256
+	case raster.GreyAlpha, raster.RGBA:
+		headerSize, bitCount, compression = bmpV4HeaderSize, 32, bmpBitFields
+	}
+	rowSize := (img.Width*bitCount + 31) / 32 * 4
+	offset := bmpFileHeaderSize + headerSize + 4*colours
+	fileSize := int64(offset) + int64(rowSize)*int64(img.Height)
+	if fileSize > 1<<32-1 {
+		return fmt.Errorf("a %dx%d image is too large for a BMP", img.Width, img.Height)
+	}
+
+	header := make([]byte, offset)
+	copy(header, bmpSignature)
+	binary.LittleEndian.PutUint32(header[2:], uint32(fileSize))
+	binary.LittleEndian.PutUint32(header[10:], uint32(offset))
+	info := header[bmpFileHeaderSize:]
+	binary.LittleEndian.PutUint32(info[0:], uint32(headerSize))
+	binary.LittleEndian.PutUint32(info[4:], uint32(img.Width))
+	binary.LittleEndian.PutUint32(info[8:], uint32(img.Height)) // Positive, so rows are stored bottom-up
+	binary.LittleEndian.PutUint16(info[12:], 1)                 // Planes
+	binary.LittleEndian.PutUint16(info[14:], uint16(bitCount))
+	binary.LittleEndian.PutUint32(info[16:], compression)
+	binary.LittleEndian.PutUint32(info[20:], uint32(rowSize*img.Height))
+	binary.LittleEndian.PutUint32(info[24:], 2835) // 72 DPI, in pixels per metre
+	binary.LittleEndian.PutUint32(info[28:], 2835)
+	binary.LittleEndian.PutUint32(info[32:], uint32(colours))
+	if compression == bmpBitFields {
+		masks := [4]uint32{0x00FF0000, 0x0000FF00, 0x000000FF, 0xFF000000} // BGRA byte order
+		for c, mask := range masks {
+			binary.LittleEndian.PutUint32(info[bmpInfoHeaderSize+4*c:], mask)
+		}
+		copy(info[bmpInfoHeaderSize+16:], "BGRs") // LCS_sRGB colour space, stored little-endian
+	}
+	palette := info[headerSize:]
+	for i := 0; i < colours; i++ {
+		palette[4*i], palette[4*i+1], palette[4*i+2] = byte(i), byte(i), byte(i)
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+	row := make([]byte, rowSize)
+	for y := img.Height - 1; y >= 0; y-- {
+		for x := 0; x < img.Width; x++ {
+			pixel := img.Pix[img.PixOffset(x, y):]
+			switch img.Channels {
+			case raster.Grey:
+				row[x] = byte(pixel[0])
+			case raster.GreyAlpha:
+				row[4*x], row[4*x+1], row[4*x+2], row[4*x+3] = byte(pixel[0]), byte(pixel[0]), byte(pixel[0]), byte(pixel[1])
+			case raster.RGB:
+				row[3*x], row[3*x+1], row[3*x+2] = byte(pixel[2]), byte(pixel[1]), byte(pixel[0])
+			default:
+				row[4*x], row[4*x+1], row[4*x+2], row[4*x+3] = byte(pixel[2]), byte(pixel[1]), byte(pixel[0]), byte(pixel[3])
+			}
+		}
+		if _, err := bw.Write(row); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"matrix-image-manipulation/raster"
+)
+
+// farbfeldSignature is the "farbfeld" every farbfeld image starts with
+var farbfeldSignature = []byte("farbfeld")
+
+// farbfeldHeaderSize is the size of the header, the signature followed by the width and height
+const farbfeldHeaderSize = 16
+
+// decodeFarbfeld decodes a farbfeld image: a header followed by 16-bit big-endian RGBA samples with straight alpha,
+// which is read as a 16-bit RGBA image
+func decodeFarbfeld(r io.Reader, options ReadOptions) (*raster.Image, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, farbfeldHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("reading the farbfeld header: %w", err)
+	}
+	if string(header[:8]) != string(farbfeldSignature) {
+		return nil, errors.New("file is not a farbfeld image")
+	}
+	width, height := binary.BigEndian.Uint32(header[8:]), binary.BigEndian.Uint32(header[12:])
+	if width == 0 || height == 0 || width > 1<<31-1 || height > 1<<31-1 {
+		return nil, fmt.Errorf("invalid farbfeld dimensions %dx%d", width, height)
+	}
+
+	var row []byte
+	img, err := readRows(int(width), int(height), raster.RGBA, 16, func(y int, out []uint32) error {
+		if row == nil {
+			row = make([]byte, 2*len(out)) // Once readRows has checked the size
+		}
+		if _, err := io.ReadFull(br, row); err != nil {
+			return fmt.Errorf("reading farbfeld row %d: %w", y, err)
+		}
+		for i := range out {
+			out[i] = uint32(binary.BigEndian.Uint16(row[2*i:]))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return convertLayout(img, options)
+}
+
+// encodeFarbfeld encodes an image as a farbfeld, which always holds 16-bit RGBA, so greyscale images are written as
+// colour ones, images without alpha as opaque and 8-bit images are scaled to 16 bits without loss
+func encodeFarbfeld(w io.Writer, img *raster.Image, options WriteOptions) error {
+	if int64(img.Width) > 1<<32-1 || int64(img.Height) > 1<<32-1 {
+		return fmt.Errorf("a %dx%d image is too large for a farbfeld", img.Width, img.Height)
+	}
+	if img.Depth != 16 {
+		converted, err := img.ConvertDepth(16)
+		if err != nil {
+			return err
+		}
+		img = converted
+	}
+	alpha := img.AlphaChannel()
+
+	bw := bufio.NewWriter(w)
+	header := make([]byte, farbfeldHeaderSize)
+	copy(header, farbfeldSignature)
+	binary.BigEndian.PutUint32(header[8:], uint32(img.Width))
+	binary.BigEndian.PutUint32(header[12:], uint32(img.Height))
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+
+	row := make([]byte, 8*img.Width)
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			in := img.Pix[img.PixOffset(x, y):]
+			pixel := [4]uint32{in[0], in[0], in[0], 65535}
+			if img.Channels >= raster.RGB {
+				pixel[1], pixel[2] = in[1], in[2]
+			}
+			if alpha >= 0 {
+				pixel[3] = in[alpha]
+			}
+			for c, sample := range pixel {
+				binary.BigEndian.PutUint16(row[8*x+2*c:], uint16(sample))
+			}
+		}
+		if _, err := bw.Write(row); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,258 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"matrix-image-manipulation/raster"
+	"path/filepath"
+	"slices"
+)
+
+// builtinFormats lists the formats this package provides, PNG first as it is the default output format
+var builtinFormats = []*Format{
+	{
+		Name:       "png",
+		Extensions: []string{".png"},
+		Magic:      [][]byte{pngSignature},
+		Decode:     decodePNG,
+		Encode:     encodePNG,
+	},
+	{
+		Name:       "jpeg",
+		Extensions: []string{".jpg", ".jpeg", ".jpe", ".jfif"},
+		Magic:      [][]byte{{0xFF, 0xD8, 0xFF}}, // Start of image marker followed by the first marker of any kind
+		Decode:     decodeJPEG,
+		Encode:     encodeJPEG,
+	},
+	{
+		Name:           "gif",
+		Extensions:     []string{".gif"},
+		Magic:          [][]byte{gifSignature},
+		Decode:         decodeGIF,
+		Encode:         encodeGIF,
+		DecodeSequence: decodeGIFSequence,
+		EncodeSequence: encodeGIFSequence,
+	},
+	{
+		Name:       "bmp",
+		Extensions: []string{".bmp", ".dib"},
+		Magic:      [][]byte{bmpSignature},
+		Decode:     decodeBMP,
+		Encode:     encodeBMP,
+	},
+	{
+		Name:           "tiff",
+		Extensions:     []string{".tif", ".tiff"},
+		Magic:          [][]byte{tiffLittleEndian, tiffBigEndian},
+		Decode:         decodeTIFF,
+		Encode:         encodeTIFF,
+		DecodeSequence: decodeTIFFSequence,
+		EncodeSequence: encodeTIFFSequence,
+	},
+	{
+		Name:       "qoi",
+		Extensions: []string{".qoi"},
+		Magic:      [][]byte{qoiSignature},
+		Decode:     decodeQOI,
+		Encode:     encodeQOI,
+	},
+	{
+		Name:       "farbfeld",
+		Extensions: []string{".ff", ".farbfeld"},
+		Magic:      [][]byte{farbfeldSignature},
+		Decode:     decodeFarbfeld,
+		Encode:     encodeFarbfeld,
+	},
+	{
+		Name:       "pbm",
+		Extensions: []string{".pbm"},
+		Magic:      pbmSignatures,
+		Decode:     decodeNetpbm,
+		Encode:     encodePBM,
+	},
+	{
+		Name:       "pgm",
+		Extensions: []string{".pgm"},
+		Magic:      pgmSignatures,
+		Decode:     decodeNetpbm,
+		Encode:     encodePGM,
+	},
+	{
+		Name:       "ppm",
+		Extensions: []string{".ppm"},
+		Magic:      ppmSignatures,
+		Decode:     decodeNetpbm,
+		Encode:     encodePPM,
+	},
+	{
+		Name:       "pnm",
+		Extensions: []string{".pnm"},
+		Decode:     decodeNetpbm,
+		Encode:     encodePNM,
+	},
+	{
+		Name:       "pam",
+		Extensions: []string{".pam"},
+		Magic:      pamSignatures,
+		Bands:      true,
+		Decode:     decodeNetpbm,
+		Encode:     encodePAM,
+	},
+	{
+		Name:       "npy",
+		Extensions: []string{".npy"},
+		Magic:      [][]byte{npySignature},
+		Bands:      true,
+		Decode:     decodeArrayImage("npy"),
+		Encode:     encodeArrayImage("npy"),
+	},
+	{
+		Name:       "csv",
+		Extensions: []string{".csv"},
+		Magic:      [][]byte{[]byte(csvShapeHeader)}, // Files written by this package, others can only be read as arrays
+		Bands:      true,
+		Decode:     decodeArrayImage("csv"),
+		Encode:     encodeArrayImage("csv"),
+	},
+	{
+		Name:       "json",
+		Extensions: []string{".json"},
+		Magic:      [][]byte{[]byte(`{"shape":`)},
+		Bands:      true,
+		Decode:     decodeArrayImage("json"),
+		Encode:     encodeArrayImage("json"),
+	},
+}
+
+// formatForPath picks the format to write a file in from its extension, files without an extension are PNG images
+func formatForPath(path string) (*Format, error) {
+	extension := filepath.Ext(path)
+	if extension == "" {
+		extension = ".png"
+	}
+	f, err := formatByName(extension)
+	if err != nil {
+		return nil, fmt.Errorf("cannot choose a format for %s from its extension, set WriteOptions.Format: %w", filepath.Base(path), err)
+	}
+	return f, nil
+}
+
+// Extension returns the canonical file extension, with the leading dot, of the named format or of the format a path's
+// extension belongs to, so ".jpeg" and "jpg" both give ".jpg"
+func Extension(format string) (string, error) {
+	f, err := formatByName(format)
+	if err != nil {
+		return "", err
+	}
+	return f.Extensions[0], nil
+}
+
+// convertLayout converts a decoded image to the layout and depth requested by options, their zero values keep the
+// image's own
+func convertLayout(img *raster.Image, options ReadOptions) (*raster.Image, error) {
+	channels, depth := options.Channels, options.Depth
+	if channels == 0 {
+		channels = img.Channels
+	}
+	if depth == 0 {
+		depth = img.Depth
+	}
+	switch {
+	case channels == img.Channels && depth == img.Depth:
+		return img, nil
+	case channels == img.Channels:
+		return img.ConvertDepth(depth) // Rounds each sample, with no detour through premultiplied colour
+	default:
+		return raster.FromImageAs(img, channels, depth)
+	}
+}
+
+// readRows creates an image of the given size and fills it row by row with read, which is handed the samples of row y
+// to set. The samples grow as the rows arrive, so a header claiming more pixels than the file holds fails when the data
+// runs out rather than first taking up the memory it claims.
+func readRows(width, height, channels, depth int, read func(y int, row []uint32) error) (*raster.Image, error) {
+	if err := raster.CheckSize(width, height, channels); err != nil {
+		return nil, err
+	}
+	img, err := raster.New(width, 0, channels, depth)
+	if err != nil {
+		return nil, err
+	}
+	img.Pix = make([]uint32, 0, min(width*height*channels, 1<<20))
+	for y := 0; y < height; y++ {
+		n := len(img.Pix)
+		img.Pix = slices.Grow(img.Pix, img.Stride)[:n+img.Stride]
+		if err := read(y, img.Pix[n:]); err != nil {
+			return nil, err
+		}
+	}
+	img.Height = height
+	return img, nil
+}
+
+// dropAlpha returns the colour channels of an image with an alpha channel, for formats that cannot store alpha. Other
+// images are returned as they are.
+func dropAlpha(img *raster.Image) (*raster.Image, error) {
+	alpha := img.AlphaChannel()
+	if alpha < 0 {
+		return img, nil
+	}
+	return raster.MergeChannels(img.SplitChannels()[:alpha]...)
+}
+
+// decodeJPEG decodes a baseline or progressive JPEG image with its metadata, which is read as RGB or greyscale as JPEG
+// has no alpha. Photos the camera stored on their side are turned upright.
+func decodeJPEG(r io.Reader, options ReadOptions) (*raster.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	imageData, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	img, err := raster.FromImageAs(imageData, options.Channels, options.Depth)
+	if err != nil {
+		return nil, err
+	}
+	return withMetadata(img, readJPEGMetadata(data)), nil
+}
+
+// encodeJPEG encodes an image as a JPEG with the requested quality.
+// JPEG only stores 8-bit samples without alpha, so 16-bit images are rounded to 8 bits and alpha is dropped.
+func encodeJPEG(w io.Writer, img *raster.Image, options WriteOptions) error {
+	quality := options.Quality
+	if quality == 0 {
+		quality = jpeg.DefaultQuality
+	}
+	if quality < 1 || quality > 100 {
+		return fmt.Errorf("invalid JPEG quality %d, expected 1 to 100", quality)
+	}
+
+	metadata := img.Metadata // Kept aside, dropping the alpha channel builds a new image
+	img, err := dropAlpha(img)
+	if err != nil {
+		return err
+	}
+	if img.Depth != 8 {
+		converted, err := img.ConvertDepth(8)
+		if err != nil {
+			return err
+		}
+		img = converted
+	}
+	out, err := img.ToImage()
+	if err != nil {
+		return err
+	}
+	if !metadata.Empty() {
+		segments, err := jpegMetadataSegments(metadata)
+		if err != nil {
+			return err
+		}
+		w = &spliceWriter{w: w, offset: 2, extra: segments} // After the start of image marker
+	}
+	return jpeg.Encode(w, out, &jpeg.Options{Quality: quality})
+}
@@ -0,0 +1,267 @@
+package utils
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"matrix-image-manipulation/raster"
+	"sort"
+	"time"
+)
+
+// gifSignature matches both the GIF87a and GIF89a versions
+var gifSignature = []byte("GIF8")
+
+// gifDelayUnit is the resolution of GIF frame delays
+const gifDelayUnit = 10 * time.Millisecond
+
+// gifOpaqueThreshold is the alpha, out of 255, from which a pixel is written as opaque, as GIF only knows fully
+// transparent and fully opaque pixels
+const gifOpaqueThreshold = 128
+
+// decodeGIF decodes the first frame of a GIF image
+func decodeGIF(r io.Reader, options ReadOptions) (*raster.Image, error) {
+	imageData, err := gif.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	return raster.FromImageAs(imageData, options.Channels, options.Depth)
+}
+
+// decodeGIFSequence decodes every frame of an animated GIF.
+// GIF frames usually only cover the part of the canvas that changed, so they are drawn onto a canvas following each
+// frame's disposal method, and every frame of the sequence holds the complete picture shown at that point.
+func decodeGIFSequence(r io.Reader, options ReadOptions) (*raster.Sequence, error) {
+	animation, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := image.Rect(0, 0, animation.Config.Width, animation.Config.Height)
+	if bounds.Empty() && len(animation.Image) > 0 { // Some encoders leave the logical screen size out
+		bounds = animation.Image[0].Bounds()
+	}
+	canvas := image.NewNRGBA(bounds) // Starts out transparent, as browsers show the background
+	sequence := &raster.Sequence{Frames: make([]raster.Frame, len(animation.Image)), LoopCount: animation.LoopCount}
+
+	for i, frame := range animation.Image {
+		var disposal raster.Disposal
+		if i < len(animation.Disposal) {
+			disposal = raster.Disposal(animation.Disposal[i])
+		}
+		var previous *image.NRGBA
+		if disposal == raster.DisposalPrevious {
+			previous = image.NewNRGBA(bounds)
+			copy(previous.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		img, err := raster.FromImageAs(canvas, options.Channels, options.Depth)
+		if err != nil {
+			return nil, err
+		}
+		sequence.Frames[i] = raster.Frame{Image: img, Delay: time.Duration(animation.Delay[i]) * gifDelayUnit, Disposal: disposal}
+
+		switch disposal {
+		case raster.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case raster.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return sequence, nil
+}
+
+// encodeGIF encodes a still image as a GIF, see encodeGIFSequence
+func encodeGIF(w io.Writer, img *raster.Image, options WriteOptions) error {
+	return encodeGIFSequence(w, raster.NewSequence(img), options)
+}
+
+// encodeGIFSequence encodes a sequence as an animated GIF.
+// Every frame covers the whole canvas and gets its own palette of up to 256 colours chosen by median cut, one of them
+// transparent if the frame has transparent pixels. Frames keep their delay, rounded to hundredths of a second, and
+// their disposal. A frame without one is written to be cleared when it or the next frame has transparent pixels, so
+// transparent pixels do not show the frame before through them.
+func encodeGIFSequence(w io.Writer, sequence *raster.Sequence, options WriteOptions) error {
+	if err := sequence.Validate(); err != nil {
+		return err
+	}
+
+	first := sequence.Frames[0].Image
+	animation := &gif.GIF{
+		Image:     make([]*image.Paletted, len(sequence.Frames)),
+		Delay:     make([]int, len(sequence.Frames)),
+		Disposal:  make([]byte, len(sequence.Frames)),
+		LoopCount: sequence.LoopCount,
+		Config:    image.Config{Width: first.Width, Height: first.Height},
+	}
+	for i, frame := range sequence.Frames {
+		if err := validGIFDelay(frame.Delay); err != nil {
+			return fmt.Errorf("frame %d: %w", i, err)
+		}
+		animation.Image[i] = quantise(frame.Image)
+		animation.Delay[i] = int((frame.Delay + gifDelayUnit/2) / gifDelayUnit)
+	}
+	for i, frame := range sequence.Frames {
+		animation.Disposal[i] = byte(frame.Disposal)
+		next := i+1 < len(animation.Image) && hasTransparency(animation.Image[i+1])
+		if frame.Disposal == raster.DisposalUnspecified && (hasTransparency(animation.Image[i]) || next) {
+			animation.Disposal[i] = gif.DisposalBackground
+		}
+	}
+	animation.Config.ColorModel = animation.Image[0].Palette
+	return gif.EncodeAll(w, animation)
+}
+
+// hasTransparency reports whether a paletted image made by quantise has transparent pixels, which it gives the last
+// palette entry
+func hasTransparency(img *image.Paletted) bool {
+	_, _, _, a := img.Palette[len(img.Palette)-1].RGBA()
+	return a == 0
+}
+
+// quantise converts an image to a paletted image with a palette generated for it by median cut
+func quantise(img *raster.Image) *image.Paletted {
+	// Count how often each opaque colour occurs, reduced to 8 bits as GIF stores it
+	histogram := map[color.NRGBA]int{}
+	transparent := false
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A < gifOpaqueThreshold {
+				transparent = true
+				continue
+			}
+			c.A = 255
+			histogram[c]++
+		}
+	}
+
+	colours := 256
+	if transparent {
+		colours-- // Keep an entry for the transparent colour
+	}
+	opaque := medianCut(histogram, colours)
+	palette := opaque
+	if transparent {
+		palette = append(opaque[:len(opaque):len(opaque)], color.NRGBA{})
+	}
+	if len(palette) == 0 {
+		palette = color.Palette{color.Black} // GIF requires at least one colour
+	}
+
+	out := image.NewPaletted(img.Bounds(), palette)
+	indices := map[color.NRGBA]uint8{} // Nearest palette entry of every colour seen so far
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A < gifOpaqueThreshold {
+				out.SetColorIndex(x, y, uint8(len(palette)-1))
+				continue
+			}
+			c.A = 255
+			index, ok := indices[c]
+			if !ok {
+				index = uint8(opaque.Index(c))
+				indices[c] = index
+			}
+			out.SetColorIndex(x, y, index)
+		}
+	}
+	return out
+}
+
+// weightedColour is a colour of an image and the number of pixels that have it
+type weightedColour struct {
+	rgb   [3]uint8
+	count int
+}
+
+// medianCut chooses up to n colours representing the histogram. Images with no more than n colours keep them
+// exactly. Otherwise the colours are repeatedly split in two at the median of the channel they vary most in, always
+// splitting the box with the widest range, and each final box is represented by the average of its colours.
+func medianCut(histogram map[color.NRGBA]int, n int) color.Palette {
+	all := make([]weightedColour, 0, len(histogram))
+	for c, count := range histogram {
+		all = append(all, weightedColour{rgb: [3]uint8{c.R, c.G, c.B}, count: count})
+	}
+	// Sort for deterministic output, map iteration order is random
+	sort.Slice(all, func(i, j int) bool {
+		a, b := all[i].rgb, all[j].rgb
+		return a[0] < b[0] || a[0] == b[0] && (a[1] < b[1] || a[1] == b[1] && a[2] < b[2])
+	})
+
+	boxes := [][]weightedColour{all}
+	if len(all) <= n {
+		boxes = make([][]weightedColour, len(all))
+		for i := range all {
+			boxes[i] = all[i : i+1]
+		}
+	}
+	for len(boxes) < n {
+		// Find the box with the widest range along any channel
+		widest, channel, width := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			for c := 0; c < 3; c++ {
+				low, high := box[0].rgb[c], box[0].rgb[c]
+				for _, colour := range box {
+					low, high = min(low, colour.rgb[c]), max(high, colour.rgb[c])
+				}
+				if int(high-low) > width || widest < 0 {
+					widest, channel, width = i, c, int(high-low)
+				}
+			}
+		}
+		if widest < 0 {
+			break // Every box holds a single colour
+		}
+
+		// Split it where half of its pixels lie on either side
+		box := boxes[widest]
+		sort.SliceStable(box, func(i, j int) bool { return box[i].rgb[channel] < box[j].rgb[channel] })
+		total := 0
+		for _, colour := range box {
+			total += colour.count
+		}
+		split, seen := 1, box[0].count
+		for split < len(box)-1 && seen*2 < total {
+			seen += box[split].count
+			split++
+		}
+		boxes[widest] = box[:split:split]
+		boxes = append(boxes, box[split:])
+	}
+
+	palette := make(color.Palette, len(boxes))
+	for i, box := range boxes {
+		var sum [3]int
+		total := 0
+		for _, colour := range box {
+			for c := range sum {
+				sum[c] += int(colour.rgb[c]) * colour.count
+			}
+			total += colour.count
+		}
+		palette[i] = color.NRGBA{
+			R: uint8((sum[0] + total/2) / total),
+			G: uint8((sum[1] + total/2) / total),
+			B: uint8((sum[2] + total/2) / total),
+			A: 255,
+		}
+	}
+	return palette
+}
+
+// validGIFDelay reports whether a delay fits in the 16 bits GIF stores it in
+func validGIFDelay(delay time.Duration) error {
+	if units := (delay + gifDelayUnit/2) / gifDelayUnit; units > 0xFFFF {
+		return fmt.Errorf("a delay of %v is too long for a GIF", delay)
+	}
+	return nil
+}
@@ -1,15 +1,42 @@
 package utils
 
 import (
+	"bufio"
 	"errors"
-	"image"
-	"image/color"
-	"image/png"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"matrix-image-manipulation/raster"
 	"os"
+	"path/filepath"
+	"strconv"
 )
 
-// ReadImageToMatrix takes a path for a given PNG image and returns a 2D uint8 slice that represents the matrix for that image
-func ReadImageToMatrix(path string) ([][][4]uint32, error) {
+// ReadOptions controls how ReadImageWithOptions converts a file into a raster.Image
+type ReadOptions struct {
+	// Depth is the bit depth of the returned image, either 8 or 16.
+	// The zero value keeps the precision of the file: 16-bit files are read with 16 bits, everything else with 8.
+	Depth int
+
+	// Channels is the channel layout of the returned image, one of raster.Grey, raster.GreyAlpha, raster.RGB or
+	// raster.RGBA. The zero value keeps the layout of the file: greyscale files are read with a single channel,
+	// colour JPEGs, PPMs and BMPs and QOIs without alpha as RGB, PAM images with as many channels as they have and
+	// everything else as RGBA.
+	Channels int
+}
+
+// ReadImage takes a path for a given PNG, JPEG, GIF, BMP, TIFF, QOI, farbfeld or Netpbm image and returns the
+// raster.Image that represents it, with 4 channels of 8 bits each
+func ReadImage(path string) (*raster.Image, error) {
+	return ReadImageWithOptions(path, ReadOptions{Depth: 8, Channels: raster.RGBA})
+}
+
+// ReadImageWithOptions takes a path for a given image and returns the raster.Image that represents it.
+// The format is recognised from the file's signature rather than its extension. Animated GIFs return their first frame.
+// The metadata of PNG and JPEG files is kept in the image, and photos the EXIF data says are on their side are turned
+// upright.
+func ReadImageWithOptions(path string, options ReadOptions) (*raster.Image, error) {
 	file, err := os.Open(path) // Open the provided file
 	if err != nil {
 		return nil, err
@@ -18,69 +45,312 @@ func ReadImageToMatrix(path string) ([][][4]uint32, error) {
 		_ = file.Close() // Ignore any errors resulting from closure
 	}(file)
 
-	isPNG, err := AssertSignature(file, []byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}) // Check the file's signature against the known PNG signature
+	img, _, err := Decode(file, options)
+	return img, err
+}
+
+// ReadSequence reads every frame of an animated image, such as a GIF, with its timing and loop count, or every page of
+// a multi-page TIFF. Still images are returned as a sequence of a single frame, so callers can handle both the same
+// way.
+func ReadSequence(path string, options ReadOptions) (*raster.Sequence, error) {
+	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
-	if !isPNG {
-		return nil, errors.New("file is not a PNG image")
+	defer func(file *os.File) {
+		_ = file.Close() // Ignore any errors resulting from closure
+	}(file)
+
+	sequence, _, err := DecodeSequence(file, options)
+	return sequence, err
+}
+
+// Decode reads an image from r, such as an upload held in memory or the standard input, like ReadImageWithOptions
+// does from a file. Like image.Decode, it also returns the name of the format, which was recognised from the
+// signature.
+func Decode(r io.Reader, options ReadOptions) (*raster.Image, string, error) {
+	br, f, err := sniff(r)
+	if err != nil {
+		return nil, "", err
 	}
+	img, err := f.Decode(br, options)
+	return img, f.Name, err
+}
 
-	imageData, err := png.Decode(file) // Decode the os.File to an image.Image
+// DecodeSequence reads every frame of an image from r, see ReadSequence, and returns them with the name of the format
+func DecodeSequence(r io.Reader, options ReadOptions) (*raster.Sequence, string, error) {
+	br, f, err := sniff(r)
 	if err != nil {
+		return nil, "", err
+	}
+	if f.DecodeSequence == nil {
+		img, err := f.Decode(br, options)
+		if err != nil {
+			return nil, "", err
+		}
+		return raster.NewSequence(img), f.Name, nil
+	}
+	sequence, err := f.DecodeSequence(br, options)
+	return sequence, f.Name, err
+}
+
+// sniff recognises the format of the image r holds from its signature, without consuming it from the returned reader
+func sniff(r io.Reader) (io.Reader, *Format, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(MaxSignatureLength) // Short files simply match nothing
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, nil, err
+	}
+	f, err := DetectFormat(header)
+	if err != nil {
+		return nil, nil, err
+	}
+	return br, f, nil
+}
+
+// WriteOptions controls how WriteImageWithOptions encodes a raster.Image
+type WriteOptions struct {
+	// Format is the name of the output format, "png", "jpeg", "gif", "bmp", "tiff", "qoi", "farbfeld", "pbm", "pgm",
+	// "ppm", "pnm", "pam" or any format registered with RegisterFormat, or one of their extensions.
+	// The zero value picks the format from the extension of the path, and files without an extension are PNG images.
+	Format string
+
+	// Quality is the JPEG quality from 1 to 100, higher is better and larger. The zero value uses
+	// jpeg.DefaultQuality. Lossless formats ignore it.
+	Quality int
+
+	// Compression is the TIFF compression, "none", "lzw" or "deflate". The zero value writes uncompressed TIFFs, which
+	// every reader understands. Other formats ignore it.
+	Compression string
+
+	// CompressionLevel is how hard PNG images are compressed, from 1, the fastest, to 9, the smallest. The zero value
+	// uses zlib's default of 6. Other formats ignore it.
+	CompressionLevel int
+
+	// Depth is the bit depth of PNG images, 8 or 16, so 16-bit results can be saved as 8-bit files or the other way
+	// round. The zero value keeps the image's own. Other formats ignore it.
+	Depth int
+
+	// Interlace writes PNG images interlaced with Adam7, so a browser can show a coarse version of the image before all
+	// of it has arrived. Interlaced files are usually a little larger. Other formats ignore it.
+	Interlace bool
+
+	// Plain writes PBM, PGM and PPM images in their plain variants, P1 to P3, whose samples are ASCII numbers that can
+	// be read and edited by hand. Other formats ignore it.
+	Plain bool
+
+	// Strip removes metadata from the output, for privacy or to save space. The zero value copies every piece of
+	// metadata the output format can hold, PNG and JPEG keep text, EXIF data, ICC profiles and the resolution.
+	Strip Strip
+
+	// NoOverwrite refuses to replace an existing file, WriteImageWithOptions, WriteSequence and WriteArrayWithOptions
+	// then return an error wrapping fs.ErrExist. The zero value replaces it, although only once the new contents have
+	// been written in full.
+	NoOverwrite bool
+}
+
+// WriteImage takes an image from ReadImage and writes it to a given path in the format matching its extension.
+// 16-bit images are written as 16-bit PNGs, everything else as 8-bit. PNGs are written in the smallest colour type
+// that holds the image without loss, such as greyscale for grey images, whatever their layout, and a palette for 8-bit
+// images of up to 256 colours.
+func WriteImage(img *raster.Image, path string) error {
+	return WriteImageWithOptions(img, path, WriteOptions{})
+}
+
+// WriteImageWithOptions writes an image to a given path in the format and with the settings requested by options
+func WriteImageWithOptions(img *raster.Image, path string, options WriteOptions) error {
+	f, err := imageFormat(img, path, options) // Checked before the file is created, so nothing is left behind
+	if err != nil {
+		return err
+	}
+	img = stripMetadata(img, options.Strip)
+	return createFile(path, !options.NoOverwrite, func(w io.Writer) error {
+		return f.Encode(w, img, options) // Encode in the chosen format
+	})
+}
+
+// Encode writes an image to w, such as the standard output, in the format named by options.Format, or as a PNG if it
+// is empty since there is no extension to pick one from
+func Encode(w io.Writer, img *raster.Image, options WriteOptions) error {
+	f, err := imageFormat(img, "", options)
+	if err != nil {
+		return err
+	}
+	return f.Encode(w, stripMetadata(img, options.Strip), options)
+}
+
+// imageFormat validates an image and picks the format to write it in, which must be able to hold its channels
+func imageFormat(img *raster.Image, path string, options WriteOptions) (*Format, error) {
+	if err := img.Validate(); err != nil {
 		return nil, err
 	}
+	f, err := outputFormat(path, options)
+	if err != nil {
+		return nil, err
+	}
+	if img.Channels > raster.RGBA && !f.Bands {
+		return nil, fmt.Errorf("cannot write a %d channel image as %s, write a PAM instead", img.Channels, f.Name)
+	}
+	return f, nil
+}
 
-	width, height := imageData.Bounds().Dx(), imageData.Bounds().Dy() // Get the width and height of the image
-
-	// This operation is inherently 0(n²), alternative implementations have been studied where imageData was cast to an
-	// image.NRGBA however this implementation didn't provide us with an operable 2D matrix
-
-	matrix := Make2D[[4]uint32](width, height)
-
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			r, g, b, a := imageData.At(x, y).RGBA()
-			// @NOTE(Mauro):In Go, the image.Image interface's At(x, y).RGBA() method returns color values as four
-			// uint32s, where each color component (Red, Green, Blue, Alpha) is represented in the range [0, 65535].
-			// This is essentially a 16-bit per channel representation.
-			//
-			// However, typical image processing and display systems use 8-bit per channel representations,
-			// where each color component is in the range [0, 255].
-			//
-			// 257 is used (which is 65535/255) as the divisor is to properly scale down these 16-bit values
-			// to 8-bit values.
-			// When you divide each component by 257, you map the 16-bit range [0, 65535] to the 8-bit range [0, 255]
-			// effectively.
-			matrix[x][y] = [4]uint32{r / 257, g / 257, b / 257, a / 257}
-		}
+// WriteSequence writes every frame of a sequence to a given path. Animated formats, such as GIF, keep the timing and
+// loop count, and TIFF writes each frame as a page. Other formats can only hold a sequence of a single frame.
+func WriteSequence(sequence *raster.Sequence, path string, options WriteOptions) error {
+	f, err := sequenceFormat(sequence, path, options)
+	if err != nil {
+		return err
 	}
+	return createFile(path, !options.NoOverwrite, func(w io.Writer) error {
+		return encodeSequence(w, sequence, f, options)
+	})
+}
 
-	return matrix, nil
+// EncodeSequence writes every frame of a sequence to w, see WriteSequence and Encode
+func EncodeSequence(w io.Writer, sequence *raster.Sequence, options WriteOptions) error {
+	f, err := sequenceFormat(sequence, "", options)
+	if err != nil {
+		return err
+	}
+	return encodeSequence(w, sequence, f, options)
 }
 
-// WriteImageFromMatrix takes a matrix from ReadImageToMatrix and outputs a PNG image to a given path
-func WriteImageFromMatrix(matrix [][][4]uint32, path string) error {
-	height, width := len(matrix[0]), len(matrix)           // Get the width and height of the matrix
-	img := image.NewNRGBA(image.Rect(0, 0, width, height)) // Create a new generic image with the appropriate width and height
+// sequenceFormat validates a sequence and picks the format to write it in, which must be able to hold its frames
+func sequenceFormat(sequence *raster.Sequence, path string, options WriteOptions) (*Format, error) {
+	if err := sequence.ValidatePages(); err != nil { // Animated formats also check that the frames have the same size
+		return nil, err
+	}
+	f, err := outputFormat(path, options)
+	if err != nil {
+		return nil, err
+	}
+	if f.EncodeSequence == nil && len(sequence.Frames) != 1 {
+		return nil, fmt.Errorf("%s images cannot hold %d frames, write a GIF or TIFF instead", f.Name, len(sequence.Frames))
+	}
+	for i, frame := range sequence.Frames {
+		if frame.Image.Channels > raster.RGBA && !f.Bands {
+			return nil, fmt.Errorf("cannot write frame %d, a %d channel image, as %s", i, frame.Image.Channels, f.Name)
+		}
+	}
+	return f, nil
+}
 
-	// Iterate through the matrix and set values for each of the pixels
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			current := matrix[x][y]
-			r, g, b, a := current[0], current[1], current[2], current[3]
-			img.SetNRGBA(x, y, color.NRGBA{R: uint8(r), G: uint8(g), B: uint8(b), A: uint8(a)})
+// encodeSequence encodes a sequence in a format, which holds a single frame unless it is animated or multi-page
+func encodeSequence(w io.Writer, sequence *raster.Sequence, f *Format, options WriteOptions) error {
+	if f.EncodeSequence == nil {
+		return f.Encode(w, stripMetadata(sequence.Frames[0].Image, options.Strip), options)
+	}
+	if options.Strip != 0 {
+		stripped := &raster.Sequence{Frames: make([]raster.Frame, len(sequence.Frames)), LoopCount: sequence.LoopCount}
+		for i, frame := range sequence.Frames {
+			stripped.Frames[i] = frame
+			stripped.Frames[i].Image = stripMetadata(frame.Image, options.Strip)
 		}
+		sequence = stripped
+	}
+	return f.EncodeSequence(w, sequence, options)
+}
+
+// outputFormat picks the format to write a file in, the one requested by options or else the one its extension names
+func outputFormat(path string, options WriteOptions) (*Format, error) {
+	var f *Format
+	var err error
+	if options.Format != "" {
+		f, err = formatByName(options.Format)
+	} else {
+		f, err = formatForPath(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f.Encode == nil {
+		return nil, fmt.Errorf("%w: writing %s images is not supported", ErrUnsupportedFormat, f.Name)
+	}
+	return f, nil
+}
+
+// createFile writes the file at path with write. The contents go to a temporary file in the same directory, which
+// replaces path once they are complete, so a failed write never leaves a truncated file behind and an existing file is
+// only lost to a finished one. Unless overwrite is set, an existing file at path is an error wrapping fs.ErrExist.
+func createFile(path string, overwrite bool, write func(w io.Writer) error) (err error) {
+	info, err := os.Stat(path)
+	switch {
+	case err == nil && !overwrite:
+		return fmt.Errorf("%s: %w", path, fs.ErrExist)
+	case err == nil && !info.Mode().IsRegular():
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	mode := fs.FileMode(0666) // Narrowed by the umask, as os.Create does
+	if err == nil {
+		mode = info.Mode().Perm() // Replacing a file keeps its permissions
 	}
 
-	file, err := os.Create(path) // Create the file
-	if err != nil {              // Return errors
+	file, err := createTemporary(path, mode)
+	if err != nil {
 		return err
 	}
-	defer func(file *os.File) {
-		_ = file.Close() // Close the file
-	}(file)
+	defer func() {
+		if err != nil { // Remove what was written of the contents
+			_ = file.Close()
+			_ = os.Remove(file.Name())
+		}
+	}()
+	if err = write(file); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil { // Make sure the contents are stored before they replace anything
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	if overwrite {
+		return os.Rename(file.Name(), path)
+	}
+	// A link fails if path has been created since it was checked, where a rename would replace it
+	if err = os.Link(file.Name(), path); errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%s: %w", path, fs.ErrExist)
+	} else if err != nil { // The file system has no hard links
+		if _, err = os.Lstat(path); err == nil {
+			return fmt.Errorf("%s: %w", path, fs.ErrExist)
+		}
+		return os.Rename(file.Name(), path)
+	}
+	return os.Remove(file.Name())
+}
 
-	// Encode as PNG
-	return png.Encode(file, img)
+// createTemporary creates an empty file with the given permissions next to path, with a name of its own that is
+// hidden on Unix
+func createTemporary(path string, mode fs.FileMode) (*os.File, error) {
+	directory, name := filepath.Split(path)
+	for attempt := 0; ; attempt++ {
+		temporary := filepath.Join(directory, "."+name+"."+strconv.FormatUint(rand.Uint64(), 36)+".tmp")
+		file, err := os.OpenFile(temporary, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if errors.Is(err, fs.ErrExist) && attempt < 100 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if mode == 0666 {
+			return file, nil
+		}
+		if err := file.Chmod(mode); err != nil { // Exactly the permissions of the file it replaces, whatever the umask
+			_ = file.Close()
+			_ = os.Remove(temporary)
+			return nil, err
+		}
+		return file, nil
+	}
+}
+
+// WriteFloatImage quantises a float image to the given bit depth and writes it to a given path, see WriteImage.
+// This is the only point at which a chain of float operations is rounded back to integers.
+func WriteFloatImage(f *raster.Float, path string, depth int) error {
+	img, err := f.ToImage(depth)
+	if err != nil {
+		return err
+	}
+	return WriteImage(img, path)
 }
@@ -0,0 +1,498 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"matrix-image-manipulation/raster"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Strip selects the metadata WriteOptions.Strip removes from the output
+type Strip uint
+
+const (
+	StripText       Strip = 1 << iota // Text chunks, comments and XMP, which may name the author or the software used
+	StripEXIF                         // EXIF data, which may hold the camera, the time and the place a photo was taken
+	StripColour                       // ICC profile and gamma, without which colours may be shown differently
+	StripResolution                   // Physical size of the pixels
+
+	StripAll = StripText | StripEXIF | StripColour | StripResolution
+)
+
+// stripNames maps the names accepted by ParseStrip to what they remove
+var stripNames = map[string]Strip{
+	"text":       StripText,
+	"exif":       StripEXIF,
+	"colour":     StripColour,
+	"color":      StripColour,
+	"resolution": StripResolution,
+	"all":        StripAll,
+}
+
+// ParseStrip parses a comma separated list of the metadata to strip, such as "exif,text", from text, exif, colour,
+// resolution and all. An empty string strips nothing.
+func ParseStrip(s string) (Strip, error) {
+	var strip Strip
+	if strings.TrimSpace(s) == "" {
+		return 0, nil
+	}
+	for _, name := range strings.Split(s, ",") {
+		flag, ok := stripNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return 0, fmt.Errorf("unknown metadata %q, expected text, exif, colour, resolution or all", name)
+		}
+		strip |= flag
+	}
+	return strip, nil
+}
+
+// stripMetadata returns img without the metadata selected by strip, as a shallow copy sharing its pixels if anything
+// has to be removed
+func stripMetadata(img *raster.Image, strip Strip) *raster.Image {
+	if strip == 0 || img.Metadata.Empty() {
+		return img
+	}
+	metadata := img.Metadata.Clone()
+	if strip&StripText != 0 {
+		metadata.Text = nil
+	}
+	if strip&StripEXIF != 0 {
+		metadata.EXIF = nil
+	}
+	if strip&StripColour != 0 {
+		metadata.ICCProfile, metadata.Gamma = nil, 0
+	}
+	if strip&StripResolution != 0 {
+		metadata.Resolution = nil
+	}
+	stripped := *img
+	stripped.Metadata = metadata
+	if metadata.Empty() {
+		stripped.Metadata = nil
+	}
+	return &stripped
+}
+
+// withMetadata attaches metadata to a decoded image, unless it is empty, and turns the image upright if the EXIF data
+// says it was stored on its side or upside down
+func withMetadata(img *raster.Image, metadata *raster.Metadata) *raster.Image {
+	if metadata.Empty() {
+		return img
+	}
+	img.Metadata = metadata
+	orientation, order, offset := exifOrientation(metadata.EXIF)
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	upright := img.Orient(orientation)
+	order.PutUint16(upright.Metadata.EXIF[offset:], 1) // The pixels are upright now, so readers must not turn them again
+	return upright
+}
+
+// exifOrientation finds the orientation in EXIF data, returning it with the byte order and the offset of its value, or
+// 0 if there is none
+func exifOrientation(exif []byte) (int, binary.ByteOrder, int) {
+	var order binary.ByteOrder
+	switch {
+	case len(exif) < 8:
+		return 0, nil, 0
+	case bytes.HasPrefix(exif, tiffLittleEndian):
+		order = binary.LittleEndian
+	case bytes.HasPrefix(exif, tiffBigEndian):
+		order = binary.BigEndian
+	default:
+		return 0, nil, 0
+	}
+	directory := uint64(order.Uint32(exif[4:]))
+	if directory+2 > uint64(len(exif)) {
+		return 0, nil, 0
+	}
+	entries := int(order.Uint16(exif[directory:]))
+	for i := 0; i < entries; i++ {
+		entry := int(directory) + 2 + 12*i
+		if entry+12 > len(exif) {
+			break
+		}
+		if order.Uint16(exif[entry:]) == tiffOrientation && order.Uint16(exif[entry+2:]) == tiffShort {
+			return int(order.Uint16(exif[entry+8:])), order, entry + 8
+		}
+	}
+	return 0, nil, 0
+}
+
+// maxMetadataLength caps the size of compressed text and profiles once inflated, so a small file cannot take up
+// unbounded memory
+const maxMetadataLength = 16 << 20
+
+// inflate decompresses zlib data of at most maxMetadataLength bytes
+func inflate(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	inflated, err := io.ReadAll(io.LimitReader(r, maxMetadataLength+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(inflated) > maxMetadataLength {
+		return nil, errors.New("compressed metadata is too large")
+	}
+	return inflated, nil
+}
+
+// deflate compresses data with zlib
+func deflate(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	_, _ = zw.Write(data) // Writing to a bytes.Buffer cannot fail
+	_ = zw.Close()
+	return buf.Bytes()
+}
+
+// latin1 converts ISO 8859-1 text, the encoding of tEXt and zTXt chunks, to UTF-8
+func latin1(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// toLatin1 converts UTF-8 text to ISO 8859-1, reporting false if it has characters ISO 8859-1 lacks
+func toLatin1(s string) ([]byte, bool) {
+	out := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xFF || r == 0 {
+			return nil, false
+		}
+		out = append(out, byte(r))
+	}
+	return out, true
+}
+
+// pngCompressText is the length from which text chunks are compressed
+const pngCompressText = 1024
+
+// readPNGMetadata reads the text, colour, resolution and EXIF chunks of a PNG file. Malformed chunks are skipped,
+// like any ancillary chunk a decoder does not understand.
+func readPNGMetadata(data []byte) *raster.Metadata {
+	metadata := &raster.Metadata{}
+	chunks := &pngChunkReader{r: bufio.NewReader(bytes.NewReader(data[len(pngSignature):]))}
+	for {
+		chunkType, chunk, err := chunks.next()
+		if err != nil || chunkType == "IEND" {
+			return metadata
+		}
+		keyword, rest, found := bytes.Cut(chunk, []byte{0})
+		switch chunkType {
+		case "tEXt":
+			if found {
+				metadata.Text = append(metadata.Text, raster.TextEntry{Keyword: latin1(keyword), Text: latin1(rest)})
+			}
+		case "zTXt":
+			if found && len(rest) > 0 && rest[0] == 0 {
+				if text, err := inflate(rest[1:]); err == nil {
+					metadata.Text = append(metadata.Text, raster.TextEntry{Keyword: latin1(keyword), Text: latin1(text)})
+				}
+			}
+		case "iTXt":
+			if text, ok := readITXt(rest); found && ok {
+				metadata.Text = append(metadata.Text, raster.TextEntry{Keyword: latin1(keyword), Text: text})
+			}
+		case "iCCP":
+			if found && len(rest) > 0 && rest[0] == 0 {
+				if profile, err := inflate(rest[1:]); err == nil {
+					metadata.ICCProfile = profile
+				}
+			}
+		case "gAMA":
+			if len(chunk) == 4 && binary.BigEndian.Uint32(chunk) != 0 {
+				metadata.Gamma = float64(binary.BigEndian.Uint32(chunk)) / 100000
+			}
+		case "pHYs":
+			if len(chunk) == 9 && binary.BigEndian.Uint32(chunk) != 0 && binary.BigEndian.Uint32(chunk[4:]) != 0 {
+				metadata.Resolution = &raster.Resolution{
+					X:          float64(binary.BigEndian.Uint32(chunk)),
+					Y:          float64(binary.BigEndian.Uint32(chunk[4:])),
+					AspectOnly: chunk[8] != 1, // 1 is the metre, the only unit defined
+				}
+			}
+		case "eXIf":
+			metadata.EXIF = append([]byte(nil), chunk...)
+		}
+	}
+}
+
+// readITXt reads the text of an iTXt chunk after its keyword: the compression flag and method, the language tag and
+// translated keyword, which are dropped, and the UTF-8 text
+func readITXt(data []byte) (string, bool) {
+	if len(data) < 2 {
+		return "", false
+	}
+	compressed, method := data[0] == 1, data[1]
+	_, rest, found := bytes.Cut(data[2:], []byte{0}) // Language tag
+	if !found {
+		return "", false
+	}
+	_, text, found := bytes.Cut(rest, []byte{0}) // Translated keyword
+	if !found || compressed && method != 0 {
+		return "", false
+	}
+	if compressed {
+		var err error
+		if text, err = inflate(text); err != nil {
+			return "", false
+		}
+	}
+	return string(text), utf8.Valid(text)
+}
+
+// pngMetadataChunks encodes metadata as PNG chunks, which can all go straight after IHDR
+func pngMetadataChunks(metadata *raster.Metadata) ([]byte, error) {
+	var buf bytes.Buffer
+	if len(metadata.ICCProfile) > 0 {
+		_ = writeChunk(&buf, "iCCP", append([]byte("ICC profile\x00\x00"), deflate(metadata.ICCProfile)...))
+	}
+	if metadata.Gamma > 0 { // Readers that understand the profile ignore it
+		_ = writeChunk(&buf, "gAMA", binary.BigEndian.AppendUint32(nil, uint32(math.Round(metadata.Gamma*100000))))
+	}
+	if r := metadata.Resolution; r != nil && r.X >= 1 && r.Y >= 1 && r.X <= math.MaxUint32 && r.Y <= math.MaxUint32 {
+		phys := binary.BigEndian.AppendUint32(nil, uint32(math.Round(r.X)))
+		phys = binary.BigEndian.AppendUint32(phys, uint32(math.Round(r.Y)))
+		unit := byte(1)
+		if r.AspectOnly {
+			unit = 0
+		}
+		_ = writeChunk(&buf, "pHYs", append(phys, unit))
+	}
+	for _, entry := range metadata.Text {
+		keyword, ok := toLatin1(entry.Keyword)
+		if !ok || len(keyword) == 0 || len(keyword) > 79 {
+			return nil, fmt.Errorf("invalid PNG text keyword %q, expected 1 to 79 Latin-1 characters", entry.Keyword)
+		}
+		chunk := append(keyword, 0)
+		text, latin := toLatin1(entry.Text)
+		switch {
+		case entry.Keyword == xmpKeyword: // XMP readers scan for it, so it is always uncompressed iTXt
+			_ = writeChunk(&buf, "iTXt", append(append(chunk, 0, 0, 0, 0), entry.Text...))
+		case latin && len(text) < pngCompressText:
+			_ = writeChunk(&buf, "tEXt", append(chunk, text...))
+		case latin:
+			_ = writeChunk(&buf, "zTXt", append(append(chunk, 0), deflate(text)...))
+		case len(entry.Text) < pngCompressText: // UTF-8 text, without a language tag or translated keyword
+			_ = writeChunk(&buf, "iTXt", append(append(chunk, 0, 0, 0, 0), entry.Text...))
+		default:
+			_ = writeChunk(&buf, "iTXt", append(append(chunk, 1, 0, 0, 0), deflate([]byte(entry.Text))...))
+		}
+	}
+	if len(metadata.EXIF) > 0 {
+		_ = writeChunk(&buf, "eXIf", metadata.EXIF)
+	}
+	return buf.Bytes(), nil
+}
+
+// JPEG markers and the signatures of the application segments that hold metadata
+const (
+	jpegSOI  = 0xD8
+	jpegEOI  = 0xD9
+	jpegSOS  = 0xDA
+	jpegAPP0 = 0xE0
+	jpegAPP1 = 0xE1
+	jpegAPP2 = 0xE2
+	jpegCOM  = 0xFE
+)
+
+var (
+	jfifSignature = []byte("JFIF\x00")
+	exifSignature = []byte("Exif\x00\x00")
+	xmpSignature  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	iccSignature  = []byte("ICC_PROFILE\x00")
+)
+
+// xmpKeyword is the keyword PNG gives XMP in an iTXt chunk, and that XMP from JPEGs is given in the metadata
+const xmpKeyword = "XML:com.adobe.xmp"
+
+// jpegComment is the keyword JPEG comments are given in the metadata
+const jpegComment = "Comment"
+
+// maxJPEGSegment is the largest payload of a JPEG segment, whose length of 16 bits counts itself
+const maxJPEGSegment = 65533
+
+// readJPEGMetadata reads the JFIF density, EXIF data, XMP, ICC profile and comments of a JPEG file, which all come
+// before the image data
+func readJPEGMetadata(data []byte) *raster.Metadata {
+	metadata := &raster.Metadata{}
+	profile := map[byte][]byte{} // ICC profiles are split into numbered chunks
+	chunks := 0
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			break
+		}
+		marker := data[i+1]
+		if marker == 0xFF { // Fill byte
+			i++
+			continue
+		}
+		if marker == jpegSOS || marker == jpegEOI {
+			break
+		}
+		if marker == jpegSOI || marker == 0x01 || marker >= 0xD0 && marker <= 0xD7 { // Markers without a length
+			i += 2
+			continue
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) || end < i+4 {
+			break
+		}
+		payload := data[i+4 : end]
+		i = end
+
+		switch {
+		case marker == jpegAPP0 && bytes.HasPrefix(payload, jfifSignature) && len(payload) >= 12:
+			x, y := float64(binary.BigEndian.Uint16(payload[8:])), float64(binary.BigEndian.Uint16(payload[10:]))
+			if x == 0 || y == 0 {
+				continue
+			}
+			switch payload[7] {
+			case 0:
+				metadata.Resolution = &raster.Resolution{X: x, Y: y, AspectOnly: true}
+			case 1: // Dots per inch
+				metadata.Resolution = &raster.Resolution{X: x / 0.0254, Y: y / 0.0254}
+			case 2: // Dots per centimetre
+				metadata.Resolution = &raster.Resolution{X: x * 100, Y: y * 100}
+			}
+		case marker == jpegAPP1 && bytes.HasPrefix(payload, exifSignature):
+			metadata.EXIF = append([]byte(nil), payload[len(exifSignature):]...)
+		case marker == jpegAPP1 && bytes.HasPrefix(payload, xmpSignature):
+			metadata.Text = append(metadata.Text, raster.TextEntry{Keyword: xmpKeyword, Text: string(payload[len(xmpSignature):])})
+		case marker == jpegAPP2 && bytes.HasPrefix(payload, iccSignature) && len(payload) > len(iccSignature)+2:
+			sequence := payload[len(iccSignature)]
+			chunks = int(payload[len(iccSignature)+1])
+			profile[sequence] = payload[len(iccSignature)+2:]
+		case marker == jpegCOM:
+			metadata.Text = append(metadata.Text, raster.TextEntry{Keyword: jpegComment, Text: string(payload)})
+		}
+	}
+
+	if len(profile) > 0 && len(profile) == chunks {
+		sequences := make([]int, 0, len(profile))
+		for sequence := range profile {
+			sequences = append(sequences, int(sequence))
+		}
+		sort.Ints(sequences)
+		if sequences[0] == 1 && sequences[len(sequences)-1] == chunks { // Chunks are numbered from 1, none may be missing
+			for _, sequence := range sequences {
+				metadata.ICCProfile = append(metadata.ICCProfile, profile[byte(sequence)]...)
+			}
+		}
+	}
+	return metadata
+}
+
+// jpegMetadataSegments encodes metadata as JPEG segments, which go straight after the start of image marker. JPEG has
+// no place for the gamma, and text other than comments and XMP is written as a comment that starts with its keyword.
+func jpegMetadataSegments(metadata *raster.Metadata) ([]byte, error) {
+	var buf bytes.Buffer
+	segment := func(marker byte, parts ...[]byte) error {
+		length := 0
+		for _, part := range parts {
+			length += len(part)
+		}
+		if length > maxJPEGSegment {
+			return fmt.Errorf("JPEG segment of %d bytes is too large, at most %d fit", length, maxJPEGSegment)
+		}
+		buf.Write([]byte{0xFF, marker})
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(length+2)))
+		for _, part := range parts {
+			buf.Write(part)
+		}
+		return nil
+	}
+
+	if r := metadata.Resolution; r != nil {
+		// JFIF version 1.02, then the unit and the density, which is written in dots per inch unless only the aspect
+		// ratio is known, and no thumbnail
+		jfif, x, y := []byte{1, 2, 1}, math.Round(r.X*0.0254), math.Round(r.Y*0.0254)
+		if r.AspectOnly {
+			jfif[2], x, y = 0, math.Round(r.X), math.Round(r.Y)
+		}
+		if x >= 1 && y >= 1 && x <= math.MaxUint16 && y <= math.MaxUint16 {
+			jfif = binary.BigEndian.AppendUint16(jfif, uint16(x))
+			jfif = binary.BigEndian.AppendUint16(jfif, uint16(y))
+			_ = segment(jpegAPP0, jfifSignature, append(jfif, 0, 0))
+		}
+	}
+	if len(metadata.EXIF) > 0 {
+		if err := segment(jpegAPP1, exifSignature, metadata.EXIF); err != nil {
+			return nil, fmt.Errorf("writing the EXIF data: %w", err)
+		}
+	}
+	for _, entry := range metadata.Text {
+		if entry.Keyword == xmpKeyword {
+			if err := segment(jpegAPP1, xmpSignature, []byte(entry.Text)); err != nil {
+				return nil, fmt.Errorf("writing the XMP data: %w", err)
+			}
+		}
+	}
+
+	// ICC profiles larger than a segment are split, each chunk giving its number and how many there are
+	chunkSize := maxJPEGSegment - len(iccSignature) - 2
+	chunks := (len(metadata.ICCProfile) + chunkSize - 1) / chunkSize
+	if chunks > 255 {
+		return nil, fmt.Errorf("ICC profile of %d bytes is too large for a JPEG", len(metadata.ICCProfile))
+	}
+	for i := 0; i < chunks; i++ {
+		chunk := metadata.ICCProfile[i*chunkSize : min((i+1)*chunkSize, len(metadata.ICCProfile))]
+		_ = segment(jpegAPP2, iccSignature, []byte{byte(i + 1), byte(chunks)}, chunk)
+	}
+
+	for _, entry := range metadata.Text {
+		text := entry.Text
+		switch entry.Keyword {
+		case xmpKeyword:
+			continue
+		case jpegComment:
+		default:
+			text = entry.Keyword + ": " + text
+		}
+		if err := segment(jpegCOM, []byte(text)); err != nil {
+			return nil, fmt.Errorf("writing the comment %s: %w", entry.Keyword, err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// spliceWriter passes writes through to w, inserting extra once offset bytes have been written, which is how metadata
+// is added to the output of the standard library's JPEG encoder without holding all of it in memory
+type spliceWriter struct {
+	w      io.Writer
+	offset int
+	extra  []byte
+}
+
+// Write writes p, with the extra bytes in the middle if the offset falls inside it
+func (s *spliceWriter) Write(p []byte) (int, error) {
+	if s.extra == nil || len(p) < s.offset {
+		n, err := s.w.Write(p)
+		s.offset -= n
+		return n, err
+	}
+	n, err := s.w.Write(p[:s.offset])
+	if err != nil {
+		return n, err
+	}
+	if _, err := s.w.Write(s.extra); err != nil {
+		return n, err
+	}
+	s.extra = nil
+	m, err := s.w.Write(p[s.offset:])
+	return n + m, err
+}
@@ -0,0 +1,461 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"matrix-image-manipulation/raster"
+	"strconv"
+	"strings"
+)
+
+// Signatures of the Netpbm formats, the plain (ASCII) variants first
+var (
+	pbmSignatures = [][]byte{[]byte("P1"), []byte("P4")}
+	pgmSignatures = [][]byte{[]byte("P2"), []byte("P5")}
+	ppmSignatures = [][]byte{[]byte("P3"), []byte("P6")}
+	pamSignatures = [][]byte{[]byte("P7")}
+)
+
+// netpbmLineLength is the longest line plain Netpbm files may have
+const netpbmLineLength = 70
+
+// netpbmHeader holds what the decoder needs from the header of a Netpbm file
+type netpbmHeader struct {
+	kind     byte // The digit after the P of the signature
+	width    int
+	height   int
+	channels int
+	maxval   int // Largest sample value, which stands for full intensity
+}
+
+// plain reports whether the samples are written as ASCII numbers
+func (h *netpbmHeader) plain() bool {
+	return h.kind >= '1' && h.kind <= '3'
+}
+
+// bitmap reports whether the image is a PBM, whose samples are bits with 1 for black
+func (h *netpbmHeader) bitmap() bool {
+	return h.kind == '1' || h.kind == '4'
+}
+
+// netpbmReader reads Netpbm headers and plain samples, which are whitespace separated numbers with comments running
+// from a # to the end of the line
+type netpbmReader struct {
+	*bufio.Reader
+}
+
+// skip discards whitespace and comments up to the next token
+func (r netpbmReader) skip() error {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch {
+		case b == '#':
+			if _, err := r.ReadString('\n'); err != nil {
+				return err
+			}
+		case !isNetpbmSpace(b):
+			return r.UnreadByte()
+		}
+	}
+}
+
+// number reads the next non-negative decimal number and the single whitespace character that ends it
+func (r netpbmReader) number() (int, error) {
+	if err := r.skip(); err != nil {
+		return 0, err
+	}
+	n, digits := 0, 0
+	for {
+		b, err := r.ReadByte()
+		if errors.Is(err, io.EOF) && digits > 0 {
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if isNetpbmSpace(b) && digits > 0 {
+			return n, nil
+		}
+		if b < '0' || b > '9' {
+			return 0, fmt.Errorf("unexpected %q in a Netpbm number", b)
+		}
+		if n > (1<<31-1)/10 {
+			return 0, errors.New("Netpbm number is too large")
+		}
+		n, digits = n*10+int(b-'0'), digits+1
+	}
+}
+
+// bit reads the next sample of a plain PBM, a single 0 or 1 that need not be separated from the next one
+func (r netpbmReader) bit() (uint32, error) {
+	if err := r.skip(); err != nil {
+		return 0, err
+	}
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != '0' && b != '1' {
+		return 0, fmt.Errorf("unexpected %q in a PBM image", b)
+	}
+	return uint32(b - '0'), nil
+}
+
+// isNetpbmSpace reports whether b separates tokens in a Netpbm file
+func isNetpbmSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\v' || b == '\f'
+}
+
+// decodeNetpbm decodes any Netpbm image: PBM, PGM and PPM in their plain and binary variants, P1 to P6, and PAM, P7.
+// Bitmaps and greymaps are read as greyscale and pixmaps as RGB, PAM images keep their depth as the number of
+// channels. Images with a maxval above 255 are read with 16 bits, and samples are scaled to the full range of the
+// bit depth.
+func decodeNetpbm(r io.Reader, options ReadOptions) (*raster.Image, error) {
+	nr := netpbmReader{bufio.NewReader(r)}
+	signature := make([]byte, 2)
+	if _, err := io.ReadFull(nr, signature); err != nil {
+		return nil, fmt.Errorf("reading the Netpbm signature: %w", err)
+	}
+	if signature[0] != 'P' || signature[1] < '1' || signature[1] > '7' {
+		return nil, errors.New("file is not a Netpbm image")
+	}
+
+	header := &netpbmHeader{kind: signature[1]}
+	var err error
+	if header.kind == '7' {
+		err = readPAMHeader(nr, header)
+	} else {
+		err = readNetpbmHeader(nr, header)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	depth, full := 8, uint32(255)
+	if header.maxval > 255 {
+		depth, full = 16, 65535
+	}
+	img, err := readRows(header.width, header.height, header.channels, depth, func(y int, row []uint32) error {
+		if err := readNetpbmRow(nr, header, row); err != nil {
+			return fmt.Errorf("reading Netpbm row %d: %w", y, err)
+		}
+		for i, sample := range row {
+			if sample > uint32(header.maxval) {
+				return fmt.Errorf("Netpbm sample %d exceeds the maxval of %d", sample, header.maxval)
+			}
+			if header.bitmap() {
+				sample = 1 - sample // PBM uses 1 for black
+			}
+			row[i] = (sample*full + uint32(header.maxval)/2) / uint32(header.maxval)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return convertLayout(img, options)
+}
+
+// readNetpbmHeader reads the width, height and maxval of a PBM, PGM or PPM image, following its signature
+func readNetpbmHeader(r netpbmReader, header *netpbmHeader) error {
+	fields := []*int{&header.width, &header.height, &header.maxval}
+	header.channels = raster.Grey
+	switch header.kind {
+	case '1', '4':
+		fields, header.maxval = fields[:2], 1 // Bitmaps have no maxval
+	case '3', '6':
+		header.channels = raster.RGB
+	}
+	for _, field := range fields {
+		n, err := r.number()
+		if err != nil {
+			return fmt.Errorf("reading the Netpbm header: %w", err)
+		}
+		*field = n
+	}
+	return validateNetpbmHeader(header)
+}
+
+// readPAMHeader reads the header of a PAM image, lines of a keyword and its value up to ENDHDR
+func readPAMHeader(r netpbmReader, header *netpbmHeader) error {
+	var tupleType []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("reading the PAM header: %w", err)
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		keyword := fields[0]
+		if keyword == "ENDHDR" {
+			break
+		}
+		if keyword == "TUPLTYPE" { // May be given over several lines, which are joined
+			tupleType = append(tupleType, fields[1:]...)
+			continue
+		}
+		field := map[string]*int{"WIDTH": &header.width, "HEIGHT": &header.height, "DEPTH": &header.channels, "MAXVAL": &header.maxval}[keyword]
+		if field == nil {
+			return fmt.Errorf("unknown PAM header keyword %q", keyword)
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("PAM header keyword %s expects a single value", keyword)
+		}
+		if *field, err = strconv.Atoi(fields[1]); err != nil {
+			return fmt.Errorf("invalid PAM %s: %w", keyword, err)
+		}
+	}
+	if err := validateNetpbmHeader(header); err != nil {
+		return err
+	}
+	if tuple := strings.Join(tupleType, " "); strings.HasSuffix(tuple, "_ALPHA") && header.channels != raster.GreyAlpha && header.channels != raster.RGBA {
+		return fmt.Errorf("PAM tuple type %s does not match a depth of %d", tuple, header.channels)
+	}
+	return nil
+}
+
+// validateNetpbmHeader checks the values of a header
+func validateNetpbmHeader(header *netpbmHeader) error {
+	if header.width <= 0 || header.height <= 0 {
+		return fmt.Errorf("invalid Netpbm dimensions %dx%d", header.width, header.height)
+	}
+	if header.channels <= 0 {
+		return fmt.Errorf("invalid PAM depth %d", header.channels)
+	}
+	if header.maxval <= 0 || header.maxval > 65535 {
+		return fmt.Errorf("invalid Netpbm maxval %d, expected 1 to 65535", header.maxval)
+	}
+	return raster.CheckSize(header.width, header.height, header.channels) // Before anything is allocated for the pixels
+}
+
+// readNetpbmRow reads the samples of one row of an image into row
+func readNetpbmRow(r netpbmReader, header *netpbmHeader, row []uint32) error {
+	switch {
+	case header.kind == '1':
+		for i := range row {
+			bit, err := r.bit()
+			if err != nil {
+				return err
+			}
+			row[i] = bit
+		}
+	case header.plain():
+		for i := range row {
+			n, err := r.number()
+			if err != nil {
+				return err
+			}
+			row[i] = uint32(n)
+		}
+	case header.kind == '4': // Packed 8 pixels to a byte, most significant bit first, with each row starting a new byte
+		packed := make([]byte, (len(row)+7)/8)
+		if _, err := io.ReadFull(r, packed); err != nil {
+			return err
+		}
+		for i := range row {
+			row[i] = uint32(packed[i/8]>>(7-i%8)) & 1
+		}
+	default: // One byte per sample, or two big-endian bytes when maxval needs them
+		size := 1
+		if header.maxval > 255 {
+			size = 2
+		}
+		data := make([]byte, len(row)*size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		for i := range row {
+			if size == 1 {
+				row[i] = uint32(data[i])
+			} else {
+				row[i] = uint32(data[2*i])<<8 | uint32(data[2*i+1])
+			}
+		}
+	}
+	return nil
+}
+
+// encodePBM encodes an image as a PBM. Pixels are black when their luma is below half of the full range and white
+// otherwise, alpha is dropped.
+func encodePBM(w io.Writer, img *raster.Image, options WriteOptions) error {
+	grey, err := netpbmLayout(img, raster.Grey)
+	if err != nil {
+		return err
+	}
+	kind, half := byte('4'), uint32(1)<<(grey.Depth-1)
+	if options.Plain {
+		kind = '1'
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := fmt.Fprintf(bw, "P%c\n%d %d\n", kind, grey.Width, grey.Height); err != nil {
+		return err
+	}
+	plain := &plainWriter{w: bw}
+	packed := make([]byte, (grey.Width+7)/8)
+	for y := 0; y < grey.Height; y++ {
+		clear(packed)
+		for x := 0; x < grey.Width; x++ {
+			if grey.Pix[grey.PixOffset(x, y)] >= half {
+				continue // White is 0
+			}
+			packed[x/8] |= 0x80 >> (x % 8)
+		}
+		if kind == '4' {
+			if _, err := bw.Write(packed); err != nil {
+				return err
+			}
+			continue
+		}
+		for x := 0; x < grey.Width; x++ {
+			plain.write(uint32(packed[x/8]>>(7-x%8)) & 1)
+		}
+		plain.endRow()
+	}
+	if plain.err != nil {
+		return plain.err
+	}
+	return bw.Flush()
+}
+
+// encodePGM encodes an image as a PGM, converting colour images to greyscale and dropping alpha. 16-bit images keep
+// their 16 bits with a maxval of 65535.
+func encodePGM(w io.Writer, img *raster.Image, options WriteOptions) error {
+	grey, err := netpbmLayout(img, raster.Grey)
+	if err != nil {
+		return err
+	}
+	kind := byte('5')
+	if options.Plain {
+		kind = '2'
+	}
+	return writeNetpbm(w, grey, fmt.Sprintf("P%c\n%d %d\n%d\n", kind, grey.Width, grey.Height, grey.MaxValue()), options.Plain)
+}
+
+// encodePPM encodes an image as a PPM, converting greyscale images to RGB and dropping alpha. 16-bit images keep their
+// 16 bits with a maxval of 65535.
+func encodePPM(w io.Writer, img *raster.Image, options WriteOptions) error {
+	rgb, err := netpbmLayout(img, raster.RGB)
+	if err != nil {
+		return err
+	}
+	kind := byte('6')
+	if options.Plain {
+		kind = '3'
+	}
+	return writeNetpbm(w, rgb, fmt.Sprintf("P%c\n%d %d\n%d\n", kind, rgb.Width, rgb.Height, rgb.MaxValue()), options.Plain)
+}
+
+// encodePNM encodes greyscale images as PGMs and everything else as PPMs, for files with the generic .pnm extension
+func encodePNM(w io.Writer, img *raster.Image, options WriteOptions) error {
+	if img.Channels <= raster.GreyAlpha {
+		return encodePGM(w, img, options)
+	}
+	return encodePPM(w, img, options)
+}
+
+// encodePAM encodes an image as a PAM, which holds any number of channels, so every layout is written as it is.
+// PAM has no plain variant, so options.Plain is ignored.
+func encodePAM(w io.Writer, img *raster.Image, options WriteOptions) error {
+	header := fmt.Sprintf("P7\nWIDTH %d\nHEIGHT %d\nDEPTH %d\nMAXVAL %d\n", img.Width, img.Height, img.Channels, img.MaxValue())
+	if tupleType, ok := map[int]string{
+		raster.Grey:      "GRAYSCALE",
+		raster.GreyAlpha: "GRAYSCALE_ALPHA",
+		raster.RGB:       "RGB",
+		raster.RGBA:      "RGB_ALPHA",
+	}[img.Channels]; ok {
+		header += "TUPLTYPE " + tupleType + "\n" // Other depths are plain bands with no tuple type
+	}
+	return writeNetpbm(w, img, header+"ENDHDR\n", false)
+}
+
+// netpbmLayout converts an image to the given layout without alpha, for the formats that only hold one layout
+func netpbmLayout(img *raster.Image, channels int) (*raster.Image, error) {
+	opaque, err := dropAlpha(img)
+	if err != nil {
+		return nil, err
+	}
+	if opaque.Channels == channels {
+		return opaque, nil
+	}
+	return raster.FromImageAs(opaque, channels, opaque.Depth)
+}
+
+// writeNetpbm writes a header followed by the samples of img, as bytes, big-endian pairs of bytes for 16-bit images,
+// or ASCII numbers when plain is set
+func writeNetpbm(w io.Writer, img *raster.Image, header string, plain bool) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(header); err != nil {
+		return err
+	}
+	samples := img.Width * img.Channels
+	size := img.Depth / 8
+	data := make([]byte, samples*size)
+	writer := &plainWriter{w: bw}
+	for y := 0; y < img.Height; y++ {
+		row := img.Pix[img.PixOffset(0, y) : img.PixOffset(0, y)+samples]
+		if plain {
+			for _, sample := range row {
+				writer.write(sample)
+			}
+			writer.endRow()
+			continue
+		}
+		for i, sample := range row {
+			if size == 1 {
+				data[i] = byte(sample)
+			} else {
+				data[2*i], data[2*i+1] = byte(sample>>8), byte(sample)
+			}
+		}
+		if _, err := bw.Write(data); err != nil {
+			return err
+		}
+	}
+	if writer.err != nil {
+		return writer.err
+	}
+	return bw.Flush()
+}
+
+// plainWriter writes the samples of plain Netpbm images as numbers separated by spaces, starting a new line for every
+// row and whenever a line would grow past netpbmLineLength. The first error is kept and later writes are skipped.
+type plainWriter struct {
+	w      *bufio.Writer
+	column int // Length of the current line
+	err    error
+}
+
+// write writes a single sample
+func (p *plainWriter) write(sample uint32) {
+	if p.err != nil {
+		return
+	}
+	text := strconv.FormatUint(uint64(sample), 10)
+	if p.column > 0 && p.column+1+len(text) > netpbmLineLength {
+		p.err = p.w.WriteByte('\n')
+		p.column = 0
+	} else if p.column > 0 {
+		p.err = p.w.WriteByte(' ')
+		p.column++
+	}
+	if p.err == nil {
+		_, p.err = p.w.WriteString(text)
+		p.column += len(text)
+	}
+}
+
+// endRow ends the line of the current row
+func (p *plainWriter) endRow() {
+	if p.err == nil && p.column > 0 {
+		p.err = p.w.WriteByte('\n')
+		p.column = 0
+	}
+}
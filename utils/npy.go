@@ -0,0 +1,231 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// npySignature is the "\x93NUMPY" every .npy file starts with
+var npySignature = []byte("\x93NUMPY")
+
+// npyAlignment is the multiple of bytes the header is padded to, so the data is aligned in memory when mapped
+const npyAlignment = 64
+
+// npyMaxElements caps the size of arrays read, so a corrupt header cannot take up unbounded memory
+const npyMaxElements = 1 << 31
+
+// Fields of the header, which is a Python dictionary literal
+var (
+	npyDescr   = regexp.MustCompile(`'descr'\s*:\s*'([<>|=])([uif])(\d+)'`)
+	npyFortran = regexp.MustCompile(`'fortran_order'\s*:\s*(True|False)`)
+	npyShape   = regexp.MustCompile(`'shape'\s*:\s*\(([^)]*)\)`)
+)
+
+// npyDescriptor returns the type descriptor of an element type, little-endian as NumPy writes on most machines
+func npyDescriptor(dtype string) string {
+	t := arrayDTypes[dtype]
+	order := "<"
+	if t.size == 1 {
+		order = "|" // Byte order does not apply
+	}
+	return fmt.Sprintf("%s%c%d", order, t.kind, t.size)
+}
+
+// npyDType returns the element type of a kind and size of a type descriptor
+func npyDType(kind byte, size int) (string, bool) {
+	for name, t := range arrayDTypes {
+		if t.kind == kind && t.size == size {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// encodeNPY writes an array in the .npy format of NumPy, which numpy.load reads back with its shape and type
+func encodeNPY(w io.Writer, a *Array) error {
+	shape := make([]string, len(a.Shape))
+	for i, length := range a.Shape {
+		shape[i] = strconv.Itoa(length)
+	}
+	tuple := strings.Join(shape, ", ")
+	if len(shape) == 1 {
+		tuple += "," // A Python tuple of one element
+	}
+	header := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': (%s), }", npyDescriptor(a.DType), tuple)
+
+	// Version 1.0 gives the header length in 2 bytes, version 2.0 in 4 for headers that do not fit
+	version, lengthSize := byte(1), 2
+	if len(header)+1+len(npySignature)+2+lengthSize > math.MaxUint16 {
+		version, lengthSize = 2, 4
+	}
+	prefix := len(npySignature) + 2 + lengthSize
+	padding := (npyAlignment - (prefix+len(header)+1)%npyAlignment) % npyAlignment
+	header += strings.Repeat(" ", padding) + "\n"
+
+	bw := bufio.NewWriter(w)
+	_, _ = bw.Write(npySignature)
+	_, _ = bw.Write([]byte{version, 0})
+	if version == 1 {
+		_, _ = bw.Write(binary.LittleEndian.AppendUint16(nil, uint16(len(header))))
+	} else {
+		_, _ = bw.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(header))))
+	}
+	_, _ = bw.WriteString(header)
+
+	t := arrayDTypes[a.DType]
+	element := make([]byte, t.size)
+	for _, v := range a.Data {
+		switch {
+		case a.DType == "float32":
+			binary.LittleEndian.PutUint32(element, math.Float32bits(float32(v)))
+		case a.DType == "float64":
+			binary.LittleEndian.PutUint64(element, math.Float64bits(v))
+		case t.kind == 'i':
+			putElement(element, uint64(int64(v)))
+		default:
+			putElement(element, uint64(v))
+		}
+		_, _ = bw.Write(element)
+	}
+	return bw.Flush() // Reports any error of the writes above, which bufio keeps
+}
+
+// putElement stores the low bytes of an integer in a little-endian element
+func putElement(element []byte, v uint64) {
+	for i := range element {
+		element[i] = byte(v >> (8 * i))
+	}
+}
+
+// decodeNPY reads an array in the .npy format of NumPy, of any byte order and in C or Fortran order
+func decodeNPY(r io.Reader) (*Array, error) {
+	br := bufio.NewReader(r)
+	prefix := make([]byte, len(npySignature)+2)
+	if _, err := io.ReadFull(br, prefix); err != nil {
+		return nil, fmt.Errorf("reading the .npy header: %w", err)
+	}
+	if !bytes.HasPrefix(prefix, npySignature) {
+		return nil, errors.New("file is not a .npy array")
+	}
+	lengthSize := 2
+	switch prefix[len(npySignature)] {
+	case 1:
+	case 2, 3:
+		lengthSize = 4
+	default:
+		return nil, fmt.Errorf("unsupported .npy version %d.%d", prefix[len(npySignature)], prefix[len(npySignature)+1])
+	}
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(br, length[:lengthSize]); err != nil {
+		return nil, fmt.Errorf("reading the .npy header: %w", err)
+	}
+	header := make([]byte, binary.LittleEndian.Uint32(length))
+	if len(header) > 1<<20 {
+		return nil, fmt.Errorf(".npy header of %d bytes is too large", len(header))
+	}
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("reading the .npy header: %w", err)
+	}
+
+	// Parse the dictionary, which gives the type, the order and the shape
+	descr := npyDescr.FindSubmatch(header)
+	if descr == nil {
+		return nil, fmt.Errorf("unsupported .npy element type in %q, expected integers or floating point", bytes.TrimSpace(header))
+	}
+	size, _ := strconv.Atoi(string(descr[3]))
+	dtype, ok := npyDType(descr[2][0], size)
+	if !ok {
+		return nil, fmt.Errorf("unsupported .npy element type %s%s", descr[2], descr[3])
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if descr[1][0] == '>' {
+		order = binary.BigEndian
+	}
+	fortran := npyFortran.FindSubmatch(header)
+	shape := npyShape.FindSubmatch(header)
+	if fortran == nil || shape == nil {
+		return nil, fmt.Errorf("invalid .npy header %q", bytes.TrimSpace(header))
+	}
+	a := &Array{Shape: []int{}, DType: dtype}
+	for _, field := range strings.Split(string(shape[1]), ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue // The trailing comma of a tuple
+		}
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 || n > npyMaxElements {
+			return nil, fmt.Errorf("invalid .npy shape (%s)", shape[1])
+		}
+		a.Shape = append(a.Shape, n)
+		if a.Len() > npyMaxElements { // Neither factor exceeds npyMaxElements, so the product cannot overflow
+			return nil, fmt.Errorf(".npy array of shape (%s) is too large", shape[1])
+		}
+	}
+
+	// Read the elements, growing the array as they arrive so a truncated file fails before taking up the memory its
+	// header claims
+	t := arrayDTypes[dtype]
+	element := make([]byte, t.size)
+	a.Data = make([]float64, 0, min(a.Len(), 1<<20))
+	for i := 0; i < a.Len(); i++ {
+		if _, err := io.ReadFull(br, element); err != nil {
+			return nil, fmt.Errorf("reading element %d of the .npy data: %w", i, err)
+		}
+		switch {
+		case t.kind == 'f' && t.size == 4:
+			a.Data = append(a.Data, float64(math.Float32frombits(order.Uint32(element))))
+		case t.kind == 'f':
+			a.Data = append(a.Data, math.Float64frombits(order.Uint64(element)))
+		default:
+			a.Data = append(a.Data, elementValue(element, order, t.kind == 'i'))
+		}
+	}
+	if string(fortran[1]) == "True" {
+		a.Data = fromFortranOrder(a.Data, a.Shape)
+	}
+	return a, nil
+}
+
+// elementValue returns the integer an element of 1 to 8 bytes holds
+func elementValue(element []byte, order binary.ByteOrder, signed bool) float64 {
+	var v uint64
+	for i := range element {
+		b := element[i]
+		if order == binary.BigEndian {
+			b = element[len(element)-1-i]
+		}
+		v |= uint64(b) << (8 * i)
+	}
+	if signed {
+		shift := 64 - 8*len(element) // Extends the sign bit
+		return float64(int64(v<<shift) >> shift)
+	}
+	return float64(v)
+}
+
+// fromFortranOrder reorders elements stored with the first index varying fastest into row-major order
+func fromFortranOrder(data []float64, shape []int) []float64 {
+	out := make([]float64, len(data))
+	index := make([]int, len(shape))
+	for _, v := range data {
+		offset := 0
+		for d, i := range index {
+			offset = offset*shape[d] + i
+		}
+		out[offset] = v
+		for d := range index { // Advance the index, the first dimension fastest
+			if index[d]++; index[d] < shape[d] {
+				break
+			}
+			index[d] = 0
+		}
+	}
+	return out
+}
@@ -0,0 +1,359 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image/png"
+	"io"
+	"matrix-image-manipulation/raster"
+)
+
+// pngMaxPalette is the number of entries a PLTE chunk holds at most
+const pngMaxPalette = 256
+
+// adam7 holds the first pixel and the spacing of each of the seven passes of an interlaced PNG
+var adam7 = [7]struct{ x, y, dx, dy int }{
+	{0, 0, 8, 8},
+	{4, 0, 8, 8},
+	{0, 4, 4, 8},
+	{2, 0, 4, 4},
+	{0, 2, 2, 4},
+	{1, 0, 2, 2},
+	{0, 1, 1, 2},
+}
+
+// decodePNG decodes a PNG image with its metadata
+func decodePNG(r io.Reader, options ReadOptions) (*raster.Image, error) {
+	data, err := io.ReadAll(r) // Held in memory, as the metadata is read from the chunks png.Decode skips
+	if err != nil {
+		return nil, err
+	}
+	imageData, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	img, err := raster.FromImageAs(imageData, options.Channels, options.Depth)
+	if err != nil {
+		return nil, err
+	}
+	return withMetadata(img, readPNGMetadata(data)), nil
+}
+
+// pngEncoding describes how the pixels of an image are stored in a PNG file
+type pngEncoding struct {
+	header  pngHeader
+	grey    bool                // Whether one sample holds every colour channel
+	alpha   int                 // Channel of the image written as alpha, -1 if it is left out
+	palette [][4]uint32         // RGBA entries of paletted images, those with transparency first
+	index   map[[4]uint32]uint8 // Position of each colour in the palette
+}
+
+// choosePNGEncoding picks the smallest colour type and bit depth that hold an image without loss: greyscale if every
+// pixel is grey, no alpha if every pixel is opaque, a palette if an 8-bit image has few enough colours, and fewer than 8
+// bits per sample if the grey levels or the palette allow it
+func choosePNGEncoding(img *raster.Image, interlaced bool) *pngEncoding {
+	alpha := img.AlphaChannel()
+	maxValue := img.MaxValue()
+	grey, opaque := true, true
+	colours := map[[4]uint32]struct{}{}
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			colour := pngColour(img, img.Pix[img.PixOffset(x, y):], alpha)
+			if colour[0] != colour[1] || colour[1] != colour[2] {
+				grey = false
+			}
+			if colour[3] != maxValue {
+				opaque = false
+			}
+			if len(colours) <= pngMaxPalette {
+				colours[colour] = struct{}{}
+			}
+		}
+	}
+	if opaque {
+		alpha = -1
+	}
+
+	e := &pngEncoding{
+		header: pngHeader{width: img.Width, height: img.Height, bitDepth: img.Depth, interlaced: interlaced},
+		grey:   grey,
+		alpha:  alpha,
+	}
+	switch {
+	case grey && alpha < 0:
+		e.header.colourType = pngGrey
+		if img.Depth == 8 {
+			e.header.bitDepth = pngGreyDepth(img)
+		}
+	case img.Depth == 8 && len(colours) <= pngMaxPalette:
+		e.header.colourType = pngPaletted
+		e.header.bitDepth = 8
+		for _, depth := range []int{4, 2, 1} {
+			if len(colours) <= 1<<depth {
+				e.header.bitDepth = depth
+			}
+		}
+		e.buildPalette(colours)
+	case grey:
+		e.header.colourType = pngGreyAlpha
+	case alpha < 0:
+		e.header.colourType = pngRGB
+	default:
+		e.header.colourType = pngRGBA
+	}
+	return e
+}
+
+// pngColour returns the RGBA colour of a pixel of an image with any of the four layouts
+func pngColour(img *raster.Image, pixel []uint32, alpha int) [4]uint32 {
+	colour := [4]uint32{pixel[0], pixel[0], pixel[0], img.MaxValue()}
+	if img.Channels >= raster.RGB {
+		colour[1], colour[2] = pixel[1], pixel[2]
+	}
+	if alpha >= 0 {
+		colour[3] = pixel[alpha]
+	}
+	return colour
+}
+
+// pngGreyDepth returns the lowest bit depth that holds every grey level of an 8-bit image exactly, once scaled up to
+// 8 bits the way decoders do
+func pngGreyDepth(img *raster.Image) int {
+	depth := 1
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			value := img.Pix[img.PixOffset(x, y)]
+			for depth < 8 && value%(255/(1<<depth-1)) != 0 {
+				depth *= 2
+			}
+		}
+	}
+	return depth
+}
+
+// buildPalette orders the colours of a paletted image, transparent ones first so the tRNS chunk can stop early
+func (e *pngEncoding) buildPalette(colours map[[4]uint32]struct{}) {
+	e.palette = make([][4]uint32, 0, len(colours))
+	for colour := range colours {
+		e.palette = append(e.palette, colour)
+	}
+	sortColours(e.palette)
+	e.index = make(map[[4]uint32]uint8, len(e.palette))
+	for i, colour := range e.palette {
+		e.index[colour] = uint8(i)
+	}
+}
+
+// sortColours sorts colours by alpha and then by value, so the output does not depend on the order of a map
+func sortColours(colours [][4]uint32) {
+	less := func(a, b [4]uint32) bool {
+		if a[3] != b[3] {
+			return a[3] < b[3]
+		}
+		for c := 0; c < 3; c++ {
+			if a[c] != b[c] {
+				return a[c] < b[c]
+			}
+		}
+		return false
+	}
+	for i := 1; i < len(colours); i++ { // Insertion sort, palettes have at most 256 entries
+		for j := i; j > 0 && less(colours[j], colours[j-1]); j-- {
+			colours[j], colours[j-1] = colours[j-1], colours[j]
+		}
+	}
+}
+
+// samples returns the samples a pixel is stored with, appended to out
+func (e *pngEncoding) samples(img *raster.Image, pixel []uint32, out []uint32) []uint32 {
+	if e.header.colourType == pngPaletted {
+		return append(out, uint32(e.index[pngColour(img, pixel, img.AlphaChannel())]))
+	}
+	if e.grey {
+		value := pixel[0]
+		if e.header.bitDepth < 8 {
+			value /= 255 / (1<<e.header.bitDepth - 1)
+		}
+		out = append(out, value)
+	} else {
+		out = append(out, pixel[:3]...)
+	}
+	if e.alpha >= 0 {
+		out = append(out, pixel[e.alpha])
+	}
+	return out
+}
+
+// encodePNG encodes an image as a PNG with its metadata, in the smallest colour type and bit depth that hold it without
+// loss. options can change the bit depth, the compression level and ask for an interlaced image.
+func encodePNG(w io.Writer, img *raster.Image, options WriteOptions) error {
+	level, err := zlibLevel(options.CompressionLevel)
+	if err != nil {
+		return err
+	}
+	switch options.Depth {
+	case 0, img.Depth:
+	case 8, 16:
+		if img, err = img.ConvertDepth(options.Depth); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid PNG bit depth %d, expected 8 or 16", options.Depth)
+	}
+	if img.Width > 1<<31-1 || img.Height > 1<<31-1 {
+		return fmt.Errorf("a %dx%d image is too large for a PNG", img.Width, img.Height)
+	}
+	e := choosePNGEncoding(img, options.Interlace)
+
+	bw := bufio.NewWriter(w)
+	if err := writePNGHeader(bw, e.header); err != nil {
+		return err
+	}
+	if !img.Metadata.Empty() {
+		chunks, err := pngMetadataChunks(img.Metadata)
+		if err != nil {
+			return err
+		}
+		if _, err := bw.Write(chunks); err != nil {
+			return err
+		}
+	}
+	if err := e.writePalette(bw); err != nil {
+		return err
+	}
+
+	idat := &idatWriter{w: bw}
+	data, err := zlib.NewWriterLevel(idat, level)
+	if err != nil {
+		return err
+	}
+	if e.header.interlaced {
+		for _, pass := range adam7 {
+			if err := e.writePass(data, img, pass.x, pass.y, pass.dx, pass.dy); err != nil {
+				return err
+			}
+		}
+	} else if err := e.writePass(data, img, 0, 0, 1, 1); err != nil {
+		return err
+	}
+	if err := data.Close(); err != nil {
+		return err
+	}
+	if err := idat.flush(); err != nil {
+		return err
+	}
+	if err := writeChunk(bw, "IEND", nil); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// zlibLevel checks a compression level from WriteOptions, where 0 stands for zlib's default
+func zlibLevel(level int) (int, error) {
+	if level < 0 || level > zlib.BestCompression {
+		return 0, fmt.Errorf("invalid compression level %d, expected 1 to 9", level)
+	}
+	if level == 0 {
+		return zlib.DefaultCompression, nil
+	}
+	return level, nil
+}
+
+// writePNGHeader writes the signature and the IHDR chunk
+func writePNGHeader(w io.Writer, h pngHeader) error {
+	if _, err := w.Write(pngSignature); err != nil {
+		return err
+	}
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(h.width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(h.height))
+	ihdr[8], ihdr[9] = byte(h.bitDepth), byte(h.colourType) // Compression and filter methods are both 0
+	if h.interlaced {
+		ihdr[12] = 1 // Adam7
+	}
+	return writeChunk(w, "IHDR", ihdr)
+}
+
+// writePalette writes the PLTE chunk of paletted images, and the tRNS chunk if some of the colours are transparent
+func (e *pngEncoding) writePalette(w io.Writer) error {
+	if e.palette == nil {
+		return nil
+	}
+	plte := make([]byte, 0, 3*len(e.palette))
+	var trns []byte
+	for _, colour := range e.palette {
+		plte = append(plte, byte(colour[0]), byte(colour[1]), byte(colour[2]))
+		if colour[3] != 255 {
+			trns = append(trns, byte(colour[3]))
+		}
+	}
+	if err := writeChunk(w, "PLTE", plte); err != nil {
+		return err
+	}
+	if trns == nil {
+		return nil
+	}
+	return writeChunk(w, "tRNS", trns)
+}
+
+// writePass filters and writes the rows of the pixels from (x0, y0) spaced dx and dy apart, the whole image for a
+// non-interlaced PNG or one of the passes of an interlaced one. Passes without pixels are left out.
+func (e *pngEncoding) writePass(w io.Writer, img *raster.Image, x0, y0, dx, dy int) error {
+	width := (img.Width - x0 + dx - 1) / dx
+	height := (img.Height - y0 + dy - 1) / dy
+	if width <= 0 || height <= 0 {
+		return nil
+	}
+	rowBytes := e.header.rowBytes(width)
+	raw, previous := make([]byte, rowBytes), make([]byte, rowBytes)
+	var filtered [5][]byte
+	for i := range filtered {
+		filtered[i] = make([]byte, 1+rowBytes)
+	}
+	bpp := (e.header.bitsPerPixel() + 7) / 8
+	samples := make([]uint32, 0, width*e.header.samplesPerPixel())
+
+	for y := y0; y < img.Height; y += dy {
+		samples = samples[:0]
+		for x := x0; x < img.Width; x += dx {
+			samples = e.samples(img, img.Pix[img.PixOffset(x, y):], samples)
+		}
+		packPNGRow(raw, samples, e.header.bitDepth)
+
+		// Filtering rarely pays off for palette indices and packed samples, which is what the specification advises
+		row := filtered[filterNone]
+		if e.header.colourType == pngPaletted || e.header.bitDepth < 8 {
+			copy(row[1:], raw)
+		} else {
+			row = filterRow(raw, previous, bpp, &filtered)
+		}
+		if _, err := w.Write(row); err != nil {
+			return err
+		}
+		raw, previous = previous, raw
+	}
+	return nil
+}
+
+// packPNGRow stores samples in a row of the given bit depth, big-endian and with the first sample in the high bits
+func packPNGRow(row []byte, samples []uint32, bitDepth int) {
+	switch bitDepth {
+	case 16:
+		for i, sample := range samples {
+			binary.BigEndian.PutUint16(row[2*i:], uint16(sample))
+		}
+	case 8:
+		for i, sample := range samples {
+			row[i] = byte(sample)
+		}
+	default:
+		clear(row)
+		perByte := 8 / bitDepth
+		for i, sample := range samples {
+			row[i/perByte] |= byte(sample) << (8 - bitDepth*(i%perByte+1))
+		}
+	}
+}
@@ -0,0 +1,641 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"matrix-image-manipulation/raster"
+)
+
+// pngSignature is the known signature every PNG file starts with
+var pngSignature = []byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}
+
+// The PNG colour types, see https://www.w3.org/TR/png/#6Colour-values
+const (
+	pngGrey      = 0
+	pngRGB       = 2
+	pngPaletted  = 3
+	pngGreyAlpha = 4
+	pngRGBA      = 6
+)
+
+// The PNG row filter types, see https://www.w3.org/TR/png/#9Filter-types
+const (
+	filterNone = iota
+	filterSub
+	filterUp
+	filterAverage
+	filterPaeth
+)
+
+// maxIDATLength is the largest IDAT chunk the writer produces, 64KB balances the per-chunk overhead against buffering
+const maxIDATLength = 1 << 16
+
+// pngHeader holds the fields of an IHDR chunk
+type pngHeader struct {
+	width, height int
+	bitDepth      int
+	colourType    int
+	interlaced    bool
+}
+
+// samplesPerPixel returns how many samples each pixel of the colour type is stored with
+func (h pngHeader) samplesPerPixel() int {
+	switch h.colourType {
+	case pngRGB:
+		return 3
+	case pngGreyAlpha:
+		return 2
+	case pngRGBA:
+		return 4
+	default:
+		return 1
+	}
+}
+
+// bitsPerPixel returns how many bits each pixel is stored with
+func (h pngHeader) bitsPerPixel() int {
+	return h.bitDepth * h.samplesPerPixel()
+}
+
+// rowBytes returns the length of a row without its filter byte
+func (h pngHeader) rowBytes(width int) int {
+	return (width*h.bitsPerPixel() + 7) / 8
+}
+
+// validate checks that the bit depth is allowed for the colour type
+func (h pngHeader) validate() error {
+	if h.width <= 0 || h.height <= 0 {
+		return fmt.Errorf("invalid PNG dimensions %dx%d", h.width, h.height)
+	}
+	valid := false
+	switch h.colourType {
+	case pngGrey:
+		valid = h.bitDepth == 1 || h.bitDepth == 2 || h.bitDepth == 4 || h.bitDepth == 8 || h.bitDepth == 16
+	case pngPaletted:
+		valid = h.bitDepth == 1 || h.bitDepth == 2 || h.bitDepth == 4 || h.bitDepth == 8
+	case pngRGB, pngGreyAlpha, pngRGBA:
+		valid = h.bitDepth == 8 || h.bitDepth == 16
+	}
+	if !valid {
+		return fmt.Errorf("invalid PNG bit depth %d for colour type %d", h.bitDepth, h.colourType)
+	}
+	return nil
+}
+
+// PNGRowReader decodes a PNG image a few rows at a time, so images larger than memory can be processed.
+// Only the current and previous row of the file are held in memory, which rules out interlaced images.
+type PNGRowReader struct {
+	header   pngHeader
+	channels int      // Channel layout of the rows returned
+	depth    int      // Bit depth of the rows returned
+	palette  [][4]int // RGBA entries of the PLTE chunk, with alpha from tRNS
+	key      []int    // Samples of the transparent colour from tRNS, for greyscale and RGB images
+	chunks   *pngChunkReader
+	data     io.ReadCloser // Inflated image data
+	current  []byte        // The row being decoded, including its filter byte
+	previous []byte        // The previous row after unfiltering, used by the Up, Average and Paeth filters
+	row      int           // Number of rows returned so far
+}
+
+// NewPNGRowReader reads the header of a PNG image from r, leaving the pixel data to ReadRows
+func NewPNGRowReader(r io.Reader) (*PNGRowReader, error) {
+	chunks := &pngChunkReader{r: bufio.NewReader(r)}
+
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(chunks.r, signature); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(signature, pngSignature) {
+		return nil, errors.New("file is not a PNG image")
+	}
+
+	reader := &PNGRowReader{chunks: chunks}
+	if err := reader.readHeader(); err != nil {
+		return nil, err
+	}
+
+	// Read the chunks preceding the image data
+	for {
+		chunkType, data, err := chunks.next()
+		if err != nil {
+			return nil, err
+		}
+		switch chunkType {
+		case "PLTE":
+			reader.palette = make([][4]int, len(data)/3)
+			for i := range reader.palette {
+				reader.palette[i] = [4]int{int(data[3*i]), int(data[3*i+1]), int(data[3*i+2]), 255}
+			}
+		case "tRNS":
+			reader.readTransparency(data)
+		case "IDAT":
+			return reader, reader.startData()
+		case "IEND":
+			return nil, errors.New("PNG image has no image data")
+		default:
+			if chunkType[0] >= 'A' && chunkType[0] <= 'Z' { // Unknown critical chunks can't be skipped
+				return nil, fmt.Errorf("unsupported critical PNG chunk %s", chunkType)
+			}
+		}
+	}
+}
+
+// readHeader reads and validates the IHDR chunk, which must come first
+func (p *PNGRowReader) readHeader() error {
+	chunkType, data, err := p.chunks.next()
+	if err != nil {
+		return err
+	}
+	if chunkType != "IHDR" || len(data) != 13 {
+		return errors.New("PNG image does not start with a valid IHDR chunk")
+	}
+
+	p.header = pngHeader{
+		width:      int(binary.BigEndian.Uint32(data[0:4])),
+		height:     int(binary.BigEndian.Uint32(data[4:8])),
+		bitDepth:   int(data[8]),
+		colourType: int(data[9]),
+		interlaced: data[12] == 1,
+	}
+	if err := p.header.validate(); err != nil {
+		return err
+	}
+	// Only a few rows are held at a time, so the height may be anything but a single row must fit in memory
+	if err := raster.CheckSize(p.header.width, 1, raster.RGBA); err != nil {
+		return fmt.Errorf("PNG rows are too wide: %w", err)
+	}
+	if p.header.interlaced {
+		return errors.New("interlaced PNG images cannot be read a row at a time")
+	}
+
+	p.depth = 8
+	if p.header.bitDepth == 16 {
+		p.depth = 16
+	}
+	switch p.header.colourType {
+	case pngGrey:
+		p.channels = raster.Grey
+	case pngGreyAlpha:
+		p.channels = raster.GreyAlpha
+	case pngRGB, pngPaletted:
+		p.channels = raster.RGB
+	default:
+		p.channels = raster.RGBA
+	}
+	return nil
+}
+
+// readTransparency reads a tRNS chunk, which adds an alpha channel to images that have none
+func (p *PNGRowReader) readTransparency(data []byte) {
+	switch p.header.colourType {
+	case pngPaletted:
+		for i := 0; i < len(data) && i < len(p.palette); i++ {
+			p.palette[i][3] = int(data[i])
+		}
+		p.channels = raster.RGBA
+	case pngGrey:
+		if len(data) >= 2 {
+			p.key = []int{int(binary.BigEndian.Uint16(data))}
+			p.channels = raster.GreyAlpha
+		}
+	case pngRGB:
+		if len(data) >= 6 {
+			p.key = []int{int(binary.BigEndian.Uint16(data)), int(binary.BigEndian.Uint16(data[2:])), int(binary.BigEndian.Uint16(data[4:]))}
+			p.channels = raster.RGBA
+		}
+	}
+}
+
+// startData starts inflating the image data, the header of the first IDAT chunk has already been read
+func (p *PNGRowReader) startData() error {
+	data, err := zlib.NewReader(p.chunks)
+	if err != nil {
+		return err
+	}
+	p.data = data
+	p.current = make([]byte, 1+p.header.rowBytes(p.header.width))
+	p.previous = make([]byte, len(p.current))
+	return nil
+}
+
+// Width returns the number of columns of the image
+func (p *PNGRowReader) Width() int { return p.header.width }
+
+// Height returns the number of rows of the image
+func (p *PNGRowReader) Height() int { return p.header.height }
+
+// Channels returns the channel layout of the rows returned by ReadRows
+func (p *PNGRowReader) Channels() int { return p.channels }
+
+// Depth returns the bit depth of the rows returned by ReadRows
+func (p *PNGRowReader) Depth() int { return p.depth }
+
+// ReadRows decodes the next dst.Height rows of the image into dst, which must be as wide as the image and have the
+// layout given by Channels and Depth
+func (p *PNGRowReader) ReadRows(dst *raster.Image) error {
+	if dst.Width != p.header.width || dst.Channels != p.channels || dst.Depth != p.depth {
+		return fmt.Errorf("expected %d pixel wide rows with %d channels of %d bits", p.header.width, p.channels, p.depth)
+	}
+	if p.row+dst.Height > p.header.height {
+		return fmt.Errorf("cannot read %d rows, only %d are left", dst.Height, p.header.height-p.row)
+	}
+
+	for y := 0; y < dst.Height; y++ {
+		if _, err := io.ReadFull(p.data, p.current); err != nil {
+			return fmt.Errorf("reading row %d: %w", p.row, err)
+		}
+		if err := unfilter(p.current, p.previous[1:], (p.header.bitsPerPixel()+7)/8); err != nil {
+			return err
+		}
+		p.convertRow(p.current[1:], dst.Pix[dst.PixOffset(0, y):])
+		p.current, p.previous = p.previous, p.current
+		p.row++
+	}
+	if p.row == p.header.height { // Read to the end of the data, which checks its checksum and the CRC of its chunks
+		if _, err := io.Copy(io.Discard, p.data); err != nil {
+			return fmt.Errorf("reading the end of the image data: %w", err)
+		}
+	}
+	return nil
+}
+
+// convertRow converts one unfiltered row of the file into samples
+func (p *PNGRowReader) convertRow(row []byte, out []uint32) {
+	h := p.header
+	spp := h.samplesPerPixel()
+	sample := func(i int) int { // Returns the i-th sample of the row
+		switch h.bitDepth {
+		case 16:
+			return int(binary.BigEndian.Uint16(row[2*i:]))
+		case 8:
+			return int(row[i])
+		default:
+			perByte := 8 / h.bitDepth
+			shift := 8 - h.bitDepth*(i%perByte+1)
+			return int(row[i/perByte]>>shift) & (1<<h.bitDepth - 1)
+		}
+	}
+
+	for x := 0; x < h.width; x++ {
+		pixel := out[x*p.channels : (x+1)*p.channels]
+		if h.colourType == pngPaletted {
+			entry := [4]int{0, 0, 0, 255}
+			if index := sample(x); index < len(p.palette) {
+				entry = p.palette[index]
+			}
+			for c := range pixel {
+				pixel[c] = uint32(entry[c])
+			}
+			continue
+		}
+
+		transparent := p.key != nil
+		for c := 0; c < spp; c++ {
+			value := sample(x*spp + c)
+			if transparent && value != p.key[c] {
+				transparent = false
+			}
+			if h.bitDepth < 8 { // Scale low bit depths up to the full 8-bit range
+				value = value * 255 / (1<<h.bitDepth - 1)
+			}
+			pixel[c] = uint32(value)
+		}
+		if p.key != nil { // The alpha channel added by tRNS
+			pixel[spp] = uint32(1<<p.depth - 1)
+			if transparent {
+				pixel[spp] = 0
+			}
+		}
+	}
+}
+
+// unfilter reverses the filter of a row in place, row starts with the filter byte and previous is the row above
+// after unfiltering. bpp is the number of bytes per complete pixel, rounded up to 1.
+func unfilter(row, previous []byte, bpp int) error {
+	filter, cdat := row[0], row[1:]
+	switch filter {
+	case filterNone:
+	case filterSub:
+		for i := bpp; i < len(cdat); i++ {
+			cdat[i] += cdat[i-bpp]
+		}
+	case filterUp:
+		for i := range cdat {
+			cdat[i] += previous[i]
+		}
+	case filterAverage:
+		for i := range cdat {
+			left := 0
+			if i >= bpp {
+				left = int(cdat[i-bpp])
+			}
+			cdat[i] += byte((left + int(previous[i])) / 2)
+		}
+	case filterPaeth:
+		for i := range cdat {
+			var left, upLeft byte
+			if i >= bpp {
+				left, upLeft = cdat[i-bpp], previous[i-bpp]
+			}
+			cdat[i] += paeth(left, previous[i], upLeft)
+		}
+	default:
+		return fmt.Errorf("invalid PNG filter type %d", filter)
+	}
+	return nil
+}
+
+// paeth returns whichever of a (left), b (up) and c (upper left) is closest to a + b - c
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+// abs returns the absolute value of an int
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// pngChunkReader reads the chunks of a PNG file. IDAT chunks are read incrementally through Read, so the image data
+// never has to fit in memory, while every other chunk is read whole and must be at most maxPNGChunkLength bytes.
+type pngChunkReader struct {
+	r         *bufio.Reader
+	remaining uint32      // Unread bytes of the current IDAT chunk
+	crc       hash.Hash32 // CRC of the current IDAT chunk so far, nil if there is none
+	done      bool        // Whether the last IDAT chunk has been consumed
+}
+
+// maxPNGChunkLength caps the chunks other than IDAT, so a forged length cannot make the reader allocate gigabytes.
+// Real metadata, such as ICC profiles and EXIF data, is far smaller.
+const maxPNGChunkLength = 16 << 20
+
+// next reads the next chunk and checks its CRC. The data of an IDAT chunk is left to Read and nil is returned for it,
+// skipping whatever Read left of an earlier one.
+func (c *pngChunkReader) next() (string, []byte, error) {
+	if c.crc != nil { // Skip the rest of an IDAT chunk and its CRC
+		if _, err := c.r.Discard(int(c.remaining) + 4); err != nil {
+			return "", nil, err
+		}
+		c.crc, c.remaining = nil, 0
+	}
+
+	var header [8]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return "", nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length > 1<<31-1 {
+		return "", nil, errors.New("invalid PNG chunk length")
+	}
+	chunkType := string(header[4:])
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	if chunkType == "IDAT" {
+		c.crc, c.remaining = crc, length
+		return chunkType, nil, nil
+	}
+	if length > maxPNGChunkLength {
+		return "", nil, fmt.Errorf("PNG chunk %s of %d bytes is too large", chunkType, length)
+	}
+
+	data := make([]byte, length+4)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return "", nil, err
+	}
+	crc.Write(data[:length])
+	if crc.Sum32() != binary.BigEndian.Uint32(data[length:]) {
+		return "", nil, fmt.Errorf("invalid CRC in PNG chunk %s", chunkType)
+	}
+	return chunkType, data[:length], nil
+}
+
+// Read returns the image data, moving on to the next chunk whenever the current one is exhausted
+func (c *pngChunkReader) Read(p []byte) (int, error) {
+	for c.crc == nil {
+		if c.done {
+			return 0, io.EOF
+		}
+		chunkType, _, err := c.next()
+		if err != nil {
+			return 0, err
+		}
+		if chunkType != "IDAT" { // Image data must be contiguous, anything else ends it
+			c.done = true
+			return 0, io.EOF
+		}
+	}
+	n, err := c.r.Read(p[:min(len(p), int(c.remaining))])
+	c.crc.Write(p[:n])
+	c.remaining -= uint32(n)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err == nil && c.remaining == 0 { // Check the CRC as soon as the chunk ends, as the inflater may stop reading here
+		var sum [4]byte
+		if _, err := io.ReadFull(c.r, sum[:]); err != nil {
+			return n, err
+		}
+		if c.crc.Sum32() != binary.BigEndian.Uint32(sum[:]) { // Hold back the bytes, a buffered caller could drop an error sent with them
+			return 0, errors.New("invalid CRC in PNG chunk IDAT")
+		}
+		c.crc = nil
+	}
+	return n, err
+}
+
+// PNGRowWriter encodes a PNG image a few rows at a time, so images larger than memory can be written.
+// The channel layout and bit depth of the file are taken from the first rows written.
+type PNGRowWriter struct {
+	w        io.Writer
+	width    int
+	height   int
+	header   pngHeader
+	idat     *idatWriter
+	data     *zlib.Writer // Deflates the filtered rows into IDAT chunks
+	raw      []byte       // The row being encoded, before filtering
+	previous []byte       // The previous raw row, used by the Up, Average and Paeth filters
+	filtered [5][]byte    // The row with each filter applied, including the filter byte
+	row      int          // Number of rows written so far
+	started  bool         // Whether the header has been written
+}
+
+// NewPNGRowWriter prepares to write a width x height PNG image to w
+func NewPNGRowWriter(w io.Writer, width, height int) (*PNGRowWriter, error) {
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("invalid PNG dimensions %dx%d", width, height)
+	}
+	return &PNGRowWriter{w: w, width: width, height: height}, nil
+}
+
+// start writes the signature and IHDR chunk for rows with the given layout and depth
+func (p *PNGRowWriter) start(channels, depth int) error {
+	colourTypes := map[int]int{raster.Grey: pngGrey, raster.GreyAlpha: pngGreyAlpha, raster.RGB: pngRGB, raster.RGBA: pngRGBA}
+	colourType, ok := colourTypes[channels]
+	if !ok {
+		return fmt.Errorf("cannot write a %d channel image", channels)
+	}
+	p.header = pngHeader{width: p.width, height: p.height, bitDepth: depth, colourType: colourType}
+	if err := writePNGHeader(p.w, p.header); err != nil {
+		return err
+	}
+
+	p.idat = &idatWriter{w: p.w}
+	p.data = zlib.NewWriter(p.idat)
+	rowBytes := p.header.rowBytes(p.width)
+	p.raw = make([]byte, rowBytes)
+	p.previous = make([]byte, rowBytes)
+	for i := range p.filtered {
+		p.filtered[i] = make([]byte, 1+rowBytes)
+	}
+	p.started = true
+	return nil
+}
+
+// WriteRows encodes the rows of src, which must be as wide as the image and have the same layout as earlier rows
+func (p *PNGRowWriter) WriteRows(src *raster.Image) error {
+	if err := src.Validate(); err != nil {
+		return err
+	}
+	if src.Width != p.width {
+		return fmt.Errorf("expected %d pixel wide rows, got %d", p.width, src.Width)
+	}
+	if p.row+src.Height > p.height {
+		return fmt.Errorf("cannot write %d rows, only %d are left", src.Height, p.height-p.row)
+	}
+	if !p.started {
+		if err := p.start(src.Channels, src.Depth); err != nil {
+			return err
+		}
+	}
+	if src.Channels != p.header.samplesPerPixel() || src.Depth != p.header.bitDepth {
+		return errors.New("rows must keep the channel layout and bit depth of the first rows written")
+	}
+
+	bpp := (p.header.bitsPerPixel() + 7) / 8
+	for y := 0; y < src.Height; y++ {
+		samples := src.Pix[src.PixOffset(0, y) : src.PixOffset(0, y)+src.Width*src.Channels]
+		for i, sample := range samples {
+			if src.Depth == 16 {
+				binary.BigEndian.PutUint16(p.raw[2*i:], uint16(sample))
+			} else {
+				p.raw[i] = byte(sample)
+			}
+		}
+		if _, err := p.data.Write(filterRow(p.raw, p.previous, bpp, &p.filtered)); err != nil {
+			return err
+		}
+		p.raw, p.previous = p.previous, p.raw
+		p.row++
+	}
+	return nil
+}
+
+// Close finishes the image, every row must have been written
+func (p *PNGRowWriter) Close() error {
+	if p.row != p.height {
+		return fmt.Errorf("only %d of %d rows were written", p.row, p.height)
+	}
+	if err := p.data.Close(); err != nil {
+		return err
+	}
+	if err := p.idat.flush(); err != nil {
+		return err
+	}
+	return writeChunk(p.w, "IEND", nil)
+}
+
+// filterRow applies every filter to a row and returns the one with the smallest sum of absolute differences, the
+// heuristic recommended by the PNG specification
+func filterRow(raw, previous []byte, bpp int, filtered *[5][]byte) []byte {
+	for filter := range filtered {
+		filtered[filter][0] = byte(filter)
+	}
+	for i := range raw {
+		var left, upLeft byte
+		if i >= bpp {
+			left, upLeft = raw[i-bpp], previous[i-bpp]
+		}
+		up := previous[i]
+		filtered[filterNone][i+1] = raw[i]
+		filtered[filterSub][i+1] = raw[i] - left
+		filtered[filterUp][i+1] = raw[i] - up
+		filtered[filterAverage][i+1] = raw[i] - byte((int(left)+int(up))/2)
+		filtered[filterPaeth][i+1] = raw[i] - paeth(left, up, upLeft)
+	}
+
+	best, bestSum := filtered[filterNone], -1
+	for _, candidate := range filtered {
+		sum := 0
+		for _, b := range candidate[1:] {
+			sum += abs(int(int8(b)))
+		}
+		if bestSum < 0 || sum < bestSum {
+			best, bestSum = candidate, sum
+		}
+	}
+	return best
+}
+
+// idatWriter splits the deflated image data into IDAT chunks of at most maxIDATLength bytes
+type idatWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+// Write buffers data, writing a chunk whenever enough has accumulated
+func (i *idatWriter) Write(data []byte) (int, error) {
+	i.buf = append(i.buf, data...)
+	for len(i.buf) >= maxIDATLength {
+		if err := writeChunk(i.w, "IDAT", i.buf[:maxIDATLength]); err != nil {
+			return 0, err
+		}
+		i.buf = i.buf[maxIDATLength:]
+	}
+	return len(data), nil
+}
+
+// flush writes whatever data is left as a final chunk
+func (i *idatWriter) flush() error {
+	if len(i.buf) == 0 {
+		return nil
+	}
+	err := writeChunk(i.w, "IDAT", i.buf)
+	i.buf = nil
+	return err
+}
+
+// writeChunk writes a PNG chunk with its length and CRC
+func writeChunk(w io.Writer, chunkType string, data []byte) error {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+	copy(header[4:], chunkType)
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	footer := binary.BigEndian.AppendUint32(nil, crc.Sum32())
+
+	for _, part := range [][]byte{header, data, footer} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"matrix-image-manipulation/raster"
+)
+
+// qoiSignature is the "qoif" every QOI image starts with
+var qoiSignature = []byte("qoif")
+
+// qoiEnd is the padding that ends the stream of chunks
+var qoiEnd = []byte{0, 0, 0, 0, 0, 0, 0, 1}
+
+// Chunk tags, the first two bytes are whole bytes and the others take the top two bits of the first byte
+const (
+	qoiOpRGB   = 0xFE // Followed by red, green and blue, alpha is unchanged
+	qoiOpRGBA  = 0xFF // Followed by red, green, blue and alpha
+	qoiOpIndex = 0x00 // Index into the array of recently seen pixels
+	qoiOpDiff  = 0x40 // Small differences from the previous pixel in each colour channel, 2 bits each
+	qoiOpLuma  = 0x80 // Difference in green of 6 bits, then red and blue relative to it in a second byte
+	qoiOpRun   = 0xC0 // Repeats the previous pixel 1 to 62 times
+	qoiMask    = 0xC0
+)
+
+// qoiHeaderSize is the size of the header, the signature followed by the width, height, channels and colour space
+const qoiHeaderSize = 14
+
+// qoiMaxPixels caps the size of decoded images, the limit of the reference implementation
+const qoiMaxPixels = 400_000_000
+
+// qoiHash returns the position of a pixel in the array of recently seen pixels
+func qoiHash(p [4]byte) byte {
+	return (p[0]*3 + p[1]*5 + p[2]*7 + p[3]*11) % 64
+}
+
+// decodeQOI decodes a QOI image, which is read as RGB or RGBA depending on the channels given in its header
+func decodeQOI(r io.Reader, options ReadOptions) (*raster.Image, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, qoiHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("reading the QOI header: %w", err)
+	}
+	if string(header[:4]) != string(qoiSignature) {
+		return nil, errors.New("file is not a QOI image")
+	}
+	width, height, channels := binary.BigEndian.Uint32(header[4:]), binary.BigEndian.Uint32(header[8:]), int(header[12])
+	if width == 0 || height == 0 || uint64(width)*uint64(height) > qoiMaxPixels {
+		return nil, fmt.Errorf("invalid QOI dimensions %dx%d", width, height)
+	}
+	if channels != raster.RGB && channels != raster.RGBA {
+		return nil, fmt.Errorf("invalid QOI channel count %d", channels)
+	}
+	var index [64][4]byte
+	pixel := [4]byte{0, 0, 0, 255}
+	run := 0
+	img, err := readRows(int(width), int(height), channels, 8, func(y int, row []uint32) error {
+		for i := 0; i < len(row); i += channels {
+			if run > 0 {
+				run--
+			} else {
+				b, err := br.ReadByte()
+				if err != nil {
+					return fmt.Errorf("reading QOI pixel %d of row %d: %w", i/channels, y, err)
+				}
+				switch {
+				case b == qoiOpRGB || b == qoiOpRGBA:
+					n := 3
+					if b == qoiOpRGBA {
+						n = 4
+					}
+					if _, err := io.ReadFull(br, pixel[:n]); err != nil {
+						return fmt.Errorf("reading QOI pixel %d of row %d: %w", i/channels, y, err)
+					}
+				case b&qoiMask == qoiOpIndex:
+					pixel = index[b]
+				case b&qoiMask == qoiOpDiff:
+					pixel[0] += b>>4&3 - 2
+					pixel[1] += b>>2&3 - 2
+					pixel[2] += b&3 - 2
+				case b&qoiMask == qoiOpLuma:
+					second, err := br.ReadByte()
+					if err != nil {
+						return fmt.Errorf("reading QOI pixel %d of row %d: %w", i/channels, y, err)
+					}
+					green := b&0x3F - 32
+					pixel[0] += green + second>>4 - 8
+					pixel[1] += green
+					pixel[2] += green + second&0x0F - 8
+				default:
+					run = int(b & 0x3F) // The pixel itself and run more, which may continue on the next row
+				}
+				index[qoiHash(pixel)] = pixel
+			}
+			for c := 0; c < channels; c++ {
+				row[i+c] = uint32(pixel[c])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return convertLayout(img, options)
+}
+
+// encodeQOI encodes an image as a QOI. QOI only stores 8-bit RGB or RGBA, so greyscale images are written as colour
+// ones and 16-bit images are rounded. The colour space is given as sRGB with linear alpha.
+func encodeQOI(w io.Writer, img *raster.Image, options WriteOptions) error {
+	if int64(img.Width) > 1<<32-1 || int64(img.Height) > 1<<32-1 || int64(img.Width)*int64(img.Height) > qoiMaxPixels {
+		return fmt.Errorf("a %dx%d image is too large for a QOI", img.Width, img.Height)
+	}
+	if img.Depth != 8 {
+		converted, err := img.ConvertDepth(8)
+		if err != nil {
+			return err
+		}
+		img = converted
+	}
+	alpha := img.AlphaChannel()
+	channels := raster.RGB
+	if alpha >= 0 {
+		channels = raster.RGBA
+	}
+
+	bw := bufio.NewWriter(w)
+	header := make([]byte, qoiHeaderSize)
+	copy(header, qoiSignature)
+	binary.BigEndian.PutUint32(header[4:], uint32(img.Width))
+	binary.BigEndian.PutUint32(header[8:], uint32(img.Height))
+	header[12] = byte(channels)
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+
+	var index [64][4]byte
+	previous := [4]byte{0, 0, 0, 255}
+	run, last := 0, img.Width*img.Height-1
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			in := img.Pix[img.PixOffset(x, y):]
+			pixel := [4]byte{byte(in[0]), byte(in[0]), byte(in[0]), 255}
+			if img.Channels >= raster.RGB {
+				pixel[1], pixel[2] = byte(in[1]), byte(in[2])
+			}
+			if alpha >= 0 {
+				pixel[3] = byte(in[alpha])
+			}
+
+			if pixel == previous {
+				run++
+				if run == 62 || y*img.Width+x == last {
+					_ = bw.WriteByte(qoiOpRun | byte(run-1))
+					run = 0
+				}
+				continue
+			}
+			if run > 0 {
+				_ = bw.WriteByte(qoiOpRun | byte(run-1))
+				run = 0
+			}
+			writeQOIPixel(bw, pixel, previous, &index)
+			previous = pixel
+		}
+	}
+	if _, err := bw.Write(qoiEnd); err != nil {
+		return err
+	}
+	return bw.Flush() // Reports any error of the writes above, which bufio keeps
+}
+
+// writeQOIPixel writes the shortest chunk that encodes pixel after previous
+func writeQOIPixel(bw *bufio.Writer, pixel, previous [4]byte, index *[64][4]byte) {
+	hash := qoiHash(pixel)
+	if index[hash] == pixel {
+		_ = bw.WriteByte(qoiOpIndex | hash)
+		return
+	}
+	index[hash] = pixel
+
+	if pixel[3] != previous[3] {
+		_, _ = bw.Write([]byte{qoiOpRGBA, pixel[0], pixel[1], pixel[2], pixel[3]})
+		return
+	}
+	// Differences wrap around, so 255 to 0 is a difference of 1
+	red, green, blue := int8(pixel[0]-previous[0]), int8(pixel[1]-previous[1]), int8(pixel[2]-previous[2])
+	redGreen, blueGreen := red-green, blue-green
+	switch {
+	case red >= -2 && red <= 1 && green >= -2 && green <= 1 && blue >= -2 && blue <= 1:
+		_ = bw.WriteByte(qoiOpDiff | byte(red+2)<<4 | byte(green+2)<<2 | byte(blue+2))
+	case green >= -32 && green <= 31 && redGreen >= -8 && redGreen <= 7 && blueGreen >= -8 && blueGreen <= 7:
+		_, _ = bw.Write([]byte{qoiOpLuma | byte(green+32), byte(redGreen+8)<<4 | byte(blueGreen+8)})
+	default:
+		_, _ = bw.Write([]byte{qoiOpRGB, pixel[0], pixel[1], pixel[2]})
+	}
+}
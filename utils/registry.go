@@ -0,0 +1,201 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"matrix-image-manipulation/raster"
+	"strings"
+	"sync"
+)
+
+// MaxSignatureLength is the longest signature a format may declare, and how many bytes of a file are read to
+// recognise it
+const MaxSignatureLength = 32
+
+// ErrUnsupportedFormat is returned, wrapped with the details, when a file or a requested format cannot be read or
+// written by any registered format
+var ErrUnsupportedFormat = errors.New("unsupported image format")
+
+// Format describes an image file format: how to recognise its files and how to read and write them. The package
+// registers the formats it supports itself, and applications can add their own with RegisterFormat.
+type Format struct {
+	Name       string   // Short name, also accepted as WriteOptions.Format
+	Extensions []string // File extensions with the leading dot, the first one is canonical
+	Bands      bool     // Whether Encode can write images of more than 4 channels
+
+	// Magic holds the signatures a file of the format starts with, any one of them. A ? matches any byte, as in
+	// image.RegisterFormat. Formats without a signature are only chosen by name or extension, when writing.
+	Magic [][]byte
+
+	Decode func(r io.Reader, options ReadOptions) (*raster.Image, error)    // Nil if the format cannot be read
+	Encode func(w io.Writer, img *raster.Image, options WriteOptions) error // Nil if it cannot be written
+
+	// Animated and multi-page formats also read and write sequences, the others are read as a sequence of a single
+	// frame and can only write one
+	DecodeSequence func(r io.Reader, options ReadOptions) (*raster.Sequence, error)
+	EncodeSequence func(w io.Writer, sequence *raster.Sequence, options WriteOptions) error
+}
+
+// registry holds every registered format in the order they were registered, which is the order signatures are
+// checked in
+var registry struct {
+	sync.RWMutex
+	formats []*Format
+}
+
+func init() {
+	for _, f := range builtinFormats {
+		RegisterFormat(f)
+	}
+}
+
+// RegisterFormat makes a format available to ReadImage, WriteImage and the functions built on them, usually from the
+// init function of the package that provides it. Names and extensions are matched without regard to case. Like
+// manipulations.Register, it panics if the format is invalid or if its name or one of its extensions is already
+// registered, since both are programming errors.
+func RegisterFormat(f *Format) {
+	if f == nil {
+		panic("utils: RegisterFormat of a nil format")
+	}
+	if f.Name == "" || f.Decode == nil && f.Encode == nil {
+		panic("utils: RegisterFormat of a format without a name or codecs")
+	}
+	format := *f // Copied, so later changes to f do not affect the registry
+	format.Name = strings.ToLower(f.Name)
+	format.Extensions = make([]string, len(f.Extensions))
+	for i, extension := range f.Extensions {
+		if len(extension) < 2 || extension[0] != '.' {
+			panic(fmt.Sprintf("utils: RegisterFormat of format %s with invalid extension %q", f.Name, extension))
+		}
+		format.Extensions[i] = strings.ToLower(extension)
+	}
+	for _, magic := range f.Magic {
+		if len(magic) == 0 || len(magic) > MaxSignatureLength {
+			panic(fmt.Sprintf("utils: RegisterFormat of format %s with a signature of %d bytes", f.Name, len(magic)))
+		}
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+	for _, name := range append([]string{format.Name}, format.Extensions...) {
+		if existing := lookupFormat(name); existing != nil {
+			panic(fmt.Sprintf("utils: RegisterFormat called twice for %s, already registered by format %s", name, existing.Name))
+		}
+	}
+	registry.formats = append(registry.formats, &format)
+}
+
+// LookupFormat returns the registered format with the given name or extension, with or without the leading dot.
+// The returned format must not be modified.
+func LookupFormat(name string) (*Format, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	f := lookupFormat(name)
+	return f, f != nil
+}
+
+// lookupFormat finds a format by name or extension, the caller holds the registry lock
+func lookupFormat(name string) *Format {
+	name = strings.ToLower(name)
+	for _, f := range registry.formats {
+		if f.Name == name {
+			return f
+		}
+		for _, extension := range f.Extensions {
+			if extension == name || extension[1:] == name {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+// Formats returns every registered format in the order they were registered, starting with the ones provided by
+// this package. The returned formats must not be modified.
+func Formats() []*Format {
+	registry.RLock()
+	defer registry.RUnlock()
+	return append([]*Format(nil), registry.formats...)
+}
+
+// unsupportedFormats lists the signatures of common formats that cannot be read unless an application registers a
+// codec for them, so errors can say what a file is rather than only what it is not
+var unsupportedFormats = []struct {
+	name  string
+	magic []byte
+}{
+	{"WebP", []byte("RIFF????WEBP")},
+	{"AVIF", []byte("????ftypavif")},
+	{"HEIF", []byte("????ftypheic")},
+	{"HEIF", []byte("????ftypheix")},
+	{"HEIF", []byte("????ftypmif1")},
+	{"JPEG XL", []byte{0xFF, 0x0A}},
+	{"JPEG XL", []byte("\x00\x00\x00\x0CJXL \x0D\x0A\x87\x0A")},
+	{"JPEG 2000", []byte("\x00\x00\x00\x0CjP  \x0D\x0A\x87\x0A")},
+	{"JPEG 2000", []byte{0xFF, 0x4F, 0xFF, 0x51}},
+	{"BigTIFF", []byte("II+\x00")},
+	{"BigTIFF", []byte("MM\x00+")},
+	{"OpenEXR", []byte{0x76, 0x2F, 0x31, 0x01}},
+	{"Radiance HDR", []byte("#?RADIANCE")},
+	{"Radiance HDR", []byte("#?RGBE")},
+	{"Photoshop", []byte("8BPS")},
+	{"GIMP XCF", []byte("gimp xcf")},
+	{"DDS", []byte("DDS ")},
+	{"ICO", []byte{0, 0, 1, 0}},
+}
+
+// DetectFormat recognises the format of a file from its first bytes, of which header should hold up to
+// MaxSignatureLength. Files of a known format that no registered format can read give an error naming the format.
+func DetectFormat(header []byte) (*Format, error) {
+	registry.RLock()
+	defer registry.RUnlock()
+	for _, f := range registry.formats {
+		for _, magic := range f.Magic {
+			if matchSignature(header, magic) {
+				if f.Decode == nil {
+					return nil, fmt.Errorf("%w: reading %s images is not supported", ErrUnsupportedFormat, f.Name)
+				}
+				return f, nil
+			}
+		}
+	}
+	for _, unsupported := range unsupportedFormats {
+		if matchSignature(header, unsupported.magic) {
+			return nil, fmt.Errorf("%w: file is a %s image, expected one of %s", ErrUnsupportedFormat, unsupported.name, formatNames())
+		}
+	}
+	return nil, fmt.Errorf("%w: file is not a recognised image, expected one of %s", ErrUnsupportedFormat, formatNames())
+}
+
+// matchSignature reports whether header starts with magic, where a ? in magic matches any byte
+func matchSignature(header, magic []byte) bool {
+	if len(header) < len(magic) {
+		return false
+	}
+	for i, b := range magic {
+		if b != '?' && header[i] != b {
+			return false
+		}
+	}
+	return true
+}
+
+// formatByName returns the format with the given name or extension, or an error listing the registered formats
+func formatByName(name string) (*Format, error) {
+	registry.RLock()
+	defer registry.RUnlock()
+	if f := lookupFormat(name); f != nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("%w %q, expected one of %s", ErrUnsupportedFormat, name, formatNames())
+}
+
+// formatNames lists the names of the registered formats for error messages, the caller holds the registry lock
+func formatNames() string {
+	names := make([]string, len(registry.formats))
+	for i, f := range registry.formats {
+		names[i] = f.Name
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,641 @@
+package utils
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"matrix-image-manipulation/raster"
+	"sort"
+)
+
+// Signatures of little-endian and big-endian TIFF files
+var (
+	tiffLittleEndian = []byte("II*\x00")
+	tiffBigEndian    = []byte("MM\x00*")
+)
+
+// Tags of the image file directory that are read or written
+const (
+	tiffNewSubfileType   = 254
+	tiffImageWidth       = 256
+	tiffImageLength      = 257
+	tiffBitsPerSample    = 258
+	tiffCompression      = 259
+	tiffPhotometric      = 262
+	tiffStripOffsets     = 273
+	tiffOrientation      = 274 // Read from the EXIF data of PNG and JPEG images, which is laid out like a TIFF
+	tiffSamplesPerPixel  = 277
+	tiffRowsPerStrip     = 278
+	tiffStripByteCounts  = 279
+	tiffXResolution      = 282
+	tiffYResolution      = 283
+	tiffPlanarConfig     = 284
+	tiffResolutionUnit   = 296
+	tiffPageNumber       = 297
+	tiffPredictor        = 317
+	tiffColorMap         = 320
+	tiffTileWidth        = 322
+	tiffExtraSamples     = 338
+	tiffSampleFormat     = 339
+	tiffReducedImage     = 1 // Bit of NewSubfileType marking a thumbnail of another page
+	tiffPredictorNone    = 1
+	tiffPredictorDiffers = 2 // Horizontal differencing, each sample is stored as the difference from the one to its left
+)
+
+// Field types of directory entries
+const (
+	tiffByte     = 1
+	tiffShort    = 3
+	tiffLong     = 4
+	tiffRational = 5
+)
+
+// tiffTypeSizes holds the size in bytes of a value of each field type, indexed by type
+var tiffTypeSizes = [...]int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+// Compression schemes
+const (
+	tiffUncompressed = 1
+	tiffLZW          = 5
+	tiffDeflate      = 8
+	tiffPackBits     = 32773
+	tiffOldDeflate   = 32946 // The code used for Deflate before it was standardised
+)
+
+// tiffCompressions maps the names accepted as WriteOptions.Compression to their schemes
+var tiffCompressions = map[string]int{"": tiffUncompressed, "none": tiffUncompressed, "lzw": tiffLZW, "deflate": tiffDeflate}
+
+// Photometric interpretations
+const (
+	tiffWhiteIsZero = 0
+	tiffBlackIsZero = 1
+	tiffRGB         = 2
+	tiffPalette     = 3
+)
+
+// Values of ExtraSamples
+const (
+	tiffUnspecified     = 0
+	tiffAssociatedAlpha = 1 // Premultiplied alpha
+	tiffStraightAlpha   = 2
+)
+
+// tiffStripSize is roughly how many bytes of pixels each written strip holds
+const tiffStripSize = 8 << 10
+
+// decodeTIFF decodes the first page of a TIFF image, see decodeTIFFSequence
+func decodeTIFF(r io.Reader, options ReadOptions) (*raster.Image, error) {
+	data, order, err := readTIFF(r)
+	if err != nil {
+		return nil, err
+	}
+	pages, err := tiffDirectories(data, order)
+	if err != nil {
+		return nil, err
+	}
+	img, err := decodeTIFFPage(data, order, pages[0])
+	if err != nil {
+		return nil, err
+	}
+	return convertLayout(img, options)
+}
+
+// decodeTIFFSequence decodes every page of a baseline TIFF, skipping reduced resolution copies such as thumbnails.
+// Pages may be uncompressed or compressed with LZW, Deflate or PackBits, with or without a horizontal predictor, and
+// stored in strips with interleaved samples. Bilevel, greyscale and paletted images of 1 to 16 bits are read as
+// greyscale or RGB, colour images of 8 or 16 bits as RGB, and both keep an alpha channel if they have one. Images
+// with more than 8 bits per sample are read with 16 bits. Every page is read at its own size.
+func decodeTIFFSequence(r io.Reader, options ReadOptions) (*raster.Sequence, error) {
+	data, order, err := readTIFF(r)
+	if err != nil {
+		return nil, err
+	}
+	pages, err := tiffDirectories(data, order)
+	if err != nil {
+		return nil, err
+	}
+	sequence := &raster.Sequence{}
+	for i, page := range pages {
+		if len(pages) > 1 && len(page[tiffNewSubfileType]) > 0 && page[tiffNewSubfileType][0]&tiffReducedImage != 0 {
+			continue
+		}
+		img, err := decodeTIFFPage(data, order, page)
+		if err == nil {
+			img, err = convertLayout(img, options)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("TIFF page %d: %w", i, err)
+		}
+		sequence.Frames = append(sequence.Frames, raster.Frame{Image: img})
+	}
+	if err := sequence.ValidatePages(); err != nil {
+		return nil, err
+	}
+	return sequence, nil
+}
+
+// readTIFF reads a whole TIFF file, as its directories may point anywhere in it, and returns it with its byte order
+func readTIFF(r io.Reader) ([]byte, binary.ByteOrder, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case len(data) < 8:
+		return nil, nil, errors.New("TIFF header is truncated")
+	case bytes.HasPrefix(data, tiffLittleEndian):
+		return data, binary.LittleEndian, nil
+	case bytes.HasPrefix(data, tiffBigEndian):
+		return data, binary.BigEndian, nil
+	default:
+		return nil, nil, errors.New("file is not a TIFF image")
+	}
+}
+
+// tiffDirectory holds the integer fields of an image file directory, by tag
+type tiffDirectory map[uint16][]uint32
+
+// value returns the first value of a field, or fallback if the directory does not have it
+func (d tiffDirectory) value(tag uint16, fallback uint32) uint32 {
+	if len(d[tag]) == 0 {
+		return fallback
+	}
+	return d[tag][0]
+}
+
+// tiffDirectories reads the chain of image file directories, one for each page
+func tiffDirectories(data []byte, order binary.ByteOrder) ([]tiffDirectory, error) {
+	var directories []tiffDirectory
+	seen := map[uint32]bool{}
+	for offset := order.Uint32(data[4:]); offset != 0; {
+		if seen[offset] {
+			return nil, errors.New("TIFF directories form a loop")
+		}
+		seen[offset] = true
+		if int64(offset)+2 > int64(len(data)) {
+			return nil, errors.New("TIFF directory lies outside the file")
+		}
+		count := int(order.Uint16(data[offset:]))
+		end := int64(offset) + 2 + 12*int64(count)
+		if end+4 > int64(len(data)) {
+			return nil, errors.New("TIFF directory is truncated")
+		}
+
+		directory := tiffDirectory{}
+		for i := 0; i < count; i++ {
+			entry := data[int(offset)+2+12*i:]
+			tag, kind, n := order.Uint16(entry), int(order.Uint16(entry[2:])), int64(order.Uint32(entry[4:]))
+			if kind != tiffByte && kind != tiffShort && kind != tiffLong {
+				continue // Only integer fields are needed
+			}
+			size := int64(tiffTypeSizes[kind]) * n
+			values := entry[8:12]
+			if size > 4 {
+				at := int64(order.Uint32(entry[8:]))
+				if at+size > int64(len(data)) {
+					return nil, fmt.Errorf("TIFF field %d lies outside the file", tag)
+				}
+				values = data[at : at+size]
+			}
+			field := make([]uint32, n)
+			for j := range field {
+				switch kind {
+				case tiffByte:
+					field[j] = uint32(values[j])
+				case tiffShort:
+					field[j] = uint32(order.Uint16(values[2*j:]))
+				default:
+					field[j] = order.Uint32(values[4*j:])
+				}
+			}
+			directory[tag] = field
+		}
+		directories = append(directories, directory)
+		offset = order.Uint32(data[end:])
+	}
+	if len(directories) == 0 {
+		return nil, errors.New("TIFF file has no images")
+	}
+	return directories, nil
+}
+
+// decodeTIFFPage decodes the image a directory describes
+func decodeTIFFPage(data []byte, order binary.ByteOrder, d tiffDirectory) (*raster.Image, error) {
+	width, height := int(d.value(tiffImageWidth, 0)), int(d.value(tiffImageLength, 0))
+	samples := int(d.value(tiffSamplesPerPixel, 1))
+	bitDepth := int(d.value(tiffBitsPerSample, 1))
+	photometric := d.value(tiffPhotometric, tiffBlackIsZero)
+	compression := d.value(tiffCompression, tiffUncompressed)
+	predictor := d.value(tiffPredictor, tiffPredictorNone)
+
+	switch {
+	case width <= 0 || height <= 0:
+		return nil, fmt.Errorf("invalid TIFF dimensions %dx%d", width, height)
+	case len(d[tiffTileWidth]) > 0:
+		return nil, errors.New("tiled TIFF images are not supported")
+	case d.value(tiffPlanarConfig, 1) != 1:
+		return nil, errors.New("TIFF images with separate colour planes are not supported")
+	case d.value(tiffSampleFormat, 1) != 1:
+		return nil, errors.New("only TIFF images with unsigned integer samples are supported")
+	case bitDepth != 1 && bitDepth != 2 && bitDepth != 4 && bitDepth != 8 && bitDepth != 16:
+		return nil, fmt.Errorf("unsupported TIFF bit depth %d", bitDepth)
+	case predictor != tiffPredictorNone && (predictor != tiffPredictorDiffers || bitDepth < 8):
+		return nil, fmt.Errorf("unsupported TIFF predictor %d for %d-bit samples", predictor, bitDepth)
+	}
+	for _, depth := range d[tiffBitsPerSample] {
+		if int(depth) != bitDepth {
+			return nil, errors.New("TIFF images with a different bit depth per sample are not supported")
+		}
+	}
+
+	// Work out the layout: the colour samples, then an optional alpha, then any other samples, which are dropped
+	colours := 1
+	switch photometric {
+	case tiffWhiteIsZero, tiffBlackIsZero:
+	case tiffRGB:
+		colours = 3
+		if bitDepth < 8 {
+			return nil, fmt.Errorf("unsupported %d-bit TIFF colour image", bitDepth)
+		}
+	case tiffPalette:
+		if len(d[tiffColorMap]) != 3<<bitDepth || bitDepth > 8 {
+			return nil, errors.New("TIFF colour map does not match the bit depth")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported TIFF photometric interpretation %d", photometric)
+	}
+	if samples < colours {
+		return nil, fmt.Errorf("TIFF image has %d samples per pixel, too few for its photometric interpretation", samples)
+	}
+	extra := d[tiffExtraSamples]
+	alpha := samples > colours && len(extra) > 0 && (extra[0] == tiffAssociatedAlpha || extra[0] == tiffStraightAlpha)
+
+	channels, depth := colours, 8
+	if photometric == tiffPalette {
+		channels = raster.RGB
+	}
+	if alpha {
+		channels++
+	}
+	if bitDepth > 8 {
+		depth = 16
+	}
+	if err := raster.CheckSize(width, height, max(samples, channels)); err != nil { // Bounds the unpacked row as well
+		return nil, err
+	}
+
+	rowBytes := (width*samples*bitDepth + 7) / 8
+	rowsPerStrip := int(d.value(tiffRowsPerStrip, uint32(height)))
+	if rowsPerStrip <= 0 || rowsPerStrip > height {
+		rowsPerStrip = height
+	}
+	offsets, counts := d[tiffStripOffsets], d[tiffStripByteCounts]
+	if strips := (height + rowsPerStrip - 1) / rowsPerStrip; len(offsets) < strips || len(counts) < strips {
+		return nil, fmt.Errorf("TIFF image needs %d strips but lists %d", strips, min(len(offsets), len(counts)))
+	}
+
+	// Strips are decompressed as the rows reach them, so the pixels only take up memory once there is data for them
+	var row []uint32
+	var pixels []byte
+	return readRows(width, height, channels, depth, func(y int, out []uint32) error {
+		strip, i := y/rowsPerStrip, y%rowsPerStrip
+		if i == 0 {
+			start, end := int64(offsets[strip]), int64(offsets[strip])+int64(counts[strip])
+			if end > int64(len(data)) {
+				return fmt.Errorf("TIFF strip %d lies outside the file", strip)
+			}
+			rows := min(rowsPerStrip, height-y)
+			var err error
+			if pixels, err = decompressTIFFStrip(data[start:end], compression, rows*rowBytes); err != nil {
+				return fmt.Errorf("TIFF strip %d: %w", strip, err)
+			}
+			if len(pixels) < rows*rowBytes {
+				return fmt.Errorf("TIFF strip %d is truncated", strip)
+			}
+		}
+		if row == nil {
+			row = make([]uint32, width*samples)
+		}
+
+		unpackTIFFRow(pixels[i*rowBytes:(i+1)*rowBytes], row, bitDepth, order)
+		if predictor == tiffPredictorDiffers {
+			for j := samples; j < len(row); j++ {
+				row[j] = (row[j] + row[j-samples]) & (1<<bitDepth - 1)
+			}
+		}
+		storeTIFFRow(out, channels, depth, alpha, row, samples, bitDepth, photometric, alpha && extra[0] == tiffAssociatedAlpha, d[tiffColorMap])
+		return nil
+	})
+}
+
+// decompressTIFFStrip decompresses the data of a strip, which should hold size bytes of pixels
+func decompressTIFFStrip(data []byte, compression uint32, size int) ([]byte, error) {
+	switch compression {
+	case tiffUncompressed:
+		return data, nil
+	case tiffLZW:
+		return lzwDecode(data, size)
+	case tiffDeflate, tiffOldDeflate:
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(io.LimitReader(zr, int64(size)))
+	case tiffPackBits:
+		return unpackBits(data, size)
+	default:
+		return nil, fmt.Errorf("unsupported TIFF compression %d", compression)
+	}
+}
+
+// unpackBits decodes PackBits run-length encoding, in which each header byte n is followed by n+1 literal bytes when
+// it is positive, or by a byte repeated 1-n times when it is negative
+func unpackBits(data []byte, size int) ([]byte, error) {
+	out := make([]byte, 0, min(size, 64*len(data))) // Runs expand 2 bytes to at most 128
+	for i := 0; i < len(data) && len(out) < size; {
+		n := int(int8(data[i]))
+		i++
+		switch {
+		case n >= 0:
+			if i+n+1 > len(data) {
+				return nil, errors.New("truncated PackBits data")
+			}
+			out = append(out, data[i:i+n+1]...)
+			i += n + 1
+		case n != -128: // -128 is a no-op
+			if i >= len(data) {
+				return nil, errors.New("truncated PackBits data")
+			}
+			for j := 0; j < 1-n; j++ {
+				out = append(out, data[i])
+			}
+			i++
+		}
+	}
+	return out, nil
+}
+
+// unpackTIFFRow splits a row of packed samples into row
+func unpackTIFFRow(data []byte, row []uint32, bitDepth int, order binary.ByteOrder) {
+	switch bitDepth {
+	case 8:
+		for i := range row {
+			row[i] = uint32(data[i])
+		}
+	case 16:
+		for i := range row {
+			row[i] = uint32(order.Uint16(data[2*i:]))
+		}
+	default: // Samples of 1, 2 or 4 bits, most significant bits first
+		perByte := 8 / bitDepth
+		for i := range row {
+			shift := (perByte - 1 - i%perByte) * bitDepth
+			row[i] = uint32(data[i/perByte]>>shift) & (1<<bitDepth - 1)
+		}
+	}
+}
+
+// storeTIFFRow converts the samples of a row to out, a row of an image with the given channels and depth, the last
+// of them alpha if alpha is set, scaling them to the depth
+func storeTIFFRow(out []uint32, channels, depth int, alpha bool, row []uint32, samples, bitDepth int, photometric uint32, premultiplied bool, colourMap []uint32) {
+	maxValue, full := uint32(1)<<bitDepth-1, uint32(1)<<depth-1
+	scale := func(v uint32) uint32 { return (v*full + maxValue/2) / maxValue }
+	colours := channels
+	if alpha {
+		colours--
+	}
+	entries := len(colourMap) / 3
+
+	for x := 0; x < len(out)/channels; x++ {
+		in, pixel := row[x*samples:], out[x*channels:]
+		switch photometric {
+		case tiffWhiteIsZero:
+			pixel[0] = scale(maxValue - in[0])
+		case tiffPalette:
+			for c := 0; c < 3; c++ {
+				pixel[c] = colourMap[c*entries+int(in[0])] >> 8 // Colour maps hold 16-bit values
+			}
+		default:
+			for c := 0; c < colours; c++ {
+				pixel[c] = scale(in[c])
+			}
+		}
+		if colours == channels {
+			continue
+		}
+		alphaSample := 1
+		if photometric == tiffRGB {
+			alphaSample = 3
+		}
+		a := scale(in[alphaSample])
+		pixel[colours] = a
+		if premultiplied && a > 0 && photometric != tiffPalette {
+			for c := 0; c < colours; c++ {
+				pixel[c] = min((pixel[c]*full+a/2)/a, full)
+			}
+		}
+	}
+}
+
+// encodeTIFF encodes an image as a single page TIFF, see encodeTIFFSequence
+func encodeTIFF(w io.Writer, img *raster.Image, options WriteOptions) error {
+	return encodeTIFFSequence(w, raster.NewSequence(img), options)
+}
+
+// encodeTIFFSequence encodes a sequence as a little-endian TIFF with one page per frame, uncompressed unless
+// options.Compression asks for LZW or Deflate, which are combined with a horizontal predictor. Images keep their
+// layout, bit depth and size, with straight alpha. Frame timing is not stored, as TIFF has nowhere to keep it.
+func encodeTIFFSequence(w io.Writer, sequence *raster.Sequence, options WriteOptions) error {
+	if err := sequence.ValidatePages(); err != nil {
+		return err
+	}
+	compression, ok := tiffCompressions[options.Compression]
+	if !ok {
+		return fmt.Errorf("unsupported TIFF compression %q, expected none, lzw or deflate", options.Compression)
+	}
+
+	header := make([]byte, 8)
+	copy(header, tiffLittleEndian)
+	binary.LittleEndian.PutUint32(header[4:], 8) // The first page follows the header
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	offset := uint32(8)
+	for i, frame := range sequence.Frames {
+		page, next, err := encodeTIFFPage(frame.Image, compression, offset, i, len(sequence.Frames))
+		if err != nil {
+			return err
+		}
+		if i < len(sequence.Frames)-1 {
+			offset += uint32(len(page))
+			binary.LittleEndian.PutUint32(page[next:], offset)
+		}
+		if _, err := w.Write(page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tiffEntry is a field of a directory being written, rationals take two values each
+type tiffEntry struct {
+	tag    uint16
+	kind   uint16
+	values []uint32
+}
+
+// count returns the number of values the entry holds
+func (e *tiffEntry) count() int {
+	if e.kind == tiffRational {
+		return len(e.values) / 2
+	}
+	return len(e.values)
+}
+
+// size returns the size of the entry's values in bytes
+func (e *tiffEntry) size() int {
+	return tiffTypeSizes[e.kind] * e.count()
+}
+
+// encodeTIFFPage encodes the directory and strips of one page, which starts at offset in the file. It returns the
+// page and where in it the offset of the next directory goes.
+func encodeTIFFPage(img *raster.Image, compression int, offset uint32, page, pages int) ([]byte, int, error) {
+	if int64(img.Width) > 1<<32-1 || int64(img.Height) > 1<<32-1 {
+		return nil, 0, fmt.Errorf("a %dx%d image is too large for a TIFF", img.Width, img.Height)
+	}
+
+	// Pack the rows into strips, compressing each one
+	samples, size := img.Channels, img.Depth/8
+	rowBytes := img.Width * samples * size
+	rowsPerStrip := max(1, tiffStripSize/rowBytes)
+	var strips [][]byte
+	for y := 0; y < img.Height; y += rowsPerStrip {
+		rows := min(rowsPerStrip, img.Height-y)
+		strip := make([]byte, rows*rowBytes)
+		for i := 0; i < rows; i++ {
+			row := img.Pix[img.PixOffset(0, y+i) : img.PixOffset(0, y+i)+img.Width*samples]
+			out := strip[i*rowBytes:]
+			for j := range row {
+				sample := row[j]
+				if compression != tiffUncompressed && j >= samples {
+					sample = (sample - row[j-samples]) & img.MaxValue()
+				}
+				if size == 1 {
+					out[j] = byte(sample)
+				} else {
+					binary.LittleEndian.PutUint16(out[2*j:], uint16(sample))
+				}
+			}
+		}
+		compressed, err := compressTIFFStrip(strip, compression)
+		if err != nil {
+			return nil, 0, err
+		}
+		strips = append(strips, compressed)
+	}
+
+	photometric := uint32(tiffBlackIsZero)
+	if samples >= raster.RGB {
+		photometric = tiffRGB
+	}
+	bitsPerSample := make([]uint32, samples)
+	for i := range bitsPerSample {
+		bitsPerSample[i] = uint32(img.Depth)
+	}
+	stripOffsets, stripCounts := make([]uint32, len(strips)), make([]uint32, len(strips))
+	entries := []*tiffEntry{
+		{tiffImageWidth, tiffLong, []uint32{uint32(img.Width)}},
+		{tiffImageLength, tiffLong, []uint32{uint32(img.Height)}},
+		{tiffBitsPerSample, tiffShort, bitsPerSample},
+		{tiffCompression, tiffShort, []uint32{uint32(compression)}},
+		{tiffPhotometric, tiffShort, []uint32{photometric}},
+		{tiffStripOffsets, tiffLong, stripOffsets},
+		{tiffSamplesPerPixel, tiffShort, []uint32{uint32(samples)}},
+		{tiffRowsPerStrip, tiffLong, []uint32{uint32(rowsPerStrip)}},
+		{tiffStripByteCounts, tiffLong, stripCounts},
+		{tiffXResolution, tiffRational, []uint32{72, 1}},
+		{tiffYResolution, tiffRational, []uint32{72, 1}},
+		{tiffPlanarConfig, tiffShort, []uint32{1}},
+		{tiffResolutionUnit, tiffShort, []uint32{2}}, // Inches
+	}
+	if pages > 1 {
+		entries = append(entries, &tiffEntry{tiffPageNumber, tiffShort, []uint32{uint32(page), uint32(pages)}})
+	}
+	if compression != tiffUncompressed {
+		entries = append(entries, &tiffEntry{tiffPredictor, tiffShort, []uint32{tiffPredictorDiffers}})
+	}
+	if img.AlphaChannel() >= 0 {
+		entries = append(entries, &tiffEntry{tiffExtraSamples, tiffShort, []uint32{tiffStraightAlpha}})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+	// Lay out the directory, then the values that do not fit in their entries, then the strips
+	directorySize := 2 + 12*len(entries) + 4
+	valuesSize := 0
+	for _, entry := range entries {
+		if entry.size() > 4 {
+			valuesSize += entry.size() + entry.size()%2 // Values start on a word boundary
+		}
+	}
+	position := int(offset) + directorySize + valuesSize
+	for i, strip := range strips {
+		stripOffsets[i], stripCounts[i] = uint32(position), uint32(len(strip))
+		position += len(strip)
+	}
+	if int64(position) > 1<<32-1 {
+		return nil, 0, errors.New("image is too large for a TIFF")
+	}
+
+	out := make([]byte, directorySize+valuesSize, position-int(offset)+1)
+	binary.LittleEndian.PutUint16(out, uint16(len(entries)))
+	values := directorySize
+	for i, entry := range entries {
+		field := out[2+12*i:]
+		binary.LittleEndian.PutUint16(field, entry.tag)
+		binary.LittleEndian.PutUint16(field[2:], entry.kind)
+		binary.LittleEndian.PutUint32(field[4:], uint32(entry.count()))
+		target := field[8:]
+		if entry.size() > 4 {
+			binary.LittleEndian.PutUint32(field[8:], offset+uint32(values))
+			target = out[values:]
+			values += entry.size() + entry.size()%2
+		}
+		for j, value := range entry.values {
+			if entry.kind == tiffShort {
+				binary.LittleEndian.PutUint16(target[2*j:], uint16(value))
+			} else {
+				binary.LittleEndian.PutUint32(target[4*j:], value)
+			}
+		}
+	}
+	for _, strip := range strips {
+		out = append(out, strip...)
+	}
+	if len(out)%2 != 0 {
+		out = append(out, 0) // The next directory starts on a word boundary
+	}
+	return out, directorySize - 4, nil
+}
+
+// compressTIFFStrip compresses the pixels of a strip with the given scheme
+func compressTIFFStrip(data []byte, compression int) ([]byte, error) {
+	switch compression {
+	case tiffLZW:
+		return lzwEncode(data), nil
+	case tiffDeflate:
+		var buffer bytes.Buffer
+		zw := zlib.NewWriter(&buffer)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	default:
+		return data, nil
+	}
+}
@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+)
+
+// TIFF's LZW differs from the one in compress/lzw used by GIF: codes are packed most significant bit first and the
+// code width grows one code earlier than the table needs it to. Codes start at 9 bits and grow up to 12.
+const (
+	lzwClear    = 256  // Resets the table
+	lzwEnd      = 257  // Ends the data
+	lzwFirst    = 258  // First code assigned to a sequence of bytes
+	lzwMaxWidth = 12   // Widest code
+	lzwMaxCodes = 4094 // Codes assigned before the encoder clears the table, the limit other encoders use as well
+)
+
+// lzwDecode decompresses TIFF LZW data, stopping once it has size bytes so a small strip cannot expand without bound
+func lzwDecode(data []byte, size int) ([]byte, error) {
+	var out bytes.Buffer
+	table := make([][]byte, lzwFirst, 1<<lzwMaxWidth)
+	for i := 0; i < 256; i++ {
+		table[i] = []byte{byte(i)}
+	}
+	width, previous := 9, []byte(nil)
+	position := 0 // In bits
+
+	for out.Len() < size {
+		if position+width > 8*len(data) {
+			return out.Bytes(), nil // Some encoders leave out the end code
+		}
+		code := 0
+		for i := 0; i < width; i++ {
+			bit := data[(position+i)/8] >> (7 - (position+i)%8) & 1
+			code = code<<1 | int(bit)
+		}
+		position += width
+
+		switch {
+		case code == lzwClear:
+			table, width, previous = table[:lzwFirst], 9, nil
+			continue
+		case code == lzwEnd:
+			return out.Bytes(), nil
+		}
+
+		var entry []byte
+		switch {
+		case code < len(table):
+			entry = table[code]
+		case code == len(table) && previous != nil: // The code being defined, its sequence starts with its own last byte
+			entry = append(previous[:len(previous):len(previous)], previous[0])
+		default:
+			return nil, errors.New("invalid LZW code")
+		}
+		out.Write(entry)
+
+		if previous != nil && len(table) < cap(table) {
+			table = append(table, append(previous[:len(previous):len(previous)], entry[0]))
+			if len(table) >= 1<<width-1 && width < lzwMaxWidth {
+				width++
+			}
+		}
+		previous = entry
+	}
+	return out.Bytes()[:size], nil
+}
+
+// lzwEncode compresses data with TIFF LZW
+func lzwEncode(data []byte) []byte {
+	w := &bitWriter{}
+	codes := map[int]int{} // Code of every sequence in the table, keyed by its prefix's code and its last byte
+	next, width := lzwFirst, 9
+	w.write(lzwClear, width)
+
+	prefix := -1
+	for _, b := range data {
+		if prefix < 0 {
+			prefix = int(b)
+			continue
+		}
+		key := prefix<<8 | int(b)
+		if code, ok := codes[key]; ok {
+			prefix = code
+			continue
+		}
+		w.write(prefix, width)
+		codes[key] = next
+		next++
+		if next >= 1<<width && width < lzwMaxWidth {
+			width++
+		}
+		if next == lzwMaxCodes {
+			w.write(lzwClear, width)
+			clear(codes)
+			next, width = lzwFirst, 9
+		}
+		prefix = int(b)
+	}
+
+	if prefix >= 0 {
+		w.write(prefix, width)
+		// The decoder adds an entry for this code as well, which may widen the end code
+		if next+1 >= 1<<width && width < lzwMaxWidth {
+			width++
+		}
+	}
+	w.write(lzwEnd, width)
+	return w.bytes()
+}
+
+// bitWriter packs codes most significant bit first
+type bitWriter struct {
+	out   []byte
+	bits  uint32 // Pending bits, in the low end
+	count int    // Number of pending bits
+}
+
+// write appends the lowest width bits of code
+func (w *bitWriter) write(code, width int) {
+	w.bits = w.bits<<width | uint32(code)
+	w.count += width
+	for w.count >= 8 {
+		w.count -= 8
+		w.out = append(w.out, byte(w.bits>>w.count))
+	}
+	w.bits &= 1<<w.count - 1
+}
+
+// bytes returns the written bits, padding the last byte with zeros
+func (w *bitWriter) bytes() []byte {
+	if w.count > 0 {
+		return append(w.out, byte(w.bits<<(8-w.count)))
+	}
+	return w.out
+}
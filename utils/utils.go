@@ -5,7 +5,8 @@ import (
 	"os"
 )
 
-// Make2D makes a 2D slice of any type of the given width and height
+// Make2D makes a 2D slice of any type with n rows of m elements each, indexed as matrix[row][column]
+// For an image this means calling Make2D(height, width) and indexing matrix[y][x], the orientation raster.FromMatrix expects
 // src:  https://stackoverflow.com/a/71781206 (adapted)
 func Make2D[Type any](n, m int) [][]Type {
 	matrix := make([][]Type, n)
@@ -19,6 +20,9 @@ func Make2D[Type any](n, m int) [][]Type {
 
 // AssertSignature asserts that a given os.File's signature (first n bytes of the file) are a given signature
 // this is preferred to using mimetype as Go's built-in mimetype detection is quite deficient
+//
+// Deprecated: use DetectFormat, which checks the first bytes of any reader against the signatures of every registered
+// format at once, including those with wildcard bytes.
 func AssertSignature(file *os.File, signature []byte) (bool, error) {
 	fileSignature := make([]byte, len(signature)) // Make a new slice to hold the signature
 	_, err := file.ReadAt(fileSignature, 0)       // read the first N bytes of the file